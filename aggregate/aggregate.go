@@ -0,0 +1,330 @@
+// Package aggregate packs many small pieces into a single deal piece.
+//
+// Sub-pieces are laid out in order of decreasing size, so that every
+// sub-piece is aligned to a multiple of its own (power of two) padded size
+// and occupies exactly one subtree of the aggregate piece's merkle tree. The
+// commP of the aggregate can then be derived from the sub-pieces' commPs
+// alone, and each sub-piece's inclusion can be proven with a merkle path
+// from its commP to the aggregate commP.
+//
+// A retrieval provider given a Locator serves the raw data of a sub-piece
+// over HTTP, by looking up the sub-piece's offset in its aggregate and
+// serving that range of the aggregate piece. Retrievals of a sub-piece's
+// payload by CID are not supported, since the provider indexes the payload
+// of a piece as a single CAR.
+package aggregate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"math/bits"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+// nodeSize is the size of a leaf of the piece merkle tree
+const nodeSize = 32
+
+// maxLayer is the layer of the root of the largest supported piece (64GiB)
+const maxLayer = 31
+
+// Aggregate is a piece made up of several sub-pieces
+type Aggregate struct {
+	Index
+
+	commPs map[cid.Cid][]byte
+	nodes  map[nodePos][]byte
+}
+
+type nodePos struct {
+	layer int
+	index uint64
+}
+
+// New lays out the given sub-pieces in an aggregate piece and computes the
+// aggregate commP. If pieceSize is zero, the aggregate is the smallest piece
+// that fits all the sub-pieces, otherwise the aggregate is padded up to
+// pieceSize.
+func New(subPieces []SubPiece, pieceSize abi.PaddedPieceSize) (*Aggregate, error) {
+	if len(subPieces) == 0 {
+		return nil, xerrors.New("an aggregate needs at least one sub-piece")
+	}
+
+	sorted := make([]SubPiece, len(subPieces))
+	copy(sorted, subPieces)
+	// sorting by decreasing size keeps every sub-piece aligned to its size
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Size > sorted[j].Size
+	})
+
+	agg := &Aggregate{
+		commPs: make(map[cid.Cid][]byte, len(sorted)),
+		nodes:  make(map[nodePos][]byte),
+	}
+	var offset uint64
+	for _, sp := range sorted {
+		if err := sp.Size.Validate(); err != nil {
+			return nil, xerrors.Errorf("invalid size for sub-piece %s: %w", sp.PieceCID, err)
+		}
+		commP, err := commcid.CIDToPieceCommitmentV1(sp.PieceCID)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid sub-piece cid %s: %w", sp.PieceCID, err)
+		}
+		if _, ok := agg.commPs[sp.PieceCID]; ok {
+			return nil, xerrors.Errorf("sub-piece %s is included more than once", sp.PieceCID)
+		}
+		agg.commPs[sp.PieceCID] = commP
+		agg.Entries = append(agg.Entries, Entry{
+			PieceCID: sp.PieceCID,
+			Size:     sp.Size,
+			Root:     sp.Root,
+			Offset:   offset,
+		})
+		offset += uint64(sp.Size)
+	}
+
+	natural := abi.PaddedPieceSize(1) << bits.Len64(offset-1)
+	if pieceSize == 0 {
+		pieceSize = natural
+	}
+	if err := pieceSize.Validate(); err != nil {
+		return nil, xerrors.Errorf("invalid aggregate piece size: %w", err)
+	}
+	if pieceSize < natural {
+		return nil, xerrors.Errorf("sub-pieces need a piece of at least %d bytes, larger than the aggregate piece size %d", natural, pieceSize)
+	}
+	if layerOf(pieceSize) > maxLayer {
+		return nil, xerrors.Errorf("aggregate piece size %d is larger than the maximum piece size", pieceSize)
+	}
+	agg.PieceSize = pieceSize
+
+	root := agg.node(layerOf(pieceSize), 0)
+	pieceCID, err := commcid.DataCommitmentV1ToCID(root)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to convert aggregate commP to cid: %w", err)
+	}
+	agg.PieceCID = pieceCID
+	return agg, nil
+}
+
+// FromIndex rebuilds an aggregate from a previously written index, verifying
+// that the index matches its aggregate commP
+func FromIndex(idx Index) (*Aggregate, error) {
+	subPieces := make([]SubPiece, 0, len(idx.Entries))
+	for _, e := range idx.Entries {
+		subPieces = append(subPieces, SubPiece{PieceCID: e.PieceCID, Size: e.Size, Root: e.Root})
+	}
+	agg, err := New(subPieces, idx.PieceSize)
+	if err != nil {
+		return nil, err
+	}
+	if !agg.PieceCID.Equals(idx.PieceCID) {
+		return nil, xerrors.Errorf("index piece cid %s does not match computed aggregate piece cid %s", idx.PieceCID, agg.PieceCID)
+	}
+	for i, e := range agg.Entries {
+		if e.Offset != idx.Entries[i].Offset {
+			return nil, xerrors.Errorf("index offset %d of sub-piece %s does not match computed offset %d", idx.Entries[i].Offset, e.PieceCID, e.Offset)
+		}
+	}
+	return agg, nil
+}
+
+// PieceInfo returns the piece info of the aggregate piece
+func (a *Aggregate) PieceInfo() abi.PieceInfo {
+	return abi.PieceInfo{Size: a.PieceSize, PieceCID: a.PieceCID}
+}
+
+// DataRef returns a data reference with which the aggregate can be proposed
+// as a single storage deal. The aggregate data must be transferred manually,
+// and is identified by the aggregate piece cid. The deal is labelled with,
+// and announced under, the given payload root, eg the root of one of the
+// sub-pieces or of a DAG linking them. The aggregate piece cid is not a
+// payload root, and can't be used as one.
+func (a *Aggregate) DataRef(root cid.Cid) (*storagemarket.DataRef, error) {
+	if !root.Defined() {
+		return nil, xerrors.New("the payload root of an aggregate deal must be defined")
+	}
+	if root.Equals(a.PieceCID) {
+		return nil, xerrors.Errorf("%s is the aggregate piece cid, not a payload root", root)
+	}
+	pieceCID := a.PieceCID
+	return &storagemarket.DataRef{
+		TransferType: storagemarket.TTManual,
+		Root:         root,
+		PieceCid:     &pieceCID,
+		PieceSize:    a.PieceSize.Unpadded(),
+	}, nil
+}
+
+// ProofFor returns a proof of inclusion of the given sub-piece in the
+// aggregate piece
+func (a *Aggregate) ProofFor(pieceCID cid.Cid) (*InclusionProof, error) {
+	e, ok := a.Find(pieceCID)
+	if !ok {
+		return nil, xerrors.Errorf("sub-piece %s is not part of aggregate %s", pieceCID, a.PieceCID)
+	}
+
+	layer := layerOf(e.Size)
+	index := e.Offset / uint64(e.Size)
+	path := make([][]byte, 0, layerOf(a.PieceSize)-layer)
+	for l := layer; l < layerOf(a.PieceSize); l++ {
+		path = append(path, a.node(l, index^1))
+		index >>= 1
+	}
+	return &InclusionProof{Offset: e.Offset, Path: path}, nil
+}
+
+// Find returns the index entry for the given sub-piece
+func (idx *Index) Find(pieceCID cid.Cid) (Entry, bool) {
+	for _, e := range idx.Entries {
+		if e.PieceCID.Equals(pieceCID) {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// FindByRoot returns the index entry for the sub-piece with the given
+// payload CID
+func (idx *Index) FindByRoot(root cid.Cid) (Entry, bool) {
+	for _, e := range idx.Entries {
+		if e.Root != nil && e.Root.Equals(root) {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Locator looks up the index of the aggregate piece a sub-piece was packed
+// into, returning false if the sub-piece is not part of any aggregate
+type Locator func(ctx context.Context, subPieceCID cid.Cid) (Index, bool, error)
+
+// IndexLocator returns a Locator that looks sub-pieces up in the given
+// indexes
+func IndexLocator(indexes ...Index) Locator {
+	byPiece := make(map[cid.Cid]Index)
+	for _, idx := range indexes {
+		for _, e := range idx.Entries {
+			byPiece[e.PieceCID] = idx
+		}
+	}
+	return func(ctx context.Context, subPieceCID cid.Cid) (Index, bool, error) {
+		idx, ok := byPiece[subPieceCID]
+		return idx, ok, nil
+	}
+}
+
+// UnpaddedOffset returns the offset of the sub-piece's data in the unpadded
+// aggregate data
+func (e Entry) UnpaddedOffset() uint64 {
+	return e.Offset / 128 * 127
+}
+
+// Verify checks that the proof shows the given sub-piece is included in the
+// given aggregate piece
+func (p *InclusionProof) Verify(subPiece abi.PieceInfo, aggregate abi.PieceInfo) error {
+	if err := subPiece.Size.Validate(); err != nil {
+		return xerrors.Errorf("invalid sub-piece size: %w", err)
+	}
+	if err := aggregate.Size.Validate(); err != nil {
+		return xerrors.Errorf("invalid aggregate piece size: %w", err)
+	}
+	if p.Offset%uint64(subPiece.Size) != 0 {
+		return xerrors.Errorf("offset %d is not aligned to sub-piece size %d", p.Offset, subPiece.Size)
+	}
+	if p.Offset+uint64(subPiece.Size) > uint64(aggregate.Size) {
+		return xerrors.Errorf("sub-piece at offset %d does not fit in aggregate piece of size %d", p.Offset, aggregate.Size)
+	}
+	if len(p.Path) != layerOf(aggregate.Size)-layerOf(subPiece.Size) {
+		return xerrors.Errorf("proof path has length %d, expected %d", len(p.Path), layerOf(aggregate.Size)-layerOf(subPiece.Size))
+	}
+
+	node, err := commcid.CIDToPieceCommitmentV1(subPiece.PieceCID)
+	if err != nil {
+		return xerrors.Errorf("invalid sub-piece cid: %w", err)
+	}
+	expected, err := commcid.CIDToPieceCommitmentV1(aggregate.PieceCID)
+	if err != nil {
+		return xerrors.Errorf("invalid aggregate piece cid: %w", err)
+	}
+
+	index := p.Offset / uint64(subPiece.Size)
+	for _, sibling := range p.Path {
+		if len(sibling) != nodeSize {
+			return xerrors.Errorf("proof node has length %d, expected %d", len(sibling), nodeSize)
+		}
+		if index&1 == 0 {
+			node = hashNodes(node, sibling)
+		} else {
+			node = hashNodes(sibling, node)
+		}
+		index >>= 1
+	}
+	if !bytes.Equal(node, expected) {
+		return xerrors.Errorf("proof for sub-piece %s does not match aggregate piece %s", subPiece.PieceCID, aggregate.PieceCID)
+	}
+	return nil
+}
+
+// node returns the merkle tree node at the given layer and index. Since
+// sub-pieces are aligned, every node either is the root of a sub-piece, is
+// the root of an empty subtree, or has sub-pieces in both its children.
+func (a *Aggregate) node(layer int, index uint64) []byte {
+	pos := nodePos{layer: layer, index: index}
+	if n, ok := a.nodes[pos]; ok {
+		return n
+	}
+
+	size := uint64(nodeSize) << layer
+	start, end := index*size, (index+1)*size
+	// entries are sorted by offset and contiguous, so find the first one
+	// that ends after the start of this subtree
+	i := sort.Search(len(a.Entries), func(i int) bool {
+		return a.Entries[i].Offset+uint64(a.Entries[i].Size) > start
+	})
+	var n []byte
+	switch {
+	case i == len(a.Entries) || a.Entries[i].Offset >= end:
+		n = zeroNode(layer)
+	case a.Entries[i].Offset == start && uint64(a.Entries[i].Size) == size:
+		n = a.commPs[a.Entries[i].PieceCID]
+	default:
+		n = hashNodes(a.node(layer-1, 2*index), a.node(layer-1, 2*index+1))
+	}
+	a.nodes[pos] = n
+	return n
+}
+
+func layerOf(size abi.PaddedPieceSize) int {
+	return bits.TrailingZeros64(uint64(size) / nodeSize)
+}
+
+func hashNodes(left, right []byte) []byte {
+	h := sha256.New()
+	_, _ = h.Write(left)
+	_, _ = h.Write(right)
+	out := h.Sum(nil)
+	out[31] &= 0x3F
+	return out
+}
+
+var zeroNodes = func() [][]byte {
+	nodes := make([][]byte, maxLayer+1)
+	nodes[0] = make([]byte, nodeSize)
+	for i := 1; i < len(nodes); i++ {
+		nodes[i] = hashNodes(nodes[i-1], nodes[i-1])
+	}
+	return nodes
+}()
+
+func zeroNode(layer int) []byte {
+	return zeroNodes[layer]
+}
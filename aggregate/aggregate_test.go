@@ -0,0 +1,207 @@
+package aggregate_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/aggregate"
+	"github.com/filecoin-project/go-fil-markets/commp"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+type testSubPiece struct {
+	aggregate.SubPiece
+	data []byte
+}
+
+func makeSubPiece(t *testing.T, size int) testSubPiece {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	res, err := commp.Compute(context.Background(), bytes.NewReader(data))
+	require.NoError(t, err)
+	root := shared_testutil.GenerateCids(1)[0]
+	return testSubPiece{
+		SubPiece: aggregate.SubPiece{PieceCID: res.PieceCID, Size: res.PieceSize, Root: &root},
+		data:     data,
+	}
+}
+
+func makeAggregate(t *testing.T, sizes []int, pieceSize abi.PaddedPieceSize) (*aggregate.Aggregate, map[cid.Cid]testSubPiece) {
+	var subPieces []aggregate.SubPiece
+	byCid := make(map[cid.Cid]testSubPiece)
+	for _, size := range sizes {
+		sp := makeSubPiece(t, size)
+		subPieces = append(subPieces, sp.SubPiece)
+		byCid[sp.PieceCID] = sp
+	}
+	agg, err := aggregate.New(subPieces, pieceSize)
+	require.NoError(t, err)
+	return agg, byCid
+}
+
+func writeData(t *testing.T, agg *aggregate.Aggregate, byCid map[cid.Cid]testSubPiece) []byte {
+	var buf bytes.Buffer
+	n, err := agg.WriteData(&buf, func(e aggregate.Entry) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(byCid[e.PieceCID].data)), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(buf.Len()), n)
+	return buf.Bytes()
+}
+
+func TestAggregate(t *testing.T) {
+	sizes := []int{100, 5000, 300, 127 * 64, 2000, 70}
+
+	t.Run("layout is aligned and ordered", func(t *testing.T) {
+		agg, _ := makeAggregate(t, sizes, 0)
+		require.Len(t, agg.Entries, len(sizes))
+		var end uint64
+		for i, e := range agg.Entries {
+			require.Zero(t, e.Offset%uint64(e.Size))
+			require.Equal(t, end, e.Offset)
+			end = e.Offset + uint64(e.Size)
+			if i > 0 {
+				require.LessOrEqual(t, e.Size, agg.Entries[i-1].Size)
+			}
+		}
+		require.LessOrEqual(t, end, uint64(agg.PieceSize))
+		require.Greater(t, 2*end, uint64(agg.PieceSize))
+	})
+
+	t.Run("aggregate commP matches commP of aggregate data", func(t *testing.T) {
+		for _, pieceSize := range []abi.PaddedPieceSize{0, 1 << 20} {
+			agg, byCid := makeAggregate(t, sizes, pieceSize)
+			if pieceSize != 0 {
+				require.Equal(t, pieceSize, agg.PieceSize)
+			}
+			data := writeData(t, agg, byCid)
+			pieceCID, err := commp.GenerateCommp(bytes.NewReader(data), uint64(len(data)), uint64(agg.PieceSize))
+			require.NoError(t, err)
+			require.Equal(t, agg.PieceCID, pieceCID)
+		}
+	})
+
+	t.Run("sub-pieces can be located in aggregate data", func(t *testing.T) {
+		agg, byCid := makeAggregate(t, sizes, 0)
+		data := writeData(t, agg, byCid)
+		for _, sp := range byCid {
+			e, ok := agg.FindByRoot(*sp.Root)
+			require.True(t, ok)
+			require.Equal(t, sp.PieceCID, e.PieceCID)
+			r := aggregate.SubPieceReader(bytes.NewReader(data), e)
+			read, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, sp.data, read[:len(sp.data)])
+			require.Equal(t, make([]byte, len(read)-len(sp.data)), read[len(sp.data):])
+		}
+	})
+
+	t.Run("locates sub-pieces in their aggregate", func(t *testing.T) {
+		agg, byCid := makeAggregate(t, sizes, 0)
+		other, _ := makeAggregate(t, []int{1000}, 0)
+		locate := aggregate.IndexLocator(agg.Index, other.Index)
+		for c := range byCid {
+			idx, ok, err := locate(context.Background(), c)
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, agg.PieceCID, idx.PieceCID)
+		}
+		_, ok, err := locate(context.Background(), agg.PieceCID)
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+
+	t.Run("inclusion proofs verify", func(t *testing.T) {
+		agg, byCid := makeAggregate(t, sizes, 1<<20)
+		for _, sp := range byCid {
+			proof, err := agg.ProofFor(sp.PieceCID)
+			require.NoError(t, err)
+			subPiece := abi.PieceInfo{Size: sp.Size, PieceCID: sp.PieceCID}
+			require.NoError(t, proof.Verify(subPiece, agg.PieceInfo()))
+
+			// round trip through cbor
+			var buf bytes.Buffer
+			require.NoError(t, proof.MarshalCBOR(&buf))
+			var decoded aggregate.InclusionProof
+			require.NoError(t, decoded.UnmarshalCBOR(&buf))
+			require.NoError(t, decoded.Verify(subPiece, agg.PieceInfo()))
+
+			// a proof at the wrong offset fails
+			decoded.Offset += uint64(sp.Size)
+			require.Error(t, decoded.Verify(subPiece, agg.PieceInfo()))
+		}
+
+		other := makeSubPiece(t, 1000)
+		_, err := agg.ProofFor(other.PieceCID)
+		require.Error(t, err)
+		proof, err := agg.ProofFor(agg.Entries[0].PieceCID)
+		require.NoError(t, err)
+		require.Error(t, proof.Verify(abi.PieceInfo{Size: agg.Entries[0].Size, PieceCID: other.PieceCID}, agg.PieceInfo()))
+	})
+
+	t.Run("index round trips", func(t *testing.T) {
+		agg, _ := makeAggregate(t, sizes, 0)
+		var buf bytes.Buffer
+		require.NoError(t, aggregate.WriteIndex(&buf, agg.Index))
+		idx, err := aggregate.ReadIndex(&buf)
+		require.NoError(t, err)
+		require.Equal(t, agg.Index, idx)
+
+		rebuilt, err := aggregate.FromIndex(idx)
+		require.NoError(t, err)
+		require.Equal(t, agg.PieceCID, rebuilt.PieceCID)
+
+		idx.Entries[0], idx.Entries[1] = idx.Entries[1], idx.Entries[0]
+		_, err = aggregate.FromIndex(idx)
+		require.Error(t, err)
+	})
+
+	t.Run("data ref proposes the aggregate piece", func(t *testing.T) {
+		agg, byCid := makeAggregate(t, sizes, 0)
+		root := *byCid[agg.Entries[0].PieceCID].Root
+		ref, err := agg.DataRef(root)
+		require.NoError(t, err)
+		require.Equal(t, root, ref.Root)
+		require.Equal(t, storagemarket.TTManual, ref.TransferType)
+		require.Equal(t, agg.PieceCID, *ref.PieceCid)
+		require.Equal(t, agg.PieceSize.Unpadded(), ref.PieceSize)
+
+		_, err = agg.DataRef(agg.PieceCID)
+		require.Error(t, err)
+		_, err = agg.DataRef(cid.Undef)
+		require.Error(t, err)
+	})
+
+	t.Run("invalid aggregates", func(t *testing.T) {
+		_, err := aggregate.New(nil, 0)
+		require.Error(t, err)
+
+		sp := makeSubPiece(t, 5000)
+		_, err = aggregate.New([]aggregate.SubPiece{sp.SubPiece, sp.SubPiece}, 0)
+		require.Error(t, err)
+
+		_, err = aggregate.New([]aggregate.SubPiece{sp.SubPiece}, sp.Size/2)
+		require.Error(t, err)
+
+		_, err = aggregate.New([]aggregate.SubPiece{sp.SubPiece}, 3000)
+		require.Error(t, err)
+	})
+
+	t.Run("sub-piece data larger than its piece", func(t *testing.T) {
+		agg, _ := makeAggregate(t, []int{100, 200}, 0)
+		_, err := agg.WriteData(ioutil.Discard, func(e aggregate.Entry) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(make([]byte, e.Size))), nil
+		})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,108 @@
+package aggregate
+
+import (
+	"bufio"
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+// OpenSubPieceFunc opens the unpadded data of a sub-piece, eg a CAR file
+type OpenSubPieceFunc func(e Entry) (io.ReadCloser, error)
+
+// WriteData writes the unpadded data of the aggregate piece to w, placing the
+// data of each sub-piece at its offset and zero filling the gaps in between.
+// The data after the last sub-piece is left out, as it is all zeroes. It
+// returns the number of bytes written.
+func (a *Aggregate) WriteData(w io.Writer, open OpenSubPieceFunc) (int64, error) {
+	var written int64
+	zeroes := &zeroReader{}
+	for _, e := range a.Entries {
+		if gap := int64(e.UnpaddedOffset()) - written; gap > 0 {
+			n, err := io.CopyN(w, zeroes, gap)
+			written += n
+			if err != nil {
+				return written, xerrors.Errorf("failed to write padding before sub-piece %s: %w", e.PieceCID, err)
+			}
+		}
+
+		rc, err := open(e)
+		if err != nil {
+			return written, xerrors.Errorf("failed to open sub-piece %s: %w", e.PieceCID, err)
+		}
+		limit := int64(e.Size.Unpadded())
+		n, err := io.Copy(w, io.LimitReader(rc, limit))
+		written += n
+		if err != nil {
+			_ = rc.Close()
+			return written, xerrors.Errorf("failed to write sub-piece %s: %w", e.PieceCID, err)
+		}
+		if n == limit {
+			// make sure the sub-piece data isn't larger than its piece
+			if extra, _ := rc.Read(make([]byte, 1)); extra > 0 {
+				_ = rc.Close()
+				return written, xerrors.Errorf("data for sub-piece %s is larger than its piece size %d", e.PieceCID, e.Size)
+			}
+		}
+		if err := rc.Close(); err != nil {
+			return written, xerrors.Errorf("failed to close sub-piece %s: %w", e.PieceCID, err)
+		}
+	}
+	return written, nil
+}
+
+// SubPieceReader returns a reader over the unpadded data of a sub-piece,
+// given a reader over the unpadded data of the aggregate piece. The data
+// includes the zero padding up to the end of the sub-piece, so CAR readers
+// should treat zero length sections as the end of the CAR.
+func SubPieceReader(r io.ReaderAt, e Entry) *io.SectionReader {
+	return io.NewSectionReader(r, int64(e.UnpaddedOffset()), int64(e.Size.Unpadded()))
+}
+
+// WriteIndex writes the index to w, as a header followed by each entry
+func WriteIndex(w io.Writer, idx Index) error {
+	header := &IndexHeader{
+		PieceCID:   idx.PieceCID,
+		PieceSize:  idx.PieceSize,
+		EntryCount: uint64(len(idx.Entries)),
+	}
+	if err := header.MarshalCBOR(w); err != nil {
+		return xerrors.Errorf("failed to write index header: %w", err)
+	}
+	for i := range idx.Entries {
+		if err := idx.Entries[i].MarshalCBOR(w); err != nil {
+			return xerrors.Errorf("failed to write index entry: %w", err)
+		}
+	}
+	return nil
+}
+
+// ReadIndex reads an index previously written with WriteIndex
+func ReadIndex(r io.Reader) (Index, error) {
+	buf := bufio.NewReader(r)
+	var header IndexHeader
+	if err := header.UnmarshalCBOR(buf); err != nil {
+		return Index{}, xerrors.Errorf("failed to read index header: %w", err)
+	}
+	idx := Index{
+		PieceCID:  header.PieceCID,
+		PieceSize: header.PieceSize,
+	}
+	for i := uint64(0); i < header.EntryCount; i++ {
+		var e Entry
+		if err := e.UnmarshalCBOR(buf); err != nil {
+			return Index{}, xerrors.Errorf("failed to read index entry %d: %w", i, err)
+		}
+		idx.Entries = append(idx.Entries, e)
+	}
+	return idx, nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
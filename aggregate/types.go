@@ -0,0 +1,55 @@
+package aggregate
+
+import (
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+//go:generate cbor-gen-for Entry IndexHeader InclusionProof
+
+// SubPiece is a piece to be packed into an aggregate piece
+type SubPiece struct {
+	// PieceCID is the commP of the sub-piece
+	PieceCID cid.Cid
+	// Size is the padded size of the sub-piece
+	Size abi.PaddedPieceSize
+	// Root is the optional payload CID of the data in the sub-piece, used to
+	// look up a sub-piece by its payload
+	Root *cid.Cid
+}
+
+// Entry records where a sub-piece is located in an aggregate piece
+type Entry struct {
+	PieceCID cid.Cid
+	Size     abi.PaddedPieceSize
+	Root     *cid.Cid
+	// Offset is the padded offset of the sub-piece from the start of the
+	// aggregate piece. It is always a multiple of the sub-piece's size.
+	Offset uint64
+}
+
+// Index lists the location of all the sub-pieces in an aggregate piece,
+// ordered by offset
+type Index struct {
+	PieceCID  cid.Cid
+	PieceSize abi.PaddedPieceSize
+	Entries   []Entry
+}
+
+// IndexHeader precedes the entries of an index when it is written out
+type IndexHeader struct {
+	PieceCID   cid.Cid
+	PieceSize  abi.PaddedPieceSize
+	EntryCount uint64
+}
+
+// InclusionProof is a merkle proof that a sub-piece is included at a given
+// offset in an aggregate piece
+type InclusionProof struct {
+	// Offset is the padded offset of the sub-piece in the aggregate piece
+	Offset uint64
+	// Path holds the sibling nodes on the path from the sub-piece's root to
+	// the aggregate root, starting at the sub-piece's layer
+	Path [][]byte
+}
@@ -0,0 +1,427 @@
+package commp
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"runtime"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+// DefaultChunkSize is the default amount of unpadded bytes hashed into a
+// single subtree by one worker (4MiB once padded)
+const DefaultChunkSize = uint64(127 << 15)
+
+// ProgressFunc is called with the total number of unpadded bytes hashed so far
+type ProgressFunc func(processed uint64)
+
+// CheckpointFunc is called with the state of a computation each time a batch
+// of subtrees has been hashed and merged. The computation can later be
+// resumed from the checkpoint with ResumeFrom.
+type CheckpointFunc func(cp Checkpoint)
+
+// Checkpoint is the intermediate state of a commP computation, from which the
+// computation can be resumed
+type Checkpoint struct {
+	// ChunkSize is the unpadded size of the subtrees that were hashed
+	ChunkSize uint64
+	// Processed is the number of unpadded bytes that have been hashed. It is
+	// always a multiple of ChunkSize.
+	Processed uint64
+	// Layers holds the root of a pending left subtree for each layer of the
+	// tree above the chunk layer, or nil if there is none
+	Layers [][]byte
+}
+
+type config struct {
+	parallelism int
+	chunkSize   uint64
+	progress    ProgressFunc
+	checkpoint  CheckpointFunc
+	resume      *Checkpoint
+}
+
+// Option configures a commP computation
+type Option func(*config)
+
+// WithParallelism sets the number of subtrees hashed concurrently. Defaults
+// to the number of CPUs.
+func WithParallelism(n int) Option {
+	return func(c *config) {
+		c.parallelism = n
+	}
+}
+
+// WithChunkSize sets the unpadded size of the subtrees that are hashed
+// concurrently. It must be 127 multiplied by a power of two, and at least 254.
+func WithChunkSize(size uint64) Option {
+	return func(c *config) {
+		c.chunkSize = size
+	}
+}
+
+// WithProgress sets a callback that is informed of the computation's progress
+func WithProgress(cb ProgressFunc) Option {
+	return func(c *config) {
+		c.progress = cb
+	}
+}
+
+// WithCheckpoint sets a callback that receives the state of the computation
+// each time a batch of subtrees has been merged
+func WithCheckpoint(cb CheckpointFunc) Option {
+	return func(c *config) {
+		c.checkpoint = cb
+	}
+}
+
+// ResumeFrom resumes a computation from the given checkpoint. The data
+// written to the Calc must start at cp.Processed.
+func ResumeFrom(cp Checkpoint) Option {
+	return func(c *config) {
+		c.resume = &cp
+	}
+}
+
+// Result is the outcome of a commP computation
+type Result struct {
+	PieceCID    cid.Cid
+	PieceSize   abi.PaddedPieceSize
+	PayloadSize uint64
+}
+
+// Calc computes commP by splitting its input into fixed size chunks, hashing
+// each chunk into a subtree in parallel, and merging the subtree roots.
+// Unlike a plain hashhash calculator its intermediate state can be
+// checkpointed and resumed.
+type Calc struct {
+	cfg        config
+	chunkLayer int
+	maxLayers  int
+	processed  uint64
+	layers     [][]byte
+	buf        []byte
+	batch      [][]byte
+}
+
+// NewCalc creates a commP calculator with the given options
+func NewCalc(opts ...Option) (*Calc, error) {
+	cfg := config{
+		parallelism: runtime.NumCPU(),
+		chunkSize:   DefaultChunkSize,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.resume != nil {
+		cfg.chunkSize = cfg.resume.ChunkSize
+	}
+	if cfg.parallelism < 1 {
+		cfg.parallelism = 1
+	}
+	if cfg.chunkSize%127 != 0 || bits.OnesCount64(cfg.chunkSize/127) != 1 || cfg.chunkSize < 254 {
+		return nil, xerrors.Errorf("chunk size %d is not 127 multiplied by a power of two", cfg.chunkSize)
+	}
+
+	chunkLayer := bits.TrailingZeros64(cfg.chunkSize / 127 * 128 / 32)
+	c := &Calc{
+		cfg:        cfg,
+		chunkLayer: chunkLayer,
+		maxLayers:  int(commp.MaxLayers) - chunkLayer,
+		buf:        make([]byte, 0, cfg.chunkSize),
+	}
+	if cfg.resume != nil {
+		if cfg.resume.Processed%cfg.chunkSize != 0 {
+			return nil, xerrors.Errorf("checkpoint processed bytes %d is not a multiple of chunk size %d", cfg.resume.Processed, cfg.chunkSize)
+		}
+		if len(cfg.resume.Layers) > c.maxLayers {
+			return nil, xerrors.Errorf("checkpoint has %d layers, more than the maximum of %d", len(cfg.resume.Layers), c.maxLayers)
+		}
+		c.processed = cfg.resume.Processed
+		for _, l := range cfg.resume.Layers {
+			// an encoded checkpoint may hold empty layers in place of nil
+			// ones
+			if len(l) == 0 {
+				c.layers = append(c.layers, nil)
+				continue
+			}
+			if len(l) != 32 {
+				return nil, xerrors.Errorf("checkpoint layer node has length %d, expected 32", len(l))
+			}
+			c.layers = append(c.layers, copyNode(l))
+		}
+	}
+	return c, nil
+}
+
+// Write adds data to the computation. Full chunks are hashed in batches of
+// up to the configured parallelism.
+func (c *Calc) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		toCopy := int(c.cfg.chunkSize) - len(c.buf)
+		if toCopy > len(p) {
+			toCopy = len(p)
+		}
+		c.buf = append(c.buf, p[:toCopy]...)
+		p = p[toCopy:]
+
+		if len(c.buf) == int(c.cfg.chunkSize) {
+			c.batch = append(c.batch, c.buf)
+			c.buf = make([]byte, 0, c.cfg.chunkSize)
+			if len(c.batch) == c.cfg.parallelism {
+				if err := c.flush(); err != nil {
+					return n - len(p), err
+				}
+			}
+		}
+	}
+	return n, nil
+}
+
+// Checkpoint returns the state of the computation up to the last merged batch
+func (c *Calc) Checkpoint() Checkpoint {
+	layers := make([][]byte, len(c.layers))
+	for i, l := range c.layers {
+		layers[i] = copyNode(l)
+	}
+	return Checkpoint{
+		ChunkSize: c.cfg.chunkSize,
+		Processed: c.processed,
+		Layers:    layers,
+	}
+}
+
+// Sum completes the computation and returns the piece commitment of the
+// data written so far
+func (c *Calc) Sum() (Result, error) {
+	payloadSize := c.processed + uint64(len(c.batch))*c.cfg.chunkSize + uint64(len(c.buf))
+
+	// data that fits in a single chunk has a piece size below the chunk size,
+	// so hash it directly
+	if c.processed == 0 && len(c.batch) == 0 {
+		return c.sumSingleChunk()
+	}
+
+	if len(c.buf) > 0 {
+		// zero padding the unpadded data is the same as zero padding the
+		// fr32 padded data, so the last chunk can simply be filled up
+		c.batch = append(c.batch, append(c.buf, make([]byte, int(c.cfg.chunkSize)-len(c.buf))...))
+		c.buf = nil
+	}
+	if err := c.flush(); err != nil {
+		return Result{}, err
+	}
+
+	chunks := c.processed / c.cfg.chunkSize
+	top := bits.Len64(chunks - 1)
+	if top > c.maxLayers {
+		return Result{}, xerrors.Errorf("payload of %d bytes exceeds the maximum piece size", payloadSize)
+	}
+
+	// collapse the pending subtrees, padding with zero subtrees up to the
+	// next power of two
+	var root []byte
+	for i := 0; i < top; i++ {
+		var left []byte
+		if i < len(c.layers) {
+			left = c.layers[i]
+		}
+		switch {
+		case root == nil && left == nil:
+		case root == nil:
+			root = hashNodes(left, zeroNode(c.chunkLayer+i))
+		case left == nil:
+			root = hashNodes(root, zeroNode(c.chunkLayer+i))
+		default:
+			root = hashNodes(left, root)
+		}
+	}
+	if root == nil {
+		root = c.layers[top]
+	}
+
+	pieceCID, err := commcid.DataCommitmentV1ToCID(root)
+	if err != nil {
+		return Result{}, xerrors.Errorf("failed to convert commP to cid: %w", err)
+	}
+	return Result{
+		PieceCID:    pieceCID,
+		PieceSize:   abi.PaddedPieceSize(c.cfg.chunkSize/127*128) << top,
+		PayloadSize: payloadSize,
+	}, nil
+}
+
+func (c *Calc) sumSingleChunk() (Result, error) {
+	cp := &commp.Calc{}
+	if _, err := cp.Write(c.buf); err != nil {
+		return Result{}, xerrors.Errorf("failed to write to commP calculator: %w", err)
+	}
+	rawCommP, paddedSize, err := cp.Digest()
+	if err != nil {
+		return Result{}, xerrors.Errorf("failed to compute commP: %w", err)
+	}
+	pieceCID, err := commcid.DataCommitmentV1ToCID(rawCommP)
+	if err != nil {
+		return Result{}, xerrors.Errorf("failed to convert commP to cid: %w", err)
+	}
+	c.report()
+	return Result{
+		PieceCID:    pieceCID,
+		PieceSize:   abi.PaddedPieceSize(paddedSize),
+		PayloadSize: uint64(len(c.buf)),
+	}, nil
+}
+
+// flush hashes the current batch of chunks in parallel, and merges the
+// resulting subtree roots in order
+func (c *Calc) flush() error {
+	if len(c.batch) == 0 {
+		return nil
+	}
+
+	roots := make([][]byte, len(c.batch))
+	errs := make([]error, len(c.batch))
+	var wg sync.WaitGroup
+	for i, chunk := range c.batch {
+		wg.Add(1)
+		go func(i int, chunk []byte) {
+			defer wg.Done()
+			roots[i], errs[i] = hashChunk(chunk)
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	for i, root := range roots {
+		if errs[i] != nil {
+			return xerrors.Errorf("failed to hash chunk at offset %d: %w", c.processed, errs[i])
+		}
+		if err := c.merge(root); err != nil {
+			return err
+		}
+		c.processed += c.cfg.chunkSize
+	}
+	c.batch = c.batch[:0]
+
+	c.report()
+	if c.cfg.checkpoint != nil {
+		c.cfg.checkpoint(c.Checkpoint())
+	}
+	return nil
+}
+
+// merge adds a chunk root to the stack of pending subtrees, combining equal
+// height subtrees as it goes
+func (c *Calc) merge(root []byte) error {
+	for i := 0; ; i++ {
+		if i >= c.maxLayers {
+			return xerrors.Errorf("payload exceeds the maximum piece size")
+		}
+		if i == len(c.layers) {
+			c.layers = append(c.layers, nil)
+		}
+		if c.layers[i] == nil {
+			c.layers[i] = root
+			return nil
+		}
+		root = hashNodes(c.layers[i], root)
+		c.layers[i] = nil
+	}
+}
+
+func (c *Calc) report() {
+	if c.cfg.progress != nil {
+		c.cfg.progress(c.processed + uint64(len(c.buf)))
+	}
+}
+
+// Compute calculates the piece commitment of all the data in the reader.
+// When resuming from a checkpoint, the reader is expected to start at the
+// beginning of the data: it is seeked (or read and discarded) up to the point
+// where the checkpoint was taken. Computation stops with the context's error
+// if it is cancelled.
+func Compute(ctx context.Context, r io.Reader, opts ...Option) (Result, error) {
+	c, err := NewCalc(opts...)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if c.processed > 0 {
+		if s, ok := r.(io.Seeker); ok {
+			if _, err := s.Seek(int64(c.processed), io.SeekStart); err != nil {
+				return Result{}, xerrors.Errorf("failed to seek to checkpoint: %w", err)
+			}
+		} else if _, err := io.CopyN(ioutil.Discard, r, int64(c.processed)); err != nil {
+			return Result{}, xerrors.Errorf("failed to skip to checkpoint: %w", err)
+		}
+	}
+
+	buf := make([]byte, c.cfg.chunkSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return Result{}, err
+		}
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, werr := c.Write(buf[:n]); werr != nil {
+				return Result{}, werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Result{}, xerrors.Errorf("failed to read data: %w", err)
+		}
+	}
+	return c.Sum()
+}
+
+func hashChunk(chunk []byte) ([]byte, error) {
+	cp := &commp.Calc{}
+	if _, err := cp.Write(chunk); err != nil {
+		return nil, err
+	}
+	root, _, err := cp.Digest()
+	return root, err
+}
+
+func hashNodes(left, right []byte) []byte {
+	h := sha256.New()
+	_, _ = h.Write(left)
+	_, _ = h.Write(right)
+	out := h.Sum(nil)
+	out[31] &= 0x3F
+	return out
+}
+
+var zeroNodes = func() [][]byte {
+	nodes := make([][]byte, commp.MaxLayers+1)
+	nodes[0] = make([]byte, 32)
+	for i := 1; i < len(nodes); i++ {
+		nodes[i] = hashNodes(nodes[i-1], nodes[i-1])
+	}
+	return nodes
+}()
+
+// zeroNode returns the root of a subtree of zeroes at the given layer, where
+// layer 0 is a single 32 byte leaf
+func zeroNode(layer int) []byte {
+	return zeroNodes[layer]
+}
+
+func copyNode(n []byte) []byte {
+	if n == nil {
+		return nil
+	}
+	return append([]byte(nil), n...)
+}
@@ -0,0 +1,189 @@
+package commp_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	hashhash "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/commp"
+)
+
+const testChunkSize = 127 << 3
+
+func serialCommP(t *testing.T, data []byte) (cid.Cid, abi.PaddedPieceSize) {
+	cp := &hashhash.Calc{}
+	_, err := cp.Write(data)
+	require.NoError(t, err)
+	raw, size, err := cp.Digest()
+	require.NoError(t, err)
+	c, err := commcid.DataCommitmentV1ToCID(raw)
+	require.NoError(t, err)
+	return c, abi.PaddedPieceSize(size)
+}
+
+func randData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func TestComputeMatchesSerial(t *testing.T) {
+	ctx := context.Background()
+	sizes := []int{
+		65,
+		500,
+		testChunkSize,
+		testChunkSize + 1,
+		2 * testChunkSize,
+		3*testChunkSize + 17,
+		8 * testChunkSize,
+		13*testChunkSize - 5,
+	}
+	for _, size := range sizes {
+		data := randData(size)
+		expectedCid, expectedSize := serialCommP(t, data)
+		for _, parallelism := range []int{1, 3, 8} {
+			res, err := commp.Compute(ctx, bytes.NewReader(data), commp.WithChunkSize(testChunkSize), commp.WithParallelism(parallelism))
+			require.NoError(t, err)
+			require.Equal(t, expectedCid, res.PieceCID, "size %d parallelism %d", size, parallelism)
+			require.Equal(t, expectedSize, res.PieceSize, "size %d parallelism %d", size, parallelism)
+			require.Equal(t, uint64(size), res.PayloadSize)
+		}
+	}
+}
+
+func TestComputeTooSmall(t *testing.T) {
+	_, err := commp.Compute(context.Background(), bytes.NewReader(randData(64)))
+	require.Error(t, err)
+}
+
+func TestInvalidChunkSize(t *testing.T) {
+	_, err := commp.NewCalc(commp.WithChunkSize(1000))
+	require.Error(t, err)
+	_, err = commp.NewCalc(commp.WithChunkSize(127))
+	require.Error(t, err)
+}
+
+func TestProgress(t *testing.T) {
+	data := randData(5*testChunkSize + 3)
+	var reported []uint64
+	_, err := commp.Compute(context.Background(), bytes.NewReader(data),
+		commp.WithChunkSize(testChunkSize),
+		commp.WithParallelism(2),
+		commp.WithProgress(func(processed uint64) {
+			reported = append(reported, processed)
+		}))
+	require.NoError(t, err)
+	require.NotEmpty(t, reported)
+	for i := 1; i < len(reported); i++ {
+		require.Greater(t, reported[i], reported[i-1])
+	}
+	require.Equal(t, uint64(6*testChunkSize), reported[len(reported)-1])
+}
+
+func TestResume(t *testing.T) {
+	data := randData(11*testChunkSize + 100)
+	expectedCid, expectedSize := serialCommP(t, data)
+
+	// interrupt the computation after a few batches
+	var checkpoints []commp.Checkpoint
+	calc, err := commp.NewCalc(
+		commp.WithChunkSize(testChunkSize),
+		commp.WithParallelism(2),
+		commp.WithCheckpoint(func(cp commp.Checkpoint) {
+			checkpoints = append(checkpoints, cp)
+		}))
+	require.NoError(t, err)
+	_, err = calc.Write(data[:7*testChunkSize+10])
+	require.NoError(t, err)
+	require.Len(t, checkpoints, 3)
+	cp := checkpoints[len(checkpoints)-1]
+	require.Equal(t, uint64(6*testChunkSize), cp.Processed)
+	require.Equal(t, cp, calc.Checkpoint())
+
+	t.Run("resume with seekable reader", func(t *testing.T) {
+		res, err := commp.Compute(context.Background(), bytes.NewReader(data), commp.ResumeFrom(cp))
+		require.NoError(t, err)
+		require.Equal(t, expectedCid, res.PieceCID)
+		require.Equal(t, expectedSize, res.PieceSize)
+		require.Equal(t, uint64(len(data)), res.PayloadSize)
+	})
+
+	t.Run("resume with plain reader", func(t *testing.T) {
+		res, err := commp.Compute(context.Background(), bytes.NewBuffer(data), commp.ResumeFrom(cp))
+		require.NoError(t, err)
+		require.Equal(t, expectedCid, res.PieceCID)
+	})
+
+	t.Run("resume by writing remaining data", func(t *testing.T) {
+		resumed, err := commp.NewCalc(commp.ResumeFrom(cp))
+		require.NoError(t, err)
+		_, err = resumed.Write(data[cp.Processed:])
+		require.NoError(t, err)
+		res, err := resumed.Sum()
+		require.NoError(t, err)
+		require.Equal(t, expectedCid, res.PieceCID)
+	})
+
+	t.Run("resume from a stored checkpoint", func(t *testing.T) {
+		ctx := context.Background()
+		store := commp.NewCheckpointStore(datastore.NewMapDatastore())
+		none, err := store.Get(ctx, "deal")
+		require.NoError(t, err)
+		require.Nil(t, none)
+
+		require.NoError(t, store.Put(ctx, "deal", cp))
+		stored, err := store.Get(ctx, "deal")
+		require.NoError(t, err)
+		require.Equal(t, cp.Processed, stored.Processed)
+		res, err := commp.Compute(ctx, bytes.NewReader(data), commp.ResumeFrom(*stored))
+		require.NoError(t, err)
+		require.Equal(t, expectedCid, res.PieceCID)
+
+		require.NoError(t, store.Delete(ctx, "deal"))
+		none, err = store.Get(ctx, "deal")
+		require.NoError(t, err)
+		require.Nil(t, none)
+	})
+
+	t.Run("invalid checkpoint", func(t *testing.T) {
+		bad := cp
+		bad.Processed++
+		_, err := commp.NewCalc(commp.ResumeFrom(bad))
+		require.Error(t, err)
+	})
+}
+
+func TestComputeCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := commp.Compute(ctx, bytes.NewReader(randData(4*testChunkSize)), commp.WithChunkSize(testChunkSize))
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestGenerateCommpPadsToTarget(t *testing.T) {
+	data := randData(3*testChunkSize + 1)
+	c, size := serialCommP(t, data)
+	raw, err := commcid.CIDToPieceCommitmentV1(c)
+	require.NoError(t, err)
+	padded, err := hashhash.PadCommP(raw, uint64(size), uint64(size)*4)
+	require.NoError(t, err)
+	expected, err := commcid.DataCommitmentV1ToCID(padded)
+	require.NoError(t, err)
+
+	actual, err := commp.GenerateCommp(bytes.NewReader(data), uint64(len(data)), uint64(size)*4, commp.WithChunkSize(testChunkSize))
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	_, err = commp.GenerateCommp(bytes.NewReader(data), uint64(len(data))+1, uint64(size))
+	require.Error(t, err)
+}
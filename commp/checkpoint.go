@@ -0,0 +1,60 @@
+package commp
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/ipfs/go-datastore"
+	"golang.org/x/xerrors"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+)
+
+//go:generate cbor-gen-for --map-encoding Checkpoint
+
+// CheckpointStore persists the checkpoints of commP computations, so that a
+// computation interrupted by a restart can be resumed
+type CheckpointStore struct {
+	ds datastore.Datastore
+}
+
+// NewCheckpointStore returns a CheckpointStore that keeps checkpoints in ds
+func NewCheckpointStore(ds datastore.Datastore) *CheckpointStore {
+	return &CheckpointStore{ds: ds}
+}
+
+// Get returns the checkpoint stored under key, or nil if there is none
+func (s *CheckpointStore) Get(ctx context.Context, key string) (*Checkpoint, error) {
+	data, err := s.ds.Get(ctx, datastore.NewKey(key))
+	if xerrors.Is(err, datastore.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("loading commP checkpoint %s: %w", key, err)
+	}
+	var cp Checkpoint
+	if err := cp.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+		return nil, xerrors.Errorf("decoding commP checkpoint %s: %w", key, err)
+	}
+	return &cp, nil
+}
+
+// Put stores a checkpoint under key, replacing any previous one
+func (s *CheckpointStore) Put(ctx context.Context, key string, cp Checkpoint) error {
+	data, err := cborutil.Dump(&cp)
+	if err != nil {
+		return xerrors.Errorf("encoding commP checkpoint %s: %w", key, err)
+	}
+	if err := s.ds.Put(ctx, datastore.NewKey(key), data); err != nil {
+		return xerrors.Errorf("saving commP checkpoint %s: %w", key, err)
+	}
+	return nil
+}
+
+// Delete removes the checkpoint stored under key, if there is one
+func (s *CheckpointStore) Delete(ctx context.Context, key string) error {
+	if err := s.ds.Delete(ctx, datastore.NewKey(key)); err != nil {
+		return xerrors.Errorf("deleting commP checkpoint %s: %w", key, err)
+	}
+	return nil
+}
@@ -1,45 +1,46 @@
 package commp
 
 import (
+	"context"
 	"io"
 
 	"github.com/ipfs/go-cid"
 	"golang.org/x/xerrors"
 
-	"github.com/filecoin-project/go-commp-utils/writer"
 	commcid "github.com/filecoin-project/go-fil-commcid"
 	commp "github.com/filecoin-project/go-fil-commp-hashhash"
 )
 
-func GenerateCommp(reader io.Reader, payloadSize uint64, targetSize uint64) (cid.Cid, error) {
-	// dump the CARv1 payload of the CARv2 file to the Commp Writer and get back the CommP.
-	w := &writer.Writer{}
-	written, err := io.Copy(w, reader)
-	if err != nil {
-		return cid.Undef, xerrors.Errorf("failed to write to CommP writer: %w", err)
-	}
-	if written != int64(payloadSize) {
-		return cid.Undef, xerrors.Errorf("number of bytes written to CommP writer %d not equal to the CARv1 payload size %d", written, payloadSize)
-	}
+func GenerateCommp(reader io.Reader, payloadSize uint64, targetSize uint64, opts ...Option) (cid.Cid, error) {
+	return GenerateCommpWithContext(context.Background(), reader, payloadSize, targetSize, opts...)
+}
 
-	cidAndSize, err := w.Sum()
+// GenerateCommpWithContext computes the commP of the payload in the reader
+// in parallel, padding it up to the target size. The computation is aborted
+// if the context is cancelled.
+func GenerateCommpWithContext(ctx context.Context, reader io.Reader, payloadSize uint64, targetSize uint64, opts ...Option) (cid.Cid, error) {
+	// dump the CARv1 payload of the CARv2 file to the CommP calculator and get back the CommP.
+	res, err := Compute(ctx, reader, opts...)
 	if err != nil {
-		return cid.Undef, xerrors.Errorf("failed to get CommP: %w", err)
+		return cid.Undef, xerrors.Errorf("failed to compute CommP: %w", err)
+	}
+	if res.PayloadSize != payloadSize {
+		return cid.Undef, xerrors.Errorf("number of bytes written to CommP calculator %d not equal to the CARv1 payload size %d", res.PayloadSize, payloadSize)
 	}
 
-	if uint64(cidAndSize.PieceSize) < targetSize {
+	if uint64(res.PieceSize) < targetSize {
 		// need to pad up!
 		rawPaddedCommp, err := commp.PadCommP(
 			// we know how long a pieceCid "hash" is, just blindly extract the trailing 32 bytes
-			cidAndSize.PieceCID.Hash()[len(cidAndSize.PieceCID.Hash())-32:],
-			uint64(cidAndSize.PieceSize),
+			res.PieceCID.Hash()[len(res.PieceCID.Hash())-32:],
+			uint64(res.PieceSize),
 			uint64(targetSize),
 		)
 		if err != nil {
 			return cid.Undef, err
 		}
-		cidAndSize.PieceCID, _ = commcid.DataCommitmentV1ToCID(rawPaddedCommp)
+		res.PieceCID, _ = commcid.DataCommitmentV1ToCID(rawPaddedCommp)
 	}
 
-	return cidAndSize.PieceCID, err
+	return res.PieceCID, nil
 }
@@ -0,0 +1,283 @@
+// Package dealarchive moves the records of finished deals out of the state
+// machine group that tracks them, and into an archive.
+//
+// The storage and retrieval clients and providers keep a record for every
+// deal they have taken part in, in a state machine group. Deals that have
+// reached a finality state never change again, but listing the group still
+// has to read them, so it gets slower as deals accumulate. An Archiver
+// periodically moves the records of deals that have been in a finality
+// state for longer than a retention period into an archive, where they can
+// still be looked up by ID, listed, or exported to a file.
+//
+// A deal's age is measured from when the Archiver first sees it in a
+// finality state, since not every deal record says when it finished. Deals
+// that had already finished when archival is enabled are kept for the
+// retention period from then.
+package dealarchive
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log/v2"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-statemachine/fsm"
+	"github.com/filecoin-project/go-statestore"
+
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+var log = logging.Logger("dealarchive")
+
+// DefaultRetention is how long a deal stays in its state machine group
+// after it reaches a finality state, by default
+const DefaultRetention = 30 * 24 * time.Hour
+
+// DefaultCheckInterval is how often deals are checked for archival, by
+// default
+const DefaultCheckInterval = time.Hour
+
+// Option is a function that configures an Archiver
+type Option func(a *Archiver)
+
+// Retention sets how long a deal stays in its state machine group after it
+// reaches a finality state. Zero archives deals as soon as they finish.
+func Retention(retention time.Duration) Option {
+	return func(a *Archiver) {
+		a.retention = retention
+	}
+}
+
+// CheckInterval sets how often deals are checked for archival
+func CheckInterval(interval time.Duration) Option {
+	return func(a *Archiver) {
+		a.checkInterval = interval
+	}
+}
+
+// ArchiverClock sets the clock the archiver uses to age deals and schedule
+// checks
+func ArchiverClock(clock shared.Clock) Option {
+	return func(a *Archiver) {
+		a.clock = clock
+	}
+}
+
+// IdentifierFunc returns the identifier a state machine group tracks a deal
+// under
+type IdentifierFunc func(deal interface{}) interface{}
+
+// Archiver archives the deals of a state machine group that have finished
+type Archiver struct {
+	group      fsm.Group
+	stateType  reflect.Type
+	identifier IdentifierFunc
+	// records holds the archived deals, under the same keys as the group
+	recordsDS datastore.Batching
+	records   *statestore.StateStore
+	// finished holds the time each deal still in the group was first seen
+	// in a finality state
+	finished      datastore.Batching
+	clock         shared.Clock
+	retention     time.Duration
+	checkInterval time.Duration
+
+	// archiveLk ensures only one archival pass runs at a time
+	archiveLk sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewArchiver returns an Archiver for the deals in group, that persists the
+// archive to ds. stateType is the zero value of the group's state type, as
+// passed to fsm.New.
+func NewArchiver(ds datastore.Batching, group fsm.Group, stateType fsm.StateType, identifier IdentifierFunc, opts ...Option) *Archiver {
+	recordsDS := namespace.Wrap(ds, datastore.NewKey("records"))
+	a := &Archiver{
+		group:         group,
+		stateType:     reflect.TypeOf(stateType),
+		identifier:    identifier,
+		recordsDS:     recordsDS,
+		records:       statestore.New(recordsDS),
+		finished:      namespace.Wrap(ds, datastore.NewKey("finished")),
+		clock:         shared.NewClock(),
+		retention:     DefaultRetention,
+		checkInterval: DefaultCheckInterval,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Start archives deals periodically, until Stop is called
+func (a *Archiver) Start() {
+	a.stop = make(chan struct{})
+	a.done = make(chan struct{})
+	go a.run(a.stop, a.done)
+}
+
+// Stop stops archiving deals
+func (a *Archiver) Stop() {
+	if a.stop == nil {
+		return
+	}
+	close(a.stop)
+	<-a.done
+	a.stop = nil
+}
+
+func (a *Archiver) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := a.clock.Ticker(a.checkInterval)
+	defer ticker.Stop()
+	for {
+		if archived, err := a.ArchiveDeals(ctx); err != nil {
+			log.Errorf("archiving deals: %s", err)
+		} else if archived > 0 {
+			log.Infof("archived %d deals", archived)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ArchiveDeals moves the deals that have been in a finality state for
+// longer than the retention period into the archive, and returns how many
+// it moved
+func (a *Archiver) ArchiveDeals(ctx context.Context) (int, error) {
+	a.archiveLk.Lock()
+	defer a.archiveLk.Unlock()
+
+	now := a.clock.Now()
+	deals := reflect.New(reflect.SliceOf(a.stateType))
+	if err := a.group.List(deals.Interface()); err != nil {
+		return 0, xerrors.Errorf("listing deals: %w", err)
+	}
+	finished, err := a.loadFinished(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	archived := 0
+	seen := make(map[datastore.Key]struct{})
+	for i := 0; i < deals.Elem().Len(); i++ {
+		deal := deals.Elem().Index(i)
+		if !a.group.IsTerminated(deal.Interface()) {
+			continue
+		}
+		id := a.identifier(deal.Interface())
+		key := statestore.ToKey(id)
+		seen[key] = struct{}{}
+
+		since, ok := finished[key]
+		if !ok {
+			since = now
+			b, err := cborutil.Dump(cbg.CborTime(now))
+			if err != nil {
+				return archived, err
+			}
+			if err := a.finished.Put(ctx, key, b); err != nil {
+				return archived, xerrors.Errorf("recording deal %s finished: %w", id, err)
+			}
+		}
+		if now.Sub(since) < a.retention {
+			continue
+		}
+
+		record, err := cborutil.Dump(deal.Addr().Interface())
+		if err != nil {
+			return archived, xerrors.Errorf("encoding deal %s: %w", id, err)
+		}
+		if err := a.archive(ctx, id, key, record); err != nil {
+			return archived, err
+		}
+		archived++
+	}
+
+	// forget deals that are no longer in the group
+	for key := range finished {
+		if _, ok := seen[key]; !ok {
+			if err := a.finished.Delete(ctx, key); err != nil {
+				return archived, xerrors.Errorf("removing finish time of %s: %w", key, err)
+			}
+		}
+	}
+	return archived, nil
+}
+
+// archive writes a deal record to the archive before ending its state
+// machine, so that if archival is interrupted the deal is archived again
+// on the next pass rather than lost
+func (a *Archiver) archive(ctx context.Context, id interface{}, key datastore.Key, record []byte) error {
+	if err := a.putRecord(ctx, key, record); err != nil {
+		return xerrors.Errorf("archiving deal %s: %w", id, err)
+	}
+	if err := a.group.Get(id).End(); err != nil {
+		return xerrors.Errorf("removing archived deal %s: %w", id, err)
+	}
+	if err := a.finished.Delete(ctx, key); err != nil {
+		return xerrors.Errorf("removing finish time of deal %s: %w", id, err)
+	}
+	return nil
+}
+
+func (a *Archiver) loadFinished(ctx context.Context) (map[datastore.Key]time.Time, error) {
+	res, err := a.finished.Query(ctx, query.Query{})
+	if err != nil {
+		return nil, xerrors.Errorf("querying finish times: %w", err)
+	}
+	defer res.Close() //nolint:errcheck
+
+	finished := make(map[datastore.Key]time.Time)
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, xerrors.Errorf("querying finish times: %w", r.Error)
+		}
+		var t cbg.CborTime
+		if err := t.UnmarshalCBOR(bytes.NewReader(r.Value)); err != nil {
+			return nil, xerrors.Errorf("decoding finish time of %s: %w", r.Key, err)
+		}
+		finished[datastore.NewKey(r.Key)] = t.Time()
+	}
+	return finished, nil
+}
+
+// Get reads the archived record of a deal into out. It returns an error
+// wrapping datastore.ErrNotFound if the deal has not been archived.
+func (a *Archiver) Get(id interface{}, out cbg.CBORUnmarshaler) error {
+	return a.records.Get(id).Get(out)
+}
+
+// Has returns whether a deal has been archived
+func (a *Archiver) Has(id interface{}) (bool, error) {
+	return a.records.Has(id)
+}
+
+// List reads the records of all archived deals into out, which must be a
+// pointer to a slice of the group's state type
+func (a *Archiver) List(out interface{}) error {
+	return a.records.List(out)
+}
@@ -0,0 +1,183 @@
+package dealarchive_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-statemachine/fsm"
+
+	"github.com/filecoin-project/go-fil-markets/dealarchive"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientstates"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+func TestArchiver(t *testing.T) {
+	ctx := context.Background()
+	newGroup := func(t *testing.T, ds datastore.Batching) fsm.Group {
+		group, err := fsm.New(namespace.Wrap(ds, datastore.NewKey("deals")), fsm.Parameters{
+			Environment:    struct{}{},
+			StateType:      retrievalmarket.ClientDealState{},
+			StateKeyField:  "Status",
+			Events:         clientstates.ClientEvents,
+			FinalityStates: clientstates.ClientFinalityStates,
+		})
+		require.NoError(t, err)
+		return group
+	}
+	newArchiver := func(ds datastore.Batching, group fsm.Group, opts ...dealarchive.Option) *dealarchive.Archiver {
+		return dealarchive.NewArchiver(namespace.Wrap(ds, datastore.NewKey("archive")), group,
+			retrievalmarket.ClientDealState{}, func(deal interface{}) interface{} {
+				return deal.(retrievalmarket.ClientDealState).ID
+			}, opts...)
+	}
+	begin := func(t *testing.T, group fsm.Group, id retrievalmarket.DealID, status retrievalmarket.DealStatus) retrievalmarket.ClientDealState {
+		deal := retrievalmarket.ClientDealState{
+			DealProposal: tut.MakeTestDealProposal(),
+			ClientWallet: address.TestAddress,
+			MinerWallet:  address.TestAddress2,
+			Status:       status,
+		}
+		deal.ID = id
+		require.NoError(t, group.Begin(id, &deal))
+		var stored retrievalmarket.ClientDealState
+		require.NoError(t, group.Get(id).Get(&stored))
+		return stored
+	}
+	live := func(t *testing.T, group fsm.Group) []retrievalmarket.DealID {
+		var deals []retrievalmarket.ClientDealState
+		require.NoError(t, group.List(&deals))
+		var ids []retrievalmarket.DealID
+		for _, deal := range deals {
+			ids = append(ids, deal.ID)
+		}
+		return ids
+	}
+
+	t.Run("archives finished deals after the retention period", func(t *testing.T) {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		group := newGroup(t, ds)
+		mockClock := clock.NewMock()
+		a := newArchiver(ds, group, dealarchive.Retention(time.Hour), dealarchive.ArchiverClock(mockClock))
+		completed := begin(t, group, 1, retrievalmarket.DealStatusCompleted)
+		begin(t, group, 2, retrievalmarket.DealStatusOngoing)
+
+		archived, err := a.ArchiveDeals(ctx)
+		require.NoError(t, err)
+		require.Zero(t, archived)
+
+		// a deal that finishes later is kept for the retention period from
+		// when it is first seen to have finished
+		mockClock.Add(30 * time.Minute)
+		cancelled := begin(t, group, 3, retrievalmarket.DealStatusCancelled)
+		archived, err = a.ArchiveDeals(ctx)
+		require.NoError(t, err)
+		require.Zero(t, archived)
+
+		mockClock.Add(30 * time.Minute)
+		archived, err = a.ArchiveDeals(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, archived)
+		require.ElementsMatch(t, []retrievalmarket.DealID{2, 3}, live(t, group))
+
+		var out retrievalmarket.ClientDealState
+		require.NoError(t, a.Get(retrievalmarket.DealID(1), &out))
+		require.Equal(t, completed, out)
+		has, err := a.Has(retrievalmarket.DealID(3))
+		require.NoError(t, err)
+		require.False(t, has)
+		err = a.Get(retrievalmarket.DealID(2), &out)
+		require.True(t, xerrors.Is(err, datastore.ErrNotFound))
+
+		mockClock.Add(30 * time.Minute)
+		archived, err = a.ArchiveDeals(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, archived)
+		require.Equal(t, []retrievalmarket.DealID{2}, live(t, group))
+
+		var all []retrievalmarket.ClientDealState
+		require.NoError(t, a.List(&all))
+		require.ElementsMatch(t, []retrievalmarket.ClientDealState{completed, cancelled}, all)
+	})
+
+	t.Run("archives deals as soon as they finish with no retention", func(t *testing.T) {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		group := newGroup(t, ds)
+		a := newArchiver(ds, group, dealarchive.Retention(0))
+		begin(t, group, 1, retrievalmarket.DealStatusErrored)
+		begin(t, group, 2, retrievalmarket.DealStatusOngoing)
+
+		archived, err := a.ArchiveDeals(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, archived)
+		require.Equal(t, []retrievalmarket.DealID{2}, live(t, group))
+	})
+
+	t.Run("remembers when deals finished across restarts", func(t *testing.T) {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		group := newGroup(t, ds)
+		mockClock := clock.NewMock()
+		a := newArchiver(ds, group, dealarchive.Retention(time.Hour), dealarchive.ArchiverClock(mockClock))
+		begin(t, group, 1, retrievalmarket.DealStatusCompleted)
+		_, err := a.ArchiveDeals(ctx)
+		require.NoError(t, err)
+
+		mockClock.Add(time.Hour)
+		restarted := newArchiver(ds, newGroup(t, ds), dealarchive.Retention(time.Hour), dealarchive.ArchiverClock(mockClock))
+		archived, err := restarted.ArchiveDeals(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, archived)
+	})
+
+	t.Run("exports and imports the archive", func(t *testing.T) {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		group := newGroup(t, ds)
+		a := newArchiver(ds, group, dealarchive.Retention(0))
+		first := begin(t, group, 1, retrievalmarket.DealStatusCompleted)
+		second := begin(t, group, 2, retrievalmarket.DealStatusRejected)
+		_, err := a.ArchiveDeals(ctx)
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+		require.NoError(t, a.Export(ctx, &buf))
+
+		otherDS := dss.MutexWrap(datastore.NewMapDatastore())
+		other := newArchiver(otherDS, newGroup(t, otherDS))
+		require.NoError(t, other.Import(ctx, &buf))
+		var out retrievalmarket.ClientDealState
+		require.NoError(t, other.Get(retrievalmarket.DealID(1), &out))
+		require.Equal(t, first, out)
+		require.NoError(t, other.Get(retrievalmarket.DealID(2), &out))
+		require.Equal(t, second, out)
+
+		require.Error(t, other.Import(ctx, bytes.NewReader([]byte{0xff})))
+	})
+
+	t.Run("archives deals periodically once started", func(t *testing.T) {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		group := newGroup(t, ds)
+		mockClock := clock.NewMock()
+		a := newArchiver(ds, group, dealarchive.Retention(time.Minute),
+			dealarchive.CheckInterval(time.Minute), dealarchive.ArchiverClock(mockClock))
+		begin(t, group, 1, retrievalmarket.DealStatusCompleted)
+		a.Start()
+		defer a.Stop()
+
+		require.Eventually(t, func() bool {
+			mockClock.Add(time.Minute)
+			has, err := a.Has(retrievalmarket.DealID(1))
+			require.NoError(t, err)
+			return has
+		}, time.Second, 10*time.Millisecond)
+	})
+}
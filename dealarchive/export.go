@@ -0,0 +1,65 @@
+package dealarchive
+
+import (
+	"bufio"
+	"context"
+	"io"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"golang.org/x/xerrors"
+)
+
+//go:generate cbor-gen-for --map-encoding Entry
+
+// Entry is an archived deal record in an export
+type Entry struct {
+	// Key is the key the deal is tracked under
+	Key string
+	// Record is the CBOR encoded deal record
+	Record []byte
+}
+
+// Export writes every archived deal record to w, as a sequence of CBOR
+// encoded entries
+func (a *Archiver) Export(ctx context.Context, w io.Writer) error {
+	res, err := a.recordsDS.Query(ctx, query.Query{})
+	if err != nil {
+		return xerrors.Errorf("querying archive: %w", err)
+	}
+	defer res.Close() //nolint:errcheck
+
+	bw := bufio.NewWriter(w)
+	for r := range res.Next() {
+		if r.Error != nil {
+			return xerrors.Errorf("querying archive: %w", r.Error)
+		}
+		entry := Entry{Key: r.Key, Record: r.Value}
+		if err := entry.MarshalCBOR(bw); err != nil {
+			return xerrors.Errorf("writing archived deal %s: %w", r.Key, err)
+		}
+	}
+	return bw.Flush()
+}
+
+// Import reads an export written by Export into the archive, so that the
+// deals in it can be looked up again
+func (a *Archiver) Import(ctx context.Context, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return nil
+		}
+		var entry Entry
+		if err := entry.UnmarshalCBOR(br); err != nil {
+			return xerrors.Errorf("reading archived deal: %w", err)
+		}
+		if err := a.putRecord(ctx, datastore.NewKey(entry.Key), entry.Record); err != nil {
+			return xerrors.Errorf("importing archived deal %s: %w", entry.Key, err)
+		}
+	}
+}
+
+func (a *Archiver) putRecord(ctx context.Context, key datastore.Key, record []byte) error {
+	return a.recordsDS.Put(ctx, key, record)
+}
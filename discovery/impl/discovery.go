@@ -1,9 +1,225 @@
 package discoveryimpl
 
 import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
 	"github.com/filecoin-project/go-fil-markets/discovery"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 )
 
-func Multi(r discovery.PeerResolver) discovery.PeerResolver { // TODO: actually support multiple mechanisms
-	return r
+// DefaultBackendTimeout is how long a MultiResolver waits for a backend to
+// answer, by default
+const DefaultBackendTimeout = 10 * time.Second
+
+// Backend is a resolver queried by a MultiResolver
+type Backend struct {
+	// Name identifies the backend in logs and errors
+	Name     string
+	Resolver discovery.PeerResolver
+	// Timeout is how long to wait for the resolver to answer. Zero means
+	// DefaultBackendTimeout.
+	Timeout time.Duration
+	// Priority orders the peers found by each backend in the results: the
+	// peers of backends with a lower priority come first, and the peers of
+	// backends with the same priority come in the order the backends were
+	// given
+	Priority int
+}
+
+// MultiResolver looks up peers with several resolvers at once, and merges
+// what they find
+type MultiResolver struct {
+	backends []Backend
+}
+
+var _ discovery.ContextPeerResolver = &MultiResolver{}
+var _ discovery.StreamingPeerResolver = &MultiResolver{}
+
+// NewMultiResolver returns a MultiResolver that queries the given backends
+func NewMultiResolver(backends ...Backend) *MultiResolver {
+	sorted := append([]Backend(nil), backends...)
+	for i := range sorted {
+		if sorted[i].Name == "" {
+			sorted[i].Name = fmt.Sprintf("backend %d", i)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+	return &MultiResolver{backends: sorted}
+}
+
+// Multi returns a resolver that queries all the given resolvers, with the
+// default timeout, preferring the peers of earlier resolvers
+func Multi(resolvers ...discovery.PeerResolver) discovery.PeerResolver {
+	if len(resolvers) == 1 {
+		return resolvers[0]
+	}
+	backends := make([]Backend, 0, len(resolvers))
+	for i, r := range resolvers {
+		backends = append(backends, Backend{Resolver: r, Priority: i})
+	}
+	return NewMultiResolver(backends...)
+}
+
+// GetPeers looks up the peers that may have the payload with every backend
+func (m *MultiResolver) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	return m.GetPeersContext(context.Background(), payloadCID)
+}
+
+// GetPeersContext looks up the peers that may have the payload with every
+// backend at once, waiting for each up to its timeout. The peers found are
+// merged, so that each provider appears once for each piece, with the
+// peer ID of the first backend that knows it. Backends that fail or time
+// out are skipped, and an error is only returned if they all do.
+func (m *MultiResolver) GetPeersContext(ctx context.Context, payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	results := make([][]retrievalmarket.RetrievalPeer, len(m.backends))
+	errs := make([]error, len(m.backends))
+	var wg sync.WaitGroup
+	for i, b := range m.backends {
+		wg.Add(1)
+		go func(i int, b Backend) {
+			defer wg.Done()
+			results[i], errs[i] = getPeers(ctx, b, payloadCID)
+			if errs[i] != nil {
+				log.Warnw("looking up retrieval peers", "backend", b.Name, "payloadCID", payloadCID, "err", errs[i])
+			}
+		}(i, b)
+	}
+	wg.Wait()
+
+	var merr error
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			failed++
+			merr = multierror.Append(merr, xerrors.Errorf("%s: %w", m.backends[i].Name, err))
+		}
+	}
+	if len(m.backends) > 0 && failed == len(m.backends) {
+		return nil, merr
+	}
+	return mergePeers(results), nil
+}
+
+// FindPeers looks up the peers that may have the payload with every backend
+// at once, sending the peers each backend finds as soon as it answers, and
+// an error result for each backend that fails or times out. A provider
+// already sent for a piece is not sent again, so peers come in the order the
+// backends answer rather than by priority.
+func (m *MultiResolver) FindPeers(ctx context.Context, payloadCID cid.Cid) <-chan retrievalmarket.PeerResult {
+	out := make(chan retrievalmarket.PeerResult)
+	var lk sync.Mutex
+	seen := make(map[peerKey]struct{})
+	send := func(r retrievalmarket.PeerResult) bool {
+		select {
+		case out <- r:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, b := range m.backends {
+		wg.Add(1)
+		go func(b Backend) {
+			defer wg.Done()
+			peers, err := getPeers(ctx, b, payloadCID)
+			if err != nil {
+				log.Warnw("looking up retrieval peers", "backend", b.Name, "payloadCID", payloadCID, "err", err)
+				send(retrievalmarket.PeerResult{Source: b.Name, Err: err})
+				return
+			}
+			for _, p := range peers {
+				key := keyOf(p)
+				lk.Lock()
+				_, ok := seen[key]
+				seen[key] = struct{}{}
+				lk.Unlock()
+				if ok {
+					continue
+				}
+				if !send(retrievalmarket.PeerResult{Source: b.Name, Peer: p}) {
+					return
+				}
+			}
+		}(b)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// getPeers queries a backend, giving up when it times out. Backends that
+// can't be cancelled are left to finish in the background.
+func getPeers(ctx context.Context, b Backend, payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	timeout := b.Timeout
+	if timeout == 0 {
+		timeout = DefaultBackendTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if r, ok := b.Resolver.(discovery.ContextPeerResolver); ok {
+		return r.GetPeersContext(ctx, payloadCID)
+	}
+
+	type result struct {
+		peers []retrievalmarket.RetrievalPeer
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		peers, err := b.Resolver.GetPeers(payloadCID)
+		done <- result{peers, err}
+	}()
+	select {
+	case r := <-done:
+		return r.peers, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type peerKey struct {
+	address  string
+	pieceCID string
+}
+
+func keyOf(p retrievalmarket.RetrievalPeer) peerKey {
+	key := peerKey{address: p.Address.String()}
+	if p.PieceCID != nil {
+		key.pieceCID = p.PieceCID.String()
+	}
+	return key
+}
+
+func mergePeers(results [][]retrievalmarket.RetrievalPeer) []retrievalmarket.RetrievalPeer {
+	merged := []retrievalmarket.RetrievalPeer{}
+	index := make(map[peerKey]int)
+	for _, peers := range results {
+		for _, p := range peers {
+			key := keyOf(p)
+			if i, ok := index[key]; ok {
+				if merged[i].ID == "" {
+					merged[i].ID = p.ID
+				}
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, p)
+		}
+	}
+	return merged
 }
@@ -0,0 +1,176 @@
+package discoveryimpl_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+	"github.com/stretchr/testify/require"
+
+	discoveryimpl "github.com/filecoin-project/go-fil-markets/discovery/impl"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+type fakeResolver struct {
+	peers []retrievalmarket.RetrievalPeer
+	err   error
+	delay time.Duration
+}
+
+func (f *fakeResolver) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	time.Sleep(f.delay)
+	return f.peers, f.err
+}
+
+func TestMultiResolver(t *testing.T) {
+	payloadCID := shared_testutil.GenerateCids(1)[0]
+	pieceCID := shared_testutil.GenerateCids(1)[0]
+	peerID := shared_testutil.GeneratePeers(1)[0]
+	peer1 := retrievalmarket.RetrievalPeer{Address: shared_testutil.NewIDAddr(t, 1)}
+	peer1WithID := retrievalmarket.RetrievalPeer{Address: shared_testutil.NewIDAddr(t, 1), ID: peerID}
+	peer1Piece := retrievalmarket.RetrievalPeer{Address: shared_testutil.NewIDAddr(t, 1), PieceCID: &pieceCID}
+	peer2 := retrievalmarket.RetrievalPeer{Address: shared_testutil.NewIDAddr(t, 2)}
+	peer3 := retrievalmarket.RetrievalPeer{Address: shared_testutil.NewIDAddr(t, 3)}
+
+	testCases := map[string]struct {
+		backends []discoveryimpl.Backend
+		expPeers []retrievalmarket.RetrievalPeer
+		expErr   bool
+	}{
+		"merges and dedups peers": {
+			backends: []discoveryimpl.Backend{
+				{Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{peer1, peer2}}},
+				{Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{peer2, peer1Piece, peer3}}},
+			},
+			expPeers: []retrievalmarket.RetrievalPeer{peer1, peer2, peer1Piece, peer3},
+		},
+		"fills in missing peer IDs": {
+			backends: []discoveryimpl.Backend{
+				{Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{peer1}}},
+				{Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{peer1WithID}}},
+			},
+			expPeers: []retrievalmarket.RetrievalPeer{peer1WithID},
+		},
+		"orders by priority": {
+			backends: []discoveryimpl.Backend{
+				{Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{peer3}}, Priority: 2},
+				{Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{peer2}}, Priority: 1},
+				{Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{peer1}}, Priority: 1},
+			},
+			expPeers: []retrievalmarket.RetrievalPeer{peer2, peer1, peer3},
+		},
+		"skips failed and slow backends": {
+			backends: []discoveryimpl.Backend{
+				{Resolver: &fakeResolver{err: errors.New("boom")}},
+				{Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{peer1}, delay: time.Second}, Timeout: 10 * time.Millisecond},
+				{Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{peer2}}},
+			},
+			expPeers: []retrievalmarket.RetrievalPeer{peer2},
+		},
+		"errors when every backend fails": {
+			backends: []discoveryimpl.Backend{
+				{Name: "broken", Resolver: &fakeResolver{err: errors.New("boom")}},
+				{Resolver: &fakeResolver{delay: time.Second}, Timeout: 10 * time.Millisecond},
+			},
+			expErr: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			m := discoveryimpl.NewMultiResolver(tc.backends...)
+			peers, err := m.GetPeersContext(ctx, payloadCID)
+			if tc.expErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expPeers, peers)
+		})
+	}
+}
+
+func TestStatic(t *testing.T) {
+	payloadCIDs := shared_testutil.GenerateCids(2)
+	pieceCID := shared_testutil.GenerateCids(1)[0]
+	peerID := test.RandPeerIDFatal(t)
+
+	path := filepath.Join(t.TempDir(), "peers.json")
+	cfg := `{"Peers": [
+		{"PayloadCID": "` + payloadCIDs[0].String() + `", "Address": "f01", "ID": "` + peer.Encode(peerID) + `", "PieceCID": "` + pieceCID.String() + `"},
+		{"Address": "f02"}
+	]}`
+	require.NoError(t, os.WriteFile(path, []byte(cfg), 0644))
+
+	s, err := discoveryimpl.LoadStatic(path)
+	require.NoError(t, err)
+
+	peers, err := s.GetPeers(payloadCIDs[0])
+	require.NoError(t, err)
+	require.Equal(t, []retrievalmarket.RetrievalPeer{
+		{Address: shared_testutil.NewIDAddr(t, 1), ID: peerID, PieceCID: &pieceCID},
+		{Address: shared_testutil.NewIDAddr(t, 2)},
+	}, peers)
+
+	peers, err = s.GetPeers(payloadCIDs[1])
+	require.NoError(t, err)
+	require.Equal(t, []retrievalmarket.RetrievalPeer{{Address: shared_testutil.NewIDAddr(t, 2)}}, peers)
+
+	_, err = discoveryimpl.NewStatic(discoveryimpl.StaticConfig{Peers: []discoveryimpl.StaticPeer{{Address: "not an address"}}})
+	require.Error(t, err)
+}
+
+func TestMultiResolver_FindPeers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	payloadCID := shared_testutil.GenerateCids(1)[0]
+	peer1 := retrievalmarket.RetrievalPeer{Address: shared_testutil.NewIDAddr(t, 1)}
+	peer2 := retrievalmarket.RetrievalPeer{Address: shared_testutil.NewIDAddr(t, 2)}
+
+	m := discoveryimpl.NewMultiResolver(
+		discoveryimpl.Backend{Name: "fast", Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{peer1}}},
+		discoveryimpl.Backend{Name: "slow", Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{peer1, peer2}, delay: 100 * time.Millisecond}},
+		discoveryimpl.Backend{Name: "broken", Resolver: &fakeResolver{err: errors.New("boom")}},
+	)
+
+	var results []retrievalmarket.PeerResult
+	for r := range m.FindPeers(ctx, payloadCID) {
+		results = append(results, r)
+	}
+	require.Len(t, results, 3)
+	var errSources []string
+	var found []retrievalmarket.PeerResult
+	for _, r := range results {
+		if r.Err != nil {
+			errSources = append(errSources, r.Source)
+			continue
+		}
+		found = append(found, r)
+	}
+	require.Equal(t, []string{"broken"}, errSources)
+	require.Equal(t, []retrievalmarket.PeerResult{
+		{Source: "fast", Peer: peer1},
+		{Source: "slow", Peer: peer2},
+	}, found)
+
+	t.Run("stops when cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		m := discoveryimpl.NewMultiResolver(
+			discoveryimpl.Backend{Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{peer1, peer2}}},
+		)
+		results := m.FindPeers(ctx, payloadCID)
+		r := <-results
+		require.Equal(t, peer1, r.Peer)
+		cancel()
+		for range results {
+		}
+	})
+}
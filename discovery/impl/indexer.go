@@ -0,0 +1,143 @@
+package discoveryimpl
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multicodec"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/index-provider/metadata"
+
+	"github.com/filecoin-project/go-fil-markets/discovery"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// MinerAddressFunc returns the address of the storage miner whose
+// retrieval provider has the given peer ID
+type MinerAddressFunc func(ctx context.Context, p peer.ID) (address.Address, error)
+
+// IndexerOption configures an Indexer
+type IndexerOption func(i *Indexer)
+
+// IndexerHTTPClient sets the HTTP client used to query the indexer
+func IndexerHTTPClient(client *http.Client) IndexerOption {
+	return func(i *Indexer) {
+		i.client = client
+	}
+}
+
+// Indexer looks up retrieval peers with an IPNI style network indexer,
+// over its HTTP find API. Only providers that announce retrieval over
+// graphsync are returned, since they are the only ones the retrieval
+// client can retrieve from.
+type Indexer struct {
+	endpoint     string
+	client       *http.Client
+	minerAddress MinerAddressFunc
+}
+
+var _ discovery.ContextPeerResolver = &Indexer{}
+
+// NewIndexer returns an Indexer that queries the indexer at the given
+// endpoint, e.g. https://cid.contact. Indexer records only identify
+// providers by peer ID, so minerAddress is used to find the miner address
+// of each provider.
+func NewIndexer(endpoint string, minerAddress MinerAddressFunc, opts ...IndexerOption) *Indexer {
+	i := &Indexer{
+		endpoint:     strings.TrimSuffix(endpoint, "/"),
+		client:       http.DefaultClient,
+		minerAddress: minerAddress,
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
+}
+
+// findResponse is the response to a find request
+type findResponse struct {
+	MultihashResults []struct {
+		ProviderResults []providerResult
+	}
+}
+
+type providerResult struct {
+	ContextID []byte
+	Metadata  []byte
+	Provider  peer.AddrInfo
+}
+
+// GetPeers looks up the peers that may have the payload
+func (i *Indexer) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	return i.GetPeersContext(context.Background(), payloadCID)
+}
+
+// GetPeersContext looks up the providers the indexer knows have the
+// payload, and the piece each has it in
+func (i *Indexer) GetPeersContext(ctx context.Context, payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	u := i.endpoint + "/multihash/" + url.PathEscape(payloadCID.Hash().B58String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("creating indexer request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("querying indexer: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return []retrievalmarket.RetrievalPeer{}, nil
+	default:
+		return nil, xerrors.Errorf("querying indexer: %s", resp.Status)
+	}
+	var found findResponse
+	if err := json.NewDecoder(resp.Body).Decode(&found); err != nil {
+		return nil, xerrors.Errorf("decoding indexer response: %w", err)
+	}
+
+	peers := []retrievalmarket.RetrievalPeer{}
+	for _, mh := range found.MultihashResults {
+		for _, pr := range mh.ProviderResults {
+			pieceCID, ok := graphsyncPiece(pr.Metadata)
+			if !ok {
+				continue
+			}
+			addr, err := i.minerAddress(ctx, pr.Provider.ID)
+			if err != nil {
+				log.Debugw("skipping indexer result", "provider", pr.Provider.ID, "err", err)
+				continue
+			}
+			peers = append(peers, retrievalmarket.RetrievalPeer{
+				Address:  addr,
+				ID:       pr.Provider.ID,
+				PieceCID: &pieceCID,
+			})
+		}
+	}
+	return peers, nil
+}
+
+// graphsyncPiece returns the piece in the graphsync retrieval metadata of
+// an indexer record, if it has any
+func graphsyncPiece(md []byte) (cid.Cid, bool) {
+	var m metadata.Metadata
+	if err := m.UnmarshalBinary(md); err != nil {
+		return cid.Undef, false
+	}
+	gs, ok := m.Get(multicodec.TransportGraphsyncFilecoinv1).(*metadata.GraphsyncFilecoinV1)
+	if !ok || !gs.PieceCID.Defined() {
+		return cid.Undef, false
+	}
+	return gs.PieceCID, true
+}
@@ -0,0 +1,76 @@
+package discoveryimpl_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/index-provider/metadata"
+
+	discoveryimpl "github.com/filecoin-project/go-fil-markets/discovery/impl"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+func TestIndexer(t *testing.T) {
+	ctx := context.Background()
+	payloadCID := shared_testutil.GenerateCids(1)[0]
+	pieceCID := shared_testutil.GenerateCids(1)[0]
+	gsProvider := test.RandPeerIDFatal(t)
+	bitswapProvider := test.RandPeerIDFatal(t)
+	unknownProvider := test.RandPeerIDFatal(t)
+	minerAddr := shared_testutil.NewIDAddr(t, 1)
+
+	gsMd := metadata.New(&metadata.GraphsyncFilecoinV1{PieceCID: pieceCID})
+	gsMetadata, err := gsMd.MarshalBinary()
+	require.NoError(t, err)
+	bitswapMd := metadata.New(metadata.Bitswap{})
+	bitswapMetadata, err := bitswapMd.MarshalBinary()
+	require.NoError(t, err)
+
+	type providerResult struct {
+		Metadata []byte
+		Provider peer.AddrInfo
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/multihash/"+payloadCID.Hash().B58String() {
+			http.NotFound(w, r)
+			return
+		}
+		resp := map[string]interface{}{
+			"MultihashResults": []map[string]interface{}{{
+				"ProviderResults": []providerResult{
+					{Metadata: gsMetadata, Provider: peer.AddrInfo{ID: gsProvider}},
+					{Metadata: bitswapMetadata, Provider: peer.AddrInfo{ID: bitswapProvider}},
+					{Metadata: gsMetadata, Provider: peer.AddrInfo{ID: unknownProvider}},
+				},
+			}},
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(resp))
+	}))
+	defer srv.Close()
+
+	minerAddress := func(ctx context.Context, p peer.ID) (address.Address, error) {
+		if p == unknownProvider {
+			return address.Undef, xerrors.New("unknown provider")
+		}
+		return minerAddr, nil
+	}
+	idx := discoveryimpl.NewIndexer(srv.URL+"/", minerAddress, discoveryimpl.IndexerHTTPClient(srv.Client()))
+
+	peers, err := idx.GetPeersContext(ctx, payloadCID)
+	require.NoError(t, err)
+	require.Equal(t, []retrievalmarket.RetrievalPeer{{Address: minerAddr, ID: gsProvider, PieceCID: &pieceCID}}, peers)
+
+	peers, err = idx.GetPeersContext(ctx, pieceCID)
+	require.NoError(t, err)
+	require.Empty(t, peers)
+}
@@ -3,12 +3,17 @@ package discoveryimpl
 import (
 	"bytes"
 	"context"
+	"sync"
+	"time"
 
 	"github.com/hannahhoward/go-pubsub"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	dshelp "github.com/ipfs/go-ipfs-ds-help"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
 
 	cborutil "github.com/filecoin-project/go-cbor-util"
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
@@ -17,28 +22,98 @@ import (
 	"github.com/filecoin-project/go-fil-markets/discovery"
 	"github.com/filecoin-project/go-fil-markets/discovery/migrations"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientstates"
 	"github.com/filecoin-project/go-fil-markets/shared"
 )
 
 var log = logging.Logger("retrieval-discovery")
 
+// DefaultMaxFailures is how many retrievals from a peer may fail in a row
+// before the peer is removed, by default
+const DefaultMaxFailures = 3
+
+// DefaultCompactionInterval is how often expired peers are removed from
+// the datastore, by default
+const DefaultCompactionInterval = time.Hour
+
+// LocalOption configures a Local
+type LocalOption func(l *Local)
+
+// LocalClock sets the clock used to expire peers and schedule compaction
+func LocalClock(clock shared.Clock) LocalOption {
+	return func(l *Local) {
+		l.clock = clock
+	}
+}
+
+// DefaultTTL sets how long peers added with AddPeer are kept. Zero, the
+// default, keeps them until they are removed.
+func DefaultTTL(ttl time.Duration) LocalOption {
+	return func(l *Local) {
+		l.defaultTTL = ttl
+	}
+}
+
+// MaxFailures sets how many retrievals from a peer may fail in a row before
+// the peer is removed. Zero never removes peers for failing.
+func MaxFailures(n uint64) LocalOption {
+	return func(l *Local) {
+		l.maxFailures = n
+	}
+}
+
+// CompactionInterval sets how often expired peers are removed from the
+// datastore. Zero disables periodic compaction; expired peers are still
+// never returned.
+func CompactionInterval(interval time.Duration) LocalOption {
+	return func(l *Local) {
+		l.compactionInterval = interval
+	}
+}
+
+// Local is a store of the retrieval peers known to have each payload.
+// Peers can be added with a TTL, after which they are no longer returned,
+// and are removed once too many retrievals from them fail in a row.
 type Local struct {
-	ds        datastore.Datastore
-	migrateDs func(context.Context) error
-	readySub  *pubsub.PubSub
+	ds                 datastore.Datastore
+	migrateDs          func(context.Context) error
+	readySub           *pubsub.PubSub
+	clock              shared.Clock
+	defaultTTL         time.Duration
+	maxFailures        uint64
+	compactionInterval time.Duration
+
+	lk   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
 }
 
-func NewLocal(ds datastore.Batching) (*Local, error) {
+func NewLocal(ds datastore.Batching, opts ...LocalOption) (*Local, error) {
 	migrations, err := migrations.RetrievalPeersMigrations.Build()
 	if err != nil {
 		return nil, err
 	}
 	versionedDs, migrateDs := versionedds.NewVersionedDatastore(ds, migrations, versioning.VersionKey("1"))
 	readySub := pubsub.New(shared.ReadyDispatcher)
-	return &Local{versionedDs, migrateDs, readySub}, nil
+	l := &Local{
+		ds:                 versionedDs,
+		migrateDs:          migrateDs,
+		readySub:           readySub,
+		clock:              shared.NewClock(),
+		maxFailures:        DefaultMaxFailures,
+		compactionInterval: DefaultCompactionInterval,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l, nil
 }
 
+// Start migrates the store, then compacts it periodically until Stop is
+// called
 func (l *Local) Start(ctx context.Context) error {
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
 	go func() {
 		err := l.migrateDs(ctx)
 		if err != nil {
@@ -48,74 +123,280 @@ func (l *Local) Start(ctx context.Context) error {
 		if err != nil {
 			log.Warnf("Publishing retrieval peers list ready event: %s", err.Error())
 		}
+		l.runCompaction(l.stop, l.done)
 	}()
 	return nil
 }
 
+// Stop stops compacting the store
+func (l *Local) Stop() {
+	if l.stop == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+	l.stop = nil
+}
+
 // OnReady registers a listener for when the retrieval peers list has finished starting up
 func (l *Local) OnReady(ready shared.ReadyFunc) {
 	l.readySub.Subscribe(ready)
 }
 
+// AddPeer adds a peer for the payload, kept for the default TTL. Adding a
+// peer that is already there refreshes its expiry and clears its failures.
 func (l *Local) AddPeer(ctx context.Context, cid cid.Cid, peer retrievalmarket.RetrievalPeer) error {
+	return l.AddPeerWithTTL(ctx, cid, peer, l.defaultTTL)
+}
+
+// AddPeerWithTTL adds a peer for the payload that is kept for ttl, or until
+// it is removed if ttl is zero
+func (l *Local) AddPeerWithTTL(ctx context.Context, cid cid.Cid, peer retrievalmarket.RetrievalPeer, ttl time.Duration) error {
+	var expiry uint64
+	if ttl > 0 {
+		expiry = uint64(l.clock.Now().Add(ttl).UnixNano())
+	}
+
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
 	key := dshelp.MultihashToDsKey(cid.Hash())
-	exists, err := l.ds.Has(ctx, key)
+	peers, err := l.load(ctx, key)
 	if err != nil {
 		return err
 	}
+	for i, p := range peers.Peers {
+		if samePeer(p, peer) {
+			peers.Expiries[i] = expiry
+			peers.Failures[i] = 0
+			return l.save(ctx, key, peers)
+		}
+	}
+	peers.Peers = append(peers.Peers, peer)
+	peers.Expiries = append(peers.Expiries, expiry)
+	peers.Failures = append(peers.Failures, 0)
+	return l.save(ctx, key, peers)
+}
 
-	var newRecord bytes.Buffer
+// RemovePeer removes a peer for the payload
+func (l *Local) RemovePeer(ctx context.Context, payloadCID cid.Cid, peer retrievalmarket.RetrievalPeer) error {
+	return l.update(ctx, payloadCID, func(peers *discovery.RetrievalPeers) {
+		filterPeers(peers, func(i int) bool { return !samePeer(peers.Peers[i], peer) })
+	})
+}
 
-	if !exists {
-		peers := discovery.RetrievalPeers{Peers: []retrievalmarket.RetrievalPeer{peer}}
-		err = cborutil.WriteCborRPC(&newRecord, &peers)
-		if err != nil {
-			return err
+// RemovePayload removes every peer for the payload
+func (l *Local) RemovePayload(ctx context.Context, payloadCID cid.Cid) error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	return l.ds.Delete(ctx, dshelp.MultihashToDsKey(payloadCID.Hash()))
+}
+
+// RecordFailure records that a retrieval of the payload from the peer with
+// the given ID failed, removing the peer once it has failed MaxFailures
+// times in a row
+func (l *Local) RecordFailure(ctx context.Context, payloadCID cid.Cid, id peer.ID) error {
+	return l.update(ctx, payloadCID, func(peers *discovery.RetrievalPeers) {
+		for i, p := range peers.Peers {
+			if p.ID == id {
+				peers.Failures[i]++
+			}
 		}
-	} else {
-		entry, err := l.ds.Get(ctx, key)
-		if err != nil {
-			return err
+		if l.maxFailures > 0 {
+			filterPeers(peers, func(i int) bool { return peers.Failures[i] < l.maxFailures })
 		}
-		var peers discovery.RetrievalPeers
-		if err = cborutil.ReadCborRPC(bytes.NewReader(entry), &peers); err != nil {
-			return err
+	})
+}
+
+// RecordSuccess records that a retrieval of the payload from the peer with
+// the given ID succeeded, clearing its failures
+func (l *Local) RecordSuccess(ctx context.Context, payloadCID cid.Cid, id peer.ID) error {
+	return l.update(ctx, payloadCID, func(peers *discovery.RetrievalPeers) {
+		for i, p := range peers.Peers {
+			if p.ID == id {
+				peers.Failures[i] = 0
+			}
 		}
-		if hasPeer(peers, peer) {
-			return nil
+	})
+}
+
+// Subscribe records the outcome of each of the client's retrievals against
+// the peer it was made with, until the returned function is called
+func (l *Local) Subscribe(client retrievalmarket.RetrievalClient) retrievalmarket.Unsubscribe {
+	return client.SubscribeToEvents(func(_ retrievalmarket.ClientEvent, state retrievalmarket.ClientDealState) {
+		// a deal the client cancelled says nothing about the peer
+		if !clientstates.IsFinalityState(state.Status) || state.Status == retrievalmarket.DealStatusCancelled {
+			return
+		}
+		var err error
+		if state.Status == retrievalmarket.DealStatusCompleted {
+			err = l.RecordSuccess(context.TODO(), state.PayloadCID, state.Sender)
+		} else {
+			err = l.RecordFailure(context.TODO(), state.PayloadCID, state.Sender)
 		}
-		peers.Peers = append(peers.Peers, peer)
-		err = cborutil.WriteCborRPC(&newRecord, &peers)
 		if err != nil {
-			return err
+			log.Warnw("recording retrieval outcome", "payloadCID", state.PayloadCID, "peer", state.Sender, "err", err)
 		}
-	}
+	})
+}
 
-	return l.ds.Put(ctx, key, newRecord.Bytes())
+func (l *Local) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	peers, err := l.load(context.TODO(), dshelp.MultihashToDsKey(payloadCID.Hash()))
+	if err != nil {
+		return nil, err
+	}
+	now := uint64(l.clock.Now().UnixNano())
+	out := []retrievalmarket.RetrievalPeer{}
+	for i, p := range peers.Peers {
+		if !expired(peers.Expiries[i], now) {
+			out = append(out, p)
+		}
+	}
+	return out, nil
 }
 
-func hasPeer(peerList discovery.RetrievalPeers, peer retrievalmarket.RetrievalPeer) bool {
-	for _, p := range peerList.Peers {
-		if p == peer {
-			return true
+// Compact removes expired peers from the datastore, and the records of
+// payloads left with no peers
+func (l *Local) Compact(ctx context.Context) error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	res, err := l.ds.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return xerrors.Errorf("listing retrieval peers: %w", err)
+	}
+	entries, err := res.Rest()
+	_ = res.Close()
+	if err != nil {
+		return xerrors.Errorf("listing retrieval peers: %w", err)
+	}
+
+	now := uint64(l.clock.Now().UnixNano())
+	for _, e := range entries {
+		key := datastore.NewKey(e.Key)
+		peers, err := l.load(ctx, key)
+		if err != nil {
+			log.Warnw("skipping retrieval peers record", "key", key, "err", err)
+			continue
+		}
+		n := len(peers.Peers)
+		filterPeers(peers, func(i int) bool { return !expired(peers.Expiries[i], now) })
+		if len(peers.Peers) == n {
+			continue
+		}
+		if err := l.save(ctx, key, peers); err != nil {
+			return err
 		}
 	}
-	return false
+	return nil
 }
 
-func (l *Local) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
-	entry, err := l.ds.Get(context.TODO(), dshelp.MultihashToDsKey(payloadCID.Hash()))
-	if err == datastore.ErrNotFound {
-		return []retrievalmarket.RetrievalPeer{}, nil
+func (l *Local) runCompaction(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	if l.compactionInterval <= 0 {
+		<-stop
+		return
 	}
+	ticker := l.clock.Ticker(l.compactionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := l.Compact(context.TODO()); err != nil {
+				log.Errorf("compacting retrieval peers: %s", err)
+			}
+		}
+	}
+}
+
+// update changes the peers for a payload, removing its record if no peers
+// are left
+func (l *Local) update(ctx context.Context, payloadCID cid.Cid, change func(peers *discovery.RetrievalPeers)) error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	key := dshelp.MultihashToDsKey(payloadCID.Hash())
+	peers, err := l.load(ctx, key)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if len(peers.Peers) == 0 {
+		return nil
 	}
-	var peers discovery.RetrievalPeers
-	if err := cborutil.ReadCborRPC(bytes.NewReader(entry), &peers); err != nil {
+	change(peers)
+	return l.save(ctx, key, peers)
+}
+
+// load reads the peers under a key, with an expiry and failure count for
+// every peer
+func (l *Local) load(ctx context.Context, key datastore.Key) (*discovery.RetrievalPeers, error) {
+	peers := &discovery.RetrievalPeers{}
+	entry, err := l.ds.Get(ctx, key)
+	switch {
+	case err == nil:
+		if err := cborutil.ReadCborRPC(bytes.NewReader(entry), peers); err != nil {
+			return nil, err
+		}
+	case xerrors.Is(err, datastore.ErrNotFound):
+	default:
 		return nil, err
 	}
-	return peers.Peers, nil
+	for len(peers.Expiries) < len(peers.Peers) {
+		peers.Expiries = append(peers.Expiries, 0)
+	}
+	for len(peers.Failures) < len(peers.Peers) {
+		peers.Failures = append(peers.Failures, 0)
+	}
+	return peers, nil
+}
+
+// save writes the peers under a key, or deletes the key if there are none
+func (l *Local) save(ctx context.Context, key datastore.Key, peers *discovery.RetrievalPeers) error {
+	if len(peers.Peers) == 0 {
+		return l.ds.Delete(ctx, key)
+	}
+	var record bytes.Buffer
+	if err := cborutil.WriteCborRPC(&record, peers); err != nil {
+		return err
+	}
+	return l.ds.Put(ctx, key, record.Bytes())
+}
+
+// filterPeers keeps the peers at the indexes for which keep returns true
+func filterPeers(peers *discovery.RetrievalPeers, keep func(i int) bool) {
+	n := 0
+	for i := range peers.Peers {
+		if keep(i) {
+			peers.Peers[n] = peers.Peers[i]
+			peers.Expiries[n] = peers.Expiries[i]
+			peers.Failures[n] = peers.Failures[i]
+			n++
+		}
+	}
+	peers.Peers = peers.Peers[:n]
+	peers.Expiries = peers.Expiries[:n]
+	peers.Failures = peers.Failures[:n]
+}
+
+// samePeer is true if two peers have the same address, ID and piece CID.
+// Peers can't be compared with ==, since the piece CID is a pointer, and a
+// peer read from the datastore never has the same pointer as one passed in.
+func samePeer(a, b retrievalmarket.RetrievalPeer) bool {
+	if a.Address != b.Address || a.ID != b.ID {
+		return false
+	}
+	if a.PieceCID == nil || b.PieceCID == nil {
+		return a.PieceCID == b.PieceCID
+	}
+	return a.PieceCID.Equals(*b.PieceCID)
+}
+
+func expired(expiry uint64, now uint64) bool {
+	return expiry != 0 && expiry <= now
 }
 
 var _ discovery.PeerResolver = &Local{}
@@ -6,6 +6,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	dshelp "github.com/ipfs/go-ipfs-ds-help"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -49,6 +51,11 @@ func TestLocal_AddPeer(t *testing.T) {
 			peers2add: []retrievalmarket.RetrievalPeer{peer1, peer1},
 			expPeers:  []retrievalmarket.RetrievalPeer{peer1},
 		},
+		{
+			name:      "can add same peer with a piece CID without duping",
+			peers2add: []retrievalmarket.RetrievalPeer{peer2, peer2},
+			expPeers:  []retrievalmarket.RetrievalPeer{peer2},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -124,3 +131,93 @@ func TestLocalMigrations(t *testing.T) {
 		require.Equal(t, expectedPeers, peers)
 	}
 }
+
+func TestLocal_ExpiryAndRemoval(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	peers := shared_testutil.GeneratePeers(3)
+	peer1 := retrievalmarket.RetrievalPeer{Address: shared_testutil.NewIDAddr(t, 1), ID: peers[0]}
+	peer2 := retrievalmarket.RetrievalPeer{Address: shared_testutil.NewIDAddr(t, 2), ID: peers[1]}
+	peer3 := retrievalmarket.RetrievalPeer{Address: shared_testutil.NewIDAddr(t, 3), ID: peers[2]}
+	pieceCID := shared_testutil.GenerateCids(1)[0]
+	withPiece := retrievalmarket.RetrievalPeer{Address: shared_testutil.NewIDAddr(t, 1), ID: peers[0], PieceCID: &pieceCID}
+	payloadCIDs := shared_testutil.GenerateCids(2)
+
+	setup := func(t *testing.T) (*discoveryimpl.Local, *clock.Mock, datastore.Batching) {
+		ds := datastore.NewMapDatastore()
+		clk := clock.NewMock()
+		l, err := discoveryimpl.NewLocal(ds, discoveryimpl.LocalClock(clk), discoveryimpl.DefaultTTL(time.Hour),
+			discoveryimpl.MaxFailures(2), discoveryimpl.CompactionInterval(0))
+		require.NoError(t, err)
+		shared_testutil.StartAndWaitForReady(ctx, t, l)
+		t.Cleanup(l.Stop)
+		return l, clk, ds
+	}
+	getPeers := func(t *testing.T, l *discoveryimpl.Local, payloadCID cid.Cid) []retrievalmarket.RetrievalPeer {
+		found, err := l.GetPeers(payloadCID)
+		require.NoError(t, err)
+		return found
+	}
+
+	t.Run("peers expire", func(t *testing.T) {
+		l, clk, _ := setup(t)
+		require.NoError(t, l.AddPeer(ctx, payloadCIDs[0], peer1))
+		require.NoError(t, l.AddPeerWithTTL(ctx, payloadCIDs[0], peer2, 2*time.Hour))
+		require.NoError(t, l.AddPeerWithTTL(ctx, payloadCIDs[0], peer3, 0))
+		clk.Add(90 * time.Minute)
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer2, peer3}, getPeers(t, l, payloadCIDs[0]))
+
+		// adding the peer again refreshes its expiry
+		require.NoError(t, l.AddPeer(ctx, payloadCIDs[0], peer2))
+		clk.Add(30 * time.Minute)
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer2, peer3}, getPeers(t, l, payloadCIDs[0]))
+		clk.Add(time.Hour)
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer3}, getPeers(t, l, payloadCIDs[0]))
+	})
+
+	t.Run("compaction removes expired peers", func(t *testing.T) {
+		l, clk, ds := setup(t)
+		require.NoError(t, l.AddPeer(ctx, payloadCIDs[0], peer1))
+		require.NoError(t, l.AddPeer(ctx, payloadCIDs[1], peer1))
+		require.NoError(t, l.AddPeerWithTTL(ctx, payloadCIDs[1], peer2, 0))
+		clk.Add(2 * time.Hour)
+		require.NoError(t, l.Compact(ctx))
+
+		has, err := ds.Has(ctx, datastore.NewKey("1").Child(dshelp.MultihashToDsKey(payloadCIDs[0].Hash())))
+		require.NoError(t, err)
+		require.False(t, has)
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer2}, getPeers(t, l, payloadCIDs[1]))
+	})
+
+	t.Run("removes peers and payloads", func(t *testing.T) {
+		l, _, _ := setup(t)
+		require.NoError(t, l.AddPeer(ctx, payloadCIDs[0], peer1))
+		require.NoError(t, l.AddPeer(ctx, payloadCIDs[0], peer2))
+		require.NoError(t, l.AddPeer(ctx, payloadCIDs[1], peer1))
+		require.NoError(t, l.RemovePeer(ctx, payloadCIDs[0], peer1))
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer2}, getPeers(t, l, payloadCIDs[0]))
+		require.NoError(t, l.RemovePayload(ctx, payloadCIDs[1]))
+		require.Empty(t, getPeers(t, l, payloadCIDs[1]))
+
+		// a peer with a piece CID is told apart from the same peer without
+		// one, and matched by the CID rather than the pointer to it
+		require.NoError(t, l.AddPeer(ctx, payloadCIDs[0], withPiece))
+		require.NoError(t, l.AddPeer(ctx, payloadCIDs[0], peer1))
+		samePiece := pieceCID
+		require.NoError(t, l.RemovePeer(ctx, payloadCIDs[0], retrievalmarket.RetrievalPeer{Address: withPiece.Address, ID: withPiece.ID, PieceCID: &samePiece}))
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer2, peer1}, getPeers(t, l, payloadCIDs[0]))
+	})
+
+	t.Run("removes peers that fail repeatedly", func(t *testing.T) {
+		l, _, _ := setup(t)
+		require.NoError(t, l.AddPeer(ctx, payloadCIDs[0], peer1))
+		require.NoError(t, l.AddPeer(ctx, payloadCIDs[0], peer2))
+		require.NoError(t, l.RecordFailure(ctx, payloadCIDs[0], peer1.ID))
+		require.NoError(t, l.RecordSuccess(ctx, payloadCIDs[0], peer1.ID))
+		require.NoError(t, l.RecordFailure(ctx, payloadCIDs[0], peer1.ID))
+		require.NoError(t, l.RecordFailure(ctx, payloadCIDs[0], peer2.ID))
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer1, peer2}, getPeers(t, l, payloadCIDs[0]))
+		require.NoError(t, l.RecordFailure(ctx, payloadCIDs[0], peer2.ID))
+		require.Equal(t, []retrievalmarket.RetrievalPeer{peer1}, getPeers(t, l, payloadCIDs[0]))
+	})
+}
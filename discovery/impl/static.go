@@ -0,0 +1,105 @@
+package discoveryimpl
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+
+	"github.com/filecoin-project/go-fil-markets/discovery"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// StaticPeer is an entry of a static peers config file
+type StaticPeer struct {
+	// PayloadCID is the payload the peer has. If it is empty the peer is
+	// returned for every payload.
+	PayloadCID string `json:",omitempty"`
+	Address    string
+	ID         string `json:",omitempty"`
+	PieceCID   string `json:",omitempty"`
+}
+
+// StaticConfig is the format of a static peers config file
+type StaticConfig struct {
+	Peers []StaticPeer
+}
+
+// Static resolves peers from a fixed list, e.g. loaded from a config file
+type Static struct {
+	byPayload map[cid.Cid][]retrievalmarket.RetrievalPeer
+	any       []retrievalmarket.RetrievalPeer
+}
+
+var _ discovery.PeerResolver = &Static{}
+
+// LoadStatic returns a Static resolver with the peers in the JSON config
+// file at path
+func LoadStatic(path string) (*Static, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("reading static peers file: %w", err)
+	}
+	var cfg StaticConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, xerrors.Errorf("parsing static peers file %s: %w", path, err)
+	}
+	return NewStatic(cfg)
+}
+
+// NewStatic returns a Static resolver with the peers in the given config
+func NewStatic(cfg StaticConfig) (*Static, error) {
+	s := &Static{byPayload: make(map[cid.Cid][]retrievalmarket.RetrievalPeer)}
+	for i, sp := range cfg.Peers {
+		p, err := sp.retrievalPeer()
+		if err != nil {
+			return nil, xerrors.Errorf("static peer %d: %w", i, err)
+		}
+		if sp.PayloadCID == "" {
+			s.any = append(s.any, p)
+			continue
+		}
+		payloadCID, err := cid.Decode(sp.PayloadCID)
+		if err != nil {
+			return nil, xerrors.Errorf("static peer %d: parsing payload CID: %w", i, err)
+		}
+		s.byPayload[payloadCID] = append(s.byPayload[payloadCID], p)
+	}
+	return s, nil
+}
+
+func (sp StaticPeer) retrievalPeer() (retrievalmarket.RetrievalPeer, error) {
+	var p retrievalmarket.RetrievalPeer
+	addr, err := address.NewFromString(sp.Address)
+	if err != nil {
+		return p, xerrors.Errorf("parsing address: %w", err)
+	}
+	p.Address = addr
+	if sp.ID != "" {
+		p.ID, err = peer.Decode(sp.ID)
+		if err != nil {
+			return p, xerrors.Errorf("parsing peer ID: %w", err)
+		}
+	}
+	if sp.PieceCID != "" {
+		pieceCID, err := cid.Decode(sp.PieceCID)
+		if err != nil {
+			return p, xerrors.Errorf("parsing piece CID: %w", err)
+		}
+		p.PieceCID = &pieceCID
+	}
+	return p, nil
+}
+
+// GetPeers returns the peers listed for the payload, followed by the peers
+// listed for every payload
+func (s *Static) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	peers := make([]retrievalmarket.RetrievalPeer, 0, len(s.byPayload[payloadCID])+len(s.any))
+	peers = append(peers, s.byPayload[payloadCID]...)
+	peers = append(peers, s.any...)
+	return peers, nil
+}
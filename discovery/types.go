@@ -1,6 +1,8 @@
 package discovery
 
 import (
+	"context"
+
 	"github.com/ipfs/go-cid"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
@@ -11,9 +13,67 @@ import (
 // RetrievalPeers is a convenience struct for encoding slices of RetrievalPeer
 type RetrievalPeers struct {
 	Peers []retrievalmarket.RetrievalPeer
+	// Expiries holds the time each of Peers expires at, in Unix
+	// nanoseconds, with zero meaning never. Records written before expiries
+	// were tracked have none, and their peers never expire.
+	Expiries []uint64
+	// Failures holds the number of retrievals from each of Peers that have
+	// failed in a row
+	Failures []uint64
 }
 
 // PeerResolver is an interface for looking up providers that may have a piece
 type PeerResolver interface {
-	GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) // TODO: channel
+	GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error)
+}
+
+// ContextPeerResolver is a PeerResolver whose lookups can be cancelled
+type ContextPeerResolver interface {
+	PeerResolver
+	GetPeersContext(ctx context.Context, payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error)
+}
+
+// StreamingPeerResolver is a PeerResolver that can send peers as each of
+// its sources finds them
+type StreamingPeerResolver interface {
+	PeerResolver
+	// FindPeers sends the peers that may have the payload, and the errors of
+	// the sources that fail, on the returned channel. The channel is closed
+	// once every source has answered or the context is cancelled.
+	FindPeers(ctx context.Context, payloadCID cid.Cid) <-chan retrievalmarket.PeerResult
+}
+
+// FindPeers looks up the peers that may have the payload with r, streaming
+// them if r is a StreamingPeerResolver, or sending them all at once when it
+// answers if not
+func FindPeers(ctx context.Context, r PeerResolver, payloadCID cid.Cid) <-chan retrievalmarket.PeerResult {
+	if sr, ok := r.(StreamingPeerResolver); ok {
+		return sr.FindPeers(ctx, payloadCID)
+	}
+	out := make(chan retrievalmarket.PeerResult)
+	go func() {
+		defer close(out)
+		var peers []retrievalmarket.RetrievalPeer
+		var err error
+		if cr, ok := r.(ContextPeerResolver); ok {
+			peers, err = cr.GetPeersContext(ctx, payloadCID)
+		} else {
+			peers, err = r.GetPeers(payloadCID)
+		}
+		if err != nil {
+			select {
+			case out <- retrievalmarket.PeerResult{Err: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+		for _, p := range peers {
+			select {
+			case out <- retrievalmarket.PeerResult{Peer: p}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
 }
@@ -27,7 +27,7 @@ func (t *RetrievalPeers) MarshalCBOR(w io.Writer) error {
 
 	cw := cbg.NewCborWriter(w)
 
-	if _, err := cw.Write([]byte{161}); err != nil {
+	if _, err := cw.Write([]byte{163}); err != nil {
 		return err
 	}
 
@@ -55,6 +55,56 @@ func (t *RetrievalPeers) MarshalCBOR(w io.Writer) error {
 			return err
 		}
 	}
+
+	// t.Expiries ([]uint64) (slice)
+	if len("Expiries") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Expiries\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Expiries"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Expiries")); err != nil {
+		return err
+	}
+
+	if len(t.Expiries) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.Expiries was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajArray, uint64(len(t.Expiries))); err != nil {
+		return err
+	}
+	for _, v := range t.Expiries {
+		if err := cw.CborWriteHeader(cbg.MajUnsignedInt, uint64(v)); err != nil {
+			return err
+		}
+	}
+
+	// t.Failures ([]uint64) (slice)
+	if len("Failures") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Failures\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Failures"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Failures")); err != nil {
+		return err
+	}
+
+	if len(t.Failures) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.Failures was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajArray, uint64(len(t.Failures))); err != nil {
+		return err
+	}
+	for _, v := range t.Failures {
+		if err := cw.CborWriteHeader(cbg.MajUnsignedInt, uint64(v)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -126,6 +176,74 @@ func (t *RetrievalPeers) UnmarshalCBOR(r io.Reader) (err error) {
 				t.Peers[i] = v
 			}
 
+			// t.Expiries ([]uint64) (slice)
+		case "Expiries":
+
+			maj, extra, err = cr.ReadHeader()
+			if err != nil {
+				return err
+			}
+
+			if extra > cbg.MaxLength {
+				return fmt.Errorf("t.Expiries: array too large (%d)", extra)
+			}
+
+			if maj != cbg.MajArray {
+				return fmt.Errorf("expected cbor array")
+			}
+
+			if extra > 0 {
+				t.Expiries = make([]uint64, extra)
+			}
+
+			for i := 0; i < int(extra); i++ {
+
+				maj, val, err := cr.ReadHeader()
+				if err != nil {
+					return xerrors.Errorf("failed to read uint64 for t.Expiries slice: %w", err)
+				}
+
+				if maj != cbg.MajUnsignedInt {
+					return xerrors.Errorf("value read for array t.Expiries was not a uint, instead got %d", maj)
+				}
+
+				t.Expiries[i] = uint64(val)
+			}
+
+			// t.Failures ([]uint64) (slice)
+		case "Failures":
+
+			maj, extra, err = cr.ReadHeader()
+			if err != nil {
+				return err
+			}
+
+			if extra > cbg.MaxLength {
+				return fmt.Errorf("t.Failures: array too large (%d)", extra)
+			}
+
+			if maj != cbg.MajArray {
+				return fmt.Errorf("expected cbor array")
+			}
+
+			if extra > 0 {
+				t.Failures = make([]uint64, extra)
+			}
+
+			for i := 0; i < int(extra); i++ {
+
+				maj, val, err := cr.ReadHeader()
+				if err != nil {
+					return xerrors.Errorf("failed to read uint64 for t.Failures slice: %w", err)
+				}
+
+				if maj != cbg.MajUnsignedInt {
+					return xerrors.Errorf("value read for array t.Failures was not a uint, instead got %d", maj)
+				}
+
+				t.Failures[i] = uint64(val)
+			}
+
 		default:
 			// Field doesn't exist on this type, so ignore it
 			cbg.ScanForLinks(r, func(cid.Cid) {})
@@ -0,0 +1,253 @@
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Discarder is implemented by files that can be closed without persisting
+// what was written to them, because they are about to be deleted
+type Discarder interface {
+	Discard() error
+}
+
+type objectFileStore struct {
+	store ObjectStore
+	cache string
+
+	// etags are the ETags of the objects the cached copies were downloaded
+	// from or uploaded as
+	lk    sync.Mutex
+	etags map[Path]string
+}
+
+// NewObjectFileStore creates a filestore that persists files in the given
+// ObjectStore. Files are staged in a local cache directory so that callers
+// can seek through them and hand their OsPath to other processes: a file is
+// downloaded to the cache when it is opened, and uploaded to the object store
+// when a file that was written to is closed.
+//
+// A cached copy is only reused while the object's ETag is the one it was
+// downloaded or uploaded with. ETags are kept in memory, so after a restart
+// every file is downloaded again the first time it is opened.
+func NewObjectFileStore(store ObjectStore, cacheDir OsPath) (FileStore, error) {
+	base, err := checkIsDir(string(cacheDir))
+	if err != nil {
+		return nil, err
+	}
+	return &objectFileStore{store: store, cache: base, etags: make(map[Path]string)}, nil
+}
+
+func (fs *objectFileStore) key(p Path) string {
+	return filepath.ToSlash(filepath.Clean(string(p)))
+}
+
+func (fs *objectFileStore) cachePath(p Path) string {
+	return filepath.Join(fs.cache, string(p))
+}
+
+func (fs *objectFileStore) Open(p Path) (File, error) {
+	ctx := context.TODO()
+	info, err := fs.store.Stat(ctx, fs.key(p))
+	if err != nil {
+		return nil, fmt.Errorf("error trying to open %s: %w", p, err)
+	}
+
+	// reuse the cached copy if it holds the current version of the object
+	name := fs.cachePath(p)
+	if !fs.cached(p, name, info) {
+		if err := fs.download(ctx, p, name); err != nil {
+			return nil, err
+		}
+		fs.setETag(p, info.ETag)
+	}
+
+	f, err := newFile(OsPath(fs.cache), p)
+	if err != nil {
+		return nil, err
+	}
+	return &objectFile{File: f, fs: fs}, nil
+}
+
+func (fs *objectFileStore) Create(p Path) (File, error) {
+	_, err := fs.store.Stat(context.TODO(), fs.key(p))
+	if err == nil {
+		return nil, fmt.Errorf("file %s already exists", p)
+	}
+	if !errors.Is(err, ErrObjectNotFound) {
+		return nil, fmt.Errorf("error checking for %s: %w", p, err)
+	}
+
+	name := fs.cachePath(p)
+	fs.setETag(p, "")
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Truncate(name, 0); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := newFile(OsPath(fs.cache), p)
+	if err != nil {
+		return nil, err
+	}
+	// make sure even an empty file is persisted on close
+	return &objectFile{File: f, fs: fs, dirty: true}, nil
+}
+
+func (fs *objectFileStore) Store(p Path, src File) (Path, error) {
+	dest, err := fs.Create(p)
+	if err != nil {
+		return Path(""), err
+	}
+
+	if _, err = io.Copy(dest, src); err != nil {
+		dest.Close()
+		return Path(""), err
+	}
+	return p, dest.Close()
+}
+
+func (fs *objectFileStore) Delete(p Path) error {
+	fs.setETag(p, "")
+	if err := fs.store.Delete(context.TODO(), fs.key(p)); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	if err := os.Remove(fs.cachePath(p)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (fs *objectFileStore) CreateTemp() (File, error) {
+	f, err := ioutil.TempFile(fs.cache, "fstmp")
+	if err != nil {
+		return nil, err
+	}
+	filename := filepath.Base(f.Name())
+	return &objectFile{File: &fd{File: f, basepath: fs.cache, filename: filename}, fs: fs, dirty: true}, nil
+}
+
+// cached returns true if the file at name is a copy of the object info
+// describes
+func (fs *objectFileStore) cached(p Path, name string, info ObjectInfo) bool {
+	fs.lk.Lock()
+	etag, ok := fs.etags[p]
+	fs.lk.Unlock()
+	if !ok || etag == "" || etag != info.ETag {
+		return false
+	}
+	st, err := os.Stat(name)
+	return err == nil && st.Size() == info.Size
+}
+
+func (fs *objectFileStore) setETag(p Path, etag string) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+	if etag == "" {
+		delete(fs.etags, p)
+		return
+	}
+	fs.etags[p] = etag
+}
+
+// download copies the object at path p to the given cache location. The
+// object is written to a temp file first so that concurrent readers never
+// see a partial copy.
+func (fs *objectFileStore) download(ctx context.Context, p Path, name string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	r, err := fs.store.Get(ctx, fs.key(p))
+	if err != nil {
+		return fmt.Errorf("error downloading %s: %w", p, err)
+	}
+	defer r.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "fsdl")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("error downloading %s: %w", p, err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (fs *objectFileStore) upload(f File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	etag, err := fs.store.Put(context.TODO(), fs.key(f.Path()), f, f.Size())
+	if err != nil {
+		return fmt.Errorf("error uploading %s: %w", f.Path(), err)
+	}
+	fs.setETag(f.Path(), etag)
+	return nil
+}
+
+// objectFile is a locally cached file that is uploaded to the object store
+// on close if it has been written to, unless it is discarded
+type objectFile struct {
+	File
+	fs *objectFileStore
+
+	lk     sync.Mutex
+	dirty  bool
+	closed bool
+}
+
+func (f *objectFile) Write(p []byte) (int, error) {
+	f.lk.Lock()
+	f.dirty = true
+	f.lk.Unlock()
+	return f.File.Write(p)
+}
+
+func (f *objectFile) Close() error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	var uploadErr error
+	if f.dirty {
+		uploadErr = f.fs.upload(f.File)
+	}
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	return uploadErr
+}
+
+// Discard closes the file without uploading it, and removes the cached copy
+func (f *objectFile) Discard() error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	f.fs.setETag(f.Path(), "")
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(string(f.OsPath())); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
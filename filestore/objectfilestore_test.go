@@ -0,0 +1,268 @@
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is an in-process stand-in for an S3-compatible object store
+type fakeS3 struct {
+	lk      sync.Mutex
+	objects map[string][]byte
+	gets    int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, ObjectStore) {
+	f := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	store, err := NewS3ObjectStore(S3Config{
+		Endpoint:  srv.URL,
+		Region:    "us-east-1",
+		Bucket:    "bucket",
+		Prefix:    "pieces/",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	require.NoError(t, err)
+	return f, store
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/bucket/pieces/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/pieces/")
+
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		f.objects[key] = data
+		w.Header().Set("ETag", etag(data))
+	case http.MethodGet, http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("ETag", etag(data))
+		if r.Method == http.MethodGet {
+			f.gets++
+			_, _ = w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) object(key string) ([]byte, bool) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	data, ok := f.objects[key]
+	return data, ok
+}
+
+func TestS3ObjectStore(t *testing.T) {
+	ctx := context.Background()
+	_, store := newFakeS3(t)
+
+	_, err := store.Stat(ctx, "missing")
+	require.True(t, errors.Is(err, ErrObjectNotFound))
+
+	data := randBytes(100)
+	tag, err := store.Put(ctx, "dir/some file", bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, etag(data), tag)
+	info, err := store.Stat(ctx, "dir/some file")
+	require.NoError(t, err)
+	require.Equal(t, ObjectInfo{Size: int64(len(data)), ETag: tag}, info)
+
+	r, err := store.Get(ctx, "dir/some file")
+	require.NoError(t, err)
+	read, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, data, read)
+
+	require.NoError(t, store.Delete(ctx, "dir/some file"))
+	_, err = store.Get(ctx, "dir/some file")
+	require.True(t, errors.Is(err, ErrObjectNotFound))
+}
+
+func TestObjectFileStore(t *testing.T) {
+	t.Run("create uploads on close", func(t *testing.T) {
+		s3, store := newFakeS3(t)
+		fs, err := NewObjectFileStore(store, OsPath(t.TempDir()))
+		require.NoError(t, err)
+
+		data := randBytes(64)
+		f, err := fs.Create("piece.car")
+		require.NoError(t, err)
+		_, err = f.Write(data)
+		require.NoError(t, err)
+		_, ok := s3.object("piece.car")
+		require.False(t, ok)
+		require.NoError(t, f.Close())
+		require.NoError(t, f.Close())
+
+		uploaded, ok := s3.object("piece.car")
+		require.True(t, ok)
+		require.Equal(t, data, uploaded)
+
+		_, err = fs.Create("piece.car")
+		require.Error(t, err)
+	})
+
+	t.Run("open downloads to a seekable local copy", func(t *testing.T) {
+		s3, store := newFakeS3(t)
+		data := randBytes(64)
+		_, err := store.Put(context.Background(), "piece.car", bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+
+		// a different machine with an empty cache
+		fs, err := NewObjectFileStore(store, OsPath(t.TempDir()))
+		require.NoError(t, err)
+		f, err := fs.Open("piece.car")
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), f.Size())
+
+		local, err := os.ReadFile(string(f.OsPath()))
+		require.NoError(t, err)
+		require.Equal(t, data, local)
+
+		_, err = f.Seek(32, io.SeekStart)
+		require.NoError(t, err)
+		buf := make([]byte, 32)
+		_, err = io.ReadFull(f, buf)
+		require.NoError(t, err)
+		require.Equal(t, data[32:], buf)
+		require.NoError(t, f.Close())
+
+		// the cached copy is reused
+		f, err = fs.Open("piece.car")
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		require.Equal(t, 1, s3.gets)
+
+		// a stale copy is downloaded again, even if its size is unchanged
+		updated := randBytes(64)
+		_, err = store.Put(context.Background(), "piece.car", bytes.NewReader(updated), int64(len(updated)))
+		require.NoError(t, err)
+		f, err = fs.Open("piece.car")
+		require.NoError(t, err)
+		local, err = os.ReadFile(string(f.OsPath()))
+		require.NoError(t, err)
+		require.Equal(t, updated, local)
+		require.NoError(t, f.Close())
+		require.Equal(t, 2, s3.gets)
+	})
+
+	t.Run("discarded files are not persisted", func(t *testing.T) {
+		s3, store := newFakeS3(t)
+		fs, err := NewObjectFileStore(store, OsPath(t.TempDir()))
+		require.NoError(t, err)
+
+		f, err := fs.CreateTemp()
+		require.NoError(t, err)
+		_, err = f.Write(randBytes(64))
+		require.NoError(t, err)
+		d, ok := f.(Discarder)
+		require.True(t, ok)
+		require.NoError(t, d.Discard())
+		require.NoError(t, f.Close())
+
+		_, ok = s3.object(string(f.Path()))
+		require.False(t, ok)
+		_, err = os.Stat(string(f.OsPath()))
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("temp files are persisted", func(t *testing.T) {
+		s3, store := newFakeS3(t)
+		fs, err := NewObjectFileStore(store, OsPath(t.TempDir()))
+		require.NoError(t, err)
+
+		data := randBytes(64)
+		f, err := fs.CreateTemp()
+		require.NoError(t, err)
+		_, err = f.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		uploaded, ok := s3.object(string(f.Path()))
+		require.True(t, ok)
+		require.Equal(t, data, uploaded)
+
+		other, err := NewObjectFileStore(store, OsPath(t.TempDir()))
+		require.NoError(t, err)
+		f2, err := other.Open(f.Path())
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), f2.Size())
+		require.NoError(t, f2.Close())
+	})
+
+	t.Run("delete removes object and cached copy", func(t *testing.T) {
+		s3, store := newFakeS3(t)
+		fs, err := NewObjectFileStore(store, OsPath(t.TempDir()))
+		require.NoError(t, err)
+
+		f, err := fs.Store("piece.car", bytesFile(t, randBytes(64)))
+		require.NoError(t, err)
+		opened, err := fs.Open(f)
+		require.NoError(t, err)
+		require.NoError(t, opened.Close())
+
+		require.NoError(t, fs.Delete(f))
+		_, ok := s3.object("piece.car")
+		require.False(t, ok)
+		_, err = os.Stat(string(opened.OsPath()))
+		require.True(t, os.IsNotExist(err))
+
+		_, err = fs.Open(f)
+		require.Error(t, err)
+	})
+}
+
+func bytesFile(t *testing.T, data []byte) File {
+	fs, err := NewLocalFileStore(OsPath(t.TempDir()))
+	require.NoError(t, err)
+	f, err := fs.CreateTemp()
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	return f
+}
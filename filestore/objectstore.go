@@ -0,0 +1,34 @@
+package filestore
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrObjectNotFound is returned by an ObjectStore when the requested key
+// does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectInfo describes an object in an ObjectStore
+type ObjectInfo struct {
+	Size int64
+	// ETag identifies the content of the object. It changes whenever the
+	// object is overwritten. An empty ETag means the store does not provide
+	// one.
+	ETag string
+}
+
+// ObjectStore is a minimal key/value blob store, such as an S3-compatible
+// bucket, that can back a FileStore
+type ObjectStore interface {
+	// Get returns a reader for the object stored under the given key
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Put stores size bytes read from r under the given key, and returns the
+	// ETag of the new object
+	Put(ctx context.Context, key string, r io.Reader, size int64) (string, error)
+	// Stat returns the size and ETag of the object stored under the given key
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Delete removes the object stored under the given key
+	Delete(ctx context.Context, key string) error
+}
@@ -31,6 +31,15 @@ type RetrieveResponse struct {
 	CarFilePath string
 }
 
+// PeerResult is a retrieval peer found by FindProvidersAsync, or an error
+// from one of the sources peers are looked up with
+type PeerResult struct {
+	// Source names the source the result came from
+	Source string
+	Peer   RetrievalPeer
+	Err    error
+}
+
 // RetrievalClient is a client interface for making retrieval deals
 type RetrievalClient interface {
 
@@ -84,3 +93,55 @@ type RetrievalClient interface {
 	// ListDeals returns all deals
 	ListDeals() (map[DealID]ClientDealState, error)
 }
+
+// RangeRetriever is implemented by a RetrievalClient that can retrieve a
+// byte range of a UnixFS file
+type RangeRetriever interface {
+	// QueryRange asks a provider about a byte range of the UnixFS file with
+	// the given payload CID. The response Size is the amount of data the
+	// provider will send for the range.
+	QueryRange(
+		ctx context.Context,
+		p RetrievalPeer,
+		payloadCID cid.Cid,
+		byteRange ByteRange,
+		params QueryParams,
+	) (QueryResponse, error)
+
+	// RetrieveRange retrieves a byte range of the UnixFS file with the given
+	// payload CID, paying only for the blocks that hold the range
+	RetrieveRange(
+		ctx context.Context,
+		id DealID,
+		payloadCID cid.Cid,
+		byteRange ByteRange,
+		params Params,
+		totalFunds abi.TokenAmount,
+		p RetrievalPeer,
+		clientWallet address.Address,
+		minerWallet address.Address,
+	) (DealID, error)
+}
+
+// AsyncProviderFinder is implemented by a RetrievalClient that can send
+// providers as each of the sources it looks them up with finds them
+type AsyncProviderFinder interface {
+	// FindProvidersAsync finds retrieval providers who may be storing a given
+	// piece, sending them as each source finds them. The channel is closed
+	// once every source has answered or the context is cancelled.
+	FindProvidersAsync(ctx context.Context, payloadCID cid.Cid) <-chan PeerResult
+}
+
+// BatchQuerier is implemented by a RetrievalClient that can ask a provider
+// about many payloads at once
+type BatchQuerier interface {
+	// QueryMany asks a provider about many payloads at once, calling
+	// onResponse with the index of each query and the response to it as the
+	// responses arrive
+	QueryMany(
+		ctx context.Context,
+		p RetrievalPeer,
+		queries []Query,
+		onResponse func(index int, resp QueryResponse),
+	) error
+}
@@ -20,3 +20,14 @@ func DecodeNode(defnode *cbg.Deferred) (ipld.Node, error) {
 	}
 	return nb.Build(), nil
 }
+
+// EncodeNode cbor-encodes a selector so it can be sent in query or deal
+// params
+func EncodeNode(node ipld.Node) (*cbg.Deferred, error) {
+	var buffer bytes.Buffer
+	err := dagcbor.Encode(node, &buffer)
+	if err != nil {
+		return nil, err
+	}
+	return &cbg.Deferred{Raw: buffer.Bytes()}, nil
+}
@@ -136,6 +136,10 @@ const (
 	// DealStatusFinalizingBlockstore means that all blocks have been received,
 	// and the blockstore is being finalized
 	DealStatusFinalizingBlockstore
+
+	// DealStatusUnsealQueued means the provider is waiting for its turn to
+	// unseal the data
+	DealStatusUnsealQueued
 )
 
 // DealStatuses maps deal status to a human readable representation
@@ -175,6 +179,7 @@ var DealStatuses = map[DealStatus]string{
 	DealStatusRejecting:                        "DealStatusRejecting",
 	DealStatusDealNotFoundCleanup:              "DealStatusDealNotFoundCleanup",
 	DealStatusFinalizingBlockstore:             "DealStatusFinalizingBlockstore",
+	DealStatusUnsealQueued:                     "DealStatusUnsealQueued",
 }
 
 func (s DealStatus) String() string {
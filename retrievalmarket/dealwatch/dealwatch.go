@@ -0,0 +1,147 @@
+// Package dealwatch follows a single retrieval deal made through a
+// RetrievalClient until it ends, cancelling it if it stops receiving data.
+package dealwatch
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientstates"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+var log = logging.Logger("retrieval-dealwatch")
+
+// CancelTimeout is how long to wait for a cancelled deal to wind down
+const CancelTimeout = 10 * time.Second
+
+// Canceller cancels retrieval deals
+type Canceller interface {
+	CancelDeal(id retrievalmarket.DealID) error
+}
+
+// Watcher keeps the latest state of a single deal. The client calls
+// subscribers from its event loop, so OnEvent never blocks.
+type Watcher struct {
+	id     retrievalmarket.DealID
+	update chan struct{}
+
+	lk    sync.Mutex
+	state retrievalmarket.ClientDealState
+}
+
+// NewWatcher returns a Watcher for the deal with the given ID
+func NewWatcher(id retrievalmarket.DealID) *Watcher {
+	return &Watcher{id: id, update: make(chan struct{}, 1)}
+}
+
+// OnEvent is a retrievalmarket.ClientSubscriber that records the state of
+// the watched deal, ignoring events for other deals
+func (w *Watcher) OnEvent(_ retrievalmarket.ClientEvent, state retrievalmarket.ClientDealState) {
+	if state.ID != w.id {
+		return
+	}
+	w.lk.Lock()
+	w.state = state
+	w.lk.Unlock()
+	select {
+	case w.update <- struct{}{}:
+	default:
+	}
+}
+
+// Latest returns the latest state of the deal
+func (w *Watcher) Latest() retrievalmarket.ClientDealState {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	return w.state
+}
+
+// Wait waits for the deal to end, calling onUpdate with each new state. If
+// the deal receives no data for stallTimeout, or ctx is cancelled, Wait
+// cancels the deal and waits for it to wind down, so that the funds it
+// spent are known and the client no longer considers it active. Zero
+// disables stall detection. Wait returns nil only if the deal completed.
+func (w *Watcher) Wait(ctx context.Context, client Canceller, clock shared.Clock, stallTimeout time.Duration, onUpdate func(retrievalmarket.ClientDealState)) error {
+	var stall <-chan time.Time
+	resetStall := func() {}
+	if stallTimeout > 0 {
+		timer := clock.Timer(stallTimeout)
+		defer timer.Stop()
+		stall = timer.C
+		resetStall = func() {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(stallTimeout)
+		}
+	}
+
+	var received uint64
+	for {
+		select {
+		case <-w.update:
+			state := w.observe(onUpdate)
+			if state.TotalReceived > received {
+				received = state.TotalReceived
+				resetStall()
+			}
+			if ended, err := Ended(state); ended {
+				return err
+			}
+		case <-stall:
+			return w.cancel(client, clock, onUpdate, xerrors.Errorf("deal %d received no data for %s", w.id, stallTimeout))
+		case <-ctx.Done():
+			return w.cancel(client, clock, onUpdate, ctx.Err())
+		}
+	}
+}
+
+func (w *Watcher) observe(onUpdate func(retrievalmarket.ClientDealState)) retrievalmarket.ClientDealState {
+	state := w.Latest()
+	if onUpdate != nil {
+		onUpdate(state)
+	}
+	return state
+}
+
+// cancel cancels the deal and waits for it to end, returning reason
+func (w *Watcher) cancel(client Canceller, clock shared.Clock, onUpdate func(retrievalmarket.ClientDealState), reason error) error {
+	if err := client.CancelDeal(w.id); err != nil {
+		log.Warnf("failed to cancel retrieval deal %d: %s", w.id, err)
+		return reason
+	}
+	timeout := clock.After(CancelTimeout)
+	for {
+		select {
+		case <-w.update:
+			if ended, _ := Ended(w.observe(onUpdate)); ended {
+				return reason
+			}
+		case <-timeout:
+			log.Warnf("timed out waiting for retrieval deal %d to cancel", w.id)
+			return reason
+		}
+	}
+}
+
+// Ended returns true if the deal is over, along with the reason it failed
+// if it did not complete
+func Ended(state retrievalmarket.ClientDealState) (bool, error) {
+	if !clientstates.IsFinalityState(state.Status) {
+		return false, nil
+	}
+	if state.Status == retrievalmarket.DealStatusCompleted {
+		return true, nil
+	}
+	return true, xerrors.Errorf("deal %d ended in state %s: %s",
+		state.ID, retrievalmarket.DealStatuses[state.Status], state.Message)
+}
@@ -0,0 +1,93 @@
+package dealwatch_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/dealwatch"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+type canceller struct {
+	w         *dealwatch.Watcher
+	cancelled []retrievalmarket.DealID
+}
+
+func (c *canceller) CancelDeal(id retrievalmarket.DealID) error {
+	c.cancelled = append(c.cancelled, id)
+	c.w.OnEvent(retrievalmarket.ClientEventCancelComplete, retrievalmarket.ClientDealState{
+		DealProposal: retrievalmarket.DealProposal{ID: id},
+		Status:       retrievalmarket.DealStatusCancelled,
+	})
+	return nil
+}
+
+func TestWatcher(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	state := func(id retrievalmarket.DealID, status retrievalmarket.DealStatus, received uint64) retrievalmarket.ClientDealState {
+		return retrievalmarket.ClientDealState{
+			DealProposal:  retrievalmarket.DealProposal{ID: id},
+			Status:        status,
+			TotalReceived: received,
+		}
+	}
+
+	t.Run("completes", func(t *testing.T) {
+		w := dealwatch.NewWatcher(1)
+		c := &canceller{w: w}
+		var updates []retrievalmarket.ClientDealState
+		go func() {
+			w.OnEvent(retrievalmarket.ClientEventBlocksReceived, state(2, retrievalmarket.DealStatusErrored, 0))
+			w.OnEvent(retrievalmarket.ClientEventComplete, state(1, retrievalmarket.DealStatusCompleted, 10))
+		}()
+		err := w.Wait(ctx, c, shared.NewClock(), time.Second, func(s retrievalmarket.ClientDealState) {
+			updates = append(updates, s)
+		})
+		require.NoError(t, err)
+		require.Empty(t, c.cancelled)
+		require.Equal(t, uint64(10), w.Latest().TotalReceived)
+		require.Equal(t, retrievalmarket.DealStatusCompleted, updates[len(updates)-1].Status)
+	})
+
+	t.Run("fails", func(t *testing.T) {
+		w := dealwatch.NewWatcher(1)
+		go w.OnEvent(retrievalmarket.ClientEventProviderCancelled, state(1, retrievalmarket.DealStatusRejected, 0))
+		err := w.Wait(ctx, &canceller{w: w}, shared.NewClock(), time.Second, nil)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "DealStatusRejected")
+	})
+
+	t.Run("cancels a stalled deal", func(t *testing.T) {
+		w := dealwatch.NewWatcher(1)
+		c := &canceller{w: w}
+		err := w.Wait(ctx, c, shared.NewClock(), 10*time.Millisecond, nil)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "received no data")
+		require.Equal(t, []retrievalmarket.DealID{1}, c.cancelled)
+		require.Equal(t, retrievalmarket.DealStatusCancelled, w.Latest().Status)
+	})
+}
+
+func TestEnded(t *testing.T) {
+	for status := range retrievalmarket.DealStatuses {
+		ended, err := dealwatch.Ended(retrievalmarket.ClientDealState{Status: status})
+		switch status {
+		case retrievalmarket.DealStatusCompleted:
+			require.True(t, ended)
+			require.NoError(t, err)
+		case retrievalmarket.DealStatusErrored,
+			retrievalmarket.DealStatusCancelled,
+			retrievalmarket.DealStatusRejected,
+			retrievalmarket.DealStatusDealNotFound:
+			require.True(t, ended)
+			require.Error(t, err)
+		default:
+			require.False(t, ended, retrievalmarket.DealStatuses[status])
+		}
+	}
+}
@@ -47,7 +47,10 @@ Identifying Retrieval Providers
 The RetrievalClient provides two functions to locate a provider from which to retrieve data.
 
 `FindProviders` returns a list of retrieval peers who may have the data your looking for. FindProviders delegates its work to
-an implementation of the PeerResolver interface.
+an implementation of the PeerResolver interface. discoveryimpl.Multi combines several resolvers, such as the local
+store, a network indexer and a static peers file, so peers can be found without adding them to the local store first.
+`FindProvidersAsync`, on clients that implement the optional AsyncProviderFinder interface, does the same, but sends
+providers on a channel as each source finds them, so the first ones can be queried while slower sources are still looking.
 
 `Query` queries a specific retrieval provider to find out definitively if they have the requested data and if so, the
 parameters they will accept for a retrieval deal.
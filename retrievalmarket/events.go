@@ -138,6 +138,10 @@ const (
 	// ClientEventFinalizeBlockstoreErrored is fired when there is an error
 	// finalizing the blockstore
 	ClientEventFinalizeBlockstoreErrored
+
+	// ClientEventBudgetExceeded is fired when a payment is blocked because it
+	// would exceed the client's spending budget
+	ClientEventBudgetExceeded
 )
 
 // ClientEvents is a human readable map of client event name -> event description
@@ -181,6 +185,7 @@ var ClientEvents = map[ClientEvent]string{
 	ClientEventPaymentNotSent:                "ClientEventPaymentNotSent",
 	ClientEventBlockstoreFinalized:           "ClientEventBlockstoreFinalized",
 	ClientEventFinalizeBlockstoreErrored:     "ClientEventFinalizeBlockstoreErrored",
+	ClientEventBudgetExceeded:                "ClientEventBudgetExceeded",
 }
 
 func (e ClientEvent) String() string {
@@ -256,6 +261,13 @@ const (
 
 	// ProviderEventClientCancelled happens when the provider gets a cancel message from the client's data transfer
 	ProviderEventClientCancelled
+
+	// ProviderEventUnsealQueued happens when a deal is queued to unseal its
+	// data, and whenever its position in the queue changes
+	ProviderEventUnsealQueued
+
+	// ProviderEventUnsealStarted happens when a queued deal starts unsealing
+	ProviderEventUnsealStarted
 )
 
 // ProviderEvents is a human readable map of provider event name -> event description
@@ -278,4 +290,6 @@ var ProviderEvents = map[ProviderEvent]string{
 	ProviderEventCleanupComplete:        "ProviderEventCleanupComplete",
 	ProviderEventMultiStoreError:        "ProviderEventMultiStoreError",
 	ProviderEventClientCancelled:        "ProviderEventClientCancelled",
+	ProviderEventUnsealQueued:           "ProviderEventUnsealQueued",
+	ProviderEventUnsealStarted:          "ProviderEventUnsealStarted",
 }
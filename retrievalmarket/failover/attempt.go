@@ -0,0 +1,49 @@
+package failover
+
+import (
+	"context"
+
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-ipld-prime"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/dealwatch"
+)
+
+// attempt makes a deal with a single provider and waits for it to
+// complete, fail or stall
+func (r *Retriever) attempt(ctx context.Context, req Request, sel ipld.Node, offer Offer, funds abi.TokenAmount, bs bstore.Blockstore) Attempt {
+	a := Attempt{Offer: offer, FundsSpent: big.Zero()}
+	params, err := offer.Response.DealParams(sel, req.PieceCID)
+	if err != nil {
+		a.Err = xerrors.Errorf("failed to create deal params: %w", err)
+		return a
+	}
+
+	a.DealID = r.client.NextID()
+	r.accessor.Bind(a.DealID, bs)
+	w := dealwatch.NewWatcher(a.DealID)
+	unsubscribe := r.client.SubscribeToEvents(w.OnEvent)
+	defer unsubscribe()
+
+	_, err = r.client.Retrieve(ctx, a.DealID, req.PayloadCID, params, funds, offer.Peer, req.ClientWallet, offer.Response.PaymentAddress)
+	if err != nil {
+		_ = r.accessor.Done(a.DealID)
+		a.Err = xerrors.Errorf("failed to start deal: %w", err)
+		return a
+	}
+
+	a.Err = w.Wait(ctx, r.client, r.clock, r.stallTimeout, a.record)
+	return a
+}
+
+func (a *Attempt) record(state retrievalmarket.ClientDealState) {
+	a.BytesReceived = state.TotalReceived
+	if !state.FundsSpent.Nil() {
+		a.FundsSpent = state.FundsSpent
+	}
+}
@@ -0,0 +1,320 @@
+// Package failover retrieves a payload from the best of several providers,
+// failing over to the next best provider when a deal fails or stalls.
+//
+// A Retriever queries every candidate provider, ranks the providers that
+// have the payload, and makes a deal with each in turn until one succeeds.
+// Every deal writes into the same blockstore, so the blocks received by a
+// deal that fails are kept. The retrieval gives up once every provider has
+// been tried, the funds budget does not cover the next provider's price, or
+// the timeout expires.
+package failover
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipld/go-ipld-prime"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/parallel"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+var log = logging.Logger("retrieval-failover")
+
+// DefaultStallTimeout is how long a deal may go without receiving data
+// before the retriever fails over to the next provider
+const DefaultStallTimeout = time.Minute
+
+// DefaultQueryTimeout is how long the retriever waits for each provider to
+// respond to a query
+const DefaultQueryTimeout = 30 * time.Second
+
+// Offer is a provider's response to a query for a payload
+type Offer struct {
+	Peer     retrievalmarket.RetrievalPeer
+	Response retrievalmarket.QueryResponse
+}
+
+// Price returns the most a deal made on the terms of the offer can cost
+func (o Offer) Price() abi.TokenAmount {
+	if o.Response.FreeRetrievalRequired {
+		return big.Zero()
+	}
+	return o.Response.PieceRetrievalPrice()
+}
+
+// Ranker sorts offers in place so that the most preferred come first
+type Ranker func(offers []Offer)
+
+// RankByPrice ranks cheaper offers first. Among offers of the same price,
+// those with no unseal price come first, because the provider already has
+// an unsealed copy and can start sending data sooner. Offers that are
+// otherwise equal keep the order of the candidates they came from.
+func RankByPrice(offers []Offer) {
+	sort.SliceStable(offers, func(i, j int) bool {
+		pi, pj := offers[i].Price(), offers[j].Price()
+		if !pi.Equals(pj) {
+			return pi.LessThan(pj)
+		}
+		return offers[i].Response.UnsealPrice.LessThan(offers[j].Response.UnsealPrice)
+	})
+}
+
+// Option is a function that configures a Retriever
+type Option func(r *Retriever)
+
+// StallTimeout sets how long a deal may go without receiving data before
+// it is cancelled and the next provider is tried. Zero disables stall
+// detection.
+func StallTimeout(timeout time.Duration) Option {
+	return func(r *Retriever) {
+		r.stallTimeout = timeout
+	}
+}
+
+// QueryTimeout sets how long to wait for each provider to respond to a
+// query. Zero means queries are bounded only by the retrieval's timeout.
+func QueryTimeout(timeout time.Duration) Option {
+	return func(r *Retriever) {
+		r.queryTimeout = timeout
+	}
+}
+
+// RankOffers sets how offers are ranked. The default is RankByPrice.
+func RankOffers(rank Ranker) Option {
+	return func(r *Retriever) {
+		r.rank = rank
+	}
+}
+
+// ResumeFromBlockstore makes the retriever commit to each deal only the
+// price of the data not already in the retrieval's blockstore, including
+// blocks left by earlier deals that failed. The client must have been
+// constructed with the retrievalimpl.ResumeFromBlockstore option, so that
+// providers do not send or charge for blocks the client already has.
+func ResumeFromBlockstore() Option {
+	return func(r *Retriever) {
+		r.resume = true
+	}
+}
+
+// RetrieverClock sets the clock the retriever uses for timeouts
+func RetrieverClock(clock shared.Clock) Option {
+	return func(r *Retriever) {
+		r.clock = clock
+	}
+}
+
+// Request describes a retrieval with failover
+type Request struct {
+	PayloadCID cid.Cid
+	// Selector optionally restricts the retrieval to part of the payload. It
+	// defaults to the entire DAG.
+	Selector ipld.Node
+	// PieceCID optionally restricts the retrieval to a single piece
+	PieceCID *cid.Cid
+	// Candidates are the providers to query. When empty, the providers are
+	// looked up with the client's FindProviders.
+	Candidates   []retrievalmarket.RetrievalPeer
+	ClientWallet address.Address
+	// MaxFunds is the most the retrieval may spend across all of its deals.
+	// A provider is only tried if its price fits in what is left of the
+	// budget. Nil means there is no limit.
+	MaxFunds abi.TokenAmount
+	// Timeout is the most time the retrieval may take, including queries.
+	// Zero means there is no limit.
+	Timeout time.Duration
+}
+
+// Attempt is a deal made with one provider during a retrieval
+type Attempt struct {
+	Offer         Offer
+	DealID        retrievalmarket.DealID
+	BytesReceived uint64
+	FundsSpent    abi.TokenAmount
+	// Err is the reason the deal failed, or nil if it succeeded
+	Err error
+}
+
+// Result is the outcome of a retrieval with failover
+type Result struct {
+	// Attempts are the deals made, in order. When the retrieval succeeds,
+	// the last attempt is the deal that succeeded.
+	Attempts []Attempt
+	// BytesReceived is the total received across all deals
+	BytesReceived uint64
+	// FundsSpent is the total spent across all deals
+	FundsSpent abi.TokenAmount
+}
+
+// Retriever runs retrievals that fail over between providers
+type Retriever struct {
+	client       retrievalmarket.RetrievalClient
+	accessor     *parallel.BlockstoreAccessor
+	stallTimeout time.Duration
+	queryTimeout time.Duration
+	rank         Ranker
+	resume       bool
+	clock        shared.Clock
+}
+
+// NewRetriever returns a Retriever that makes deals with the given client.
+// The client must have been constructed with accessor as its blockstore
+// accessor.
+func NewRetriever(client retrievalmarket.RetrievalClient, accessor *parallel.BlockstoreAccessor, opts ...Option) *Retriever {
+	r := &Retriever{
+		client:       client,
+		accessor:     accessor,
+		stallTimeout: DefaultStallTimeout,
+		queryTimeout: DefaultQueryTimeout,
+		rank:         RankByPrice,
+		clock:        shared.NewClock(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Retrieve retrieves the payload of a request into bs from the best
+// provider that will serve it, failing over to the next best provider each
+// time a deal fails or stalls. The returned Result records every deal that
+// was made, whether or not the retrieval succeeded.
+func (r *Retriever) Retrieve(ctx context.Context, req Request, bs bstore.Blockstore) (Result, error) {
+	res := Result{FundsSpent: big.Zero()}
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = r.clock.WithTimeout(ctx, req.Timeout)
+		defer cancel()
+	}
+
+	offers, err := r.Query(ctx, req)
+	if err != nil {
+		return res, err
+	}
+	if len(offers) == 0 {
+		return res, xerrors.Errorf("no provider offered to serve %s", req.PayloadCID)
+	}
+
+	sel := req.Selector
+	if sel == nil {
+		sel = selectorparse.CommonSelector_ExploreAllRecursively
+	}
+
+	var lastErr error
+	overBudget := false
+	for _, offer := range offers {
+		funds := r.funds(ctx, req, sel, offer, bs)
+		if !req.MaxFunds.Nil() {
+			remaining := big.Sub(req.MaxFunds, res.FundsSpent)
+			if funds.GreaterThan(remaining) {
+				log.Infof("skipping provider %s for %s: price %s exceeds remaining budget %s",
+					offer.Peer.ID, req.PayloadCID, funds, remaining)
+				overBudget = true
+				continue
+			}
+		}
+
+		attempt := r.attempt(ctx, req, sel, offer, funds, bs)
+		res.Attempts = append(res.Attempts, attempt)
+		res.BytesReceived += attempt.BytesReceived
+		res.FundsSpent = big.Add(res.FundsSpent, attempt.FundsSpent)
+		if attempt.Err == nil {
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return res, xerrors.Errorf("retrieving %s: %w", req.PayloadCID, ctx.Err())
+		}
+		log.Warnf("retrieving %s from %s failed, trying next provider: %s", req.PayloadCID, offer.Peer.ID, attempt.Err)
+		lastErr = attempt.Err
+	}
+
+	if overBudget {
+		if lastErr == nil {
+			return res, xerrors.Errorf("no provider can serve %s within the remaining budget", req.PayloadCID)
+		}
+		return res, xerrors.Errorf("no provider can serve %s within the remaining budget, last error: %w", req.PayloadCID, lastErr)
+	}
+	return res, xerrors.Errorf("all providers failed to retrieve %s, last error: %w", req.PayloadCID, lastErr)
+}
+
+// funds returns the funds to commit to a deal with the provider of an offer
+func (r *Retriever) funds(ctx context.Context, req Request, sel ipld.Node, offer Offer, bs bstore.Blockstore) abi.TokenAmount {
+	if !r.resume || offer.Response.FreeRetrievalRequired {
+		return offer.Price()
+	}
+	_, have, err := shared.LocalBlocks(ctx, bs, req.PayloadCID, sel)
+	if err != nil {
+		log.Warnf("finding local blocks of %s: %s", req.PayloadCID, err)
+		return offer.Price()
+	}
+	return offer.Response.RemainingRetrievalPrice(have)
+}
+
+// Query queries the candidate providers of a request concurrently, and
+// returns the ranked offers of the providers that have the payload
+func (r *Retriever) Query(ctx context.Context, req Request) ([]Offer, error) {
+	candidates := req.Candidates
+	if len(candidates) == 0 {
+		candidates = r.client.FindProviders(req.PayloadCID)
+	}
+
+	params := retrievalmarket.QueryParams{PieceCID: req.PieceCID}
+	if req.Selector != nil {
+		sel, err := retrievalmarket.EncodeNode(req.Selector)
+		if err != nil {
+			return nil, xerrors.Errorf("encoding selector: %w", err)
+		}
+		params.Selector = sel
+	}
+
+	responses := make([]*Offer, len(candidates))
+	var wg sync.WaitGroup
+	for i, p := range candidates {
+		wg.Add(1)
+		go func(i int, p retrievalmarket.RetrievalPeer) {
+			defer wg.Done()
+			qctx := ctx
+			if r.queryTimeout > 0 {
+				var cancel context.CancelFunc
+				qctx, cancel = r.clock.WithTimeout(ctx, r.queryTimeout)
+				defer cancel()
+			}
+			resp, err := r.client.Query(qctx, p, req.PayloadCID, params)
+			if err != nil {
+				log.Debugf("querying %s for %s: %s", p.ID, req.PayloadCID, err)
+				return
+			}
+			if resp.Status != retrievalmarket.QueryResponseAvailable {
+				log.Debugf("provider %s cannot serve %s: %s", p.ID, req.PayloadCID, resp.Message)
+				return
+			}
+			responses[i] = &Offer{Peer: p, Response: resp}
+		}(i, p)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, xerrors.Errorf("querying providers for %s: %w", req.PayloadCID, ctx.Err())
+	}
+
+	var offers []Offer
+	for _, offer := range responses {
+		if offer != nil {
+			offers = append(offers, *offer)
+		}
+	}
+	r.rank(offers)
+	return offers, nil
+}
@@ -0,0 +1,273 @@
+package failover_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/failover"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/parallel"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+const offerSize = 1000
+
+func TestRetrieve(t *testing.T) {
+	testCases := map[string]struct {
+		providers []testnodes.FakeProvider
+		// noCandidates looks the providers up with FindProviders
+		noCandidates bool
+		maxFunds     abi.TokenAmount
+		timeout      time.Duration
+		expectErr    error
+		// expectAttempts are the indexes of the providers deals are made
+		// with, in order
+		expectAttempts []int
+		expectCancels  int
+	}{
+		"retrieves from the cheapest provider": {
+			providers:      []testnodes.FakeProvider{provider(testnodes.ServeDeals, 3), provider(testnodes.ServeDeals, 1)},
+			expectAttempts: []int{1},
+		},
+		"fails over when a deal is rejected": {
+			providers:      []testnodes.FakeProvider{provider(testnodes.RejectDeals, 1), provider(testnodes.ServeDeals, 2)},
+			expectAttempts: []int{0, 1},
+		},
+		"fails over when a deal stalls": {
+			providers:      []testnodes.FakeProvider{provider(testnodes.StallDeals, 1), provider(testnodes.ServeDeals, 2)},
+			expectAttempts: []int{0, 1},
+			expectCancels:  1,
+		},
+		"skips providers that do not have the payload": {
+			providers:      []testnodes.FakeProvider{unavailable(), provider(testnodes.ServeDeals, 2)},
+			expectAttempts: []int{1},
+		},
+		"looks up providers when no candidates are given": {
+			providers:      []testnodes.FakeProvider{provider(testnodes.RejectDeals, 1), provider(testnodes.ServeDeals, 2)},
+			noCandidates:   true,
+			expectAttempts: []int{0, 1},
+		},
+		"skips providers whose price exceeds the remaining budget": {
+			providers:      []testnodes.FakeProvider{provider(testnodes.RejectDeals, 1), provider(testnodes.ServeDeals, 3)},
+			maxFunds:       abi.NewTokenAmount(2 * offerSize),
+			expectAttempts: []int{0},
+			expectErr:      errors.New("no provider can serve"),
+		},
+		"gives up when every provider fails": {
+			providers:      []testnodes.FakeProvider{provider(testnodes.RejectDeals, 1), provider(testnodes.RejectDeals, 2)},
+			expectAttempts: []int{0, 1},
+			expectErr:      errors.New("all providers failed"),
+		},
+		"gives up when the timeout expires": {
+			providers:      []testnodes.FakeProvider{provider(testnodes.StallDeals, 1), provider(testnodes.ServeDeals, 2)},
+			timeout:        200 * time.Millisecond,
+			expectAttempts: []int{0},
+			expectCancels:  1,
+			expectErr:      context.DeadlineExceeded,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			payload := blocks.NewBlock([]byte("failover payload"))
+			fc, accessor := newFakeClient(payload)
+			var peers []retrievalmarket.RetrievalPeer
+			for _, p := range tc.providers {
+				peers = append(peers, fc.AddProvider(t, p))
+			}
+
+			stallTimeout := 50 * time.Millisecond
+			if tc.timeout > 0 {
+				// leave the timeout to end the retrieval
+				stallTimeout = 0
+			}
+			retriever := failover.NewRetriever(fc, accessor, failover.StallTimeout(stallTimeout))
+
+			req := failover.Request{
+				PayloadCID:   payload.Cid(),
+				ClientWallet: address.TestAddress,
+				MaxFunds:     tc.maxFunds,
+				Timeout:      tc.timeout,
+			}
+			if !tc.noCandidates {
+				req.Candidates = peers
+			}
+			dest := newBlockstore()
+			res, err := retriever.Retrieve(ctx, req, dest)
+
+			var attempted []peer.ID
+			for _, a := range res.Attempts {
+				attempted = append(attempted, a.Offer.Peer.ID)
+			}
+			var expected []peer.ID
+			for _, i := range tc.expectAttempts {
+				expected = append(expected, peers[i].ID)
+			}
+			require.Equal(t, expected, attempted)
+			require.Len(t, fc.Cancelled(), tc.expectCancels)
+
+			// every deal writes into the retrieval's blockstore
+			for _, a := range res.Attempts {
+				require.True(t, fc.BlockstoreFor(a.DealID) == dest, "deal %d did not use the shared blockstore", a.DealID)
+			}
+
+			if tc.expectErr != nil {
+				require.Error(t, err)
+				if errors.Is(tc.expectErr, context.DeadlineExceeded) {
+					require.ErrorIs(t, err, context.DeadlineExceeded)
+				} else {
+					require.Contains(t, err.Error(), tc.expectErr.Error())
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.Nil(t, res.Attempts[len(res.Attempts)-1].Err)
+			has, err := dest.Has(ctx, payload.Cid())
+			require.NoError(t, err)
+			require.True(t, has)
+			require.Equal(t, uint64(len(payload.RawData())), res.BytesReceived)
+			require.Equal(t, fc.Spent(), res.FundsSpent)
+		})
+	}
+}
+
+func TestRetrieveResumes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	data := []byte("failover payload")
+	c, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum(data)
+	require.NoError(t, err)
+	payload, err := blocks.NewBlockWithCid(data, c)
+	require.NoError(t, err)
+	have := uint64(len(payload.RawData()))
+	fullPrice := abi.NewTokenAmount(2 * offerSize)
+	remainingPrice := abi.NewTokenAmount(2 * int64(offerSize-have))
+
+	testCases := map[string]struct {
+		opts        []failover.Option
+		maxFunds    abi.TokenAmount
+		expectFunds abi.TokenAmount
+		expectErr   bool
+	}{
+		"commits the price of the whole payload by default": {
+			expectFunds: fullPrice,
+		},
+		"commits the price of the blocks not yet held when resuming": {
+			opts:        []failover.Option{failover.ResumeFromBlockstore()},
+			expectFunds: remainingPrice,
+		},
+		"checks the budget against the remaining price when resuming": {
+			opts:        []failover.Option{failover.ResumeFromBlockstore()},
+			maxFunds:    remainingPrice,
+			expectFunds: remainingPrice,
+		},
+		"checks the budget against the full price by default": {
+			maxFunds:  remainingPrice,
+			expectErr: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fc, accessor := newFakeClient(payload)
+			peers := []retrievalmarket.RetrievalPeer{fc.AddProvider(t, provider(testnodes.ServeDeals, 2))}
+			retriever := failover.NewRetriever(fc, accessor, tc.opts...)
+
+			// an earlier retrieval left the payload block in the blockstore
+			dest := newBlockstore()
+			require.NoError(t, dest.Put(ctx, payload))
+			res, err := retriever.Retrieve(ctx, failover.Request{
+				PayloadCID:   payload.Cid(),
+				Candidates:   peers,
+				ClientWallet: address.TestAddress,
+				MaxFunds:     tc.maxFunds,
+			}, dest)
+			if tc.expectErr {
+				require.Error(t, err)
+				require.Empty(t, res.Attempts)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, res.Attempts, 1)
+			funds, _ := fc.DealFunds()
+			require.Equal(t, tc.expectFunds, funds[res.Attempts[0].DealID])
+		})
+	}
+}
+
+func TestRankByPrice(t *testing.T) {
+	offer := func(name string, pricePerByte, unsealPrice int64, free bool) failover.Offer {
+		return failover.Offer{
+			Peer: retrievalmarket.RetrievalPeer{ID: peer.ID(name)},
+			Response: retrievalmarket.QueryResponse{
+				Size:                  offerSize,
+				MinPricePerByte:       abi.NewTokenAmount(pricePerByte),
+				UnsealPrice:           abi.NewTokenAmount(unsealPrice),
+				FreeRetrievalRequired: free,
+			},
+		}
+	}
+	offers := []failover.Offer{
+		offer("expensive", 5, 0, false),
+		offer("sealed", 0, offerSize, false),
+		offer("unsealed", 1, 0, false),
+		offer("unsealed-later", 1, 0, false),
+		offer("free", 9, 0, true),
+	}
+	failover.RankByPrice(offers)
+	var ranked []peer.ID
+	for _, o := range offers {
+		ranked = append(ranked, o.Peer.ID)
+	}
+	require.Equal(t, []peer.ID{"free", "unsealed", "unsealed-later", "sealed", "expensive"}, ranked)
+}
+
+// newFakeClient returns a fake client whose providers serve the payload
+// block
+func newFakeClient(payload blocks.Block) (*testnodes.FakeRetrievalClient, *parallel.BlockstoreAccessor) {
+	accessor := parallel.NewBlockstoreAccessor(tut.NewTestRetrievalBlockstoreAccessor())
+	return testnodes.NewFakeRetrievalClient(accessor, func(ctx context.Context, _ cid.Cid, _ retrievalmarket.Params, bs bstore.Blockstore) (uint64, error) {
+		return uint64(len(payload.RawData())), bs.Put(ctx, payload)
+	}), accessor
+}
+
+// provider returns a provider with the payload that responds to deals with
+// behaviour, at the given price per byte
+func provider(behaviour testnodes.DealBehaviour, price int64) testnodes.FakeProvider {
+	return testnodes.FakeProvider{
+		Behaviour: behaviour,
+		Query: retrievalmarket.QueryResponse{
+			Status:          retrievalmarket.QueryResponseAvailable,
+			Size:            offerSize,
+			PaymentAddress:  address.TestAddress2,
+			MinPricePerByte: abi.NewTokenAmount(price),
+			UnsealPrice:     big.Zero(),
+		},
+	}
+}
+
+// unavailable returns a provider that does not have the payload
+func unavailable() testnodes.FakeProvider {
+	return testnodes.FakeProvider{Query: retrievalmarket.QueryResponse{Status: retrievalmarket.QueryResponseUnavailable}}
+}
+
+func newBlockstore() bstore.Blockstore {
+	return bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+}
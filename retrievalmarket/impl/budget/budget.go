@@ -0,0 +1,362 @@
+// Package budget limits how much a retrieval client spends.
+//
+// A Manager tracks spending per client wallet, and per client wallet and
+// provider, against optional total and daily caps. When a deal starts, the
+// funds it may spend are committed against the caps, so that concurrent
+// deals can't together commit more than the caps allow. Each payment the
+// deal makes is then authorized before the voucher is created, which holds
+// the payment against the caps, and recorded as spent once the voucher has
+// been created. A payment beyond what the deal committed, e.g. after its
+// payment channel is topped up, is only authorized if the caps still allow
+// it.
+//
+// Spending is persisted, so that the caps hold across restarts. Caps are
+// configuration, and are set again each time the Manager is constructed.
+package budget
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+// ErrBudgetExceeded is returned when committing or spending funds would
+// exceed a cap
+var ErrBudgetExceeded = errors.New("retrieval spending budget exceeded")
+
+// Caps limits spending. A nil cap means there is no limit.
+type Caps struct {
+	// Total caps everything ever spent
+	Total abi.TokenAmount
+	// Daily caps what is spent in a day, from midnight UTC
+	Daily abi.TokenAmount
+}
+
+// Usage is a snapshot of the spending of a wallet, or of a wallet with a
+// single provider
+type Usage struct {
+	Caps Caps
+	// Committed is what active deals may still spend
+	Committed abi.TokenAmount
+	// Spent is the total ever spent
+	Spent abi.TokenAmount
+	// SpentToday is the total spent since midnight UTC
+	SpentToday abi.TokenAmount
+}
+
+// Option is a function that configures a Manager
+type Option func(m *Manager)
+
+// ManagerClock sets the clock the manager uses to tell when a day ends
+func ManagerClock(clock shared.Clock) Option {
+	return func(m *Manager) {
+		m.clock = clock
+	}
+}
+
+type dealBudget struct {
+	wallet   address.Address
+	provider peer.ID
+	// committed is what the deal may still spend without checking caps
+	committed abi.TokenAmount
+	// authorized is the total of the payments recorded as spent for the deal
+	authorized abi.TokenAmount
+	// pending is the payment authorized but not yet recorded as spent, and
+	// covered the part of it taken from committed
+	pending      abi.TokenAmount
+	covered      abi.TokenAmount
+	pendingTotal abi.TokenAmount
+}
+
+func newDealBudget(wallet address.Address, provider peer.ID, committed abi.TokenAmount) *dealBudget {
+	return &dealBudget{
+		wallet:       wallet,
+		provider:     provider,
+		committed:    committed,
+		authorized:   big.Zero(),
+		pending:      big.Zero(),
+		covered:      big.Zero(),
+		pendingTotal: big.Zero(),
+	}
+}
+
+// dropPending returns the part of a payment that was authorized but never
+// spent to the deal's commitment
+func (d *dealBudget) dropPending() {
+	d.committed = big.Add(d.committed, d.covered)
+	d.pending = big.Zero()
+	d.covered = big.Zero()
+}
+
+// Manager enforces spending caps for a retrieval client
+type Manager struct {
+	ds    datastore.Batching
+	clock shared.Clock
+
+	lk      sync.Mutex
+	caps    map[datastore.Key]Caps
+	ledgers map[datastore.Key]*Ledger
+	deals   map[retrievalmarket.DealID]*dealBudget
+}
+
+// NewManager returns a Manager that persists spending to ds
+func NewManager(ds datastore.Batching, opts ...Option) *Manager {
+	m := &Manager{
+		ds:      ds,
+		clock:   shared.NewClock(),
+		caps:    make(map[datastore.Key]Caps),
+		ledgers: make(map[datastore.Key]*Ledger),
+		deals:   make(map[retrievalmarket.DealID]*dealBudget),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// SetWalletCaps sets the caps on what a wallet spends across all providers
+func (m *Manager) SetWalletCaps(wallet address.Address, caps Caps) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.caps[walletKey(wallet)] = caps
+}
+
+// SetProviderCaps sets the caps on what a wallet spends with a single
+// provider
+func (m *Manager) SetProviderCaps(wallet address.Address, provider peer.ID, caps Caps) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.caps[providerKey(wallet, provider)] = caps
+}
+
+// WalletUsage returns the spending of a wallet across all providers
+func (m *Manager) WalletUsage(ctx context.Context, wallet address.Address) (Usage, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.usageLocked(ctx, walletKey(wallet))
+}
+
+// ProviderUsage returns the spending of a wallet with a single provider
+func (m *Manager) ProviderUsage(ctx context.Context, wallet address.Address, provider peer.ID) (Usage, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.usageLocked(ctx, providerKey(wallet, provider))
+}
+
+// Commit commits the funds a new deal may spend, returning an error
+// wrapping ErrBudgetExceeded if they don't fit under the caps of the wallet
+// or of the wallet with the provider
+func (m *Manager) Commit(ctx context.Context, id retrievalmarket.DealID, wallet address.Address, provider peer.ID, amount abi.TokenAmount) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if _, ok := m.deals[id]; ok {
+		return xerrors.Errorf("funds already committed for deal %d", id)
+	}
+	if err := m.checkLocked(ctx, wallet, provider, amount); err != nil {
+		return err
+	}
+	m.deals[id] = newDealBudget(wallet, provider, amount)
+	return nil
+}
+
+// Authorize authorizes a deal to pay the given total, which includes all
+// of the deal's earlier payments, and holds the new part of the total
+// against the caps until Spend records it. spent is what the deal has paid
+// so far, which is used when the deal's earlier payments were made before a
+// restart. The part of the payment not covered by the deal's commitment
+// must fit under the caps. Authorizing a new total drops any earlier
+// payment that was authorized but never spent.
+func (m *Manager) Authorize(ctx context.Context, id retrievalmarket.DealID, wallet address.Address, provider peer.ID, spent abi.TokenAmount, total abi.TokenAmount) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	d, ok := m.deals[id]
+	if !ok {
+		d = newDealBudget(wallet, provider, big.Zero())
+		m.deals[id] = d
+	}
+	d.dropPending()
+	paid := big.Max(d.authorized, spent)
+	delta := big.Sub(total, paid)
+	if delta.LessThanEqual(big.Zero()) {
+		return nil
+	}
+
+	covered := big.Min(delta, d.committed)
+	uncovered := big.Sub(delta, covered)
+	if uncovered.GreaterThan(big.Zero()) {
+		if err := m.checkLocked(ctx, wallet, provider, uncovered); err != nil {
+			return err
+		}
+	}
+
+	d.committed = big.Sub(d.committed, covered)
+	d.pending = delta
+	d.covered = covered
+	d.pendingTotal = total
+	return nil
+}
+
+// Spend records the payment last authorized for a deal as spent, once its
+// voucher has been created. The wallet's and the provider's ledgers are
+// updated together.
+func (m *Manager) Spend(ctx context.Context, id retrievalmarket.DealID) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	d, ok := m.deals[id]
+	if !ok || d.pending.IsZero() {
+		return nil
+	}
+
+	keys := []datastore.Key{walletKey(d.wallet), providerKey(d.wallet, d.provider)}
+	updated := make([]*Ledger, 0, len(keys))
+	for _, key := range keys {
+		l, err := m.ledgerLocked(ctx, key)
+		if err != nil {
+			return err
+		}
+		u := *l
+		u.Spent = big.Add(l.Spent, d.pending)
+		u.SpentToday = big.Add(l.SpentToday, d.pending)
+		updated = append(updated, &u)
+	}
+	if err := m.saveLedgersLocked(ctx, keys, updated); err != nil {
+		return err
+	}
+	d.authorized = d.pendingTotal
+	d.pending = big.Zero()
+	d.covered = big.Zero()
+	return nil
+}
+
+// Release releases whatever a deal committed or was authorized to pay but
+// did not spend, once the deal has ended
+func (m *Manager) Release(id retrievalmarket.DealID) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	delete(m.deals, id)
+}
+
+// checkLocked checks that amount fits under the caps of the wallet and of
+// the wallet with the provider, on top of what has been spent and committed
+func (m *Manager) checkLocked(ctx context.Context, wallet address.Address, provider peer.ID, amount abi.TokenAmount) error {
+	for _, key := range []datastore.Key{walletKey(wallet), providerKey(wallet, provider)} {
+		caps, ok := m.caps[key]
+		if !ok {
+			continue
+		}
+		usage, err := m.usageLocked(ctx, key)
+		if err != nil {
+			return err
+		}
+		if !caps.Total.Nil() {
+			total := big.Sum(usage.Spent, usage.Committed, amount)
+			if total.GreaterThan(caps.Total) {
+				return xerrors.Errorf("%w: %s needs %s on top of %s spent and %s committed, over the total cap of %s",
+					ErrBudgetExceeded, key, amount, usage.Spent, usage.Committed, caps.Total)
+			}
+		}
+		if !caps.Daily.Nil() {
+			total := big.Sum(usage.SpentToday, usage.Committed, amount)
+			if total.GreaterThan(caps.Daily) {
+				return xerrors.Errorf("%w: %s needs %s on top of %s spent today and %s committed, over the daily cap of %s",
+					ErrBudgetExceeded, key, amount, usage.SpentToday, usage.Committed, caps.Daily)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Manager) usageLocked(ctx context.Context, key datastore.Key) (Usage, error) {
+	l, err := m.ledgerLocked(ctx, key)
+	if err != nil {
+		return Usage{}, err
+	}
+	committed := big.Zero()
+	for _, d := range m.deals {
+		if key == walletKey(d.wallet) || key == providerKey(d.wallet, d.provider) {
+			committed = big.Sum(committed, d.committed, d.pending)
+		}
+	}
+	return Usage{
+		Caps:       m.caps[key],
+		Committed:  committed,
+		Spent:      l.Spent,
+		SpentToday: l.SpentToday,
+	}, nil
+}
+
+// ledgerLocked returns the ledger for a key, loading it from the datastore
+// the first time, and starting a new day's total if the day has changed
+func (m *Manager) ledgerLocked(ctx context.Context, key datastore.Key) (*Ledger, error) {
+	l, ok := m.ledgers[key]
+	if !ok {
+		l = newLedger()
+		data, err := m.ds.Get(ctx, key)
+		switch {
+		case err == nil:
+			if err := l.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+				return nil, xerrors.Errorf("decoding ledger %s: %w", key, err)
+			}
+		case xerrors.Is(err, datastore.ErrNotFound):
+		default:
+			return nil, xerrors.Errorf("loading ledger %s: %w", key, err)
+		}
+		m.ledgers[key] = l
+	}
+	l.rollover(m.today())
+	return l, nil
+}
+
+// saveLedgersLocked saves ledgers in a single batch, so that either all of
+// them or none are updated
+func (m *Manager) saveLedgersLocked(ctx context.Context, keys []datastore.Key, ledgers []*Ledger) error {
+	batch, err := m.ds.Batch(ctx)
+	if err != nil {
+		return xerrors.Errorf("creating ledger batch: %w", err)
+	}
+	for i, key := range keys {
+		data, err := cborutil.Dump(ledgers[i])
+		if err != nil {
+			return xerrors.Errorf("encoding ledger %s: %w", key, err)
+		}
+		if err := batch.Put(ctx, key, data); err != nil {
+			return xerrors.Errorf("saving ledger %s: %w", key, err)
+		}
+	}
+	if err := batch.Commit(ctx); err != nil {
+		return xerrors.Errorf("saving ledgers: %w", err)
+	}
+	for i, key := range keys {
+		m.ledgers[key] = ledgers[i]
+	}
+	return nil
+}
+
+func (m *Manager) today() int64 {
+	return m.clock.Now().UTC().Unix() / int64(24*time.Hour/time.Second)
+}
+
+func walletKey(wallet address.Address) datastore.Key {
+	return datastore.NewKey(wallet.String())
+}
+
+func providerKey(wallet address.Address, provider peer.ID) datastore.Key {
+	return walletKey(wallet).ChildString(provider.String())
+}
@@ -0,0 +1,136 @@
+package budget_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/budget"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	wallet := tut.NewIDAddr(t, 100)
+	peers := tut.GeneratePeers(2)
+	p1, p2 := peers[0], peers[1]
+
+	setup := func(ds datastore.Batching, clk clock.Clock) *budget.Manager {
+		m := budget.NewManager(ds, budget.ManagerClock(clk))
+		m.SetWalletCaps(wallet, budget.Caps{Total: abi.NewTokenAmount(1000), Daily: abi.NewTokenAmount(600)})
+		m.SetProviderCaps(wallet, p1, budget.Caps{Total: abi.NewTokenAmount(400)})
+		return m
+	}
+
+	t.Run("commit checks wallet and provider caps", func(t *testing.T) {
+		m := setup(dss.MutexWrap(datastore.NewMapDatastore()), clock.NewMock())
+		err := m.Commit(ctx, 1, wallet, p1, abi.NewTokenAmount(500))
+		require.ErrorIs(t, err, budget.ErrBudgetExceeded)
+
+		require.NoError(t, m.Commit(ctx, 2, wallet, p1, abi.NewTokenAmount(400)))
+		err = m.Commit(ctx, 3, wallet, p2, abi.NewTokenAmount(300))
+		require.ErrorIs(t, err, budget.ErrBudgetExceeded)
+		require.NoError(t, m.Commit(ctx, 4, wallet, p2, abi.NewTokenAmount(200)))
+
+		usage, err := m.WalletUsage(ctx, wallet)
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(600), usage.Committed)
+		require.True(t, usage.Spent.IsZero())
+
+		// releasing a deal frees what it committed
+		m.Release(2)
+		require.NoError(t, m.Commit(ctx, 5, wallet, p2, abi.NewTokenAmount(300)))
+	})
+
+	t.Run("authorize moves committed funds to spent", func(t *testing.T) {
+		m := setup(dss.MutexWrap(datastore.NewMapDatastore()), clock.NewMock())
+		require.NoError(t, m.Commit(ctx, 1, wallet, p1, abi.NewTokenAmount(300)))
+		require.NoError(t, m.Authorize(ctx, 1, wallet, p1, big.Zero(), abi.NewTokenAmount(100)))
+		require.NoError(t, m.Spend(ctx, 1))
+		// retrying the same voucher does not spend twice
+		require.NoError(t, m.Authorize(ctx, 1, wallet, p1, big.Zero(), abi.NewTokenAmount(100)))
+		require.NoError(t, m.Spend(ctx, 1))
+		require.NoError(t, m.Authorize(ctx, 1, wallet, p1, abi.NewTokenAmount(100), abi.NewTokenAmount(250)))
+		require.NoError(t, m.Spend(ctx, 1))
+
+		usage, err := m.ProviderUsage(ctx, wallet, p1)
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(50), usage.Committed)
+		require.Equal(t, abi.NewTokenAmount(250), usage.Spent)
+		require.Equal(t, abi.NewTokenAmount(250), usage.SpentToday)
+
+		// paying beyond the commitment is checked against the caps
+		err = m.Authorize(ctx, 1, wallet, p1, abi.NewTokenAmount(250), abi.NewTokenAmount(450))
+		require.ErrorIs(t, err, budget.ErrBudgetExceeded)
+		require.NoError(t, m.Authorize(ctx, 1, wallet, p1, abi.NewTokenAmount(250), abi.NewTokenAmount(400)))
+		require.NoError(t, m.Spend(ctx, 1))
+
+		usage, err = m.WalletUsage(ctx, wallet)
+		require.NoError(t, err)
+		require.True(t, usage.Committed.IsZero())
+		require.Equal(t, abi.NewTokenAmount(400), usage.Spent)
+	})
+
+	t.Run("payments are only spent once recorded", func(t *testing.T) {
+		m := setup(dss.MutexWrap(datastore.NewMapDatastore()), clock.NewMock())
+		require.NoError(t, m.Commit(ctx, 1, wallet, p1, abi.NewTokenAmount(300)))
+		require.NoError(t, m.Authorize(ctx, 1, wallet, p1, big.Zero(), abi.NewTokenAmount(100)))
+
+		// an authorized payment is held against the caps, but not spent
+		usage, err := m.ProviderUsage(ctx, wallet, p1)
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(300), usage.Committed)
+		require.True(t, usage.Spent.IsZero())
+
+		// when the voucher is never created, the next authorization replaces
+		// the payment, which is then spent once
+		require.NoError(t, m.Authorize(ctx, 1, wallet, p1, big.Zero(), abi.NewTokenAmount(150)))
+		require.NoError(t, m.Spend(ctx, 1))
+		usage, err = m.ProviderUsage(ctx, wallet, p1)
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(150), usage.Committed)
+		require.Equal(t, abi.NewTokenAmount(150), usage.Spent)
+
+		// releasing a deal drops a payment that was never spent
+		require.NoError(t, m.Authorize(ctx, 1, wallet, p1, abi.NewTokenAmount(150), abi.NewTokenAmount(250)))
+		m.Release(1)
+		usage, err = m.WalletUsage(ctx, wallet)
+		require.NoError(t, err)
+		require.True(t, usage.Committed.IsZero())
+		require.Equal(t, abi.NewTokenAmount(150), usage.Spent)
+		usage, err = m.ProviderUsage(ctx, wallet, p1)
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(150), usage.Spent)
+	})
+
+	t.Run("daily cap resets and spending persists", func(t *testing.T) {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		clk := clock.NewMock()
+		m := setup(ds, clk)
+		require.NoError(t, m.Authorize(ctx, 1, wallet, p2, big.Zero(), abi.NewTokenAmount(600)))
+		require.NoError(t, m.Spend(ctx, 1))
+		err := m.Commit(ctx, 2, wallet, p2, abi.NewTokenAmount(1))
+		require.ErrorIs(t, err, budget.ErrBudgetExceeded)
+
+		// a new day resets the daily total, and a restarted manager loads
+		// what was spent
+		clk.Add(24 * time.Hour)
+		m = setup(ds, clk)
+		usage, err := m.WalletUsage(ctx, wallet)
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(600), usage.Spent)
+		require.True(t, usage.SpentToday.IsZero())
+
+		require.NoError(t, m.Commit(ctx, 2, wallet, p2, abi.NewTokenAmount(400)))
+		err = m.Commit(ctx, 3, wallet, p2, abi.NewTokenAmount(1))
+		require.ErrorIs(t, err, budget.ErrBudgetExceeded)
+	})
+}
@@ -0,0 +1,32 @@
+package budget
+
+import (
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+)
+
+//go:generate cbor-gen-for --map-encoding Ledger
+
+// Ledger is the persisted record of what a wallet, or a wallet with a
+// single provider, has spent on retrievals
+type Ledger struct {
+	// Spent is the total ever spent
+	Spent abi.TokenAmount
+	// Day is the day SpentToday is for, as a number of days since the
+	// Unix epoch in UTC
+	Day int64
+	// SpentToday is the total spent during Day
+	SpentToday abi.TokenAmount
+}
+
+func newLedger() *Ledger {
+	return &Ledger{Spent: big.Zero(), SpentToday: big.Zero()}
+}
+
+// rollover resets the daily total when day is after the ledger's day
+func (l *Ledger) rollover(day int64) {
+	if day != l.Day {
+		l.Day = day
+		l.SpentToday = big.Zero()
+	}
+}
@@ -0,0 +1,181 @@
+// Code generated by github.com/whyrusleeping/cbor-gen. DO NOT EDIT.
+
+package budget
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	cid "github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	xerrors "golang.org/x/xerrors"
+)
+
+var _ = xerrors.Errorf
+var _ = cid.Undef
+var _ = math.E
+var _ = sort.Sort
+
+func (t *Ledger) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write([]byte{163}); err != nil {
+		return err
+	}
+
+	// t.Spent (big.Int) (struct)
+	if len("Spent") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Spent\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Spent"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Spent")); err != nil {
+		return err
+	}
+
+	if err := t.Spent.MarshalCBOR(cw); err != nil {
+		return err
+	}
+
+	// t.Day (int64) (int64)
+	if len("Day") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Day\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Day"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Day")); err != nil {
+		return err
+	}
+
+	if t.Day >= 0 {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Day)); err != nil {
+			return err
+		}
+	} else {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-t.Day-1)); err != nil {
+			return err
+		}
+	}
+
+	// t.SpentToday (big.Int) (struct)
+	if len("SpentToday") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"SpentToday\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("SpentToday"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("SpentToday")); err != nil {
+		return err
+	}
+
+	if err := t.SpentToday.MarshalCBOR(cw); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *Ledger) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = Ledger{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("Ledger: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadString(cr)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Spent (big.Int) (struct)
+		case "Spent":
+
+			{
+
+				if err := t.Spent.UnmarshalCBOR(cr); err != nil {
+					return xerrors.Errorf("unmarshaling t.Spent: %w", err)
+				}
+
+			}
+			// t.Day (int64) (int64)
+		case "Day":
+			{
+				maj, extra, err := cr.ReadHeader()
+				var extraI int64
+				if err != nil {
+					return err
+				}
+				switch maj {
+				case cbg.MajUnsignedInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 positive overflow")
+					}
+				case cbg.MajNegativeInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 negative oveflow")
+					}
+					extraI = -1 - extraI
+				default:
+					return fmt.Errorf("wrong type for int64 field: %d", maj)
+				}
+
+				t.Day = int64(extraI)
+			}
+			// t.SpentToday (big.Int) (struct)
+		case "SpentToday":
+
+			{
+
+				if err := t.SpentToday.UnmarshalCBOR(cr); err != nil {
+					return xerrors.Errorf("unmarshaling t.SpentToday: %w", err)
+				}
+
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
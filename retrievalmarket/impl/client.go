@@ -9,8 +9,10 @@ import (
 	"github.com/hannahhoward/go-pubsub"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipld/go-ipld-prime"
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"golang.org/x/xerrors"
@@ -22,10 +24,13 @@ import (
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-statemachine/fsm"
 
+	"github.com/filecoin-project/go-fil-markets/dealarchive"
 	"github.com/filecoin-project/go-fil-markets/discovery"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/budget"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientstates"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/dtutils"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/lanes"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/migrations"
 	rmnet "github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
 	"github.com/filecoin-project/go-fil-markets/shared"
@@ -39,6 +44,7 @@ type Client struct {
 	dataTransfer datatransfer.Manager
 	node         retrievalmarket.RetrievalClientNode
 	dealIDGen    *shared.TimeCounter
+	clock        shared.Clock
 
 	subscribers          *pubsub.PubSub
 	readySub             *pubsub.PubSub
@@ -46,6 +52,12 @@ type Client struct {
 	stateMachines        fsm.Group
 	migrateStateMachines func(context.Context) error
 	bstores              retrievalmarket.BlockstoreAccessor
+	doNotSend            *dtutils.DoNotSendExchange
+	budget               *budget.Manager
+	lanes                *lanes.Pool
+	archiveDeals         bool
+	archiveOpts          []dealarchive.Option
+	archiver             *dealarchive.Archiver
 
 	// Guards concurrent access to Retrieve method
 	retrieveLk sync.Mutex
@@ -71,6 +83,66 @@ func dispatcher(evt pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
 }
 
 var _ retrievalmarket.RetrievalClient = &Client{}
+var _ retrievalmarket.BatchQuerier = &Client{}
+var _ retrievalmarket.AsyncProviderFinder = &Client{}
+var _ retrievalmarket.RangeRetriever = &Client{}
+
+// RetrievalClientOption is a function that configures a retrieval client
+type RetrievalClientOption func(c *Client)
+
+// ClientClock sets the clock the client uses to generate deal IDs
+func ClientClock(clock shared.Clock) RetrievalClientOption {
+	return func(c *Client) {
+		c.clock = clock
+	}
+}
+
+// ResumeFromBlockstore makes the client resume retrievals from the blocks
+// already in a deal's blockstore, e.g. those left by an earlier deal for
+// the same payload that was cancelled or interrupted by a restart. When a
+// deal starts, the client tells the provider which of the blocks matched
+// by the deal's selector it already has, so that the provider does not send
+// or charge for them. The data transfer transport of the client must use
+// the given exchange.
+func ResumeFromBlockstore(exchange *dtutils.DoNotSendExchange) RetrievalClientOption {
+	return func(c *Client) {
+		c.doNotSend = exchange
+	}
+}
+
+// SpendingBudget makes the client enforce the spending caps of the given
+// budget manager. The funds of a new deal are committed against the caps
+// when the deal starts, and each payment is authorized before its voucher is
+// created and recorded as spent once the voucher exists.
+func SpendingBudget(m *budget.Manager) RetrievalClientOption {
+	return func(c *Client) {
+		c.budget = m
+	}
+}
+
+// PaymentLaneReuse makes deals lease payment channel lanes from a pool,
+// instead of allocating a new lane for every deal. When a deal completes,
+// its lane is returned to the pool, and the next deal with the same
+// provider carries on paying on the lane, with vouchers that add up from
+// where the earlier deal's left off. The lanes of deals that fail or are
+// cancelled are not reused. The pool is not persisted, so deals allocate
+// new lanes after a restart.
+func PaymentLaneReuse() RetrievalClientOption {
+	return func(c *Client) {
+		c.lanes = lanes.NewPool()
+	}
+}
+
+// ClientDealArchival moves the records of deals that have finished into an
+// archive once they have been finished for a while, so that the client's
+// state machines only hold live deals. GetDeal still finds archived deals,
+// and the archive can be listed or exported with DealArchiver.
+func ClientDealArchival(opts ...dealarchive.Option) RetrievalClientOption {
+	return func(c *Client) {
+		c.archiveDeals = true
+		c.archiveOpts = opts
+	}
+}
 
 // NewClient creates a new retrieval client
 func NewClient(
@@ -80,17 +152,22 @@ func NewClient(
 	resolver discovery.PeerResolver,
 	ds datastore.Batching,
 	ba retrievalmarket.BlockstoreAccessor,
+	opts ...RetrievalClientOption,
 ) (retrievalmarket.RetrievalClient, error) {
 	c := &Client{
 		network:      network,
 		dataTransfer: dataTransfer,
 		node:         node,
 		resolver:     resolver,
-		dealIDGen:    shared.NewTimeCounter(),
 		subscribers:  pubsub.New(dispatcher),
 		readySub:     pubsub.New(shared.ReadyDispatcher),
 		bstores:      ba,
+		clock:        shared.NewClock(),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.dealIDGen = shared.NewTimeCounterWithClock(c.clock)
 	retrievalMigrations, err := migrations.ClientMigrations.Build()
 	if err != nil {
 		return nil, err
@@ -107,6 +184,12 @@ func NewClient(
 	if err != nil {
 		return nil, err
 	}
+	if c.archiveDeals {
+		c.archiver = dealarchive.NewArchiver(namespace.Wrap(ds, datastore.NewKey("archive/2")), c.stateMachines,
+			retrievalmarket.ClientDealState{}, func(deal interface{}) interface{} {
+				return deal.(retrievalmarket.ClientDealState).ID
+			}, append([]dealarchive.Option{dealarchive.ArchiverClock(c.clock)}, c.archiveOpts...)...)
+	}
 	err = dataTransfer.RegisterVoucherResultType(&retrievalmarket.DealResponse{})
 	if err != nil {
 		return nil, err
@@ -154,6 +237,8 @@ func (c *Client) Start(ctx context.Context) error {
 		err := c.migrateStateMachines(ctx)
 		if err != nil {
 			log.Errorf("Migrating retrieval client state machines: %s", err.Error())
+		} else if c.archiver != nil {
+			c.archiver.Start()
 		}
 
 		err = c.readySub.Publish(err)
@@ -164,6 +249,19 @@ func (c *Client) Start(ctx context.Context) error {
 	return nil
 }
 
+// Stop stops archiving deals
+func (c *Client) Stop() {
+	if c.archiver != nil {
+		c.archiver.Stop()
+	}
+}
+
+// DealArchiver returns the archiver of the client's finished deals, or nil
+// if deal archival is not enabled
+func (c *Client) DealArchiver() *dealarchive.Archiver {
+	return c.archiver
+}
+
 // OnReady registers a listener for when the client has finished starting up
 func (c *Client) OnReady(ready shared.ReadyFunc) {
 	c.readySub.Subscribe(ready)
@@ -179,6 +277,13 @@ func (c *Client) FindProviders(payloadCID cid.Cid) []retrievalmarket.RetrievalPe
 	return peers
 }
 
+// FindProvidersAsync uses the PeerResolver to locate providers who may have a
+// given payload CID, sending them as each of its sources finds them, along
+// with the errors of sources that fail.
+func (c *Client) FindProvidersAsync(ctx context.Context, payloadCID cid.Cid) <-chan retrievalmarket.PeerResult {
+	return discovery.FindPeers(ctx, c.resolver, payloadCID)
+}
+
 /*
 Query sends a retrieval query to a specific retrieval provider, to determine
 if the provider can serve a retrieval request and what its specific parameters for
@@ -193,17 +298,22 @@ func (c *Client) Query(ctx context.Context, p retrievalmarket.RetrievalPeer, pay
 		log.Warn(err)
 		return retrievalmarket.QueryResponseUndefined, err
 	}
-	s, err := c.network.NewQueryStream(p.ID)
+	return c.query(p.ID, retrievalmarket.Query{
+		PayloadCID:  payloadCID,
+		QueryParams: params,
+	})
+}
+
+// query sends a single query to a provider and reads the response
+func (c *Client) query(p peer.ID, query retrievalmarket.Query) (retrievalmarket.QueryResponse, error) {
+	s, err := c.network.NewQueryStream(p)
 	if err != nil {
 		log.Warn(err)
 		return retrievalmarket.QueryResponseUndefined, err
 	}
 	defer s.Close()
 
-	err = s.WriteQuery(retrievalmarket.Query{
-		PayloadCID:  payloadCID,
-		QueryParams: params,
-	})
+	err = s.WriteQuery(query)
 	if err != nil {
 		log.Warn(err)
 		return retrievalmarket.QueryResponseUndefined, err
@@ -212,6 +322,128 @@ func (c *Client) Query(ctx context.Context, p retrievalmarket.RetrievalPeer, pay
 	return s.ReadQueryResponse()
 }
 
+// fallbackQueryWorkers is how many single queries QueryMany sends at once to
+// a provider that doesn't support batch queries
+var fallbackQueryWorkers = 8
+
+// QueryMany asks a provider about many payloads at once. The queries are sent
+// in batches on the batch query protocol, and onResponse is called with the
+// index of each query and the provider's response as the responses arrive,
+// which may not be in the order of the queries. If the provider doesn't
+// support batch queries, or the client's network can't send them, the
+// queries are sent on the single query protocol, several at a time, and a
+// query that fails is reported with an error response. onResponse is never
+// called concurrently.
+func (c *Client) QueryMany(ctx context.Context, p retrievalmarket.RetrievalPeer, queries []retrievalmarket.Query, onResponse func(index int, resp retrievalmarket.QueryResponse)) error {
+	err := c.addMultiaddrs(ctx, p)
+	if err != nil {
+		log.Warn(err)
+		return err
+	}
+
+	for start := 0; start < len(queries); start += retrievalmarket.MaxBatchQuerySize {
+		end := start + retrievalmarket.MaxBatchQuerySize
+		if end > len(queries) {
+			end = len(queries)
+		}
+		offset := start
+		respond := func(index int, resp retrievalmarket.QueryResponse) {
+			onResponse(offset+index, resp)
+		}
+		err := c.queryBatch(ctx, p, queries[start:end], respond)
+		if errors.Is(err, rmnet.ErrBatchQueryNotSupported) {
+			return c.queryEach(ctx, p, queries[start:], respond)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryBatch sends a batch of queries on a single stream and reads the
+// responses to them
+func (c *Client) queryBatch(ctx context.Context, p retrievalmarket.RetrievalPeer, queries []retrievalmarket.Query, onResponse func(index int, resp retrievalmarket.QueryResponse)) error {
+	bn, ok := c.network.(rmnet.BatchQueryNetwork)
+	if !ok {
+		return rmnet.ErrBatchQueryNotSupported
+	}
+	s, err := bn.NewBatchQueryStream(p.ID)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// closing the stream unblocks reading responses when the context ends
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.Close()
+		case <-done:
+		}
+	}()
+
+	err = s.WriteBatchQuery(retrievalmarket.BatchQuery{Queries: queries})
+	if err != nil {
+		log.Warn(err)
+		return err
+	}
+
+	answered := make([]bool, len(queries))
+	for remaining := len(queries); remaining > 0; remaining-- {
+		resp, err := s.ReadBatchQueryResponse()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return xerrors.Errorf("reading response to batch query: %w", err)
+		}
+		if resp.Index >= uint64(len(queries)) || answered[resp.Index] {
+			return xerrors.Errorf("unexpected response to query %d of batch of %d", resp.Index, len(queries))
+		}
+		answered[resp.Index] = true
+		onResponse(int(resp.Index), resp.Response)
+	}
+	return nil
+}
+
+// queryEach sends queries one at a time on the single query protocol, for
+// providers that don't support batch queries
+func (c *Client) queryEach(ctx context.Context, p retrievalmarket.RetrievalPeer, queries []retrievalmarket.Query, onResponse func(index int, resp retrievalmarket.QueryResponse)) error {
+	var lk sync.Mutex
+	var wg sync.WaitGroup
+	throttle := make(chan struct{}, fallbackQueryWorkers)
+	for i, query := range queries {
+		select {
+		case throttle <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		}
+		wg.Add(1)
+		go func(i int, query retrievalmarket.Query) {
+			defer func() {
+				<-throttle
+				wg.Done()
+			}()
+			resp, err := c.query(p.ID, query)
+			if err != nil {
+				resp = retrievalmarket.QueryResponse{
+					Status:  retrievalmarket.QueryResponseError,
+					Message: err.Error(),
+				}
+			}
+			lk.Lock()
+			defer lk.Unlock()
+			onResponse(i, resp)
+		}(i, query)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
 // Retrieve initiates the retrieval deal flow, which involves multiple requests and responses
 //
 // To start this processes, the client creates a new `RetrievalDealStream`.  Currently, this connection is
@@ -239,6 +471,9 @@ func (c *Client) Query(ctx context.Context, p retrievalmarket.RetrievalPeer, pay
 //
 // Retrieve can use an ID generated through NextID, or can generate an ID if the user passes a zero value.
 //
+// A free retrieval (see retrievalmarket.NewFreeParams) must have zero prices
+// and zero total funds, and never touches a payment channel.
+//
 // Use NextID when it's necessary to reserve an ID ahead of time, e.g. to
 // associate it with a given blockstore in the BlockstoreAccessor.
 //
@@ -253,6 +488,10 @@ func (c *Client) Retrieve(
 	clientWallet address.Address,
 	minerWallet address.Address,
 ) (retrievalmarket.DealID, error) {
+	if params.Free && (!params.PricePerByte.IsZero() || !params.UnsealPrice.IsZero() || !totalFunds.IsZero()) {
+		return 0, xerrors.New("free retrieval must have zero prices and total funds")
+	}
+
 	c.retrieveLk.Lock()
 	defer c.retrieveLk.Unlock()
 
@@ -293,20 +532,63 @@ func (c *Client) Retrieve(
 		UnsealFundsPaid:  big.Zero(),
 	}
 
+	if c.budget != nil {
+		err = c.budget.Commit(ctx, id, clientWallet, p.ID, totalFunds)
+		if err != nil {
+			return 0, xerrors.Errorf("committing funds for retrieval deal: %w", err)
+		}
+	}
+
 	// start the deal processing
 	err = c.stateMachines.Begin(dealState.ID, &dealState)
 	if err != nil {
+		c.releaseBudget(id)
 		return 0, err
 	}
 
 	err = c.stateMachines.Send(dealState.ID, retrievalmarket.ClientEventOpen)
 	if err != nil {
+		c.releaseBudget(id)
 		return 0, err
 	}
 
 	return id, nil
 }
 
+// QueryRange queries a provider for a byte range of the UnixFS file with the
+// given payload CID, by sending a query with a range selector
+func (c *Client) QueryRange(ctx context.Context, p retrievalmarket.RetrievalPeer, payloadCID cid.Cid, byteRange retrievalmarket.ByteRange, params retrievalmarket.QueryParams) (retrievalmarket.QueryResponse, error) {
+	sel, err := retrievalmarket.EncodeNode(byteRange.Selector())
+	if err != nil {
+		return retrievalmarket.QueryResponseUndefined, xerrors.Errorf("encoding range selector: %w", err)
+	}
+	params.Selector = sel
+	return c.Query(ctx, p, payloadCID, params)
+}
+
+// RetrieveRange retrieves a byte range of the UnixFS file with the given
+// payload CID. It behaves like Retrieve with the params' selector replaced by
+// a range selector, so only the blocks that hold the range are transferred
+// and paid for.
+func (c *Client) RetrieveRange(
+	ctx context.Context,
+	id retrievalmarket.DealID,
+	payloadCID cid.Cid,
+	byteRange retrievalmarket.ByteRange,
+	params retrievalmarket.Params,
+	totalFunds abi.TokenAmount,
+	p retrievalmarket.RetrievalPeer,
+	clientWallet address.Address,
+	minerWallet address.Address,
+) (retrievalmarket.DealID, error) {
+	sel, err := retrievalmarket.EncodeNode(byteRange.Selector())
+	if err != nil {
+		return 0, xerrors.Errorf("encoding range selector: %w", err)
+	}
+	params.Selector = sel
+	return c.Retrieve(ctx, id, payloadCID, params, totalFunds, p, clientWallet, minerWallet)
+}
+
 // Check if there's already an active retrieval deal with the same peer
 // for the same payload CID
 func (c *Client) checkForActiveDeal(payloadCID cid.Cid, pid peer.ID) error {
@@ -335,9 +617,39 @@ func (c *Client) checkForActiveDeal(payloadCID cid.Cid, pid peer.ID) error {
 func (c *Client) notifySubscribers(eventName fsm.EventName, state fsm.StateType) {
 	evt := eventName.(retrievalmarket.ClientEvent)
 	ds := state.(retrievalmarket.ClientDealState)
+	if clientstates.IsFinalityState(ds.Status) {
+		c.releaseBudget(ds.ID)
+		c.releaseLane(ds)
+	}
 	_ = c.subscribers.Publish(internalEvent{evt, ds})
 }
 
+// releaseBudget releases the funds a deal committed but did not spend
+func (c *Client) releaseBudget(id retrievalmarket.DealID) {
+	if c.budget != nil {
+		c.budget.Release(id)
+	}
+}
+
+// releaseLane returns the lane of a deal that completed to the lane pool,
+// with what its vouchers now add up to. The lane of a deal that ended any
+// other way is discarded, since a voucher the deal made may not have
+// reached the provider.
+func (c *Client) releaseLane(ds retrievalmarket.ClientDealState) {
+	if c.lanes == nil || ds.PaymentInfo == nil {
+		return
+	}
+	if ds.Status != retrievalmarket.DealStatusCompleted {
+		c.lanes.Discard(ds.ID, ds.PaymentInfo.PayCh, ds.PaymentInfo.Lane)
+		return
+	}
+	total := ds.FundsSpent
+	if !ds.PaymentInfo.LaneBase.Nil() {
+		total = big.Add(ds.PaymentInfo.LaneBase, ds.FundsSpent)
+	}
+	c.lanes.Release(ds.ID, ds.PaymentInfo.PayCh, lanes.Lane{Lane: ds.PaymentInfo.Lane, Total: total})
+}
+
 func (c *Client) addMultiaddrs(ctx context.Context, p retrievalmarket.RetrievalPeer) error {
 	tok, _, err := c.node.GetChainHead(ctx)
 	if err != nil {
@@ -384,10 +696,15 @@ func (c *Client) CancelDeal(dealID retrievalmarket.DealID) error {
 	return c.stateMachines.Send(dealID, retrievalmarket.ClientEventCancel)
 }
 
-// GetDeal returns a given deal by deal ID, if it exists
+// GetDeal returns a given deal by deal ID, if it exists, looking in the
+// archive for deals that are no longer live
 func (c *Client) GetDeal(dealID retrievalmarket.DealID) (retrievalmarket.ClientDealState, error) {
 	var out retrievalmarket.ClientDealState
-	if err := c.stateMachines.Get(dealID).Get(&out); err != nil {
+	err := c.stateMachines.Get(dealID).Get(&out)
+	if err != nil && c.archiver != nil && xerrors.Is(err, datastore.ErrNotFound) {
+		err = c.archiver.Get(dealID, &out)
+	}
+	if err != nil {
 		return retrievalmarket.ClientDealState{}, err
 	}
 	return out, nil
@@ -428,6 +745,15 @@ func (c *clientDealEnvironment) OpenDataTransfer(ctx context.Context, to peer.ID
 		}
 	}
 
+	if c.c.doNotSend != nil {
+		release, err := c.skipLocalBlocks(ctx, to, proposal, sel)
+		if err != nil {
+			log.Warnf("retrieval deal %d: not resuming from local blocks: %s", proposal.ID, err)
+		} else {
+			defer release()
+		}
+	}
+
 	var vouch datatransfer.Voucher = proposal
 	if legacy {
 		vouch = &migrations.DealProposal0{
@@ -446,6 +772,24 @@ func (c *clientDealEnvironment) OpenDataTransfer(ctx context.Context, to peer.ID
 	return c.c.dataTransfer.OpenPullDataChannel(ctx, to, vouch, proposal.PayloadCID, sel)
 }
 
+// skipLocalBlocks registers the blocks of the deal's payload that are
+// already in its blockstore as blocks the provider should not send
+func (c *clientDealEnvironment) skipLocalBlocks(ctx context.Context, to peer.ID, proposal *retrievalmarket.DealProposal, sel ipld.Node) (func(), error) {
+	bs, err := c.c.bstores.Get(proposal.ID, proposal.PayloadCID)
+	if err != nil {
+		return nil, xerrors.Errorf("getting blockstore: %w", err)
+	}
+	have, size, err := shared.LocalBlocks(ctx, bs, proposal.PayloadCID, sel)
+	if err != nil {
+		return nil, xerrors.Errorf("finding local blocks: %w", err)
+	}
+	if have.Len() > 0 {
+		log.Infof("retrieval deal %d: resuming with %d blocks (%d bytes) of %s already held locally",
+			proposal.ID, have.Len(), size, proposal.PayloadCID)
+	}
+	return c.c.doNotSend.DoNotSend(to, proposal.PayloadCID, have), nil
+}
+
 func (c *clientDealEnvironment) SendDataTransferVoucher(ctx context.Context, channelID datatransfer.ChannelID, payment *retrievalmarket.DealPayment, legacy bool) error {
 	var vouch datatransfer.Voucher = payment
 	if legacy {
@@ -473,6 +817,41 @@ func (c *clientDealEnvironment) CloseDataTransfer(ctx context.Context, channelID
 	return err
 }
 
+// AuthorizePayment checks a payment against the client's spending budget, if
+// it has one
+func (c *clientDealEnvironment) AuthorizePayment(ctx context.Context, deal retrievalmarket.ClientDealState, total abi.TokenAmount) error {
+	if c.c.budget == nil {
+		return nil
+	}
+	return c.c.budget.Authorize(ctx, deal.ID, deal.ClientWallet, deal.Sender, deal.FundsSpent, total)
+}
+
+// RecordPayment records the deal's authorized payment as spent in the
+// client's spending budget, if it has one
+func (c *clientDealEnvironment) RecordPayment(ctx context.Context, deal retrievalmarket.ClientDealState) error {
+	if c.c.budget == nil {
+		return nil
+	}
+	if err := c.c.budget.Spend(ctx, deal.ID); err != nil {
+		return xerrors.Errorf("recording payment against spending budget: %w", err)
+	}
+	return nil
+}
+
+// LeaseLane leases a lane from the client's lane pool, if it reuses lanes,
+// or otherwise allocates a new lane
+func (c *clientDealEnvironment) LeaseLane(ctx context.Context, id retrievalmarket.DealID, paymentChannel address.Address) (uint64, abi.TokenAmount, error) {
+	if c.c.lanes == nil {
+		lane, err := c.c.node.AllocateLane(ctx, paymentChannel)
+		return lane, big.Zero(), err
+	}
+	lane, err := c.c.lanes.Lease(ctx, id, paymentChannel, c.c.node.AllocateLane)
+	if err != nil {
+		return 0, abi.TokenAmount{}, err
+	}
+	return lane.Lane, lane.Total, nil
+}
+
 // FinalizeBlockstore is called when all blocks have been received
 func (c *clientDealEnvironment) FinalizeBlockstore(ctx context.Context, dealID retrievalmarket.DealID) error {
 	return c.c.bstores.Done(dealID)
@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/namespace"
@@ -25,6 +26,7 @@ import (
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 
+	"github.com/filecoin-project/go-fil-markets/dealarchive"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	retrievalimpl "github.com/filecoin-project/go-fil-markets/retrievalmarket/impl"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
@@ -65,6 +67,20 @@ func TestClient_Construction(t *testing.T) {
 	require.True(t, ok)
 }
 
+func TestClient_NextIDFollowsClock(t *testing.T) {
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	dt := tut.NewTestDataTransfer()
+	net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{})
+	ba := tut.NewTestRetrievalBlockstoreAccessor()
+	clock := clock.NewMock()
+	clock.Set(time.Unix(0, 1000))
+	c, err := retrievalimpl.NewClient(net, dt, testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{}), &tut.TestPeerResolver{}, ds, ba,
+		retrievalimpl.ClientClock(clock))
+	require.NoError(t, err)
+	require.Equal(t, retrievalmarket.DealID(1001), c.NextID())
+	require.Equal(t, retrievalmarket.DealID(1002), c.NextID())
+}
+
 func TestClient_Query(t *testing.T) {
 	ctx := context.Background()
 
@@ -175,6 +191,128 @@ func TestClient_Query(t *testing.T) {
 	})
 }
 
+func TestClient_QueryMany(t *testing.T) {
+	ctx := context.Background()
+
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	dt := tut.NewTestDataTransfer()
+	ba := tut.NewTestRetrievalBlockstoreAccessor()
+
+	rpeer := retrievalmarket.RetrievalPeer{
+		Address: address.TestAddress2,
+		ID:      peer.ID("somevalue"),
+	}
+	cids := tut.GenerateCids(3)
+	var queries []retrievalmarket.Query
+	for _, c := range cids {
+		queries = append(queries, retrievalmarket.Query{PayloadCID: c})
+	}
+	// the response to each query carries its payload CID in the message
+	responseTo := func(q retrievalmarket.Query) retrievalmarket.QueryResponse {
+		return retrievalmarket.QueryResponse{
+			Status:  retrievalmarket.QueryResponseAvailable,
+			Message: q.PayloadCID.String(),
+		}
+	}
+	collect := func() (map[int]retrievalmarket.QueryResponse, func(int, retrievalmarket.QueryResponse)) {
+		responses := make(map[int]retrievalmarket.QueryResponse)
+		return responses, func(index int, resp retrievalmarket.QueryResponse) {
+			responses[index] = resp
+		}
+	}
+
+	t.Run("sends a batch on one stream", func(t *testing.T) {
+		streams := 0
+		var bqsb tut.BatchQueryStreamBuilder = func(p peer.ID) (rmnet.RetrievalBatchQueryStream, error) {
+			streams++
+			var pending []retrievalmarket.BatchQueryResponse
+			return tut.NewTestRetrievalBatchQueryStream(tut.TestBatchQueryStreamParams{
+				PeerID: p,
+				Writer: func(batch retrievalmarket.BatchQuery) error {
+					require.Equal(t, queries, batch.Queries)
+					// answer in reverse order
+					for i := len(batch.Queries) - 1; i >= 0; i-- {
+						pending = append(pending, retrievalmarket.BatchQueryResponse{Index: uint64(i), Response: responseTo(batch.Queries[i])})
+					}
+					return nil
+				},
+				RespReader: func() (retrievalmarket.BatchQueryResponse, error) {
+					resp := pending[0]
+					pending = pending[1:]
+					return resp, nil
+				},
+			}), nil
+		}
+		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{
+			BatchQueryStreamBuilder: bqsb,
+			QueryStreamBuilder:      tut.FailNewQueryStream,
+		})
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+		node.ExpectKnownAddresses(rpeer, nil)
+		c, err := retrievalimpl.NewClient(net, dt, node, &tut.TestPeerResolver{}, ds, ba)
+		require.NoError(t, err)
+
+		responses, onResponse := collect()
+		require.NoError(t, c.(retrievalmarket.BatchQuerier).QueryMany(ctx, rpeer, queries, onResponse))
+		require.Equal(t, 1, streams)
+		require.Len(t, responses, len(queries))
+		for i, q := range queries {
+			require.Equal(t, responseTo(q), responses[i])
+		}
+	})
+
+	t.Run("fails on an unexpected response", func(t *testing.T) {
+		var bqsb tut.BatchQueryStreamBuilder = func(p peer.ID) (rmnet.RetrievalBatchQueryStream, error) {
+			return tut.NewTestRetrievalBatchQueryStream(tut.TestBatchQueryStreamParams{
+				PeerID: p,
+				RespReader: func() (retrievalmarket.BatchQueryResponse, error) {
+					return retrievalmarket.BatchQueryResponse{Index: 7}, nil
+				},
+			}), nil
+		}
+		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{BatchQueryStreamBuilder: bqsb})
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+		node.ExpectKnownAddresses(rpeer, nil)
+		c, err := retrievalimpl.NewClient(net, dt, node, &tut.TestPeerResolver{}, ds, ba)
+		require.NoError(t, err)
+
+		_, onResponse := collect()
+		require.EqualError(t, c.(retrievalmarket.BatchQuerier).QueryMany(ctx, rpeer, queries, onResponse), "unexpected response to query 7 of batch of 3")
+	})
+
+	t.Run("falls back to single queries", func(t *testing.T) {
+		failing := cids[1]
+		var qsb tut.QueryStreamBuilder = func(p peer.ID) (rmnet.RetrievalQueryStream, error) {
+			var query retrievalmarket.Query
+			return tut.NewTestRetrievalQueryStream(tut.TestQueryStreamParams{
+				PeerID: p,
+				Writer: func(q retrievalmarket.Query) error {
+					query = q
+					return nil
+				},
+				RespReader: func() (retrievalmarket.QueryResponse, error) {
+					if query.PayloadCID == failing {
+						return retrievalmarket.QueryResponseUndefined, errors.New("stream reset")
+					}
+					return responseTo(query), nil
+				},
+			}), nil
+		}
+		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{QueryStreamBuilder: qsb})
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+		node.ExpectKnownAddresses(rpeer, nil)
+		c, err := retrievalimpl.NewClient(net, dt, node, &tut.TestPeerResolver{}, ds, ba)
+		require.NoError(t, err)
+
+		responses, onResponse := collect()
+		require.NoError(t, c.(retrievalmarket.BatchQuerier).QueryMany(ctx, rpeer, queries, onResponse))
+		require.Len(t, responses, len(queries))
+		require.Equal(t, responseTo(queries[0]), responses[0])
+		require.Equal(t, retrievalmarket.QueryResponse{Status: retrievalmarket.QueryResponseError, Message: "stream reset"}, responses[1])
+		require.Equal(t, responseTo(queries[2]), responses[2])
+	})
+}
+
 func TestClient_FindProviders(t *testing.T) {
 	ds := dss.MutexWrap(datastore.NewMapDatastore())
 	dt := tut.NewTestDataTransfer()
@@ -219,6 +357,32 @@ func TestClient_FindProviders(t *testing.T) {
 		testCid := tut.GenerateCids(1)[0]
 		assert.Len(t, c.FindProviders(testCid), 0)
 	})
+
+	t.Run("streams providers and errors", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		peers := tut.RequireGenerateRetrievalPeers(t, 2)
+		testResolver := tut.TestPeerResolver{Peers: peers}
+		c, err := retrievalimpl.NewClient(net, dt, &testnodes.TestRetrievalClientNode{}, &testResolver, ds, ba)
+		require.NoError(t, err)
+
+		var found []retrievalmarket.RetrievalPeer
+		for r := range c.(retrievalmarket.AsyncProviderFinder).FindProvidersAsync(ctx, tut.GenerateCids(1)[0]) {
+			require.NoError(t, r.Err)
+			found = append(found, r.Peer)
+		}
+		assert.Equal(t, peers, found)
+
+		testResolver = tut.TestPeerResolver{ResolverError: errors.New("boom")}
+		c, err = retrievalimpl.NewClient(net, dt, &testnodes.TestRetrievalClientNode{}, &testResolver, ds, ba)
+		require.NoError(t, err)
+		var errs []error
+		for r := range c.(retrievalmarket.AsyncProviderFinder).FindProvidersAsync(ctx, tut.GenerateCids(1)[0]) {
+			errs = append(errs, r.Err)
+		}
+		require.Len(t, errs, 1)
+		assert.EqualError(t, errs[0], "boom")
+	})
 }
 
 // TestClient_DuplicateRetrieve verifies that it's not possible to make a
@@ -496,8 +660,9 @@ func TestMigrations(t *testing.T) {
 			ClientWallet:         address.TestAddress,
 			MinerWallet:          address.TestAddress2,
 			PaymentInfo: &retrievalmarket.PaymentInfo{
-				PayCh: address.TestAddress,
-				Lane:  lanes[i],
+				PayCh:    address.TestAddress,
+				Lane:     lanes[i],
+				LaneBase: big.Zero(),
 			},
 			Status:           retrievalmarket.DealStatusCompleted,
 			Sender:           senders[i],
@@ -515,3 +680,52 @@ func TestMigrations(t *testing.T) {
 		require.Equal(t, expectedDeal, deal)
 	}
 }
+
+func TestClient_DealArchival(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	dt := tut.NewTestDataTransfer()
+	net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{})
+	ba := tut.NewTestRetrievalBlockstoreAccessor()
+	node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+	client, err := retrievalimpl.NewClient(net, dt, node, &tut.TestPeerResolver{}, ds, ba,
+		retrievalimpl.ClientDealArchival(dealarchive.Retention(0), dealarchive.CheckInterval(time.Hour)))
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, client)
+	defer client.(*retrievalimpl.Client).Stop()
+
+	putDeal := func(id retrievalmarket.DealID, status retrievalmarket.DealStatus) retrievalmarket.ClientDealState {
+		deal := retrievalmarket.ClientDealState{
+			DealProposal: tut.MakeTestDealProposal(),
+			ClientWallet: address.TestAddress,
+			MinerWallet:  address.TestAddress2,
+			Status:       status,
+		}
+		deal.ID = id
+		buf := new(bytes.Buffer)
+		require.NoError(t, deal.MarshalCBOR(buf))
+		require.NoError(t, ds.Put(ctx, datastore.NewKey("2").ChildString(fmt.Sprint(id)), buf.Bytes()))
+		stored, err := client.GetDeal(id)
+		require.NoError(t, err)
+		return stored
+	}
+	completed := putDeal(1, retrievalmarket.DealStatusCompleted)
+	putDeal(2, retrievalmarket.DealStatusOngoing)
+
+	archiver := client.(*retrievalimpl.Client).DealArchiver()
+	archived, err := archiver.ArchiveDeals(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, archived)
+
+	deals, err := client.ListDeals()
+	require.NoError(t, err)
+	require.Len(t, deals, 1)
+	require.Contains(t, deals, retrievalmarket.DealID(2))
+
+	deal, err := client.GetDeal(1)
+	require.NoError(t, err)
+	require.Equal(t, completed, deal)
+	_, err = client.GetDeal(3)
+	require.Error(t, err)
+}
@@ -70,8 +70,11 @@ var ClientEvents = fsm.Events{
 		FromMany(rm.DealStatusWaitForAcceptance, rm.DealStatusWaitForAcceptanceLegacy).To(rm.DealStatusAccepted),
 	fsm.Event(rm.ClientEventUnknownResponseReceived).
 		FromAny().To(rm.DealStatusFailing).
-		Action(func(deal *rm.ClientDealState, status rm.DealStatus) error {
+		Action(func(deal *rm.ClientDealState, status rm.DealStatus, message string) error {
 			deal.Message = fmt.Sprintf("Unexpected deal response status: %s", rm.DealStatuses[status])
+			if message != "" {
+				deal.Message += ": " + message
+			}
 			return nil
 		}),
 
@@ -83,7 +86,7 @@ var ClientEvents = fsm.Events{
 			return nil
 		}),
 
-	// Price of deal is zero so skip creating a payment channel
+	// Deal is free, or its price is zero, so skip creating a payment channel
 	fsm.Event(rm.ClientEventPaymentChannelSkip).
 		From(rm.DealStatusAccepted).To(rm.DealStatusOngoing),
 
@@ -147,8 +150,9 @@ var ClientEvents = fsm.Events{
 
 	fsm.Event(rm.ClientEventLaneAllocated).
 		From(rm.DealStatusPaymentChannelAllocatingLane).To(rm.DealStatusOngoing).
-		Action(func(deal *rm.ClientDealState, lane uint64) error {
+		Action(func(deal *rm.ClientDealState, lane uint64, laneBase abi.TokenAmount) error {
 			deal.PaymentInfo.Lane = lane
+			deal.PaymentInfo.LaneBase = laneBase
 			return nil
 		}),
 
@@ -237,7 +241,11 @@ var ClientEvents = fsm.Events{
 			return nil
 		}),
 	fsm.Event(rm.ClientEventBadPaymentRequested).
-		FromMany(rm.DealStatusSendFunds, rm.DealStatusSendFundsLastPayment).To(rm.DealStatusFailing).
+		FromMany(
+			rm.DealStatusSendFunds,
+			rm.DealStatusSendFundsLastPayment,
+			rm.DealStatusFundsNeeded,
+			rm.DealStatusFundsNeededLastPayment).To(rm.DealStatusFailing).
 		Action(func(deal *rm.ClientDealState, message string) error {
 			deal.Message = message
 			return nil
@@ -248,6 +256,12 @@ var ClientEvents = fsm.Events{
 			deal.Message = xerrors.Errorf("creating payment voucher: %w", err).Error()
 			return nil
 		}),
+	fsm.Event(rm.ClientEventBudgetExceeded).
+		FromMany(rm.DealStatusSendFunds, rm.DealStatusSendFundsLastPayment).To(rm.DealStatusFailing).
+		Action(func(deal *rm.ClientDealState, err error) error {
+			deal.Message = xerrors.Errorf("payment blocked by spending budget: %w", err).Error()
+			return nil
+		}),
 	fsm.Event(rm.ClientEventVoucherShortfall).
 		FromMany(rm.DealStatusSendFunds, rm.DealStatusSendFundsLastPayment).To(rm.DealStatusCheckFunds).
 		Action(func(deal *rm.ClientDealState, shortfall abi.TokenAmount) error {
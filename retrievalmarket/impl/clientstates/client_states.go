@@ -27,6 +27,15 @@ type ClientDealEnvironment interface {
 	SendDataTransferVoucher(context.Context, datatransfer.ChannelID, *rm.DealPayment, bool) error
 	CloseDataTransfer(context.Context, datatransfer.ChannelID) error
 	FinalizeBlockstore(context.Context, rm.DealID) error
+	// AuthorizePayment checks that the deal may pay the given total against
+	// the client's spending budget
+	AuthorizePayment(context.Context, rm.ClientDealState, abi.TokenAmount) error
+	// RecordPayment records the payment last authorized for the deal as
+	// spent, once its voucher has been created
+	RecordPayment(context.Context, rm.ClientDealState) error
+	// LeaseLane leases a lane of the payment channel for the deal, returning
+	// what the vouchers on the lane already add up to
+	LeaseLane(context.Context, rm.DealID, address.Address) (uint64, abi.TokenAmount, error)
 }
 
 // ProposeDeal sends the proposal to the other party
@@ -41,8 +50,9 @@ func ProposeDeal(ctx fsm.Context, environment ClientDealEnvironment, deal rm.Cli
 
 // SetupPaymentChannelStart initiates setting up a payment channel for a deal
 func SetupPaymentChannelStart(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientDealState) error {
-	// If the total funds required for the deal are zero, skip creating the payment channel
-	if deal.TotalFunds.IsZero() {
+	// If the deal is free, or the total funds required for the deal are
+	// zero, skip creating the payment channel
+	if deal.Free || deal.TotalFunds.IsZero() {
 		return ctx.Trigger(rm.ClientEventPaymentChannelSkip)
 	}
 
@@ -77,11 +87,11 @@ func WaitPaymentChannelReady(ctx fsm.Context, environment ClientDealEnvironment,
 
 // AllocateLane allocates a lane for this retrieval operation
 func AllocateLane(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientDealState) error {
-	lane, err := environment.Node().AllocateLane(ctx.Context(), deal.PaymentInfo.PayCh)
+	lane, laneBase, err := environment.LeaseLane(ctx.Context(), deal.ID, deal.PaymentInfo.PayCh)
 	if err != nil {
 		return ctx.Trigger(rm.ClientEventAllocateLaneErrored, err)
 	}
-	return ctx.Trigger(rm.ClientEventLaneAllocated, lane)
+	return ctx.Trigger(rm.ClientEventLaneAllocated, lane, laneBase)
 }
 
 // Ongoing just double checks that we may need to move out of the ongoing state cause a payment was previously requested
@@ -97,6 +107,11 @@ func Ongoing(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientD
 
 // ProcessPaymentRequested processes a request for payment from the provider
 func ProcessPaymentRequested(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientDealState) error {
+	// A free retrieval has no payment channel to pay from
+	if deal.Free {
+		return ctx.Trigger(rm.ClientEventBadPaymentRequested, "provider requested payment for a free retrieval")
+	}
+
 	// If the unseal payment hasn't been made, we need to send funds
 	if deal.UnsealPrice.GreaterThan(deal.UnsealFundsPaid) {
 		log.Debugf("client: payment needed: unseal price %d > unseal paid %d",
@@ -170,8 +185,20 @@ func SendFunds(ctx fsm.Context, environment ClientDealEnvironment, deal rm.Clien
 	log.Debugf("client: sending voucher for %d = transfer price %d + unseal price %d (payment requested %d)",
 		totalPrice, transferPrice, deal.UnsealPrice, deal.PaymentRequested)
 
-	// Create a payment voucher
-	voucher, err := environment.Node().CreatePaymentVoucher(ctx.Context(), deal.PaymentInfo.PayCh, totalPrice, deal.PaymentInfo.Lane, tok)
+	// Check the payment against the spending budget
+	err = environment.AuthorizePayment(ctx.Context(), deal, totalPrice)
+	if err != nil {
+		return ctx.Trigger(rm.ClientEventBudgetExceeded, err)
+	}
+
+	// Create a payment voucher. The vouchers on a lane add up, so when the
+	// lane was reused from an earlier deal the voucher is for what the lane
+	// added up to before this deal plus what this deal has to pay.
+	voucherAmt := totalPrice
+	if !deal.PaymentInfo.LaneBase.Nil() {
+		voucherAmt = big.Add(deal.PaymentInfo.LaneBase, totalPrice)
+	}
+	voucher, err := environment.Node().CreatePaymentVoucher(ctx.Context(), deal.PaymentInfo.PayCh, voucherAmt, deal.PaymentInfo.Lane, tok)
 	if err != nil {
 		shortfallErr, ok := err.(rm.ShortfallError)
 		if ok {
@@ -185,6 +212,12 @@ func SendFunds(ctx fsm.Context, environment ClientDealEnvironment, deal rm.Clien
 		return ctx.Trigger(rm.ClientEventCreateVoucherFailed, err)
 	}
 
+	// The voucher exists, so the payment counts against the spending budget
+	err = environment.RecordPayment(ctx.Context(), deal)
+	if err != nil {
+		return ctx.Trigger(rm.ClientEventCreateVoucherFailed, err)
+	}
+
 	// Send the payment voucher
 	err = environment.SendDataTransferVoucher(ctx.Context(), *deal.ChannelID, &rm.DealPayment{
 		ID:             deal.DealProposal.ID,
@@ -38,6 +38,11 @@ type fakeEnvironment struct {
 	SendDataTransferVoucherError error
 	CloseDataTransferError       error
 	FinalizeBlockstoreError      error
+	AuthorizePaymentError        error
+	RecordPaymentError           error
+	recordedPayments             int
+	LaneBase                     abi.TokenAmount
+	onVoucher                    func(*rm.DealPayment)
 }
 
 func (e *fakeEnvironment) Node() retrievalmarket.RetrievalClientNode {
@@ -48,7 +53,10 @@ func (e *fakeEnvironment) OpenDataTransfer(ctx context.Context, to peer.ID, prop
 	return datatransfer.ChannelID{ID: datatransfer.TransferID(rand.Uint64()), Responder: to, Initiator: testnet.GeneratePeers(1)[0]}, e.OpenDataTransferError
 }
 
-func (e *fakeEnvironment) SendDataTransferVoucher(_ context.Context, _ datatransfer.ChannelID, _ *rm.DealPayment, _ bool) error {
+func (e *fakeEnvironment) SendDataTransferVoucher(_ context.Context, _ datatransfer.ChannelID, payment *rm.DealPayment, _ bool) error {
+	if e.onVoucher != nil {
+		e.onVoucher(payment)
+	}
 	return e.SendDataTransferVoucherError
 }
 
@@ -60,6 +68,23 @@ func (e *fakeEnvironment) FinalizeBlockstore(ctx context.Context, id rm.DealID)
 	return e.FinalizeBlockstoreError
 }
 
+func (e *fakeEnvironment) LeaseLane(ctx context.Context, _ rm.DealID, paymentChannel address.Address) (uint64, abi.TokenAmount, error) {
+	lane, err := e.node.AllocateLane(ctx, paymentChannel)
+	if e.LaneBase.Nil() {
+		return lane, big.Zero(), err
+	}
+	return lane, e.LaneBase, err
+}
+
+func (e *fakeEnvironment) AuthorizePayment(_ context.Context, _ rm.ClientDealState, _ abi.TokenAmount) error {
+	return e.AuthorizePaymentError
+}
+
+func (e *fakeEnvironment) RecordPayment(_ context.Context, _ rm.ClientDealState) error {
+	e.recordedPayments++
+	return e.RecordPaymentError
+}
+
 func TestProposeDeal(t *testing.T) {
 	ctx := context.Background()
 	node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
@@ -174,6 +199,17 @@ func TestSetupPaymentChannel(t *testing.T) {
 		assert.Empty(t, dealState.Message)
 		assert.Equal(t, dealState.Status, retrievalmarket.DealStatusOngoing)
 	})
+
+	t.Run("payment channel skip if deal is free", func(t *testing.T) {
+		envParams := testnodes.TestRetrievalClientNodeParams{
+			PayChErr: errors.New("payment channel should not be created"),
+		}
+		dealState := makeDealState(retrievalmarket.DealStatusAccepted)
+		dealState.Free = true
+		runSetupPaymentChannel(t, envParams, dealState)
+		assert.Empty(t, dealState.Message)
+		assert.Equal(t, dealState.Status, retrievalmarket.DealStatusOngoing)
+	})
 }
 
 func TestWaitForPaymentReady(t *testing.T) {
@@ -238,9 +274,10 @@ func TestAllocateLane(t *testing.T) {
 	require.NoError(t, err)
 	runAllocateLane := func(t *testing.T,
 		params testnodes.TestRetrievalClientNodeParams,
-		dealState *retrievalmarket.ClientDealState) {
+		dealState *retrievalmarket.ClientDealState,
+		laneBase abi.TokenAmount) {
 		node := testnodes.NewTestRetrievalClientNode(params)
-		environment := &fakeEnvironment{node: node}
+		environment := &fakeEnvironment{node: node, LaneBase: laneBase}
 		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
 		err := clientstates.AllocateLane(fsmCtx, environment, *dealState)
 		require.NoError(t, err)
@@ -252,9 +289,21 @@ func TestAllocateLane(t *testing.T) {
 		params := testnodes.TestRetrievalClientNodeParams{
 			Lane: expectedLane,
 		}
-		runAllocateLane(t, params, dealState)
+		runAllocateLane(t, params, dealState, abi.TokenAmount{})
 		require.Equal(t, retrievalmarket.DealStatusOngoing, dealState.Status)
 		require.Equal(t, expectedLane, dealState.PaymentInfo.Lane)
+		require.Equal(t, big.Zero(), dealState.PaymentInfo.LaneBase)
+	})
+
+	t.Run("it records the base of a reused lane", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusPaymentChannelAllocatingLane)
+		params := testnodes.TestRetrievalClientNodeParams{
+			Lane: expectedLane,
+		}
+		runAllocateLane(t, params, dealState, abi.NewTokenAmount(5000))
+		require.Equal(t, retrievalmarket.DealStatusOngoing, dealState.Status)
+		require.Equal(t, expectedLane, dealState.PaymentInfo.Lane)
+		require.Equal(t, abi.NewTokenAmount(5000), dealState.PaymentInfo.LaneBase)
 	})
 
 	t.Run("if AllocateLane fails", func(t *testing.T) {
@@ -262,7 +311,7 @@ func TestAllocateLane(t *testing.T) {
 		params := testnodes.TestRetrievalClientNodeParams{
 			LaneError: errors.New("boom"),
 		}
-		runAllocateLane(t, params, dealState)
+		runAllocateLane(t, params, dealState, abi.TokenAmount{})
 		require.Contains(t, dealState.Message, "boom")
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailing)
 	})
@@ -369,6 +418,15 @@ func TestProcessPaymentRequested(t *testing.T) {
 		runProcessPaymentRequested(t, dealState)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFundsNeeded)
 	})
+
+	t.Run("fail if deal is free", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusFundsNeeded)
+		dealState.Free = true
+		dealState.TotalReceived = 1000
+		runProcessPaymentRequested(t, dealState)
+		require.Equal(t, retrievalmarket.DealStatusFailing, dealState.Status)
+		require.Equal(t, "provider requested payment for a free retrieval", dealState.Message)
+	})
 }
 
 func TestSendFunds(t *testing.T) {
@@ -421,6 +479,40 @@ func TestSendFunds(t *testing.T) {
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusOngoing)
 	})
 
+	t.Run("send funds on a reused lane", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusSendFunds)
+		var sent *paych.SignedVoucher
+		nodeParams := testnodes.TestRetrievalClientNodeParams{
+			Voucher: testVoucher,
+		}
+		dealState.PaymentInfo.LaneBase = abi.NewTokenAmount(5000)
+		dealState.PricePerByte = abi.NewTokenAmount(1)
+		dealState.UnsealPrice = abi.NewTokenAmount(200)
+		dealState.UnsealFundsPaid = abi.NewTokenAmount(200)
+		dealState.BytesPaidFor = 800
+		dealState.FundsSpent = abi.NewTokenAmount(1000)
+		dealState.PaymentRequested = abi.NewTokenAmount(500)
+		dealState.CurrentInterval = 1000
+		dealState.PaymentInterval = 1000
+		dealState.PaymentIntervalIncrease = 100
+		dealState.TotalReceived = 1000
+
+		// The voucher is for 6200 = lane base 5000 + transfer price (1000 * 1)
+		// + unseal price 200, but the deal has only spent 1200
+		node := testnodes.NewTestRetrievalClientNode(nodeParams)
+		environment := &fakeEnvironment{node: node}
+		environment.onVoucher = func(payment *rm.DealPayment) { sent = payment.PaymentVoucher }
+		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
+		dealState.ChannelID = &datatransfer.ChannelID{Initiator: "initiator", Responder: dealState.Sender, ID: 1}
+		require.NoError(t, clientstates.SendFunds(fsmCtx, environment, *dealState))
+		fsmCtx.ReplayEvents(t, dealState)
+		require.Empty(t, dealState.Message)
+		require.Equal(t, abi.NewTokenAmount(6200), sent.Amount)
+		require.Equal(t, abi.NewTokenAmount(1200), dealState.FundsSpent)
+		require.EqualValues(t, 1000, dealState.BytesPaidFor)
+		require.Equal(t, retrievalmarket.DealStatusOngoing, dealState.Status)
+	})
+
 	t.Run("send funds last payment", func(t *testing.T) {
 		dealState := makeDealState(retrievalmarket.DealStatusSendFundsLastPayment)
 		var sendVoucherError error = nil
@@ -634,6 +726,59 @@ func TestSendFunds(t *testing.T) {
 		require.NotEmpty(t, dealState.Message)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusErroring)
 	})
+
+	t.Run("payment blocked by spending budget", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusSendFunds)
+		dealState.PricePerByte = abi.NewTokenAmount(1)
+		dealState.UnsealPrice = abi.NewTokenAmount(0)
+		dealState.UnsealFundsPaid = abi.NewTokenAmount(0)
+		dealState.BytesPaidFor = 0
+		dealState.FundsSpent = abi.NewTokenAmount(0)
+		dealState.PaymentRequested = abi.NewTokenAmount(1000)
+		dealState.CurrentInterval = 1000
+		dealState.TotalReceived = 1000
+		dealState.ChannelID = &datatransfer.ChannelID{Initiator: "initiator", Responder: dealState.Sender, ID: 1}
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{Voucher: testVoucher})
+		environment := &fakeEnvironment{node: node, AuthorizePaymentError: errors.New("over the daily cap")}
+		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
+		err := clientstates.SendFunds(fsmCtx, environment, *dealState)
+		require.NoError(t, err)
+		fsmCtx.ReplayEvents(t, dealState)
+		require.Contains(t, dealState.Message, "spending budget")
+		require.True(t, dealState.FundsSpent.IsZero())
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailing)
+	})
+
+	t.Run("payment is recorded against the budget once the voucher exists", func(t *testing.T) {
+		run := func(nodeParams testnodes.TestRetrievalClientNodeParams, recordErr error) (*retrievalmarket.ClientDealState, *fakeEnvironment) {
+			dealState := makeDealState(retrievalmarket.DealStatusSendFunds)
+			dealState.PricePerByte = abi.NewTokenAmount(1)
+			dealState.UnsealPrice = abi.NewTokenAmount(0)
+			dealState.UnsealFundsPaid = abi.NewTokenAmount(0)
+			dealState.BytesPaidFor = 0
+			dealState.FundsSpent = abi.NewTokenAmount(0)
+			dealState.PaymentRequested = abi.NewTokenAmount(1000)
+			dealState.CurrentInterval = 1000
+			dealState.TotalReceived = 1000
+			dealState.ChannelID = &datatransfer.ChannelID{Initiator: "initiator", Responder: dealState.Sender, ID: 1}
+			environment := &fakeEnvironment{node: testnodes.NewTestRetrievalClientNode(nodeParams), RecordPaymentError: recordErr}
+			fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
+			require.NoError(t, clientstates.SendFunds(fsmCtx, environment, *dealState))
+			fsmCtx.ReplayEvents(t, dealState)
+			return dealState, environment
+		}
+
+		dealState, environment := run(testnodes.TestRetrievalClientNodeParams{Voucher: testVoucher}, nil)
+		require.Equal(t, 1, environment.recordedPayments)
+		require.Equal(t, retrievalmarket.DealStatusOngoing, dealState.Status)
+
+		_, environment = run(testnodes.TestRetrievalClientNodeParams{VoucherError: errors.New("Something Went Wrong")}, nil)
+		require.Zero(t, environment.recordedPayments)
+
+		dealState, _ = run(testnodes.TestRetrievalClientNodeParams{Voucher: testVoucher}, errors.New("datastore closed"))
+		require.Contains(t, dealState.Message, "datastore closed")
+		require.Equal(t, retrievalmarket.DealStatusFailing, dealState.Status)
+	})
 }
 
 func TestCheckFunds(t *testing.T) {
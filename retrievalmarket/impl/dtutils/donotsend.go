@@ -0,0 +1,85 @@
+package dtutils
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/cidset"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+type doNotSendKey struct {
+	p    peer.ID
+	root cid.Cid
+}
+
+// DoNotSendExchange wraps a graphsync exchange so that a retrieval client
+// can tell the provider not to send blocks it already has. The data
+// transfer transport of the client must be constructed with the wrapped
+// exchange, and the client with the ResumeFromBlockstore option.
+//
+// Requests are matched to the blocks to skip by peer and root CID. A client
+// only runs one deal at a time for a given peer and payload, so this
+// identifies the deal the request is for.
+type DoNotSendExchange struct {
+	graphsync.GraphExchange
+
+	lk   sync.Mutex
+	skip map[doNotSendKey]*cid.Set
+}
+
+var _ graphsync.GraphExchange = (*DoNotSendExchange)(nil)
+
+// NewDoNotSendExchange wraps the given graphsync exchange
+func NewDoNotSendExchange(gs graphsync.GraphExchange) *DoNotSendExchange {
+	return &DoNotSendExchange{
+		GraphExchange: gs,
+		skip:          make(map[doNotSendKey]*cid.Set),
+	}
+}
+
+// DoNotSend adds the given CIDs to the do-not-send list of requests to the
+// peer for the DAG under root, until the returned function is called
+func (e *DoNotSendExchange) DoNotSend(p peer.ID, root cid.Cid, cids *cid.Set) func() {
+	key := doNotSendKey{p: p, root: root}
+	e.lk.Lock()
+	e.skip[key] = cids
+	e.lk.Unlock()
+	return func() {
+		e.lk.Lock()
+		defer e.lk.Unlock()
+		if e.skip[key] == cids {
+			delete(e.skip, key)
+		}
+	}
+}
+
+// Request initiates a graphsync request, adding the do-not-send list for
+// the peer and root if there is one
+func (e *DoNotSendExchange) Request(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	if lnk, ok := root.(cidlink.Link); ok {
+		e.lk.Lock()
+		cids, ok := e.skip[doNotSendKey{p: p, root: lnk.Cid}]
+		e.lk.Unlock()
+		if ok && cids.Len() > 0 && !hasExtension(extensions, graphsync.ExtensionDoNotSendCIDs) {
+			extensions = append(extensions, graphsync.ExtensionData{
+				Name: graphsync.ExtensionDoNotSendCIDs,
+				Data: cidset.EncodeCidSet(cids),
+			})
+		}
+	}
+	return e.GraphExchange.Request(ctx, p, root, selector, extensions...)
+}
+
+func hasExtension(extensions []graphsync.ExtensionData, name graphsync.ExtensionName) bool {
+	for _, ext := range extensions {
+		if ext.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -94,7 +94,7 @@ func clientEventForResponse(response *rm.DealResponse) (rm.ClientEvent, []interf
 	case rm.DealStatusFundsNeeded, rm.DealStatusOngoing:
 		return rm.ClientEventPaymentRequested, []interface{}{response.PaymentOwed}
 	default:
-		return rm.ClientEventUnknownResponseReceived, []interface{}{response.Status}
+		return rm.ClientEventUnknownResponseReceived, []interface{}{response.Status, response.Message}
 	}
 }
 
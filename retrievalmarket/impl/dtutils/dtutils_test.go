@@ -6,9 +6,14 @@ import (
 	"math/rand"
 	"testing"
 
+	"github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/cidset"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
 	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/require"
 
@@ -302,7 +307,21 @@ func TestClientDataTransferSubscriber(t *testing.T) {
 				Status: datatransfer.Ongoing},
 			expectedID:    dealProposal.ID,
 			expectedEvent: rm.ClientEventUnknownResponseReceived,
-			expectedArgs:  []interface{}{retrievalmarket.DealStatusPaymentChannelAddingFunds},
+			expectedArgs:  []interface{}{retrievalmarket.DealStatusPaymentChannelAddingFunds, ""},
+		},
+		"new voucher result - provider errored": {
+			code: datatransfer.NewVoucherResult,
+			state: shared_testutil.TestChannelParams{
+				Vouchers: []datatransfer.Voucher{&dealProposal},
+				VoucherResults: []datatransfer.VoucherResult{&retrievalmarket.DealResponse{
+					Status:  retrievalmarket.DealStatusErrored,
+					ID:      dealProposal.ID,
+					Message: "over the limit of 1000 bytes per day",
+				}},
+				Status: datatransfer.Ongoing},
+			expectedID:    dealProposal.ID,
+			expectedEvent: rm.ClientEventUnknownResponseReceived,
+			expectedArgs:  []interface{}{retrievalmarket.DealStatusErrored, "over the limit of 1000 bytes per day"},
 		},
 		"error": {
 			code:    datatransfer.Error,
@@ -505,3 +524,42 @@ func (fgt *fakeGsTransport) UseStore(channelID datatransfer.ChannelID, lsys ipld
 	fgt.called = true
 	return nil
 }
+
+func TestDoNotSendExchange(t *testing.T) {
+	ctx := context.Background()
+	peers := shared_testutil.GeneratePeers(2)
+	cids := shared_testutil.GenerateCids(3)
+	root := cidlink.Link{Cid: cids[0]}
+	have := cid.NewSet()
+	have.Add(cids[1])
+	have.Add(cids[2])
+
+	fgs := &fakeGraphExchange{}
+	exchange := dtutils.NewDoNotSendExchange(fgs)
+	release := exchange.DoNotSend(peers[0], root.Cid, have)
+
+	// requests to other peers are left alone
+	exchange.Request(ctx, peers[1], root, selectorparse.CommonSelector_ExploreAllRecursively)
+	require.Empty(t, fgs.extensions)
+
+	exchange.Request(ctx, peers[0], root, selectorparse.CommonSelector_ExploreAllRecursively)
+	require.Len(t, fgs.extensions, 1)
+	require.Equal(t, graphsync.ExtensionDoNotSendCIDs, fgs.extensions[0].Name)
+	skipped, err := cidset.DecodeCidSet(fgs.extensions[0].Data)
+	require.NoError(t, err)
+	require.ElementsMatch(t, have.Keys(), skipped.Keys())
+
+	release()
+	exchange.Request(ctx, peers[0], root, selectorparse.CommonSelector_ExploreAllRecursively)
+	require.Empty(t, fgs.extensions)
+}
+
+type fakeGraphExchange struct {
+	graphsync.GraphExchange
+	extensions []graphsync.ExtensionData
+}
+
+func (fgs *fakeGraphExchange) Request(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	fgs.extensions = extensions
+	return nil, nil
+}
@@ -0,0 +1,475 @@
+package retrievalimpl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/aggregate"
+	"github.com/filecoin-project/go-fil-markets/piecestore"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/ratelimit"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/unsealqueue"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+// HTTPRetrieval makes the provider serve retrievals over HTTP on the given
+// listener, for clients that can't use graphsync, from when it starts until
+// it stops. Two kinds of request are served:
+//
+//	GET /ipfs/{cid}[/{path}][?selector={selector}&piece={pieceCid}]
+//
+// returns a CARv1 of the blocks of the DAG under the payload CID matched by
+// the selector, which is the DAG-JSON of an IPLD selector and defaults to
+// the whole DAG. The path, if given, is a path of IPLD data model fields to
+// follow from the root before applying the selector. The piece parameter
+// picks which piece to retrieve the payload from.
+//
+//	GET /piece/{pieceCid}
+//
+// returns the raw bytes of the piece. If the provider was given a locator
+// of aggregate sub-pieces with AggregateSubPieces, the piece may also be a
+// sub-piece of an aggregate piece, in which case the range of the aggregate
+// holding the sub-piece's data is returned.
+//
+// HTTP clients can't pay for a retrieval, so the provider only serves a
+// retrieval over HTTP if the free retrieval policy applies to it or its
+// pricing function prices it at zero, and the deal decider accepts it. HTTP
+// clients have no peer ID, so the policy, pricing function and decider see
+// an empty client peer.
+//
+// Retrievals over HTTP count towards the provider's rate limits, as deals
+// from the empty peer, so the per peer limits apply to all HTTP clients
+// together. A request over the limits on concurrent deals or bytes per day
+// is refused with 429 Too Many Requests. A request for a piece with no
+// unsealed copy waits its turn in the unseal queue, at the lowest priority
+// since it pays nothing for the unseal.
+func HTTPRetrieval(listener net.Listener) RetrievalProviderOption {
+	return func(provider *Provider) {
+		provider.httpListener = listener
+	}
+}
+
+const carContentType = "application/vnd.ipld.car; version=1"
+
+// startHTTP starts serving retrievals over HTTP, if configured to
+func (p *Provider) startHTTP() {
+	if p.httpListener == nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ipfs/", p.handleHTTPPayload)
+	mux.HandleFunc("/piece/", p.handleHTTPPiece)
+	p.httpServer = &http.Server{Handler: mux}
+	go func() {
+		err := p.httpServer.Serve(p.httpListener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("serving HTTP retrievals: %s", err)
+		}
+	}()
+}
+
+// stopHTTP stops serving retrievals over HTTP
+func (p *Provider) stopHTTP() error {
+	if p.httpServer == nil {
+		return nil
+	}
+	return p.httpServer.Close()
+}
+
+// handleHTTPPayload serves a CAR of the DAG under a payload CID
+func (p *Provider) handleHTTPPayload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), "/ipfs/"), "/"), "/")
+	payloadCID, err := cid.Parse(segments[0])
+	if err != nil {
+		http.Error(w, "invalid payload CID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	sel, err := httpSelector(segments[1:], r.URL.Query().Get("selector"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	buf := new(bytes.Buffer)
+	err = dagcbor.Encode(sel, buf)
+	if err != nil {
+		http.Error(w, "encoding selector: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	encodedSel := &cbg.Deferred{Raw: buf.Bytes()}
+
+	pieceCID := cid.Undef
+	if piece := r.URL.Query().Get("piece"); piece != "" {
+		pieceCID, err = cid.Parse(piece)
+		if err != nil {
+			http.Error(w, "invalid piece CID: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	pieces, piecesErr := p.getAllPieceInfoForPayload(payloadCID)
+	pieceInfo, isUnsealed := p.getBestPieceInfoMatch(ctx, pieces, pieceCID)
+	if !pieceInfo.Defined() {
+		if piecesErr != nil && !errors.Is(piecesErr, retrievalmarket.ErrNotFound) {
+			http.Error(w, "failed to fetch piece to retrieve from: "+piecesErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "no piece found for payload "+payloadCID.String(), http.StatusNotFound)
+		return
+	}
+
+	payloadSize, err := p.selectorPayloadSize(ctx, payloadCID, pieceInfo.PieceCID, isUnsealed, encodedSel)
+	if err != nil {
+		log.Warnf("HTTP retrieval: measuring selector size: %s", err)
+	}
+	storageDeals := p.storageDealsForPiece(pieceCID.Defined(), pieces, pieceInfo)
+	state := httpDealState(payloadCID, pieceInfo, encodedSel)
+	if status, err := p.authorizeHTTP(ctx, state, storageDeals, payloadSize, isUnsealed); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	id, done, status, err := p.admitHTTP(ctx, pieceInfo.PieceCID, isUnsealed)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer done()
+
+	// loading the shard unseals the piece if need be
+	bs, err := p.dagStore.LoadShard(ctx, pieceInfo.PieceCID)
+	p.unsealQueue.Done(id)
+	if err != nil {
+		http.Error(w, "loading blockstore for piece: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer bs.Close() //nolint:errcheck
+	has, err := bs.Has(ctx, payloadCID)
+	if err != nil {
+		http.Error(w, "checking for payload root: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !has {
+		http.Error(w, "payload "+payloadCID.String()+" not found in piece", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", carContentType)
+	sc := car.NewSelectiveCar(ctx, bs, []car.Dag{{Root: payloadCID, Selector: sel}}, car.TraverseLinksOnlyOnce())
+	err = sc.Write(p.httpWriter(ctx, w, id))
+	if err != nil {
+		// the response has already started, so all we can do is stop
+		log.Warnf("HTTP retrieval of %s: writing CAR: %s", payloadCID, err)
+	}
+}
+
+// handleHTTPPiece serves the raw bytes of a piece
+func (p *Provider) handleHTTPPiece(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+
+	pieceCID, err := cid.Parse(strings.Trim(strings.TrimPrefix(r.URL.Path, "/piece/"), "/"))
+	if err != nil {
+		http.Error(w, "invalid piece CID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	pieceInfo, subPiece, err := p.httpPieceInfo(ctx, pieceCID)
+	if err != nil {
+		if errors.Is(err, retrievalmarket.ErrNotFound) {
+			http.Error(w, "piece "+pieceCID.String()+" not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to fetch piece: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(pieceInfo.Deals) == 0 {
+		http.Error(w, "no storage deals for piece "+pieceInfo.PieceCID.String(), http.StatusNotFound)
+		return
+	}
+
+	// the range of the piece to serve, which for a sub-piece is its data in
+	// the aggregate piece
+	span := func(di piecestore.DealInfo) (abi.UnpaddedPieceSize, abi.UnpaddedPieceSize) {
+		if subPiece != nil {
+			return di.Offset.Unpadded() + abi.UnpaddedPieceSize(subPiece.UnpaddedOffset()), subPiece.Size.Unpadded()
+		}
+		return di.Offset.Unpadded(), di.Length.Unpadded()
+	}
+
+	// prefer a deal in a sector that is already unsealed
+	deal := pieceInfo.Deals[0]
+	isUnsealed := false
+	for _, di := range pieceInfo.Deals {
+		offset, size := span(di)
+		unsealed, err := p.sa.IsUnsealed(ctx, di.SectorID, offset, size)
+		if err != nil {
+			log.Errorf("failed to find out if sector %d is unsealed, err=%s", di.SectorID, err)
+			continue
+		}
+		if unsealed {
+			deal, isUnsealed = di, true
+			break
+		}
+	}
+
+	offset, size := span(deal)
+	state := httpDealState(cid.Undef, pieceInfo, nil)
+	if status, err := p.authorizeHTTP(ctx, state, dealsFromPieces([]piecestore.PieceInfo{pieceInfo}), uint64(size), isUnsealed); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// the piece is read as it is unsealed, so the retrieval holds its place
+	// in the unseal queue until it is done
+	id, done, status, err := p.admitHTTP(ctx, pieceInfo.PieceCID, isUnsealed)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer done()
+
+	rd, err := p.sa.UnsealSector(ctx, deal.SectorID, offset, size)
+	if err != nil {
+		http.Error(w, "unsealing piece: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rd.Close() //nolint:errcheck
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatUint(uint64(size), 10))
+	_, err = io.Copy(p.httpWriter(ctx, w, id), rd)
+	if err != nil {
+		log.Warnf("HTTP retrieval of piece %s: %s", pieceCID, err)
+	}
+}
+
+// httpPieceInfo looks up the piece with the given CID. A piece the provider
+// does not store may be a sub-piece of an aggregate piece it does store, in
+// which case the aggregate's piece info is returned along with the
+// sub-piece's entry in the aggregate index.
+func (p *Provider) httpPieceInfo(ctx context.Context, pieceCID cid.Cid) (piecestore.PieceInfo, *aggregate.Entry, error) {
+	pieceInfo, err := p.pieceStore.GetPieceInfo(pieceCID)
+	if err == nil || !errors.Is(err, retrievalmarket.ErrNotFound) || p.locateSubPiece == nil {
+		return pieceInfo, nil, err
+	}
+
+	idx, ok, lerr := p.locateSubPiece(ctx, pieceCID)
+	if lerr != nil {
+		return piecestore.PieceInfo{}, nil, xerrors.Errorf("failed to locate sub-piece %s: %w", pieceCID, lerr)
+	}
+	if !ok {
+		return piecestore.PieceInfo{}, nil, err
+	}
+	e, ok := idx.Find(pieceCID)
+	if !ok {
+		return piecestore.PieceInfo{}, nil, xerrors.Errorf("sub-piece %s is missing from the index of aggregate %s: %w", pieceCID, idx.PieceCID, retrievalmarket.ErrNotFound)
+	}
+	pieceInfo, err = p.pieceStore.GetPieceInfo(idx.PieceCID)
+	if err != nil {
+		return piecestore.PieceInfo{}, nil, xerrors.Errorf("failed to fetch aggregate piece %s: %w", idx.PieceCID, err)
+	}
+	return pieceInfo, &e, nil
+}
+
+// authorizeHTTP decides whether to serve a retrieval over HTTP, and if not
+// returns the HTTP status to respond with and why
+func (p *Provider) authorizeHTTP(ctx context.Context, state retrievalmarket.ProviderDealState, storageDeals []abi.DealID, payloadSize uint64, isUnsealed bool) (int, error) {
+	pieceCID := state.PieceInfo.PieceCID
+	free, err := p.freeRetrievalRequired(ctx, "", state.PayloadCID, pieceCID)
+	if err != nil {
+		return http.StatusInternalServerError, xerrors.Errorf("failed to check free retrieval policy: %w", err)
+	}
+	if !free {
+		ask, err := p.GetDynamicAsk(ctx, retrievalmarket.PricingInput{
+			PieceCID:    pieceCID,
+			PayloadCID:  state.PayloadCID,
+			PayloadSize: payloadSize,
+			Unsealed:    isUnsealed,
+		}, storageDeals)
+		if err != nil {
+			return http.StatusInternalServerError, xerrors.Errorf("failed to price retrieval: %w", err)
+		}
+		if !ask.PricePerByte.IsZero() || !ask.UnsealPrice.IsZero() {
+			return http.StatusPaymentRequired, xerrors.New("retrieval is not free, retrieve it over graphsync to pay for it")
+		}
+	}
+
+	if p.dealDecider != nil {
+		accepted, reason, err := p.dealDecider(ctx, state)
+		if err != nil {
+			return http.StatusInternalServerError, xerrors.Errorf("deal decider: %w", err)
+		}
+		if !accepted {
+			return http.StatusForbidden, errors.New(reason)
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// admitHTTP admits a retrieval over HTTP under the provider's rate limits,
+// and if the piece has no unsealed copy waits for the unseal queue to let
+// it be unsealed. It returns the identifier the retrieval is counted under
+// and a function to call when the retrieval ends, or the HTTP status to
+// respond with and why the retrieval can't be served.
+func (p *Provider) admitHTTP(ctx context.Context, pieceCID cid.Cid, isUnsealed bool) (retrievalmarket.ProviderDealIdentifier, func(), int, error) {
+	id := retrievalmarket.ProviderDealIdentifier{
+		DealID: retrievalmarket.DealID(atomic.AddUint64(&p.httpDeals, 1)),
+	}
+	if p.limiter != nil {
+		if err := p.limiter.Admit(id); err != nil {
+			return id, nil, http.StatusTooManyRequests, err
+		}
+	}
+	done := func() {
+		p.unsealQueue.Done(id)
+		p.releaseLimits(id)
+	}
+	if isUnsealed {
+		return id, done, http.StatusOK, nil
+	}
+
+	started := make(chan struct{})
+	p.unsealQueue.Push(&unsealqueue.Job{
+		Deal:        id,
+		PieceCID:    pieceCID,
+		UnsealPrice: big.Zero(),
+		Queued: func(position int) {
+			log.Infow("HTTP retrieval queued for unseal", "piece", pieceCID, "position", position)
+		},
+		Start: func() { close(started) },
+	})
+	select {
+	case <-started:
+		return id, done, http.StatusOK, nil
+	case <-ctx.Done():
+		done()
+		return id, nil, http.StatusServiceUnavailable, xerrors.Errorf("waiting to unseal piece: %w", ctx.Err())
+	}
+}
+
+// httpWriter counts what is written for a retrieval over HTTP against the
+// provider's rate limits, if any
+func (p *Provider) httpWriter(ctx context.Context, w io.Writer, id retrievalmarket.ProviderDealIdentifier) io.Writer {
+	if p.limiter == nil {
+		return w
+	}
+	return &limitedWriter{ctx: ctx, w: w, limiter: p.limiter, id: id, clock: p.clock}
+}
+
+// limitedWriter waits after each write to stay under the limits on bytes
+// per second, and fails once a write takes the retrieval over a limit on
+// bytes per day. Unlike a graphsync transfer, a retrieval over HTTP has a
+// goroutine of its own to wait on.
+type limitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *ratelimit.Limiter
+	id      retrievalmarket.ProviderDealIdentifier
+	clock   shared.Clock
+}
+
+func (lw *limitedWriter) Write(b []byte) (int, error) {
+	n, err := lw.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	wait, err := lw.limiter.Sent(lw.id, uint64(n))
+	if err != nil {
+		return n, err
+	}
+	if wait > 0 {
+		select {
+		case <-lw.clock.After(wait):
+		case <-lw.ctx.Done():
+			return n, lw.ctx.Err()
+		}
+	}
+	return n, nil
+}
+
+// httpDealState describes a retrieval over HTTP as a free deal, for the
+// deal decider
+func httpDealState(payloadCID cid.Cid, pieceInfo piecestore.PieceInfo, sel *cbg.Deferred) retrievalmarket.ProviderDealState {
+	return retrievalmarket.ProviderDealState{
+		DealProposal: retrievalmarket.DealProposal{
+			PayloadCID: payloadCID,
+			Params: retrievalmarket.Params{
+				Selector:     sel,
+				PieceCID:     &pieceInfo.PieceCID,
+				PricePerByte: big.Zero(),
+				UnsealPrice:  big.Zero(),
+				Free:         true,
+			},
+		},
+		PieceInfo: &pieceInfo,
+	}
+}
+
+// httpSelector builds the selector for a retrieval over HTTP, that follows
+// the path and then applies the selector given as DAG-JSON, or selects the
+// whole DAG if none is given
+func httpSelector(path []string, selectorJSON string) (ipld.Node, error) {
+	sel := selectorparse.CommonSelector_ExploreAllRecursively
+	if selectorJSON != "" {
+		var err error
+		sel, err = selectorparse.ParseJSONSelector(selectorJSON)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid selector: %w", err)
+		}
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		field, err := url.PathUnescape(path[i])
+		if err != nil {
+			return nil, xerrors.Errorf("invalid path: %w", err)
+		}
+		if field == "" {
+			continue
+		}
+		inner := sel
+		sel, err = qp.BuildMap(basicnode.Prototype.Any, 1, func(ma datamodel.MapAssembler) {
+			qp.MapEntry(ma, selector.SelectorKey_ExploreFields, qp.Map(1, func(ma datamodel.MapAssembler) {
+				qp.MapEntry(ma, selector.SelectorKey_Fields, qp.Map(1, func(ma datamodel.MapAssembler) {
+					qp.MapEntry(ma, field, qp.Node(inner))
+				}))
+			}))
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("building selector for path: %w", err)
+		}
+	}
+	if _, err := selector.CompileSelector(sel); err != nil {
+		return nil, xerrors.Errorf("invalid selector: %w", err)
+	}
+	return sel, nil
+}
@@ -0,0 +1,250 @@
+package retrievalimpl_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-car"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/aggregate"
+	"github.com/filecoin-project/go-fil-markets/commp"
+	"github.com/filecoin-project/go-fil-markets/piecestore"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	retrievalimpl "github.com/filecoin-project/go-fil-markets/retrievalmarket/impl"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/ratelimit"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/stores"
+)
+
+func TestHTTPRetrieval(t *testing.T) {
+	ctx := context.Background()
+
+	payloadCID, carPath := tut.CreateDenseCARv2(t, filepath.Join(tut.ThisDir(t), "./fixtures/lorem.txt"))
+	carData, err := os.ReadFile(carPath)
+	require.NoError(t, err)
+
+	pieceCID := tut.GenerateCids(1)[0]
+	sectorID := abi.SectorNumber(100000)
+	offset := abi.PaddedPieceSize(1000)
+	length := abi.UnpaddedPieceSize(len(carData))
+	pieceInfo := piecestore.PieceInfo{
+		PieceCID: pieceCID,
+		Deals: []piecestore.DealInfo{
+			{
+				DealID:   abi.DealID(100),
+				SectorID: sectorID,
+				Offset:   offset,
+				Length:   length.Padded(),
+			},
+		},
+	}
+
+	// an aggregate piece in another sector, packing two small pieces
+	var subPieces []aggregate.SubPiece
+	for _, size := range []int{500, 100} {
+		res, err := commp.Compute(ctx, bytes.NewReader(bytes.Repeat([]byte{byte(size)}, size)))
+		require.NoError(t, err)
+		subPieces = append(subPieces, aggregate.SubPiece{PieceCID: res.PieceCID, Size: res.PieceSize})
+	}
+	agg, err := aggregate.New(subPieces, 0)
+	require.NoError(t, err)
+	aggSectorID := abi.SectorNumber(100001)
+	aggInfo := piecestore.PieceInfo{
+		PieceCID: agg.PieceCID,
+		Deals: []piecestore.DealInfo{
+			{
+				DealID:   abi.DealID(101),
+				SectorID: aggSectorID,
+				Offset:   offset,
+				Length:   agg.PieceSize,
+			},
+		},
+	}
+	// the data of the second sub-piece, padded with zeroes to its size
+	subPiece, ok := agg.Find(subPieces[1].PieceCID)
+	require.True(t, ok)
+	subPieceData := make([]byte, subPiece.Size.Unpadded())
+	copy(subPieceData, bytes.Repeat([]byte{100}, 100))
+
+	zeroPrice := func(ctx context.Context, _ retrievalmarket.PricingInput) (retrievalmarket.Ask, error) {
+		return retrievalmarket.Ask{PricePerByte: big.Zero(), UnsealPrice: big.Zero()}, nil
+	}
+	paid := func(ctx context.Context, _ retrievalmarket.PricingInput) (retrievalmarket.Ask, error) {
+		return retrievalmarket.Ask{PricePerByte: abi.NewTokenAmount(1), UnsealPrice: big.Zero()}, nil
+	}
+
+	startProvider := func(t *testing.T, priceFunc retrievalimpl.RetrievalPricingFunc, opts ...retrievalimpl.RetrievalProviderOption) string {
+		pieceStore := tut.NewTestPieceStore()
+		pieceStore.ExpectPiece(pieceCID, pieceInfo)
+		pieceStore.ExpectPiece(agg.PieceCID, aggInfo)
+		pieceStore.ExpectMissingPiece(subPiece.PieceCID)
+		sa := testnodes.NewTestSectorAccessor()
+		sa.StubUnseal(sectorID, offset.Unpadded(), length, carData)
+		sa.StubUnseal(aggSectorID, offset.Unpadded()+abi.UnpaddedPieceSize(subPiece.UnpaddedOffset()), subPiece.Size.Unpadded(), subPieceData)
+		dagStore := tut.NewMockDagStoreWrapper(pieceStore, sa)
+		dagStore.AddBlockToPieceIndex(payloadCID, pieceCID)
+		require.NoError(t, stores.RegisterShardSync(ctx, dagStore, pieceCID, carPath, true))
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		network := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{})
+		opts = append(opts, retrievalimpl.HTTPRetrieval(listener))
+		p, err := retrievalimpl.NewProvider(address.TestAddress2, testnodes.NewTestRetrievalProviderNode(), sa, network, pieceStore, dagStore, tut.NewTestDataTransfer(), ds, priceFunc, opts...)
+		require.NoError(t, err)
+		tut.StartAndWaitForReady(ctx, t, p)
+		t.Cleanup(func() { _ = p.Stop() })
+		return "http://" + listener.Addr().String()
+	}
+
+	get := func(t *testing.T, u string) (int, []byte) {
+		resp, err := http.Get(u)
+		require.NoError(t, err)
+		defer resp.Body.Close() //nolint:errcheck
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, body
+	}
+
+	readCar := func(t *testing.T, data []byte) (roots []cid.Cid, blocks int) {
+		cr, err := car.NewCarReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		for {
+			blk, err := cr.Next()
+			if err != nil {
+				break
+			}
+			require.NotNil(t, blk)
+			blocks++
+		}
+		return cr.Header.Roots, blocks
+	}
+
+	t.Run("serves a CAR of the payload when the ask is free", func(t *testing.T) {
+		base := startProvider(t, zeroPrice)
+		status, body := get(t, base+"/ipfs/"+payloadCID.String())
+		require.Equal(t, http.StatusOK, status, string(body))
+		roots, blocks := readCar(t, body)
+		require.Equal(t, []cid.Cid{payloadCID}, roots)
+		require.Greater(t, blocks, 1)
+
+		// following a path selects part of the DAG
+		status, body = get(t, base+"/ipfs/"+payloadCID.String()+"/Links/0/Hash")
+		require.Equal(t, http.StatusOK, status, string(body))
+		_, partBlocks := readCar(t, body)
+		require.Less(t, partBlocks, blocks)
+
+		// as does a selector
+		status, body = get(t, base+"/ipfs/"+payloadCID.String()+"?selector="+url.QueryEscape(`{".":{}}`))
+		require.Equal(t, http.StatusOK, status, string(body))
+		_, rootBlocks := readCar(t, body)
+		require.Equal(t, 1, rootBlocks)
+	})
+
+	t.Run("serves the raw piece", func(t *testing.T) {
+		base := startProvider(t, zeroPrice)
+		status, body := get(t, base+"/piece/"+pieceCID.String())
+		require.Equal(t, http.StatusOK, status, string(body))
+		require.Equal(t, carData, body)
+	})
+
+	t.Run("serves a sub-piece of an aggregate piece", func(t *testing.T) {
+		base := startProvider(t, zeroPrice, retrievalimpl.AggregateSubPieces(aggregate.IndexLocator(agg.Index)))
+		status, body := get(t, base+"/piece/"+subPiece.PieceCID.String())
+		require.Equal(t, http.StatusOK, status, string(body))
+		require.Equal(t, subPieceData, body)
+
+		// sub-pieces are only looked up with a locator
+		base = startProvider(t, zeroPrice)
+		status, _ = get(t, base+"/piece/"+subPiece.PieceCID.String())
+		require.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("requires payment for a priced ask", func(t *testing.T) {
+		base := startProvider(t, paid)
+		status, _ := get(t, base+"/ipfs/"+payloadCID.String())
+		require.Equal(t, http.StatusPaymentRequired, status)
+		status, _ = get(t, base+"/piece/"+pieceCID.String())
+		require.Equal(t, http.StatusPaymentRequired, status)
+	})
+
+	t.Run("serves a priced ask the free retrieval policy applies to", func(t *testing.T) {
+		base := startProvider(t, paid, retrievalimpl.FreeRetrievalPolicyOpt(
+			func(ctx context.Context, _ peer.ID, _ cid.Cid, _ cid.Cid) (bool, error) {
+				return true, nil
+			}))
+		status, body := get(t, base+"/ipfs/"+payloadCID.String())
+		require.Equal(t, http.StatusOK, status, string(body))
+	})
+
+	t.Run("applies the deal decider", func(t *testing.T) {
+		var decided retrievalmarket.ProviderDealState
+		base := startProvider(t, zeroPrice, retrievalimpl.DealDeciderOpt(
+			func(ctx context.Context, state retrievalmarket.ProviderDealState) (bool, string, error) {
+				decided = state
+				return false, "not today", nil
+			}))
+		status, body := get(t, base+"/ipfs/"+payloadCID.String())
+		require.Equal(t, http.StatusForbidden, status)
+		require.Contains(t, string(body), "not today")
+		require.Equal(t, payloadCID, decided.PayloadCID)
+		require.True(t, decided.Free)
+		require.Equal(t, pieceCID, *decided.PieceCID)
+	})
+
+	t.Run("unseals through the unseal queue", func(t *testing.T) {
+		// each retrieval must leave the queue when it is done, or the next
+		// would wait forever for the single unseal allowed at once
+		base := startProvider(t, zeroPrice, retrievalimpl.MaxConcurrentUnseals(1))
+		for i := 0; i < 2; i++ {
+			status, body := get(t, base+"/ipfs/"+payloadCID.String())
+			require.Equal(t, http.StatusOK, status, string(body))
+			status, body = get(t, base+"/piece/"+pieceCID.String())
+			require.Equal(t, http.StatusOK, status, string(body))
+			require.Equal(t, carData, body)
+		}
+	})
+
+	t.Run("applies the rate limits", func(t *testing.T) {
+		limiter := ratelimit.NewLimiter(ratelimit.Limits{BytesPerDay: uint64(len(carData))}, ratelimit.Limits{})
+		base := startProvider(t, zeroPrice, retrievalimpl.RateLimits(limiter))
+		status, body := get(t, base+"/piece/"+pieceCID.String())
+		require.Equal(t, http.StatusOK, status, string(body))
+		require.Equal(t, carData, body)
+
+		// the first retrieval used up the bytes for the day
+		status, _ = get(t, base+"/ipfs/"+payloadCID.String())
+		require.Equal(t, http.StatusTooManyRequests, status)
+		status, _ = get(t, base+"/piece/"+pieceCID.String())
+		require.Equal(t, http.StatusTooManyRequests, status)
+	})
+
+	t.Run("rejects bad requests", func(t *testing.T) {
+		base := startProvider(t, zeroPrice)
+		status, _ := get(t, base+"/ipfs/"+tut.GenerateCids(1)[0].String())
+		require.Equal(t, http.StatusNotFound, status)
+		status, _ = get(t, base+"/ipfs/notacid")
+		require.Equal(t, http.StatusBadRequest, status)
+		status, _ = get(t, base+"/ipfs/"+payloadCID.String()+"?selector=nonsense")
+		require.Equal(t, http.StatusBadRequest, status)
+		status, _ = get(t, base+"/piece/notacid")
+		require.Equal(t, http.StatusBadRequest, status)
+	})
+}
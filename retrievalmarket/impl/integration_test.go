@@ -13,14 +13,17 @@ import (
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-graphsync"
 	graphsyncimpl "github.com/ipfs/go-graphsync/impl"
 	"github.com/ipfs/go-graphsync/network"
+	"github.com/ipfs/go-merkledag"
 	"github.com/ipld/go-car"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -35,9 +38,12 @@ import (
 	"github.com/filecoin-project/go-fil-markets/piecestore"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	retrievalimpl "github.com/filecoin-project/go-fil-markets/retrievalmarket/impl"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/dtutils"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/ratelimit"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
 	rmnet "github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
 	rmtesting "github.com/filecoin-project/go-fil-markets/retrievalmarket/testing"
+	"github.com/filecoin-project/go-fil-markets/shared"
 	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
 	"github.com/filecoin-project/go-fil-markets/stores"
 )
@@ -227,6 +233,12 @@ func TestClientCanMakeDealWithProvider(t *testing.T) {
 		fundsReplenish          abi.TokenAmount
 		cancelled               bool
 		disableNewDeals         bool
+		freeRetrieval           bool
+		// resumeLeaves is the number of leaves of the file the client
+		// already holds, along with the root, before the deal starts
+		resumeLeaves int
+		// bytesPerSecond rate limits the provider
+		bytesPerSecond uint64
 	}{
 		{name: "1 block file retrieval succeeds",
 			filename:    "lorem_under_1_block.txt",
@@ -291,11 +303,29 @@ func TestClientCanMakeDealWithProvider(t *testing.T) {
 			filesize:    19000,
 			voucherAmts: []abi.TokenAmount{abi.NewTokenAmount(10174000), abi.NewTokenAmount(19958000)},
 		},
+		{name: "multi-block file retrieval succeeds when paused by a rate limit",
+			filename:       "lorem.txt",
+			filesize:       19000,
+			voucherAmts:    []abi.TokenAmount{abi.NewTokenAmount(10174000), abi.NewTokenAmount(19958000)},
+			bytesPerSecond: 50000,
+		},
 		{name: "multi-block file retrieval with zero price per byte succeeds",
 			filename:         "lorem.txt",
 			filesize:         19000,
 			zeroPricePerByte: true,
 		},
+		{name: "multi-block file retrieval succeeds in free mode required by the provider",
+			filename:      "lorem.txt",
+			filesize:      19000,
+			freeRetrieval: true,
+		},
+		{name: "multi-block file retrieval resumes from blocks the client already holds",
+			filename:     "lorem.txt",
+			filesize:     19000,
+			resumeLeaves: 10,
+			// only the 8,760 bytes of the last 9 leaves are paid for
+			voucherAmts: []abi.TokenAmount{abi.NewTokenAmount(8760000)},
+		},
 		{name: "multi-block file retrieval succeeds with V1 params and AllSelector",
 			filename:    "lorem.txt",
 			filesize:    19000,
@@ -437,7 +467,20 @@ func TestClientCanMakeDealWithProvider(t *testing.T) {
 				},
 			}
 			providerNode := testnodes.NewTestRetrievalProviderNode()
-			providerNode.ExpectPricingParams(pieceInfo.PieceCID, []abi.DealID{100})
+			var providerOpts []retrievalimpl.RetrievalProviderOption
+			if testCase.bytesPerSecond > 0 {
+				limiter := ratelimit.NewLimiter(ratelimit.Limits{BytesPerSecond: testCase.bytesPerSecond}, ratelimit.Limits{})
+				providerOpts = append(providerOpts, retrievalimpl.RateLimits(limiter))
+			}
+			if testCase.freeRetrieval {
+				// free retrievals are never priced
+				providerOpts = append(providerOpts, retrievalimpl.FreeRetrievalPolicyOpt(
+					func(ctx context.Context, client peer.ID, payloadCID cid.Cid, pieceCID cid.Cid) (bool, error) {
+						return true, nil
+					}))
+			} else {
+				providerNode.ExpectPricingParams(pieceInfo.PieceCID, []abi.DealID{100})
+			}
 
 			sectorAccessor := testnodes.NewTestSectorAccessor()
 			if testCase.failsUnseal {
@@ -456,7 +499,7 @@ func TestClientCanMakeDealWithProvider(t *testing.T) {
 			defer cancel()
 
 			provider := setupProvider(bgCtx, t, testData, payloadCID, pieceInfo, carFile.Name(), expectedQR,
-				providerPaymentAddr, providerNode, sectorAccessor, decider, testCase.disableNewDeals)
+				providerPaymentAddr, providerNode, sectorAccessor, decider, testCase.disableNewDeals, providerOpts...)
 			tut.StartAndWaitForReady(ctx, t, provider)
 
 			retrievalPeer := retrievalmarket.RetrievalPeer{Address: providerPaymentAddr, ID: testData.Host2.ID()}
@@ -474,8 +517,33 @@ func TestClientCanMakeDealWithProvider(t *testing.T) {
 			}
 
 			nw1 := rmnet.NewFromLibp2pHost(testData.Host1, rmnet.RetryParameters(0, 0, 0, 0))
-			createdChan, newLaneAddr, createdVoucher, clientNode, client, ba, err := setupClient(bgCtx, t, clientPaymentChannel, expectedVoucher, nw1, testData, testCase.addFunds, testCase.channelAvailableFunds)
+			createdChan, newLaneAddr, createdVoucher, clientNode, client, ba, err := setupClient(bgCtx, t, clientPaymentChannel, expectedVoucher, nw1, testData, testCase.addFunds, testCase.channelAvailableFunds, testCase.resumeLeaves > 0)
 			require.NoError(t, err)
+
+			// copy the root and the first leaves of the file to the client,
+			// as if an earlier deal had been interrupted
+			var resumedSize uint64
+			var fullSize uint64
+			if testCase.resumeLeaves > 0 {
+				srcBs, err := stores.ReadOnlyFilestore(path)
+				require.NoError(t, err)
+				fullSize, err = shared.SelectorSize(bgCtx, srcBs, payloadCID, selectorparse.CommonSelector_ExploreAllRecursively)
+				require.NoError(t, err)
+				rootBlk, err := srcBs.Get(bgCtx, payloadCID)
+				require.NoError(t, err)
+				rootNd, err := merkledag.DecodeProtobufBlock(rootBlk)
+				require.NoError(t, err)
+				require.NoError(t, ba.Blockstore.Put(bgCtx, rootBlk))
+				resumedSize += uint64(len(rootBlk.RawData()))
+				for _, l := range rootNd.Links()[:testCase.resumeLeaves] {
+					blk, err := srcBs.Get(bgCtx, l.Cid)
+					require.NoError(t, err)
+					require.NoError(t, ba.Blockstore.Put(bgCtx, blk))
+					resumedSize += uint64(len(blk.RawData()))
+				}
+				require.NoError(t, srcBs.Close())
+				expectedTotal = big.Mul(pricePerByte, big.NewIntUnsigned(fullSize-resumedSize))
+			}
 			tut.StartAndWaitForReady(ctx, t, client)
 
 			clientNode.ExpectKnownAddresses(retrievalPeer, nil)
@@ -537,9 +605,14 @@ CurrentInterval: %d
 			resp, err := client.Query(bgCtx, retrievalPeer, payloadCID, retrievalmarket.QueryParams{})
 			require.NoError(t, err)
 			require.Equal(t, retrievalmarket.QueryResponseAvailable, resp.Status)
+			require.Equal(t, testCase.freeRetrieval, resp.FreeRetrievalRequired)
 
 			var rmParams retrievalmarket.Params
-			if testCase.paramsV1 {
+			if testCase.freeRetrieval {
+				rmParams, err = retrievalmarket.NewFreeParams(selectorparse.CommonSelector_ExploreAllRecursively, nil)
+				require.NoError(t, err)
+				expectedTotal = big.Zero()
+			} else if testCase.paramsV1 {
 				rmParams, err = retrievalmarket.NewParamsV1(pricePerByte, paymentInterval, paymentIntervalIncrease, testCase.selector, nil, unsealPrice)
 				require.NoError(t, err)
 			} else {
@@ -561,7 +634,11 @@ CurrentInterval: %d
 			if testCase.failsUnseal || testCase.cancelled {
 				assert.Equal(t, retrievalmarket.DealStatusCancelled, clientDealState.Status)
 			} else {
-				if !testCase.zeroPricePerByte {
+				if testCase.freeRetrieval {
+					// no payment channel was created or used
+					require.True(t, createdChan.amt.Nil())
+					require.Nil(t, clientDealState.PaymentInfo)
+				} else if !testCase.zeroPricePerByte {
 					assert.Equal(t, clientDealState.PaymentInfo.Lane, expectedVoucher.Lane)
 					require.NotNil(t, createdChan)
 					require.Equal(t, expectedTotal, createdChan.amt)
@@ -572,6 +649,11 @@ CurrentInterval: %d
 					tut.TestVoucherEquality(t, createdVoucher, expectedVoucher)
 				}
 				assert.Equal(t, retrievalmarket.DealStatusCompleted, clientDealState.Status)
+				if testCase.resumeLeaves > 0 {
+					// only the blocks the client didn't have were sent and paid for
+					require.Equal(t, fullSize-resumedSize, clientDealState.TotalReceived)
+					require.Equal(t, expectedTotal, clientDealState.FundsSpent)
+				}
 			}
 
 			ctxProv, cancelProv := context.WithTimeout(bgCtx, 10*time.Second)
@@ -591,6 +673,9 @@ CurrentInterval: %d
 			} else {
 				tut.AssertRetrievalDealState(t, retrievalmarket.DealStatusCompleted, providerDealState.Status)
 			}
+			if testCase.resumeLeaves > 0 {
+				require.Equal(t, fullSize-resumedSize, providerDealState.TotalSent)
+			}
 			// TODO this is terrible, but it's temporary until the test harness refactor
 			// in the resuming retrieval deals branch is done
 			// https://github.com/filecoin-project/go-fil-markets/issues/65
@@ -617,6 +702,7 @@ func setupClient(
 	testData *tut.Libp2pTestData,
 	addFunds bool,
 	channelAvailableFunds retrievalmarket.ChannelAvailableFunds,
+	resume bool,
 ) (
 	*pmtChan,
 	*address.Address,
@@ -654,7 +740,13 @@ func setupClient(
 		ChannelAvailableFunds:  channelAvailableFunds,
 	})
 
-	gs1 := graphsyncimpl.New(ctx, network.NewFromLibp2pHost(testData.Host1), testData.LinkSystem1)
+	var gs1 graphsync.GraphExchange = graphsyncimpl.New(ctx, network.NewFromLibp2pHost(testData.Host1), testData.LinkSystem1)
+	var opts []retrievalimpl.RetrievalClientOption
+	if resume {
+		doNotSend := dtutils.NewDoNotSendExchange(gs1)
+		gs1 = doNotSend
+		opts = append(opts, retrievalimpl.ResumeFromBlockstore(doNotSend))
+	}
 	dtTransport1 := dtgstransport.NewTransport(testData.Host1.ID(), gs1)
 	dt1, err := dtimpl.NewDataTransfer(testData.DTStore1, testData.DTNet1, dtTransport1)
 	require.NoError(t, err)
@@ -663,7 +755,7 @@ func setupClient(
 	clientDs := namespace.Wrap(testData.Ds1, datastore.NewKey("/retrievals/client"))
 	ba := tut.NewTestRetrievalBlockstoreAccessor()
 
-	client, err := retrievalimpl.NewClient(nw1, dt1, clientNode, &tut.TestPeerResolver{}, clientDs, ba)
+	client, err := retrievalimpl.NewClient(nw1, dt1, clientNode, &tut.TestPeerResolver{}, clientDs, ba, opts...)
 	return &createdChan, &newLaneAddr, &createdVoucher, clientNode, client, ba, err
 }
 
@@ -680,6 +772,7 @@ func setupProvider(
 	sectorAccessor retrievalmarket.SectorAccessor,
 	decider retrievalimpl.DealDecider,
 	disableNewDeals bool,
+	extraOpts ...retrievalimpl.RetrievalProviderOption,
 ) retrievalmarket.RetrievalProvider {
 	nw2 := rmnet.NewFromLibp2pHost(testData.Host2, rmnet.RetryParameters(0, 0, 0, 0))
 	pieceStore := tut.NewTestPieceStore()
@@ -706,6 +799,7 @@ func setupProvider(
 	if disableNewDeals {
 		opts = append(opts, retrievalimpl.DisableNewDeals())
 	}
+	opts = append(opts, extraOpts...)
 
 	priceFunc := func(ctx context.Context, dealPricingParams retrievalmarket.PricingInput) (retrievalmarket.Ask, error) {
 		ask := retrievalmarket.Ask{}
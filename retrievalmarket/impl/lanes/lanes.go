@@ -0,0 +1,122 @@
+// Package lanes pools the payment channel lanes of a retrieval client, so
+// that deals with the same provider can share them.
+//
+// Each retrieval deal pays through vouchers on a lane of the payment
+// channel with its provider. Allocating a new lane for every deal leaves a
+// client that makes many small retrievals from one provider with many
+// lanes, each of which costs gas to redeem when the channel settles.
+// Instead, a deal can lease an idle lane from a Pool, and return it when
+// it completes.
+//
+// The vouchers on a lane add up: each voucher is for the total paid on the
+// lane so far, and the provider is paid the difference between it and the
+// best voucher it has seen on the lane. A deal on a reused lane therefore
+// makes vouchers for the lane's total before the deal, its base, plus what
+// the deal has paid.
+package lanes
+
+import (
+	"context"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// Lane is a lane of a payment channel, with the total its vouchers add up to
+type Lane struct {
+	Lane  uint64
+	Total abi.TokenAmount
+}
+
+// AllocateFunc allocates a new lane on a payment channel
+type AllocateFunc func(ctx context.Context, paymentChannel address.Address) (uint64, error)
+
+type laneKey struct {
+	paymentChannel address.Address
+	lane           uint64
+}
+
+// Pool holds the idle lanes of each payment channel
+type Pool struct {
+	lk   sync.Mutex
+	idle map[address.Address][]Lane
+	// leased maps each leased lane to the deal that leased it
+	leased map[laneKey]retrievalmarket.DealID
+}
+
+// NewPool returns an empty Pool
+func NewPool() *Pool {
+	return &Pool{
+		idle:   make(map[address.Address][]Lane),
+		leased: make(map[laneKey]retrievalmarket.DealID),
+	}
+}
+
+// Lease leases an idle lane of the payment channel to a deal, or allocates
+// a new lane with a total of zero if none is idle. The lane is not leased
+// again until the deal releases it.
+func (p *Pool) Lease(ctx context.Context, id retrievalmarket.DealID, paymentChannel address.Address, allocate AllocateFunc) (Lane, error) {
+	p.lk.Lock()
+	idle := p.idle[paymentChannel]
+	if len(idle) > 0 {
+		lane := idle[len(idle)-1]
+		if len(idle) == 1 {
+			delete(p.idle, paymentChannel)
+		} else {
+			p.idle[paymentChannel] = idle[:len(idle)-1]
+		}
+		p.leased[laneKey{paymentChannel, lane.Lane}] = id
+		p.lk.Unlock()
+		return lane, nil
+	}
+	p.lk.Unlock()
+
+	lane, err := allocate(ctx, paymentChannel)
+	if err != nil {
+		return Lane{}, err
+	}
+	p.lk.Lock()
+	p.leased[laneKey{paymentChannel, lane}] = id
+	p.lk.Unlock()
+	return Lane{Lane: lane, Total: big.Zero()}, nil
+}
+
+// Release returns the lane leased to a deal to the pool once the deal has
+// finished, with the total of the last voucher the deal made on it. It must
+// only be called if no voucher beyond that total was made on the lane.
+// Releasing a lane the deal does not hold, e.g. because it was leased
+// before a restart or has already been released, does nothing.
+func (p *Pool) Release(id retrievalmarket.DealID, paymentChannel address.Address, lane Lane) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	key := laneKey{paymentChannel, lane.Lane}
+	if holder, ok := p.leased[key]; !ok || holder != id {
+		return
+	}
+	delete(p.leased, key)
+	p.idle[paymentChannel] = append(p.idle[paymentChannel], lane)
+}
+
+// Discard gives up the lane leased to a deal without returning it to the pool, when
+// the deal that leased it did not finish cleanly, so that what its vouchers
+// add up to is not known for certain
+func (p *Pool) Discard(id retrievalmarket.DealID, paymentChannel address.Address, lane uint64) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	key := laneKey{paymentChannel, lane}
+	if holder, ok := p.leased[key]; ok && holder == id {
+		delete(p.leased, key)
+	}
+}
+
+// Idle returns the idle lanes of a payment channel
+func (p *Pool) Idle(paymentChannel address.Address) []Lane {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return append([]Lane(nil), p.idle[paymentChannel]...)
+}
@@ -0,0 +1,98 @@
+package lanes_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/lanes"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+func TestPool(t *testing.T) {
+	ctx := context.Background()
+	ch1 := tut.NewIDAddr(t, 100)
+	ch2 := tut.NewIDAddr(t, 101)
+	newAllocator := func() (lanes.AllocateFunc, *int) {
+		allocated := 0
+		return func(ctx context.Context, paymentChannel address.Address) (uint64, error) {
+			allocated++
+			return uint64(allocated - 1), nil
+		}, &allocated
+	}
+
+	t.Run("allocates a lane when none is idle", func(t *testing.T) {
+		p := lanes.NewPool()
+		allocate, allocated := newAllocator()
+		lane, err := p.Lease(ctx, 1, ch1, allocate)
+		require.NoError(t, err)
+		require.Equal(t, lanes.Lane{Lane: 0, Total: big.Zero()}, lane)
+		lane, err = p.Lease(ctx, 2, ch1, allocate)
+		require.NoError(t, err)
+		require.Equal(t, lanes.Lane{Lane: 1, Total: big.Zero()}, lane)
+		require.Equal(t, 2, *allocated)
+	})
+
+	t.Run("reuses a released lane on the same channel", func(t *testing.T) {
+		p := lanes.NewPool()
+		allocate, allocated := newAllocator()
+		lane, err := p.Lease(ctx, 1, ch1, allocate)
+		require.NoError(t, err)
+		released := lanes.Lane{Lane: lane.Lane, Total: abi.NewTokenAmount(1000)}
+		p.Release(1, ch1, released)
+		require.Equal(t, []lanes.Lane{released}, p.Idle(ch1))
+
+		// a lane is not shared between channels
+		other, err := p.Lease(ctx, 2, ch2, allocate)
+		require.NoError(t, err)
+		require.Equal(t, big.Zero(), other.Total)
+		require.Equal(t, 2, *allocated)
+
+		reused, err := p.Lease(ctx, 3, ch1, allocate)
+		require.NoError(t, err)
+		require.Equal(t, released, reused)
+		require.Empty(t, p.Idle(ch1))
+		require.Equal(t, 2, *allocated)
+	})
+
+	t.Run("only releases a lane held by the deal", func(t *testing.T) {
+		p := lanes.NewPool()
+		allocate, _ := newAllocator()
+		lane, err := p.Lease(ctx, 1, ch1, allocate)
+		require.NoError(t, err)
+		p.Release(2, ch1, lanes.Lane{Lane: lane.Lane, Total: abi.NewTokenAmount(10)})
+		require.Empty(t, p.Idle(ch1))
+
+		p.Release(1, ch1, lanes.Lane{Lane: lane.Lane, Total: abi.NewTokenAmount(100)})
+		p.Release(1, ch1, lanes.Lane{Lane: lane.Lane, Total: abi.NewTokenAmount(100)})
+		require.Len(t, p.Idle(ch1), 1)
+	})
+
+	t.Run("discards a lane", func(t *testing.T) {
+		p := lanes.NewPool()
+		allocate, allocated := newAllocator()
+		lane, err := p.Lease(ctx, 1, ch1, allocate)
+		require.NoError(t, err)
+		p.Discard(1, ch1, lane.Lane)
+		p.Release(1, ch1, lanes.Lane{Lane: lane.Lane, Total: abi.NewTokenAmount(100)})
+		require.Empty(t, p.Idle(ch1))
+
+		_, err = p.Lease(ctx, 2, ch1, allocate)
+		require.NoError(t, err)
+		require.Equal(t, 2, *allocated)
+	})
+
+	t.Run("returns allocation errors", func(t *testing.T) {
+		p := lanes.NewPool()
+		_, err := p.Lease(ctx, 1, ch1, func(ctx context.Context, paymentChannel address.Address) (uint64, error) {
+			return 0, errors.New("something went wrong")
+		})
+		require.EqualError(t, err, "something went wrong")
+	})
+}
@@ -0,0 +1,176 @@
+package pricing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+// Config is a chain of pricing strategies, as read from a JSON file such as:
+//
+//	{
+//	  "Strategies": [
+//	    { "PieceSizeTiers": [ { "MinPieceSize": 0, "PricePerByte": "2" },
+//	                          { "MinPieceSize": 1073741824, "PricePerByte": "1" } ] },
+//	    { "VerifiedDiscount": { "Percent": 50 } },
+//	    { "PeakHours": { "Start": 18, "End": 23, "Percent": 150 } },
+//	    { "SealedSurcharge": { "Amount": "1000" } },
+//	    { "PerClient": { "12D3KooW...": [ { "Flat": { "PricePerByte": "0", "UnsealPrice": "0" } } ] } }
+//	  ]
+//	}
+type Config struct {
+	Strategies []StrategyConfig
+}
+
+// StrategyConfig configures a single strategy. Exactly one field must be set.
+type StrategyConfig struct {
+	Flat             *FlatConfig                 `json:",omitempty"`
+	VerifiedDiscount *PercentConfig              `json:",omitempty"`
+	FreeForVerified  *struct{}                   `json:",omitempty"`
+	PerClient        map[string][]StrategyConfig `json:",omitempty"`
+	PieceSizeTiers   []Tier                      `json:",omitempty"`
+	PeakHours        *PeakHoursConfig            `json:",omitempty"`
+	SealedSurcharge  *SurchargeConfig            `json:",omitempty"`
+}
+
+// FlatConfig configures the Flat strategy
+type FlatConfig struct {
+	PricePerByte abi.TokenAmount
+	UnsealPrice  abi.TokenAmount
+}
+
+// PercentConfig configures the VerifiedDiscount strategy
+type PercentConfig struct {
+	Percent uint64
+}
+
+// PeakHoursConfig configures the PeakHours strategy
+type PeakHoursConfig struct {
+	Start   int
+	End     int
+	Percent uint64
+}
+
+// SurchargeConfig configures the SealedSurcharge strategy
+type SurchargeConfig struct {
+	Amount abi.TokenAmount
+}
+
+// ParseConfig reads a pricing config as JSON
+func ParseConfig(r io.Reader) (Config, error) {
+	var cfg Config
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return Config{}, xerrors.Errorf("parsing pricing config: %w", err)
+	}
+	return cfg, nil
+}
+
+// LoadConfigFile reads a pricing config from a JSON file
+func LoadConfigFile(path string) (Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Config{}, xerrors.Errorf("opening pricing config: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+	return ParseConfig(f)
+}
+
+// PricingFunc builds the configured strategies into a pricing function for
+// a retrieval provider
+func (c Config) PricingFunc(clock shared.Clock) (func(ctx context.Context, input retrievalmarket.PricingInput) (retrievalmarket.Ask, error), error) {
+	strategies, err := c.Build(clock)
+	if err != nil {
+		return nil, err
+	}
+	return NewPricingFunc(strategies...), nil
+}
+
+// Build validates the config and builds the strategies it describes, in order
+func (c Config) Build(clock shared.Clock) ([]Strategy, error) {
+	return buildStrategies(c.Strategies, clock)
+}
+
+func buildStrategies(configs []StrategyConfig, clock shared.Clock) ([]Strategy, error) {
+	strategies := make([]Strategy, 0, len(configs))
+	for i, sc := range configs {
+		s, err := sc.build(clock)
+		if err != nil {
+			return nil, xerrors.Errorf("pricing strategy %d: %w", i, err)
+		}
+		strategies = append(strategies, s)
+	}
+	return strategies, nil
+}
+
+func (sc StrategyConfig) build(clock shared.Clock) (Strategy, error) {
+	var strategies []Strategy
+	if sc.Flat != nil {
+		if sc.Flat.PricePerByte.Nil() || sc.Flat.UnsealPrice.Nil() {
+			return nil, xerrors.New("flat pricing must set PricePerByte and UnsealPrice")
+		}
+		strategies = append(strategies, Flat(sc.Flat.PricePerByte, sc.Flat.UnsealPrice))
+	}
+	if sc.VerifiedDiscount != nil {
+		if sc.VerifiedDiscount.Percent > 100 {
+			return nil, xerrors.Errorf("verified discount of %d%% is more than 100%%", sc.VerifiedDiscount.Percent)
+		}
+		strategies = append(strategies, VerifiedDiscount(sc.VerifiedDiscount.Percent))
+	}
+	if sc.FreeForVerified != nil {
+		strategies = append(strategies, FreeForVerified())
+	}
+	if sc.PerClient != nil {
+		overrides := make(map[peer.ID]Strategy, len(sc.PerClient))
+		for id, configs := range sc.PerClient {
+			p, err := peer.Decode(id)
+			if err != nil {
+				return nil, xerrors.Errorf("per client pricing for %s: %w", id, err)
+			}
+			clientStrategies, err := buildStrategies(configs, clock)
+			if err != nil {
+				return nil, xerrors.Errorf("per client pricing for %s: %w", id, err)
+			}
+			overrides[p] = Chain(clientStrategies...)
+		}
+		strategies = append(strategies, PerClient(overrides))
+	}
+	if sc.PieceSizeTiers != nil {
+		for _, tier := range sc.PieceSizeTiers {
+			if tier.PricePerByte.Nil() {
+				return nil, xerrors.Errorf("piece size tier from %d must set PricePerByte", tier.MinPieceSize)
+			}
+		}
+		strategies = append(strategies, PieceSizeTiers(sc.PieceSizeTiers))
+	}
+	if sc.PeakHours != nil {
+		ph := sc.PeakHours
+		if ph.Start < 0 || ph.Start > 23 || ph.End < 0 || ph.End > 24 {
+			return nil, xerrors.Errorf("peak hours %d to %d are not hours of the day", ph.Start, ph.End)
+		}
+		if clock == nil {
+			clock = shared.NewClock()
+		}
+		strategies = append(strategies, PeakHours(ph.Start, ph.End, ph.Percent, clock))
+	}
+	if sc.SealedSurcharge != nil {
+		if sc.SealedSurcharge.Amount.Nil() {
+			return nil, xerrors.New("sealed surcharge must set Amount")
+		}
+		strategies = append(strategies, SealedSurcharge(sc.SealedSurcharge.Amount))
+	}
+	if len(strategies) != 1 {
+		return nil, xerrors.Errorf("must configure exactly one strategy, found %d", len(strategies))
+	}
+	return strategies[0], nil
+}
@@ -0,0 +1,186 @@
+// Package pricing provides ready-made retrieval pricing strategies that can
+// be chained together into the pricing function a retrieval provider is
+// constructed with.
+//
+// A provider prices a retrieval by calling its pricing function with a
+// PricingInput, whose CurrentAsk is the ask the provider has set in its ask
+// store. The function returned by NewPricingFunc starts from that ask and
+// passes it through each strategy in turn, so that a strategy sees the ask
+// as adjusted by the strategies before it. As with the provider's default
+// pricing function, a retrieval from a piece that has an unsealed copy is
+// not charged for unsealing: the unseal price is zeroed before the
+// strategies run. With no strategies, retrievals are priced at the current
+// ask.
+package pricing
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+// Strategy adjusts the ask for a retrieval
+type Strategy interface {
+	Price(ctx context.Context, input retrievalmarket.PricingInput, ask retrievalmarket.Ask) (retrievalmarket.Ask, error)
+}
+
+// StrategyFunc is a function that implements Strategy
+type StrategyFunc func(ctx context.Context, input retrievalmarket.PricingInput, ask retrievalmarket.Ask) (retrievalmarket.Ask, error)
+
+// Price calls the function
+func (f StrategyFunc) Price(ctx context.Context, input retrievalmarket.PricingInput, ask retrievalmarket.Ask) (retrievalmarket.Ask, error) {
+	return f(ctx, input, ask)
+}
+
+// NewPricingFunc returns a pricing function for a retrieval provider that
+// starts from the provider's current ask, with no unseal price if the piece
+// has an unsealed copy, and applies the strategies in order
+func NewPricingFunc(strategies ...Strategy) func(ctx context.Context, input retrievalmarket.PricingInput) (retrievalmarket.Ask, error) {
+	chain := Chain(strategies...)
+	return func(ctx context.Context, input retrievalmarket.PricingInput) (retrievalmarket.Ask, error) {
+		ask := input.CurrentAsk
+		// don't charge for unsealing if we have an unsealed copy
+		if input.Unsealed {
+			ask.UnsealPrice = big.Zero()
+		}
+		return chain.Price(ctx, input, ask)
+	}
+}
+
+// Chain returns a strategy that applies the strategies in order
+func Chain(strategies ...Strategy) Strategy {
+	return StrategyFunc(func(ctx context.Context, input retrievalmarket.PricingInput, ask retrievalmarket.Ask) (retrievalmarket.Ask, error) {
+		var err error
+		for _, s := range strategies {
+			ask, err = s.Price(ctx, input, ask)
+			if err != nil {
+				return retrievalmarket.Ask{}, err
+			}
+		}
+		return ask, nil
+	})
+}
+
+// Flat sets the price per byte and the unseal price, whatever the retrieval
+func Flat(pricePerByte abi.TokenAmount, unsealPrice abi.TokenAmount) Strategy {
+	return StrategyFunc(func(ctx context.Context, input retrievalmarket.PricingInput, ask retrievalmarket.Ask) (retrievalmarket.Ask, error) {
+		ask.PricePerByte = pricePerByte
+		ask.UnsealPrice = unsealPrice
+		return ask, nil
+	})
+}
+
+// VerifiedDiscount takes the given percentage off the price per byte of
+// retrievals from pieces with a verified storage deal
+func VerifiedDiscount(percent uint64) Strategy {
+	if percent > 100 {
+		percent = 100
+	}
+	return StrategyFunc(func(ctx context.Context, input retrievalmarket.PricingInput, ask retrievalmarket.Ask) (retrievalmarket.Ask, error) {
+		if input.VerifiedDeal {
+			ask.PricePerByte = percentOf(ask.PricePerByte, 100-percent)
+		}
+		return ask, nil
+	})
+}
+
+// FreeForVerified makes the transfer of data from pieces with a verified
+// storage deal free. The unseal price is unchanged, so that unsealing for
+// a verified deal is still paid for.
+func FreeForVerified() Strategy {
+	return StrategyFunc(func(ctx context.Context, input retrievalmarket.PricingInput, ask retrievalmarket.Ask) (retrievalmarket.Ask, error) {
+		if input.VerifiedDeal {
+			ask.PricePerByte = big.Zero()
+		}
+		return ask, nil
+	})
+}
+
+// PerClient applies a different strategy to retrievals by particular
+// clients. Retrievals by other clients are unchanged.
+func PerClient(overrides map[peer.ID]Strategy) Strategy {
+	return StrategyFunc(func(ctx context.Context, input retrievalmarket.PricingInput, ask retrievalmarket.Ask) (retrievalmarket.Ask, error) {
+		s, ok := overrides[input.Client]
+		if !ok {
+			return ask, nil
+		}
+		return s.Price(ctx, input, ask)
+	})
+}
+
+// Tier is a price per byte for pieces of at least a minimum size
+type Tier struct {
+	MinPieceSize abi.UnpaddedPieceSize
+	PricePerByte abi.TokenAmount
+}
+
+// PieceSizeTiers sets the price per byte from the tier with the largest
+// minimum size that the piece is at least as large as. Retrievals from
+// pieces smaller than every tier are unchanged.
+func PieceSizeTiers(tiers []Tier) Strategy {
+	sorted := append([]Tier(nil), tiers...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].MinPieceSize > sorted[j].MinPieceSize
+	})
+	return StrategyFunc(func(ctx context.Context, input retrievalmarket.PricingInput, ask retrievalmarket.Ask) (retrievalmarket.Ask, error) {
+		for _, tier := range sorted {
+			if input.PieceSize >= tier.MinPieceSize {
+				ask.PricePerByte = tier.PricePerByte
+				break
+			}
+		}
+		return ask, nil
+	})
+}
+
+// PeakHours scales the price per byte to the given percentage of itself
+// between the start and end hours of each day, in UTC. If end is before
+// start, the peak runs over midnight.
+func PeakHours(start, end int, percent uint64, clock shared.Clock) Strategy {
+	return StrategyFunc(func(ctx context.Context, input retrievalmarket.PricingInput, ask retrievalmarket.Ask) (retrievalmarket.Ask, error) {
+		if inHours(clock.Now(), start, end) {
+			ask.PricePerByte = percentOf(ask.PricePerByte, percent)
+		}
+		return ask, nil
+	})
+}
+
+func inHours(now time.Time, start, end int) bool {
+	hour := now.UTC().Hour()
+	if start <= end {
+		return hour >= start && hour < end
+	}
+	return hour >= start || hour < end
+}
+
+// SealedSurcharge adds to the unseal price of retrievals from pieces that
+// have no unsealed copy, and so must be unsealed to be served
+func SealedSurcharge(surcharge abi.TokenAmount) Strategy {
+	return StrategyFunc(func(ctx context.Context, input retrievalmarket.PricingInput, ask retrievalmarket.Ask) (retrievalmarket.Ask, error) {
+		if !input.Unsealed {
+			ask.UnsealPrice = big.Add(tokens(ask.UnsealPrice), surcharge)
+		}
+		return ask, nil
+	})
+}
+
+// percentOf returns the given percentage of an amount, rounded down
+func percentOf(amount abi.TokenAmount, percent uint64) abi.TokenAmount {
+	return big.Div(big.Mul(tokens(amount), big.NewIntUnsigned(percent)), big.NewInt(100))
+}
+
+// tokens treats an unset amount as zero
+func tokens(amount abi.TokenAmount) abi.TokenAmount {
+	if amount.Nil() {
+		return big.Zero()
+	}
+	return amount
+}
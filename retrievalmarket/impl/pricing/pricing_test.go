@@ -0,0 +1,267 @@
+package pricing_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	retrievalimpl "github.com/filecoin-project/go-fil-markets/retrievalmarket/impl"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/pricing"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+func TestStrategies(t *testing.T) {
+	ctx := context.Background()
+	peers := tut.GeneratePeers(2)
+	current := retrievalmarket.Ask{
+		PricePerByte:            abi.NewTokenAmount(1000),
+		UnsealPrice:             abi.NewTokenAmount(500),
+		PaymentInterval:         1 << 20,
+		PaymentIntervalIncrease: 1 << 10,
+	}
+	withPrices := func(pricePerByte, unsealPrice int64) retrievalmarket.Ask {
+		ask := current
+		ask.PricePerByte = abi.NewTokenAmount(pricePerByte)
+		ask.UnsealPrice = abi.NewTokenAmount(unsealPrice)
+		return ask
+	}
+
+	// 13:00 UTC
+	mockClock := clock.NewMock()
+	mockClock.Set(time.Date(2021, 6, 1, 13, 0, 0, 0, time.UTC))
+
+	testCases := map[string]struct {
+		strategies []pricing.Strategy
+		input      retrievalmarket.PricingInput
+		expected   retrievalmarket.Ask
+	}{
+		"no strategies prices at the current ask": {
+			expected: current,
+		},
+		"flat": {
+			strategies: []pricing.Strategy{pricing.Flat(abi.NewTokenAmount(3), big.Zero())},
+			expected:   withPrices(3, 0),
+		},
+		"verified discount for a verified deal": {
+			strategies: []pricing.Strategy{pricing.VerifiedDiscount(25)},
+			input:      retrievalmarket.PricingInput{VerifiedDeal: true},
+			expected:   withPrices(750, 500),
+		},
+		"verified discount without a verified deal": {
+			strategies: []pricing.Strategy{pricing.VerifiedDiscount(25)},
+			expected:   current,
+		},
+		"free for verified keeps the unseal price": {
+			strategies: []pricing.Strategy{pricing.FreeForVerified()},
+			input:      retrievalmarket.PricingInput{VerifiedDeal: true},
+			expected:   withPrices(0, 500),
+		},
+		"per client override": {
+			strategies: []pricing.Strategy{pricing.PerClient(map[peer.ID]pricing.Strategy{
+				peers[0]: pricing.Flat(big.Zero(), big.Zero()),
+			})},
+			input:    retrievalmarket.PricingInput{Client: peers[0]},
+			expected: withPrices(0, 0),
+		},
+		"per client without an override": {
+			strategies: []pricing.Strategy{pricing.PerClient(map[peer.ID]pricing.Strategy{
+				peers[0]: pricing.Flat(big.Zero(), big.Zero()),
+			})},
+			input:    retrievalmarket.PricingInput{Client: peers[1]},
+			expected: current,
+		},
+		"piece size tiers pick the largest tier the piece reaches": {
+			strategies: []pricing.Strategy{pricing.PieceSizeTiers([]pricing.Tier{
+				{MinPieceSize: 1 << 30, PricePerByte: abi.NewTokenAmount(1)},
+				{MinPieceSize: 1 << 20, PricePerByte: abi.NewTokenAmount(2)},
+			})},
+			input:    retrievalmarket.PricingInput{PieceSize: 1 << 25},
+			expected: withPrices(2, 500),
+		},
+		"piece size tiers leave small pieces alone": {
+			strategies: []pricing.Strategy{pricing.PieceSizeTiers([]pricing.Tier{
+				{MinPieceSize: 1 << 20, PricePerByte: abi.NewTokenAmount(2)},
+			})},
+			input:    retrievalmarket.PricingInput{PieceSize: 1 << 10},
+			expected: current,
+		},
+		"peak hours": {
+			strategies: []pricing.Strategy{pricing.PeakHours(12, 14, 150, mockClock)},
+			expected:   withPrices(1500, 500),
+		},
+		"off peak": {
+			strategies: []pricing.Strategy{pricing.PeakHours(18, 2, 150, mockClock)},
+			expected:   current,
+		},
+		"peak hours over midnight": {
+			strategies: []pricing.Strategy{pricing.PeakHours(10, 2, 200, mockClock)},
+			expected:   withPrices(2000, 500),
+		},
+		"sealed surcharge for a sealed piece": {
+			strategies: []pricing.Strategy{pricing.SealedSurcharge(abi.NewTokenAmount(100))},
+			expected:   withPrices(1000, 600),
+		},
+		"no sealed surcharge for an unsealed piece": {
+			strategies: []pricing.Strategy{pricing.SealedSurcharge(abi.NewTokenAmount(100))},
+			input:      retrievalmarket.PricingInput{Unsealed: true},
+			expected:   withPrices(1000, 0),
+		},
+		"no unseal price for an unsealed piece": {
+			input:    retrievalmarket.PricingInput{Unsealed: true},
+			expected: withPrices(1000, 0),
+		},
+		"strategies apply in order": {
+			strategies: []pricing.Strategy{
+				pricing.Flat(abi.NewTokenAmount(10), big.Zero()),
+				pricing.VerifiedDiscount(50),
+				pricing.PeakHours(12, 14, 300, mockClock),
+				pricing.SealedSurcharge(abi.NewTokenAmount(7)),
+			},
+			input:    retrievalmarket.PricingInput{VerifiedDeal: true},
+			expected: withPrices(15, 7),
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			input := tc.input
+			input.CurrentAsk = current
+			ask, err := pricing.NewPricingFunc(tc.strategies...)(ctx, input)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, ask)
+		})
+	}
+
+	t.Run("errors stop the chain", func(t *testing.T) {
+		failing := pricing.StrategyFunc(func(ctx context.Context, _ retrievalmarket.PricingInput, _ retrievalmarket.Ask) (retrievalmarket.Ask, error) {
+			return retrievalmarket.Ask{}, xerrors.New("something went wrong")
+		})
+		_, err := pricing.NewPricingFunc(failing, pricing.Flat(big.Zero(), big.Zero()))(ctx, retrievalmarket.PricingInput{CurrentAsk: current})
+		require.EqualError(t, err, "something went wrong")
+	})
+}
+
+func TestConfig(t *testing.T) {
+	ctx := context.Background()
+	peers := []peer.ID{test.RandPeerIDFatal(t)}
+	mockClock := clock.NewMock()
+	mockClock.Set(time.Date(2021, 6, 1, 19, 0, 0, 0, time.UTC))
+
+	cfg := `{
+  "Strategies": [
+    { "PieceSizeTiers": [ { "MinPieceSize": 0, "PricePerByte": "20" },
+                          { "MinPieceSize": 1024, "PricePerByte": "10" } ] },
+    { "VerifiedDiscount": { "Percent": 50 } },
+    { "PeakHours": { "Start": 18, "End": 23, "Percent": 150 } },
+    { "SealedSurcharge": { "Amount": "1000" } },
+    { "PerClient": { "` + peers[0].String() + `": [ { "FreeForVerified": {} } ] } }
+  ]
+}`
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pricing.json")
+	require.NoError(t, os.WriteFile(path, []byte(cfg), 0644))
+	parsed, err := pricing.LoadConfigFile(path)
+	require.NoError(t, err)
+	priceFunc, err := parsed.PricingFunc(mockClock)
+	require.NoError(t, err)
+
+	ask, err := priceFunc(ctx, retrievalmarket.PricingInput{
+		PieceSize:    2048,
+		VerifiedDeal: true,
+		CurrentAsk:   retrievalmarket.Ask{PricePerByte: abi.NewTokenAmount(1), UnsealPrice: big.Zero()},
+	})
+	require.NoError(t, err)
+	require.Equal(t, abi.NewTokenAmount(7), ask.PricePerByte)
+	require.Equal(t, abi.NewTokenAmount(1000), ask.UnsealPrice)
+
+	ask, err = priceFunc(ctx, retrievalmarket.PricingInput{
+		PieceSize:    2048,
+		VerifiedDeal: true,
+		Unsealed:     true,
+		Client:       peers[0],
+		CurrentAsk:   retrievalmarket.Ask{PricePerByte: abi.NewTokenAmount(1), UnsealPrice: big.Zero()},
+	})
+	require.NoError(t, err)
+	require.Equal(t, big.Zero(), ask.PricePerByte)
+	require.Equal(t, big.Zero(), ask.UnsealPrice)
+
+	invalid := map[string]string{
+		"unknown field":         `{ "Strategies": [ { "Bogus": {} } ] }`,
+		"no strategy":           `{ "Strategies": [ {} ] }`,
+		"two strategies":        `{ "Strategies": [ { "FreeForVerified": {}, "VerifiedDiscount": { "Percent": 10 } } ] }`,
+		"discount over 100%":    `{ "Strategies": [ { "VerifiedDiscount": { "Percent": 101 } } ] }`,
+		"bad hours":             `{ "Strategies": [ { "PeakHours": { "Start": 25, "End": 3, "Percent": 150 } } ] }`,
+		"bad peer":              `{ "Strategies": [ { "PerClient": { "notapeer": [ { "FreeForVerified": {} } ] } } ] }`,
+		"missing flat price":    `{ "Strategies": [ { "Flat": { "PricePerByte": "1" } } ] }`,
+		"bad token amount":      `{ "Strategies": [ { "SealedSurcharge": { "Amount": "lots" } } ] }`,
+		"missing tier price":    `{ "Strategies": [ { "PieceSizeTiers": [ { "MinPieceSize": 0 } ] } ] }`,
+		"missing surcharge":     `{ "Strategies": [ { "SealedSurcharge": {} } ] }`,
+		"bad per client config": `{ "Strategies": [ { "PerClient": { "` + peers[0].String() + `": [ {} ] } } ] }`,
+	}
+	for name, cfg := range invalid {
+		t.Run(name, func(t *testing.T) {
+			parsed, err := pricing.ParseConfig(strings.NewReader(cfg))
+			if err == nil {
+				_, err = parsed.Build(mockClock)
+			}
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestProviderPricing(t *testing.T) {
+	ctx := context.Background()
+	client := tut.GeneratePeers(1)[0]
+	pieceCID := tut.GenerateCids(1)[0]
+
+	node := testnodes.NewTestRetrievalProviderNode()
+	node.MarkVerified()
+	sa := testnodes.NewTestSectorAccessor()
+	pieceStore := tut.NewTestPieceStore()
+	dagStore := tut.NewMockDagStoreWrapper(pieceStore, sa)
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{})
+	priceFunc := pricing.NewPricingFunc(
+		pricing.VerifiedDiscount(40),
+		pricing.SealedSurcharge(abi.NewTokenAmount(50)),
+	)
+	p, err := retrievalimpl.NewProvider(address.TestAddress2, node, sa, net, pieceStore, dagStore, tut.NewTestDataTransfer(), ds, priceFunc)
+	require.NoError(t, err)
+	provider := p.(*retrievalimpl.Provider)
+
+	// the strategies start from the ask the provider has set
+	provider.SetAsk(&retrievalmarket.Ask{
+		PricePerByte:            abi.NewTokenAmount(100),
+		UnsealPrice:             abi.NewTokenAmount(10),
+		PaymentInterval:         1000,
+		PaymentIntervalIncrease: 100,
+	})
+	ask, err := provider.GetDynamicAsk(ctx, retrievalmarket.PricingInput{PieceCID: pieceCID, Client: client}, nil)
+	require.NoError(t, err)
+	require.Equal(t, retrievalmarket.Ask{
+		PricePerByte:            abi.NewTokenAmount(60),
+		UnsealPrice:             abi.NewTokenAmount(60),
+		PaymentInterval:         1000,
+		PaymentIntervalIncrease: 100,
+	}, ask)
+
+	ask, err = provider.GetDynamicAsk(ctx, retrievalmarket.PricingInput{PieceCID: pieceCID, Client: client, Unsealed: true}, nil)
+	require.NoError(t, err)
+	require.Equal(t, big.Zero(), ask.UnsealPrice)
+}
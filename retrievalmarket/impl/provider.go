@@ -1,19 +1,28 @@
 package retrievalimpl
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/hannahhoward/go-pubsub"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/namespace"
 	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/traversal"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	peer "github.com/libp2p/go-libp2p-core/peer"
 	"github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-address"
@@ -24,12 +33,17 @@ import (
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-statemachine/fsm"
 
+	"github.com/filecoin-project/go-fil-markets/aggregate"
+	"github.com/filecoin-project/go-fil-markets/dealarchive"
 	"github.com/filecoin-project/go-fil-markets/piecestore"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/askstore"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/dtutils"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/providerstates"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/ratelimit"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/requestvalidation"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/settlement"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/unsealqueue"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/migrations"
 	rmnet "github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
 	"github.com/filecoin-project/go-fil-markets/shared"
@@ -50,12 +64,26 @@ type RetrievalProviderOption func(p *Provider)
 // DealDecider is a function that makes a decision about whether to accept a deal
 type DealDecider func(ctx context.Context, state retrievalmarket.ProviderDealState) (bool, string, error)
 
+// FreeRetrievalPolicy decides whether the provider requires a retrieval of
+// the payload in the given piece by the given client to be made in free mode
+type FreeRetrievalPolicy func(ctx context.Context, client peer.ID, payloadCID cid.Cid, pieceCID cid.Cid) (bool, error)
+
 type RetrievalPricingFunc func(ctx context.Context, dealPricingParams retrievalmarket.PricingInput) (retrievalmarket.Ask, error)
 
 var queryTimeout = 5 * time.Second
 
+var allSelectorBytes = func() []byte {
+	buf := new(bytes.Buffer)
+	_ = dagcbor.Encode(selectorparse.CommonSelector_ExploreAllRecursively, buf)
+	return buf.Bytes()
+}()
+
 // Provider is the production implementation of the RetrievalProvider interface
 type Provider struct {
+	// httpDeals numbers the retrievals served over HTTP. It comes first so
+	// that it is 64-bit aligned for atomic access.
+	httpDeals uint64
+
 	dataTransfer         datatransfer.Manager
 	node                 retrievalmarket.RetrievalProviderNode
 	sa                   retrievalmarket.SectorAccessor
@@ -69,11 +97,36 @@ type Provider struct {
 	stateMachines        fsm.Group
 	migrateStateMachines func(context.Context) error
 	dealDecider          DealDecider
+	freeRetrievalPolicy  FreeRetrievalPolicy
 	askStore             retrievalmarket.AskStore
 	disableNewDeals      bool
 	retrievalPricingFunc RetrievalPricingFunc
 	dagStore             stores.DAGStoreWrapper
 	stores               *stores.ReadOnlyBlockstores
+	clock                shared.Clock
+	limiter              *ratelimit.Limiter
+	unsealQueue          *unsealqueue.Queue
+	settlement           *settlement.Manager
+	archiveDeals         bool
+	archiveOpts          []dealarchive.Option
+	archiver             *dealarchive.Archiver
+	httpListener         net.Listener
+	httpServer           *http.Server
+	locateSubPiece       aggregate.Locator
+	// payloadSizes caches the sizes measured by selectorPayloadSize, since
+	// a deal is measured when it is queried and again when it is validated
+	payloadSizes *lru.Cache
+}
+
+// payloadSizeCacheSize is how many selector payload sizes the provider
+// remembers
+const payloadSizeCacheSize = 1024
+
+// payloadSizeKey identifies the data a selector matches in a piece
+type payloadSizeKey struct {
+	payloadCID cid.Cid
+	pieceCID   cid.Cid
+	selector   string
 }
 
 type internalProviderEvent struct {
@@ -96,6 +149,7 @@ func providerDispatcher(evt pubsub.Event, subscriberFn pubsub.SubscriberFn) erro
 }
 
 var _ retrievalmarket.RetrievalProvider = new(Provider)
+var _ rmnet.BatchQueryReceiver = new(Provider)
 
 // DealDeciderOpt sets a custom protocol
 func DealDeciderOpt(dd DealDecider) RetrievalProviderOption {
@@ -104,6 +158,15 @@ func DealDeciderOpt(dd DealDecider) RetrievalProviderOption {
 	}
 }
 
+// FreeRetrievalPolicyOpt sets a policy that makes the provider serve some
+// retrievals for free. Deals the policy applies to are only accepted when
+// they are proposed in free mode.
+func FreeRetrievalPolicyOpt(policy FreeRetrievalPolicy) RetrievalProviderOption {
+	return func(provider *Provider) {
+		provider.freeRetrievalPolicy = policy
+	}
+}
+
 // DisableNewDeals disables setup for v1 deal protocols
 func DisableNewDeals() RetrievalProviderOption {
 	return func(provider *Provider) {
@@ -111,6 +174,68 @@ func DisableNewDeals() RetrievalProviderOption {
 	}
 }
 
+// ProviderClock sets the clock the provider uses for query timeouts
+func ProviderClock(clock shared.Clock) RetrievalProviderOption {
+	return func(provider *Provider) {
+		provider.clock = clock
+	}
+}
+
+// RateLimits makes the provider enforce the limits of the given limiter on
+// the deals it serves. Deals over the limits on concurrent deals or bytes
+// per day are rejected when they are proposed, transfers are paused to stay
+// under the limits on bytes per second, and a deal that goes over a limit on
+// bytes per day part way through is ended with an error. The bytes sent per
+// day are counted in memory, so the count starts from zero when the
+// provider restarts.
+func RateLimits(limiter *ratelimit.Limiter) RetrievalProviderOption {
+	return func(provider *Provider) {
+		provider.limiter = limiter
+	}
+}
+
+// MaxConcurrentUnseals limits how many pieces the provider unseals at once
+// to serve retrievals. Deals for pieces with no unsealed copy wait in a
+// queue, ordered by the unseal price paid and then by arrival, until there
+// is room for their piece to be unsealed. By default there is no limit.
+func MaxConcurrentUnseals(n int) RetrievalProviderOption {
+	return func(provider *Provider) {
+		provider.unsealQueue = unsealqueue.NewQueue(n)
+	}
+}
+
+// VoucherSettlement makes the provider record the payment vouchers it
+// receives with the given settlement manager, so that they are redeemed
+// before their payment channels settle. The manager checks payment
+// channels while the provider is running. A voucher the manager refuses,
+// because its channel has settled or been collected, does not count as
+// payment, and the deal fails.
+func VoucherSettlement(m *settlement.Manager) RetrievalProviderOption {
+	return func(provider *Provider) {
+		provider.settlement = m
+	}
+}
+
+// ProviderDealArchival moves the records of deals that have finished into
+// an archive once they have been finished for a while, so that the
+// provider's state machines only hold live deals. Archived deals can be
+// looked up, listed or exported with DealArchiver.
+func ProviderDealArchival(opts ...dealarchive.Option) RetrievalProviderOption {
+	return func(provider *Provider) {
+		provider.archiveDeals = true
+		provider.archiveOpts = opts
+	}
+}
+
+// AggregateSubPieces makes the provider serve the raw data of sub-pieces of
+// aggregate pieces over HTTP, looking up the aggregate a sub-piece is part
+// of with locate
+func AggregateSubPieces(locate aggregate.Locator) RetrievalProviderOption {
+	return func(provider *Provider) {
+		provider.locateSubPiece = locate
+	}
+}
+
 // NewProvider returns a new retrieval Provider
 func NewProvider(minerAddress address.Address,
 	node retrievalmarket.RetrievalProviderNode,
@@ -140,7 +265,10 @@ func NewProvider(minerAddress address.Address,
 		retrievalPricingFunc: retrievalPricingFunc,
 		dagStore:             dagStore,
 		stores:               stores.NewReadOnlyBlockstores(),
+		clock:                shared.NewClock(),
+		unsealQueue:          unsealqueue.NewQueue(0),
 	}
+	p.payloadSizes, _ = lru.New(payloadSizeCacheSize)
 
 	err := shared.MoveKey(ds, "retrieval-ask", "retrieval-ask/latest")
 	if err != nil {
@@ -170,6 +298,12 @@ func NewProvider(minerAddress address.Address,
 		return nil, err
 	}
 	p.Configure(opts...)
+	if p.archiveDeals {
+		p.archiver = dealarchive.NewArchiver(namespace.Wrap(ds, datastore.NewKey("archive/1")), p.stateMachines,
+			retrievalmarket.ProviderDealState{}, func(deal interface{}) interface{} {
+				return deal.(retrievalmarket.ProviderDealState).Identifier()
+			}, append([]dealarchive.Option{dealarchive.ArchiverClock(p.clock)}, p.archiveOpts...)...)
+	}
 	p.requestValidator = requestvalidation.NewProviderRequestValidator(&providerValidationEnvironment{p})
 	transportConfigurer := dtutils.TransportConfigurer(network.ID(), &providerStoreGetter{p})
 	p.revalidator = requestvalidation.NewProviderRevalidator(&providerRevalidatorEnvironment{p})
@@ -226,6 +360,15 @@ func NewProvider(minerAddress address.Address,
 
 // Stop stops handling incoming requests.
 func (p *Provider) Stop() error {
+	if err := p.stopHTTP(); err != nil {
+		log.Errorf("stopping HTTP retrievals: %s", err)
+	}
+	if p.settlement != nil {
+		p.settlement.Stop()
+	}
+	if p.archiver != nil {
+		p.archiver.Stop()
+	}
 	return p.network.StopHandlingRequests()
 }
 
@@ -236,15 +379,27 @@ func (p *Provider) Start(ctx context.Context) error {
 		err := p.migrateStateMachines(ctx)
 		if err != nil {
 			log.Errorf("Migrating retrieval provider state machines: %s", err.Error())
+		} else if p.archiver != nil {
+			p.archiver.Start()
 		}
 		err = p.readyMgr.FireReady(err)
 		if err != nil {
 			log.Warnf("Publish retrieval provider ready event: %s", err.Error())
 		}
 	}()
+	p.startHTTP()
+	if p.settlement != nil {
+		p.settlement.Start()
+	}
 	return p.network.SetDelegate(p)
 }
 
+// DealArchiver returns the archiver of the provider's finished deals, or
+// nil if deal archival is not enabled
+func (p *Provider) DealArchiver() *dealarchive.Archiver {
+	return p.archiver
+}
+
 // OnReady registers a listener for when the provider has finished starting up
 func (p *Provider) OnReady(ready shared.ReadyFunc) {
 	p.readyMgr.OnReady(ready)
@@ -253,9 +408,24 @@ func (p *Provider) OnReady(ready shared.ReadyFunc) {
 func (p *Provider) notifySubscribers(eventName fsm.EventName, state fsm.StateType) {
 	evt := eventName.(retrievalmarket.ProviderEvent)
 	ds := state.(retrievalmarket.ProviderDealState)
+	if ds.Status != retrievalmarket.DealStatusUnsealQueued && ds.Status != retrievalmarket.DealStatusUnsealing {
+		p.unsealQueue.Done(ds.Identifier())
+	}
+	for _, finality := range providerstates.ProviderFinalityStates {
+		if ds.Status == finality {
+			p.releaseLimits(ds.Identifier())
+		}
+	}
 	_ = p.subscribers.Publish(internalProviderEvent{evt, ds})
 }
 
+// releaseLimits stops a deal counting towards the provider's rate limits
+func (p *Provider) releaseLimits(id retrievalmarket.ProviderDealIdentifier) {
+	if p.limiter != nil {
+		p.limiter.Release(id)
+	}
+}
+
 // SubscribeToEvents listens for events that happen related to client retrievals
 func (p *Provider) SubscribeToEvents(subscriber retrievalmarket.ProviderSubscriber) retrievalmarket.Unsubscribe {
 	return retrievalmarket.Unsubscribe(p.subscribers.Subscribe(subscriber))
@@ -287,6 +457,20 @@ func (p *Provider) ListDeals() map[retrievalmarket.ProviderDealIdentifier]retrie
 	return dealMap
 }
 
+// GetDeal returns a given deal by its identifier, if it exists, looking in
+// the archive for deals that are no longer live
+func (p *Provider) GetDeal(id retrievalmarket.ProviderDealIdentifier) (retrievalmarket.ProviderDealState, error) {
+	var out retrievalmarket.ProviderDealState
+	err := p.stateMachines.Get(id).Get(&out)
+	if err != nil && p.archiver != nil && xerrors.Is(err, datastore.ErrNotFound) {
+		err = p.archiver.Get(id, &out)
+	}
+	if err != nil {
+		return retrievalmarket.ProviderDealState{}, err
+	}
+	return out, nil
+}
+
 /*
 HandleQueryStream is called by the network implementation whenever a new message is received on the query protocol
 
@@ -303,7 +487,7 @@ A Provider handling a retrieval `Query` does the following:
 The connection is kept open only as long as the query-response exchange.
 */
 func (p *Provider) HandleQueryStream(stream rmnet.RetrievalQueryStream) {
-	ctx, cancel := context.WithTimeout(context.TODO(), queryTimeout)
+	ctx, cancel := p.clock.WithTimeout(context.TODO(), queryTimeout)
 	defer cancel()
 
 	defer stream.Close()
@@ -318,29 +502,130 @@ func (p *Provider) HandleQueryStream(stream rmnet.RetrievalQueryStream) {
 		}
 	}
 
-	answer := retrievalmarket.QueryResponse{
-		Status:          retrievalmarket.QueryResponseUnavailable,
-		PieceCIDFound:   retrievalmarket.QueryItemUnavailable,
-		MinPricePerByte: big.Zero(),
-		UnsealPrice:     big.Zero(),
+	paymentAddress, answer, ok := p.queryPaymentAddress(ctx)
+	if !ok {
+		return
+	}
+	if answer.Status == retrievalmarket.QueryResponseError {
+		sendResp(answer)
+		return
+	}
+	sendResp(p.answerQuery(ctx, stream.RemotePeer(), paymentAddress, query))
+}
+
+// batchQueryWorkers is how many queries of a batch the provider answers at
+// once
+var batchQueryWorkers = 16
+
+// HandleBatchQueryStream is called by the network implementation whenever a
+// new stream is opened on the batch query protocol. It reads a batch of
+// queries and answers them in parallel, writing each response to the stream
+// as soon as it is ready. Each query is answered within the same timeout as
+// a single query.
+func (p *Provider) HandleBatchQueryStream(stream rmnet.RetrievalBatchQueryStream) {
+	defer stream.Close()
+	batch, err := stream.ReadBatchQuery()
+	if err != nil {
+		return
+	}
+	if len(batch.Queries) > retrievalmarket.MaxBatchQuerySize {
+		log.Warnf("Retrieval batch query: %d queries from %s is over the limit of %d", len(batch.Queries), stream.RemotePeer(), retrievalmarket.MaxBatchQuerySize)
+		return
 	}
 
+	lookupCtx, lookupCancel := p.clock.WithTimeout(context.TODO(), queryTimeout)
+	paymentAddress, failed, ok := p.queryPaymentAddress(lookupCtx)
+	lookupCancel()
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	indexes := make(chan int)
+	responses := make(chan retrievalmarket.BatchQueryResponse)
+	var wg sync.WaitGroup
+	for i := 0; i < batchQueryWorkers && i < len(batch.Queries); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				answer := failed
+				if answer.Status != retrievalmarket.QueryResponseError {
+					queryCtx, queryCancel := p.clock.WithTimeout(ctx, queryTimeout)
+					answer = p.answerQuery(queryCtx, stream.RemotePeer(), paymentAddress, batch.Queries[index])
+					queryCancel()
+				}
+				select {
+				case responses <- retrievalmarket.BatchQueryResponse{Index: uint64(index), Response: answer}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(responses)
+		defer wg.Wait()
+		defer close(indexes)
+		for index := range batch.Queries {
+			select {
+			case indexes <- index:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for resp := range responses {
+		if ctx.Err() != nil {
+			continue
+		}
+		if err := stream.WriteBatchQueryResponse(resp); err != nil {
+			log.Errorf("Retrieval batch query: writing query response: %s", err)
+			// stop answering the rest of the batch
+			cancel()
+		}
+	}
+}
+
+// queryPaymentAddress looks up the address clients should send payment to,
+// for answering queries. It returns false if the chain head can't be
+// fetched, in which case queries go unanswered. If the address can't be
+// looked up, it returns the error response to send to queries instead.
+func (p *Provider) queryPaymentAddress(ctx context.Context) (address.Address, retrievalmarket.QueryResponse, bool) {
 	// get chain head to query actor states.
 	tok, _, err := p.node.GetChainHead(ctx)
 	if err != nil {
 		log.Errorf("Retrieval query: GetChainHead: %s", err)
-		return
+		return address.Undef, retrievalmarket.QueryResponseUndefined, false
 	}
 
 	// fetch the payment address the client should send the payment to.
 	paymentAddress, err := p.node.GetMinerWorkerAddress(ctx, p.minerAddress, tok)
 	if err != nil {
 		log.Errorf("Retrieval query: Lookup Payment Address: %s", err)
+		answer := newQueryResponse()
 		answer.Status = retrievalmarket.QueryResponseError
 		answer.Message = fmt.Sprintf("failed to look up payment address: %s", err)
-		sendResp(answer)
-		return
+		return address.Undef, answer, true
+	}
+	return paymentAddress, retrievalmarket.QueryResponseUndefined, true
+}
+
+func newQueryResponse() retrievalmarket.QueryResponse {
+	return retrievalmarket.QueryResponse{
+		Status:          retrievalmarket.QueryResponseUnavailable,
+		PieceCIDFound:   retrievalmarket.QueryItemUnavailable,
+		MinPricePerByte: big.Zero(),
+		UnsealPrice:     big.Zero(),
 	}
+}
+
+// answerQuery looks up the payload of a query from the given client, and
+// prices retrieving it
+func (p *Provider) answerQuery(ctx context.Context, client peer.ID, paymentAddress address.Address, query retrievalmarket.Query) retrievalmarket.QueryResponse {
+	answer := newQueryResponse()
 	answer.PaymentAddress = paymentAddress
 
 	// fetch the piece from which the payload will be retrieved.
@@ -367,14 +652,23 @@ func (p *Provider) HandleQueryStream(stream rmnet.RetrievalQueryStream) {
 		if answer.Message == "" {
 			answer.Message = "piece info for cid not found (deal has not been added to a piece yet)"
 		}
-		sendResp(answer)
-		return
+		return answer
 	}
 
 	answer.Status = retrievalmarket.QueryResponseAvailable
 	answer.Size = uint64(pieceInfo.Deals[0].Length.Unpadded()) // TODO: verify on intermediate
 	answer.PieceCIDFound = retrievalmarket.QueryItemAvailable
 
+	// if the client asked for part of the payload, report and price the size
+	// of just that part
+	payloadSize, err := p.selectorPayloadSize(ctx, query.PayloadCID, pieceInfo.PieceCID, isUnsealed, query.Selector)
+	if err != nil {
+		log.Warnf("Retrieval query: measuring selector size: %s", err)
+	}
+	if payloadSize > 0 {
+		answer.Size = payloadSize
+	}
+
 	storageDeals := p.storageDealsForPiece(query.PieceCID != nil, pieces, pieceInfo)
 
 	if len(storageDeals) == 0 {
@@ -385,8 +679,19 @@ func (p *Provider) HandleQueryStream(stream rmnet.RetrievalQueryStream) {
 		} else {
 			answer.Message = fmt.Sprintf("failed to fetch storage deals containing payload [%s]", query.PayloadCID.String())
 		}
-		sendResp(answer)
-		return
+		return answer
+	}
+
+	free, err := p.freeRetrievalRequired(ctx, client, query.PayloadCID, pieceInfo.PieceCID)
+	if err != nil {
+		log.Errorf("Retrieval query: free retrieval policy: %s", err)
+		answer.Status = retrievalmarket.QueryResponseError
+		answer.Message = fmt.Sprintf("failed to check free retrieval policy: %s", err)
+		return answer
+	}
+	if free {
+		answer.FreeRetrievalRequired = true
+		return answer
 	}
 
 	input := retrievalmarket.PricingInput{
@@ -394,24 +699,32 @@ func (p *Provider) HandleQueryStream(stream rmnet.RetrievalQueryStream) {
 		// If user hasn't given a PieceCID, we try to choose an unsealed piece in the call to `getPieceInfoFromCid` above.
 		PieceCID: pieceInfo.PieceCID,
 
-		PayloadCID: query.PayloadCID,
-		Unsealed:   isUnsealed,
-		Client:     stream.RemotePeer(),
+		PayloadCID:  query.PayloadCID,
+		PayloadSize: payloadSize,
+		Unsealed:    isUnsealed,
+		Client:      client,
 	}
 	ask, err := p.GetDynamicAsk(ctx, input, storageDeals)
 	if err != nil {
 		log.Errorf("Retrieval query: GetAsk: %s", err)
 		answer.Status = retrievalmarket.QueryResponseError
 		answer.Message = fmt.Sprintf("failed to price deal: %s", err)
-		sendResp(answer)
-		return
+		return answer
 	}
 
 	answer.MinPricePerByte = ask.PricePerByte
 	answer.MaxPaymentInterval = ask.PaymentInterval
 	answer.MaxPaymentIntervalIncrease = ask.PaymentIntervalIncrease
 	answer.UnsealPrice = ask.UnsealPrice
-	sendResp(answer)
+	return answer
+}
+
+// freeRetrievalRequired runs the free retrieval policy, if present
+func (p *Provider) freeRetrievalRequired(ctx context.Context, client peer.ID, payloadCID cid.Cid, pieceCID cid.Cid) (bool, error) {
+	if p.freeRetrievalPolicy == nil {
+		return false, nil
+	}
+	return p.freeRetrievalPolicy(ctx, client, payloadCID, pieceCID)
 }
 
 // getBestPieceInfoMatch will take a list of pieces, and an optional PieceCID from a client, and
@@ -632,6 +945,39 @@ func dealsFromPieces(pieces []piecestore.PieceInfo) []abi.DealID {
 	return dealsIds
 }
 
+// selectorPayloadSize measures the amount of data a retrieval of the payload
+// with the given selector would transfer. It returns zero without measuring
+// if the selector is for the whole DAG, or if the piece is only available in
+// a sealed sector, so that pricing a retrieval never triggers an unseal.
+// Sizes are cached, so that the DAG is only traversed once for the query
+// and the validation of a deal.
+func (p *Provider) selectorPayloadSize(ctx context.Context, payloadCID cid.Cid, pieceCID cid.Cid, isUnsealed bool, sel *cbg.Deferred) (uint64, error) {
+	if sel == nil || bytes.Equal(sel.Raw, cbg.CborNull) || bytes.Equal(sel.Raw, allSelectorBytes) || !isUnsealed {
+		return 0, nil
+	}
+
+	key := payloadSizeKey{payloadCID: payloadCID, pieceCID: pieceCID, selector: string(sel.Raw)}
+	if size, ok := p.payloadSizes.Get(key); ok {
+		return size.(uint64), nil
+	}
+
+	node, err := retrievalmarket.DecodeNode(sel)
+	if err != nil {
+		return 0, xerrors.Errorf("decoding selector: %w", err)
+	}
+	bs, err := p.dagStore.LoadShard(ctx, pieceCID)
+	if err != nil {
+		return 0, xerrors.Errorf("loading blockstore for piece %s: %w", pieceCID, err)
+	}
+	defer bs.Close() //nolint:errcheck
+	size, err := shared.SelectorSize(ctx, bs, payloadCID, node)
+	if err != nil {
+		return 0, err
+	}
+	p.payloadSizes.Add(key, size)
+	return size, nil
+}
+
 // GetDynamicAsk quotes a dynamic price for the retrieval deal by calling the user configured
 // dynamic pricing function. It passes the static price parameters set in the Ask Store to the pricing function.
 func (p *Provider) GetDynamicAsk(ctx context.Context, input retrievalmarket.PricingInput, storageDeals []abi.DealID) (retrievalmarket.Ask, error) {
@@ -647,6 +993,7 @@ func (p *Provider) GetDynamicAsk(ctx context.Context, input retrievalmarket.Pric
 	}
 
 	dp.PayloadCID = input.PayloadCID
+	dp.PayloadSize = input.PayloadSize
 	dp.PieceCID = input.PieceCID
 	dp.Unsealed = input.Unsealed
 	dp.Client = input.Client
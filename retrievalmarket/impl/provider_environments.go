@@ -4,22 +4,27 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
 	"github.com/libp2p/go-libp2p-core/peer"
+	cbg "github.com/whyrusleeping/cbor-gen"
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/dagstore"
+	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
+	paychtypes "github.com/filecoin-project/go-state-types/builtin/v8/paych"
 
 	"github.com/filecoin-project/go-fil-markets/piecestore"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/dtutils"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/providerstates"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/requestvalidation"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/unsealqueue"
 	"github.com/filecoin-project/go-fil-markets/shared"
 )
 
@@ -30,7 +35,7 @@ type providerValidationEnvironment struct {
 }
 
 func (pve *providerValidationEnvironment) GetAsk(ctx context.Context, payloadCid cid.Cid, pieceCid *cid.Cid,
-	piece piecestore.PieceInfo, isUnsealed bool, client peer.ID) (retrievalmarket.Ask, error) {
+	piece piecestore.PieceInfo, isUnsealed bool, client peer.ID, selector *cbg.Deferred) (retrievalmarket.Ask, error) {
 
 	pieces, piecesErr := pve.p.getAllPieceInfoForPayload(payloadCid)
 	// err may be non-nil, but we may have successfuly found >0 pieces, so defer error handling till
@@ -51,6 +56,11 @@ func (pve *providerValidationEnvironment) GetAsk(ctx context.Context, payloadCid
 		Unsealed:   isUnsealed,
 		Client:     client,
 	}
+	payloadSize, err := pve.p.selectorPayloadSize(ctx, payloadCid, piece.PieceCID, isUnsealed, selector)
+	if err != nil {
+		log.Warnf("failed to measure size of retrieval of %s with selector: %s", payloadCid, err)
+	}
+	input.PayloadSize = payloadSize
 
 	return pve.p.GetDynamicAsk(ctx, input, storageDeals)
 }
@@ -74,6 +84,11 @@ func (pve *providerValidationEnvironment) GetPiece(c cid.Cid, pieceCID *cid.Cid)
 	return piecestore.PieceInfoUndefined, false, fmt.Errorf("unknown pieceCID %s", pieceCID.String())
 }
 
+// FreeRetrievalRequired runs the provider's free retrieval policy, if present
+func (pve *providerValidationEnvironment) FreeRetrievalRequired(ctx context.Context, client peer.ID, payloadCid cid.Cid, pieceCid cid.Cid) (bool, error) {
+	return pve.p.freeRetrievalRequired(ctx, client, payloadCid, pieceCid)
+}
+
 // CheckDealParams verifies the given deal params are acceptable
 func (pve *providerValidationEnvironment) CheckDealParams(ask retrievalmarket.Ask, pricePerByte abi.TokenAmount, paymentInterval uint64, paymentIntervalIncrease uint64, unsealPrice abi.TokenAmount) error {
 	if pricePerByte.LessThan(ask.PricePerByte) {
@@ -99,6 +114,20 @@ func (pve *providerValidationEnvironment) RunDealDecisioningLogic(ctx context.Co
 	return pve.p.dealDecider(ctx, state)
 }
 
+// AdmitDeal checks the deal against the provider's rate limits, if any
+func (pve *providerValidationEnvironment) AdmitDeal(state retrievalmarket.ProviderDealState) error {
+	if pve.p.limiter == nil {
+		return nil
+	}
+	return pve.p.limiter.Admit(state.Identifier())
+}
+
+// ReleaseDeal stops an admitted deal counting towards the provider's rate
+// limits
+func (pve *providerValidationEnvironment) ReleaseDeal(state retrievalmarket.ProviderDealState) {
+	pve.p.releaseLimits(state.Identifier())
+}
+
 // StateMachines returns the FSM Group to begin tracking with
 func (pve *providerValidationEnvironment) BeginTracking(pds retrievalmarket.ProviderDealState) error {
 	err := pve.p.stateMachines.Begin(pds.Identifier(), &pds)
@@ -131,6 +160,29 @@ func (pre *providerRevalidatorEnvironment) Get(dealID retrievalmarket.ProviderDe
 	return deal, err
 }
 
+func (pre *providerRevalidatorEnvironment) ThrottleTransfer(dealID retrievalmarket.ProviderDealIdentifier, bytesSent uint64) (time.Duration, error) {
+	if pre.p.limiter == nil {
+		return 0, nil
+	}
+	return pre.p.limiter.Sent(dealID, bytesSent)
+}
+
+func (pre *providerRevalidatorEnvironment) ResumeTransferAfter(chid datatransfer.ChannelID, wait time.Duration) {
+	pre.p.clock.AfterFunc(wait, func() {
+		err := pre.p.dataTransfer.ResumeDataTransferChannel(context.TODO(), chid)
+		if err != nil {
+			log.Warnf("resuming rate limited transfer %s: %s", chid, err)
+		}
+	})
+}
+
+func (pre *providerRevalidatorEnvironment) RecordPaymentVoucher(paymentChannel address.Address, voucher *paychtypes.SignedVoucher) error {
+	if pre.p.settlement == nil {
+		return nil
+	}
+	return pre.p.settlement.RecordVoucher(context.TODO(), paymentChannel, voucher)
+}
+
 var _ providerstates.ProviderDealEnvironment = new(providerDealEnvironment)
 
 type providerDealEnvironment struct {
@@ -142,6 +194,38 @@ func (pde *providerDealEnvironment) Node() retrievalmarket.RetrievalProviderNode
 	return pde.p.node
 }
 
+// QueueUnseal queues the deal to unseal its piece, unless the piece is
+// already unsealed, in which case the deal starts at once
+func (pde *providerDealEnvironment) QueueUnseal(ctx context.Context, deal retrievalmarket.ProviderDealState) error {
+	if deal.PieceInfo == nil {
+		return xerrors.Errorf("deal %d has no piece to unseal", deal.ID)
+	}
+	id := deal.Identifier()
+	start := func() {
+		if err := pde.p.stateMachines.Send(id, retrievalmarket.ProviderEventUnsealStarted); err != nil {
+			log.Errorf("starting unseal for deal %s: %s", id, err)
+		}
+	}
+	if pde.p.pieceInUnsealedSector(ctx, *deal.PieceInfo) {
+		start()
+		return nil
+	}
+
+	pde.p.unsealQueue.Push(&unsealqueue.Job{
+		Deal:        id,
+		PieceCID:    deal.PieceInfo.PieceCID,
+		UnsealPrice: deal.UnsealPrice,
+		Queued: func(position int) {
+			log.Infow("deal queued for unseal", "deal", id, "piece", deal.PieceInfo.PieceCID, "position", position)
+			if err := pde.p.stateMachines.Send(id, retrievalmarket.ProviderEventUnsealQueued, uint64(position)); err != nil {
+				log.Errorf("updating unseal queue position for deal %s: %s", id, err)
+			}
+		},
+		Start: start,
+	})
+	return nil
+}
+
 // PrepareBlockstore is called when the deal data has been unsealed and we need
 // to add all blocks to a blockstore that is used to serve retrieval
 func (pde *providerDealEnvironment) PrepareBlockstore(ctx context.Context, dealID retrievalmarket.DealID, pieceCid cid.Cid) error {
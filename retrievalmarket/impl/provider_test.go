@@ -25,6 +25,7 @@ import (
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 
+	"github.com/filecoin-project/go-fil-markets/dealarchive"
 	"github.com/filecoin-project/go-fil-markets/piecestore"
 	piecemigrations "github.com/filecoin-project/go-fil-markets/piecestore/migrations"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
@@ -1052,6 +1053,89 @@ func TestHandleQueryStream(t *testing.T) {
 
 }
 
+func TestHandleBatchQueryStream(t *testing.T) {
+	ctx := context.Background()
+
+	payloadCID := tut.GenerateCids(1)[0]
+	missingCID := tut.GenerateCids(1)[0]
+	pieceCID := tut.GenerateCids(1)[0]
+	paddedSize := uint64(1234)
+	piece := piecestore.PieceInfo{
+		PieceCID: pieceCID,
+		Deals: []piecestore.DealInfo{
+			{
+				Length: abi.PaddedPieceSize(paddedSize),
+			},
+		},
+	}
+	pricePerByte := abi.NewTokenAmount(4321)
+
+	receiveBatch := func(t *testing.T, batch retrievalmarket.BatchQuery) []retrievalmarket.BatchQueryResponse {
+		pieceStore := tut.NewTestPieceStore()
+		pieceStore.ExpectPiece(pieceCID, piece)
+		sa := testnodes.NewTestSectorAccessor()
+		dagStore := tut.NewMockDagStoreWrapper(pieceStore, sa)
+		dagStore.AddBlockToPieceIndex(payloadCID, pieceCID)
+
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{})
+		priceFunc := func(ctx context.Context, _ retrievalmarket.PricingInput) (retrievalmarket.Ask, error) {
+			return retrievalmarket.Ask{PricePerByte: pricePerByte, UnsealPrice: big.Zero()}, nil
+		}
+		p, err := retrievalimpl.NewProvider(address.TestAddress2, testnodes.NewTestRetrievalProviderNode(), sa, net, pieceStore, dagStore, tut.NewTestDataTransfer(), ds, priceFunc)
+		require.NoError(t, err)
+		tut.StartAndWaitForReady(ctx, t, p)
+
+		var responses []retrievalmarket.BatchQueryResponse
+		net.ReceiveBatchQueryStream(tut.NewTestRetrievalBatchQueryStream(tut.TestBatchQueryStreamParams{
+			PeerID: peer.ID("somepeer"),
+			Reader: func() (retrievalmarket.BatchQuery, error) {
+				return batch, nil
+			},
+			RespWriter: func(resp retrievalmarket.BatchQueryResponse) error {
+				responses = append(responses, resp)
+				return nil
+			},
+		}))
+		return responses
+	}
+
+	t.Run("answers every query", func(t *testing.T) {
+		var batch retrievalmarket.BatchQuery
+		for i := 0; i < 40; i++ {
+			c := payloadCID
+			if i%2 == 1 {
+				c = missingCID
+			}
+			batch.Queries = append(batch.Queries, retrievalmarket.Query{PayloadCID: c})
+		}
+		responses := receiveBatch(t, batch)
+		require.Len(t, responses, len(batch.Queries))
+
+		answered := make(map[uint64]bool)
+		for _, resp := range responses {
+			require.False(t, answered[resp.Index], "query %d answered twice", resp.Index)
+			answered[resp.Index] = true
+			require.Equal(t, address.TestAddress2, resp.Response.PaymentAddress)
+			if resp.Index%2 == 1 {
+				require.Equal(t, retrievalmarket.QueryResponseUnavailable, resp.Response.Status)
+				continue
+			}
+			require.Equal(t, retrievalmarket.QueryResponseAvailable, resp.Response.Status)
+			require.Equal(t, uint64(abi.PaddedPieceSize(paddedSize).Unpadded()), resp.Response.Size)
+			require.Equal(t, pricePerByte, resp.Response.MinPricePerByte)
+		}
+	})
+
+	t.Run("ignores a batch over the limit", func(t *testing.T) {
+		batch := retrievalmarket.BatchQuery{Queries: make([]retrievalmarket.Query, retrievalmarket.MaxBatchQuerySize+1)}
+		for i := range batch.Queries {
+			batch.Queries[i] = retrievalmarket.Query{PayloadCID: payloadCID}
+		}
+		require.Empty(t, receiveBatch(t, batch))
+	})
+}
+
 func TestProvider_Construct(t *testing.T) {
 	ds := datastore.NewMapDatastore()
 	pieceStore := tut.NewTestPieceStore()
@@ -1155,6 +1239,57 @@ func TestProviderConfigOpts(t *testing.T) {
 	require.NotNil(t, p)
 }
 
+func TestProvider_DealArchival(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	pieceStore := tut.NewTestPieceStore()
+	sa := testnodes.NewTestSectorAccessor()
+	dagStore := tut.NewMockDagStoreWrapper(pieceStore, sa)
+	priceFunc := func(ctx context.Context, dealPricingParams retrievalmarket.PricingInput) (retrievalmarket.Ask, error) {
+		return retrievalmarket.Ask{}, nil
+	}
+	p, err := retrievalimpl.NewProvider(address.TestAddress2, testnodes.NewTestRetrievalProviderNode(), sa,
+		tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{}), pieceStore, dagStore, tut.NewTestDataTransfer(), ds, priceFunc,
+		retrievalimpl.ProviderDealArchival(dealarchive.Retention(0), dealarchive.CheckInterval(time.Hour)))
+	require.NoError(t, err)
+	provider := p.(*retrievalimpl.Provider)
+	tut.StartAndWaitForReady(ctx, t, provider)
+	defer provider.Stop() //nolint:errcheck
+
+	receiver := tut.GeneratePeers(1)[0]
+	putDeal := func(id retrievalmarket.DealID, status retrievalmarket.DealStatus) retrievalmarket.ProviderDealState {
+		deal := retrievalmarket.ProviderDealState{
+			DealProposal: tut.MakeTestDealProposal(),
+			Receiver:     receiver,
+			Status:       status,
+		}
+		deal.ID = id
+		buf := new(bytes.Buffer)
+		require.NoError(t, deal.MarshalCBOR(buf))
+		require.NoError(t, ds.Put(ctx, datastore.NewKey("1").Child(datastore.NewKey(deal.Identifier().String())), buf.Bytes()))
+		stored, err := provider.GetDeal(deal.Identifier())
+		require.NoError(t, err)
+		return stored
+	}
+	completed := putDeal(1, retrievalmarket.DealStatusCompleted)
+	putDeal(2, retrievalmarket.DealStatusOngoing)
+
+	archived, err := provider.DealArchiver().ArchiveDeals(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, archived)
+
+	deals := provider.ListDeals()
+	require.Len(t, deals, 1)
+	require.Contains(t, deals, retrievalmarket.ProviderDealIdentifier{Receiver: receiver, DealID: 2})
+
+	deal, err := provider.GetDeal(retrievalmarket.ProviderDealIdentifier{Receiver: receiver, DealID: 1})
+	require.NoError(t, err)
+	require.Equal(t, completed, deal)
+	_, err = provider.GetDeal(retrievalmarket.ProviderDealIdentifier{Receiver: receiver, DealID: 3})
+	require.Error(t, err)
+}
+
 // loadPieceCIDS sets expectations to receive expectedPieceCID and 3 other random PieceCIDs to
 // disinguish the case of a PayloadCID is found but the PieceCID is not
 func loadPieceCIDS(t *testing.T, pieceStore *tut.TestPieceStore, expPayloadCID, expectedPieceCID cid.Cid) {
@@ -1,6 +1,8 @@
 package providerstates
 
 import (
+	"fmt"
+
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
@@ -31,15 +33,27 @@ var ProviderEvents = fsm.Events{
 	// accepting
 	fsm.Event(rm.ProviderEventDealAccepted).
 		From(rm.DealStatusFundsNeededUnseal).ToNoChange().
-		From(rm.DealStatusNew).To(rm.DealStatusUnsealing).
+		From(rm.DealStatusNew).To(rm.DealStatusUnsealQueued).
 		Action(func(deal *rm.ProviderDealState, channelID datatransfer.ChannelID) error {
 			deal.ChannelID = &channelID
 			return nil
 		}),
 
 	//unsealing
+	fsm.Event(rm.ProviderEventUnsealQueued).
+		From(rm.DealStatusUnsealQueued).ToNoChange().
+		Action(func(deal *rm.ProviderDealState, position uint64) error {
+			deal.Message = fmt.Sprintf("queued for unseal at position %d", position)
+			return nil
+		}),
+	fsm.Event(rm.ProviderEventUnsealStarted).
+		From(rm.DealStatusUnsealQueued).To(rm.DealStatusUnsealing).
+		Action(func(deal *rm.ProviderDealState) error {
+			deal.Message = ""
+			return nil
+		}),
 	fsm.Event(rm.ProviderEventUnsealError).
-		From(rm.DealStatusUnsealing).To(rm.DealStatusFailing).
+		FromMany(rm.DealStatusUnsealQueued, rm.DealStatusUnsealing).To(rm.DealStatusFailing).
 		Action(recordError),
 	fsm.Event(rm.ProviderEventUnsealComplete).
 		From(rm.DealStatusUnsealing).To(rm.DealStatusUnsealed),
@@ -79,7 +93,7 @@ var ProviderEvents = fsm.Events{
 	fsm.Event(rm.ProviderEventPaymentReceived).
 		From(rm.DealStatusFundsNeeded).To(rm.DealStatusOngoing).
 		From(rm.DealStatusFundsNeededLastPayment).To(rm.DealStatusFinalizing).
-		From(rm.DealStatusFundsNeededUnseal).To(rm.DealStatusUnsealing).
+		From(rm.DealStatusFundsNeededUnseal).To(rm.DealStatusUnsealQueued).
 		FromMany(rm.DealStatusBlocksComplete, rm.DealStatusOngoing, rm.DealStatusFinalizing).ToJustRecord().
 		Action(func(deal *rm.ProviderDealState, fundsReceived abi.TokenAmount) error {
 			deal.FundsReceived = big.Add(deal.FundsReceived, fundsReceived)
@@ -126,6 +140,7 @@ var ProviderEvents = fsm.Events{
 // ProviderStateEntryFuncs are the handlers for different states in a retrieval provider
 var ProviderStateEntryFuncs = fsm.StateEntryFuncs{
 	rm.DealStatusFundsNeededUnseal: TrackTransfer,
+	rm.DealStatusUnsealQueued:      QueueUnseal,
 	rm.DealStatusUnsealing:         UnsealData,
 	rm.DealStatusUnsealed:          UnpauseDeal,
 	rm.DealStatusFailing:           CancelDeal,
@@ -21,6 +21,9 @@ var log = logging.Logger("retrieval-fsm")
 type ProviderDealEnvironment interface {
 	// Node returns the node interface for this deal
 	Node() rm.RetrievalProviderNode
+	// QueueUnseal queues the deal to unseal its data, sending
+	// ProviderEventUnsealStarted when its turn comes
+	QueueUnseal(ctx context.Context, deal rm.ProviderDealState) error
 	PrepareBlockstore(ctx context.Context, dealID rm.DealID, pieceCid cid.Cid) error
 	TrackTransfer(deal rm.ProviderDealState) error
 	UntrackTransfer(deal rm.ProviderDealState) error
@@ -29,6 +32,15 @@ type ProviderDealEnvironment interface {
 	CloseDataTransfer(context.Context, datatransfer.ChannelID) error
 }
 
+// QueueUnseal waits for the deal's turn to unseal the piece containing the
+// data needed for the retrieval
+func QueueUnseal(ctx fsm.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState) error {
+	if err := environment.QueueUnseal(ctx.Context(), deal); err != nil {
+		return ctx.Trigger(rm.ProviderEventUnsealError, err)
+	}
+	return nil
+}
+
 // UnsealData fetches the piece containing data needed for the retrieval,
 // unsealing it if necessary
 func UnsealData(ctx fsm.Context, environment ProviderDealEnvironment, deal rm.ProviderDealState) error {
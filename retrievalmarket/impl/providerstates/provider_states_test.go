@@ -18,6 +18,7 @@ import (
 	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/providerstates"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/unsealqueue"
 	rmtesting "github.com/filecoin-project/go-fil-markets/retrievalmarket/testing"
 	testnet "github.com/filecoin-project/go-fil-markets/shared_testutil"
 )
@@ -102,6 +103,84 @@ func TestUnsealData(t *testing.T) {
 	})
 }
 
+func TestQueueUnseal(t *testing.T) {
+	ctx := context.Background()
+	eventMachine, err := fsm.NewEventProcessor(rm.ProviderDealState{}, "Status", providerstates.ProviderEvents)
+	require.NoError(t, err)
+	runQueueUnseal := func(t *testing.T,
+		setupEnv func(e *rmtesting.TestProviderDealEnvironment),
+		dealState *rm.ProviderDealState) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		environment := rmtesting.NewTestProviderDealEnvironment(node)
+		setupEnv(environment)
+		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
+		err := providerstates.QueueUnseal(fsmCtx, environment, *dealState)
+		require.NoError(t, err)
+		fsmCtx.ReplayEvents(t, dealState)
+	}
+
+	t.Run("it works", func(t *testing.T) {
+		dealState := makeDealState(rm.DealStatusUnsealQueued)
+		setupEnv := func(fe *rmtesting.TestProviderDealEnvironment) {}
+		runQueueUnseal(t, setupEnv, dealState)
+		require.Equal(t, dealState.Status, rm.DealStatusUnsealQueued)
+	})
+
+	t.Run("waits for a free slot", func(t *testing.T) {
+		// an accepted deal waits in the queue
+		dealState := makeDealState(rm.DealStatusNew)
+		dealState.PieceInfo = &piecestore.PieceInfo{PieceCID: testnet.GenerateCids(1)[0]}
+		acceptCtx := fsmtest.NewTestContext(ctx, eventMachine)
+		require.NoError(t, acceptCtx.Trigger(rm.ProviderEventDealAccepted, datatransfer.ChannelID{ID: 1}))
+		acceptCtx.ReplayEvents(t, dealState)
+		require.Equal(t, rm.DealStatusUnsealQueued, dealState.Status)
+
+		// behind another deal that is using the only slot
+		queue := unsealqueue.NewQueue(1)
+		other := rm.ProviderDealIdentifier{DealID: dealID + 1}
+		queue.Push(&unsealqueue.Job{
+			Deal:        other,
+			PieceCID:    testnet.GenerateCids(1)[0],
+			UnsealPrice: big.Zero(),
+			Queued:      func(int) {},
+			Start:       func() {},
+		})
+
+		node := testnodes.NewTestRetrievalProviderNode()
+		environment := rmtesting.NewTestProviderDealEnvironment(node)
+		environment.UnsealQueue = queue
+		queuedCtx := fsmtest.NewTestContext(ctx, eventMachine)
+		environment.UnsealEvents = queuedCtx
+		require.NoError(t, providerstates.QueueUnseal(fsmtest.NewTestContext(ctx, eventMachine), environment, *dealState))
+		queuedCtx.ReplayEvents(t, dealState)
+		require.Equal(t, rm.DealStatusUnsealQueued, dealState.Status)
+		require.Equal(t, "queued for unseal at position 1", dealState.Message)
+
+		// and starts unsealing once the slot is free
+		startedCtx := fsmtest.NewTestContext(ctx, eventMachine)
+		environment.UnsealEvents = startedCtx
+		queue.Done(other)
+		startedCtx.ReplayEvents(t, dealState)
+		require.Equal(t, rm.DealStatusUnsealing, dealState.Status)
+		require.Empty(t, dealState.Message)
+
+		unsealCtx := fsmtest.NewTestContext(ctx, eventMachine)
+		require.NoError(t, providerstates.UnsealData(unsealCtx, environment, *dealState))
+		unsealCtx.ReplayEvents(t, dealState)
+		require.Equal(t, rm.DealStatusUnsealed, dealState.Status)
+	})
+
+	t.Run("error queueing", func(t *testing.T) {
+		dealState := makeDealState(rm.DealStatusUnsealQueued)
+		setupEnv := func(fe *rmtesting.TestProviderDealEnvironment) {
+			fe.QueueUnsealError = errors.New("Something went wrong")
+		}
+		runQueueUnseal(t, setupEnv, dealState)
+		require.Equal(t, dealState.Status, rm.DealStatusFailing)
+		require.Equal(t, dealState.Message, "Something went wrong")
+	})
+}
+
 func TestUnpauseDeal(t *testing.T) {
 	ctx := context.Background()
 	eventMachine, err := fsm.NewEventProcessor(rm.ProviderDealState{}, "Status", providerstates.ProviderEvents)
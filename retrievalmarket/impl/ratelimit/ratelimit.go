@@ -0,0 +1,236 @@
+// Package ratelimit limits how much a retrieval provider serves, to each
+// client and in total.
+//
+// A Limiter enforces three kinds of limit, each both per client peer and
+// across all peers: the number of deals served at once, the bytes sent per
+// second and the bytes sent per day. The first and last are checked when a
+// deal is proposed, so that a deal over the limit is rejected outright. The
+// bytes sent per second is enforced by pausing the transfer after a block is
+// queued until the bytes sent so far have been paced out, and the bytes sent
+// per day by ending a deal that goes over the limit part way through.
+//
+// Usage is kept in memory only, so a provider that restarts starts counting
+// the bytes sent that day from zero.
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+// ErrLimitExceeded is returned when serving a deal would exceed a limit
+var ErrLimitExceeded = errors.New("retrieval rate limit exceeded")
+
+// Limits are limits on serving retrievals. A zero limit means there is no
+// limit.
+type Limits struct {
+	// MaxConcurrentDeals is the most deals served at once
+	MaxConcurrentDeals int
+	// BytesPerSecond is the most bytes sent per second
+	BytesPerSecond uint64
+	// BytesPerDay is the most bytes sent in a day, from midnight UTC. The
+	// count is not persisted, so it starts again from zero when the
+	// provider restarts.
+	BytesPerDay uint64
+}
+
+// MinWait is the shortest wait Sent returns. Shorter waits are carried over
+// to the next bytes sent, so that a transfer is not paused for every block.
+const MinWait = 100 * time.Millisecond
+
+// Option is a function that configures a Limiter
+type Option func(l *Limiter)
+
+// LimiterClock sets the clock the limiter uses to pace transfers and to
+// tell when a day ends
+func LimiterClock(clock shared.Clock) Option {
+	return func(l *Limiter) {
+		l.clock = clock
+	}
+}
+
+// usage is what is being served under a set of limits
+type usage struct {
+	deals     int
+	day       int64
+	sentToday uint64
+	// free is when the bytes sent so far have been paced out at the limit
+	// on bytes per second
+	free time.Time
+}
+
+// rollover resets the daily total when the day has changed
+func (u *usage) rollover(day int64) {
+	if day != u.day {
+		u.day = day
+		u.sentToday = 0
+	}
+}
+
+// pace records n bytes sent, and returns how long to wait for the bytes
+// sent so far to have been paced out at rate bytes per second
+func (u *usage) pace(now time.Time, n uint64, rate uint64) time.Duration {
+	if rate == 0 {
+		return 0
+	}
+	if u.free.Before(now) {
+		u.free = now
+	}
+	u.free = u.free.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	return u.free.Sub(now)
+}
+
+// Limiter enforces limits on the retrievals a provider serves
+type Limiter struct {
+	global  Limits
+	perPeer Limits
+	clock   shared.Clock
+
+	lk         sync.Mutex
+	peerLimits map[peer.ID]Limits
+	total      usage
+	peers      map[peer.ID]*usage
+	deals      map[retrievalmarket.ProviderDealIdentifier]struct{}
+}
+
+// NewLimiter returns a Limiter that enforces global limits across all
+// peers, and perPeer limits on each peer unless overridden with
+// SetPeerLimits
+func NewLimiter(global Limits, perPeer Limits, opts ...Option) *Limiter {
+	l := &Limiter{
+		global:     global,
+		perPeer:    perPeer,
+		clock:      shared.NewClock(),
+		peerLimits: make(map[peer.ID]Limits),
+		peers:      make(map[peer.ID]*usage),
+		deals:      make(map[retrievalmarket.ProviderDealIdentifier]struct{}),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// SetPeerLimits overrides the per peer limits for a single peer
+func (l *Limiter) SetPeerLimits(p peer.ID, limits Limits) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.peerLimits[p] = limits
+}
+
+// Admit admits a new deal, returning an error wrapping ErrLimitExceeded if
+// the deal's peer or the provider is already serving as many deals as it
+// may at once, or has already sent as many bytes as it may today. An
+// admitted deal counts towards the limit on concurrent deals until it is
+// released.
+func (l *Limiter) Admit(id retrievalmarket.ProviderDealIdentifier) error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	if _, ok := l.deals[id]; ok {
+		return nil
+	}
+	day := l.today()
+	pu := l.peerUsageLocked(id.Receiver)
+	pl := l.limitsLocked(id.Receiver)
+	pu.rollover(day)
+	l.total.rollover(day)
+
+	if pl.MaxConcurrentDeals > 0 && pu.deals >= pl.MaxConcurrentDeals {
+		return xerrors.Errorf("%w: already serving %d deals to %s, the most allowed at once", ErrLimitExceeded, pu.deals, id.Receiver)
+	}
+	if l.global.MaxConcurrentDeals > 0 && l.total.deals >= l.global.MaxConcurrentDeals {
+		return xerrors.Errorf("%w: already serving %d deals, the most allowed at once", ErrLimitExceeded, l.total.deals)
+	}
+	if pl.BytesPerDay > 0 && pu.sentToday >= pl.BytesPerDay {
+		return xerrors.Errorf("%w: already sent %d bytes to %s today, the most allowed per day", ErrLimitExceeded, pu.sentToday, id.Receiver)
+	}
+	if l.global.BytesPerDay > 0 && l.total.sentToday >= l.global.BytesPerDay {
+		return xerrors.Errorf("%w: already sent %d bytes today, the most allowed per day", ErrLimitExceeded, l.total.sentToday)
+	}
+
+	l.deals[id] = struct{}{}
+	pu.deals++
+	l.total.deals++
+	return nil
+}
+
+// Release releases a deal once it has ended, so that it no longer counts
+// towards the limit on concurrent deals
+func (l *Limiter) Release(id retrievalmarket.ProviderDealIdentifier) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	if _, ok := l.deals[id]; !ok {
+		return
+	}
+	delete(l.deals, id)
+	l.total.deals--
+	pu := l.peers[id.Receiver]
+	pu.deals--
+	if pu.deals == 0 && pu.free.Before(l.clock.Now()) && l.limitsLocked(id.Receiver).BytesPerDay == 0 {
+		delete(l.peers, id.Receiver)
+	}
+}
+
+// Sent records bytes sent for a deal. It returns how long the transfer
+// should wait before sending more to stay under the limits on bytes per
+// second, which is either zero or at least MinWait, or an error wrapping
+// ErrLimitExceeded if the bytes took the peer or the provider over its
+// limit on bytes per day.
+func (l *Limiter) Sent(id retrievalmarket.ProviderDealIdentifier, n uint64) (time.Duration, error) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	now := l.clock.Now()
+	day := l.today()
+	pu := l.peerUsageLocked(id.Receiver)
+	pl := l.limitsLocked(id.Receiver)
+	pu.rollover(day)
+	l.total.rollover(day)
+
+	pu.sentToday += n
+	l.total.sentToday += n
+	if pl.BytesPerDay > 0 && pu.sentToday > pl.BytesPerDay {
+		return 0, xerrors.Errorf("%w: sent %d bytes to %s today, over the limit of %d per day", ErrLimitExceeded, pu.sentToday, id.Receiver, pl.BytesPerDay)
+	}
+	if l.global.BytesPerDay > 0 && l.total.sentToday > l.global.BytesPerDay {
+		return 0, xerrors.Errorf("%w: sent %d bytes today, over the limit of %d per day", ErrLimitExceeded, l.total.sentToday, l.global.BytesPerDay)
+	}
+
+	wait := pu.pace(now, n, pl.BytesPerSecond)
+	if total := l.total.pace(now, n, l.global.BytesPerSecond); total > wait {
+		wait = total
+	}
+	if wait < MinWait {
+		return 0, nil
+	}
+	return wait, nil
+}
+
+func (l *Limiter) limitsLocked(p peer.ID) Limits {
+	if limits, ok := l.peerLimits[p]; ok {
+		return limits
+	}
+	return l.perPeer
+}
+
+func (l *Limiter) peerUsageLocked(p peer.ID) *usage {
+	u, ok := l.peers[p]
+	if !ok {
+		u = &usage{day: l.today()}
+		l.peers[p] = u
+	}
+	return u
+}
+
+func (l *Limiter) today() int64 {
+	return l.clock.Now().UTC().Unix() / int64(24*time.Hour/time.Second)
+}
@@ -0,0 +1,94 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/ratelimit"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+func TestLimiter(t *testing.T) {
+	peers := tut.GeneratePeers(3)
+	deal := func(p int, id retrievalmarket.DealID) retrievalmarket.ProviderDealIdentifier {
+		return retrievalmarket.ProviderDealIdentifier{Receiver: peers[p], DealID: id}
+	}
+
+	t.Run("limits concurrent deals", func(t *testing.T) {
+		l := ratelimit.NewLimiter(ratelimit.Limits{MaxConcurrentDeals: 3}, ratelimit.Limits{MaxConcurrentDeals: 2}, ratelimit.LimiterClock(clock.NewMock()))
+		require.NoError(t, l.Admit(deal(0, 1)))
+		require.NoError(t, l.Admit(deal(0, 2)))
+		require.ErrorIs(t, l.Admit(deal(0, 3)), ratelimit.ErrLimitExceeded)
+		require.NoError(t, l.Admit(deal(1, 1)))
+		require.ErrorIs(t, l.Admit(deal(2, 1)), ratelimit.ErrLimitExceeded)
+
+		// releasing a deal frees its slot
+		l.Release(deal(0, 1))
+		require.NoError(t, l.Admit(deal(0, 3)))
+
+		// a peer can be given its own limits
+		l.Release(deal(1, 1))
+		l.SetPeerLimits(peers[2], ratelimit.Limits{MaxConcurrentDeals: 1})
+		require.NoError(t, l.Admit(deal(2, 1)))
+		l.Release(deal(0, 2))
+		require.ErrorIs(t, l.Admit(deal(2, 2)), ratelimit.ErrLimitExceeded)
+	})
+
+	t.Run("limits bytes per day", func(t *testing.T) {
+		clk := clock.NewMock()
+		l := ratelimit.NewLimiter(ratelimit.Limits{BytesPerDay: 1500}, ratelimit.Limits{BytesPerDay: 1000}, ratelimit.LimiterClock(clk))
+		require.NoError(t, l.Admit(deal(0, 1)))
+		_, err := l.Sent(deal(0, 1), 1000)
+		require.NoError(t, err)
+		_, err = l.Sent(deal(0, 1), 1)
+		require.ErrorIs(t, err, ratelimit.ErrLimitExceeded)
+		l.Release(deal(0, 1))
+		require.ErrorIs(t, l.Admit(deal(0, 2)), ratelimit.ErrLimitExceeded)
+
+		require.NoError(t, l.Admit(deal(1, 1)))
+		_, err = l.Sent(deal(1, 1), 600)
+		require.ErrorIs(t, err, ratelimit.ErrLimitExceeded)
+		l.Release(deal(1, 1))
+
+		// the limits reset at the start of the next day
+		clk.Add(24 * time.Hour)
+		require.NoError(t, l.Admit(deal(0, 2)))
+		_, err = l.Sent(deal(0, 2), 1000)
+		require.NoError(t, err)
+	})
+
+	t.Run("paces bytes per second", func(t *testing.T) {
+		clk := clock.NewMock()
+		l := ratelimit.NewLimiter(ratelimit.Limits{BytesPerSecond: 1000}, ratelimit.Limits{BytesPerSecond: 500}, ratelimit.LimiterClock(clk))
+		wait, err := l.Sent(deal(0, 1), 250)
+		require.NoError(t, err)
+		require.Equal(t, 500*time.Millisecond, wait)
+		wait, err = l.Sent(deal(0, 1), 250)
+		require.NoError(t, err)
+		require.Equal(t, time.Second, wait)
+
+		// the global limit paces across peers
+		wait, err = l.Sent(deal(1, 1), 500)
+		require.NoError(t, err)
+		require.Equal(t, time.Second, wait)
+
+		// time spent not sending is not saved up
+		clk.Add(10 * time.Second)
+		wait, err = l.Sent(deal(0, 1), 100)
+		require.NoError(t, err)
+		require.Equal(t, 200*time.Millisecond, wait)
+
+		// waits shorter than the minimum are carried over to the next bytes
+		clk.Add(10 * time.Second)
+		wait, err = l.Sent(deal(0, 1), 25)
+		require.NoError(t, err)
+		require.Zero(t, wait)
+		wait, err = l.Sent(deal(0, 1), 25)
+		require.NoError(t, err)
+		require.Equal(t, ratelimit.MinWait, wait)
+	})
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/ipld/go-ipld-prime/codec/dagcbor"
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	peer "github.com/libp2p/go-libp2p-core/peer"
+	cbg "github.com/whyrusleeping/cbor-gen"
 
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
@@ -33,13 +34,24 @@ func init() {
 
 // ValidationEnvironment contains the dependencies needed to validate deals
 type ValidationEnvironment interface {
-	GetAsk(ctx context.Context, payloadCid cid.Cid, pieceCid *cid.Cid, piece piecestore.PieceInfo, isUnsealed bool, client peer.ID) (retrievalmarket.Ask, error)
+	// GetAsk prices a retrieval of the data matched by the selector, which
+	// may be nil to retrieve the whole payload
+	GetAsk(ctx context.Context, payloadCid cid.Cid, pieceCid *cid.Cid, piece piecestore.PieceInfo, isUnsealed bool, client peer.ID, selector *cbg.Deferred) (retrievalmarket.Ask, error)
 
 	GetPiece(c cid.Cid, pieceCID *cid.Cid) (piecestore.PieceInfo, bool, error)
+	// FreeRetrievalRequired checks whether the provider only serves the
+	// retrieval in free mode
+	FreeRetrievalRequired(ctx context.Context, client peer.ID, payloadCid cid.Cid, pieceCid cid.Cid) (bool, error)
 	// CheckDealParams verifies the given deal params are acceptable
 	CheckDealParams(ask retrievalmarket.Ask, pricePerByte abi.TokenAmount, paymentInterval uint64, paymentIntervalIncrease uint64, unsealPrice abi.TokenAmount) error
 	// RunDealDecisioningLogic runs custom deal decision logic to decide if a deal is accepted, if present
 	RunDealDecisioningLogic(ctx context.Context, state retrievalmarket.ProviderDealState) (bool, string, error)
+	// AdmitDeal checks the deal against the provider's rate limits, if any,
+	// and counts it towards them
+	AdmitDeal(state retrievalmarket.ProviderDealState) error
+	// ReleaseDeal stops an admitted deal counting towards the provider's
+	// rate limits
+	ReleaseDeal(state retrievalmarket.ProviderDealState)
 	// StateMachines returns the FSM Group to begin tracking with
 	BeginTracking(pds retrievalmarket.ProviderDealState) error
 }
@@ -147,6 +159,9 @@ func (rv *ProviderRequestValidator) validatePull(isRestart bool, receiver peer.I
 
 	err = rv.env.BeginTracking(pds)
 	if err != nil {
+		// the deal was admitted but will never run, so it must not hold
+		// on to its place under the rate limits
+		rv.env.ReleaseDeal(pds)
 		return nil, err
 	}
 
@@ -167,16 +182,31 @@ func (rv *ProviderRequestValidator) acceptDeal(deal *retrievalmarket.ProviderDea
 	ctx, cancel := context.WithTimeout(context.TODO(), askTimeout)
 	defer cancel()
 
-	ask, err := rv.env.GetAsk(ctx, deal.PayloadCID, deal.PieceCID, pieceInfo, isUnsealed, deal.Receiver)
+	if deal.Free && (!deal.PricePerByte.IsZero() || !deal.UnsealPrice.IsZero()) {
+		return retrievalmarket.DealStatusRejected, errors.New("free retrieval proposed with a non-zero price")
+	}
+
+	freeRequired, err := rv.env.FreeRetrievalRequired(ctx, deal.Receiver, deal.PayloadCID, pieceInfo.PieceCID)
 	if err != nil {
 		return retrievalmarket.DealStatusErrored, err
 	}
 
-	// check that the deal parameters match our required parameters or
-	// reject outright
-	err = rv.env.CheckDealParams(ask, deal.PricePerByte, deal.PaymentInterval, deal.PaymentIntervalIncrease, deal.UnsealPrice)
-	if err != nil {
-		return retrievalmarket.DealStatusRejected, err
+	if freeRequired {
+		if !deal.Free {
+			return retrievalmarket.DealStatusRejected, errors.New("provider only serves this retrieval in free mode")
+		}
+	} else {
+		ask, err := rv.env.GetAsk(ctx, deal.PayloadCID, deal.PieceCID, pieceInfo, isUnsealed, deal.Receiver, deal.Selector)
+		if err != nil {
+			return retrievalmarket.DealStatusErrored, err
+		}
+
+		// check that the deal parameters match our required parameters or
+		// reject outright
+		err = rv.env.CheckDealParams(ask, deal.PricePerByte, deal.PaymentInterval, deal.PaymentIntervalIncrease, deal.UnsealPrice)
+		if err != nil {
+			return retrievalmarket.DealStatusRejected, err
+		}
 	}
 
 	accepted, reason, err := rv.env.RunDealDecisioningLogic(context.TODO(), *deal)
@@ -187,6 +217,11 @@ func (rv *ProviderRequestValidator) acceptDeal(deal *retrievalmarket.ProviderDea
 		return retrievalmarket.DealStatusRejected, errors.New(reason)
 	}
 
+	err = rv.env.AdmitDeal(*deal)
+	if err != nil {
+		return retrievalmarket.DealStatusRejected, err
+	}
+
 	deal.PieceInfo = &pieceInfo
 
 	if deal.UnsealPrice.GreaterThan(big.Zero()) {
@@ -12,9 +12,11 @@ import (
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
 
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
 
 	"github.com/filecoin-project/go-fil-markets/piecestore"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
@@ -47,6 +49,14 @@ func TestValidatePull(t *testing.T) {
 			UnsealPrice:             proposal.UnsealPrice,
 		},
 	}
+	freeProposal := proposal
+	freeProposal.PricePerByte = big.Zero()
+	freeProposal.UnsealPrice = big.Zero()
+	freeProposal.PaymentInterval = 0
+	freeProposal.PaymentIntervalIncrease = 0
+	freeProposal.Free = true
+	pricedFreeProposal := freeProposal
+	pricedFreeProposal.PricePerByte = abi.NewTokenAmount(1)
 	testCases := map[string]struct {
 		isRestart             bool
 		fve                   fakeValidationEnvironment
@@ -56,6 +66,7 @@ func TestValidatePull(t *testing.T) {
 		selector              ipld.Node
 		expectedVoucherResult datatransfer.VoucherResult
 		expectedError         error
+		expectReleased        bool
 	}{
 		"not a retrieval voucher": {
 			expectedError: errors.New("wrong voucher type"),
@@ -148,10 +159,11 @@ func TestValidatePull(t *testing.T) {
 				BeginTrackingError:              errors.New("everything is awful"),
 				RunDealDecisioningLogicAccepted: true,
 			},
-			baseCid:       proposal.PayloadCID,
-			selector:      selectorparse.CommonSelector_ExploreAllRecursively,
-			voucher:       &proposal,
-			expectedError: errors.New("everything is awful"),
+			baseCid:        proposal.PayloadCID,
+			selector:       selectorparse.CommonSelector_ExploreAllRecursively,
+			voucher:        &proposal,
+			expectedError:  errors.New("everything is awful"),
+			expectReleased: true,
 		},
 		"success": {
 			fve: fakeValidationEnvironment{
@@ -179,6 +191,80 @@ func TestValidatePull(t *testing.T) {
 				ID:     proposal.ID,
 			},
 		},
+		"free retrieval required, priced proposal": {
+			fve: fakeValidationEnvironment{
+				RequireFree:                     true,
+				RunDealDecisioningLogicAccepted: true,
+			},
+			baseCid:       proposal.PayloadCID,
+			selector:      selectorparse.CommonSelector_ExploreAllRecursively,
+			voucher:       &proposal,
+			expectedError: errors.New("provider only serves this retrieval in free mode"),
+			expectedVoucherResult: &retrievalmarket.DealResponse{
+				Status:  retrievalmarket.DealStatusRejected,
+				ID:      proposal.ID,
+				Message: "provider only serves this retrieval in free mode",
+			},
+		},
+		"free proposal with a price": {
+			fve: fakeValidationEnvironment{
+				RunDealDecisioningLogicAccepted: true,
+			},
+			baseCid:       proposal.PayloadCID,
+			selector:      selectorparse.CommonSelector_ExploreAllRecursively,
+			voucher:       &pricedFreeProposal,
+			expectedError: errors.New("free retrieval proposed with a non-zero price"),
+			expectedVoucherResult: &retrievalmarket.DealResponse{
+				Status:  retrievalmarket.DealStatusRejected,
+				ID:      proposal.ID,
+				Message: "free retrieval proposed with a non-zero price",
+			},
+		},
+		"free retrieval required, deal decisioning rejected": {
+			fve: fakeValidationEnvironment{
+				RequireFree:                       true,
+				RunDealDecisioningLogicFailReason: "something went wrong",
+			},
+			baseCid:       proposal.PayloadCID,
+			selector:      selectorparse.CommonSelector_ExploreAllRecursively,
+			voucher:       &freeProposal,
+			expectedError: errors.New("something went wrong"),
+			expectedVoucherResult: &retrievalmarket.DealResponse{
+				Status:  retrievalmarket.DealStatusRejected,
+				ID:      proposal.ID,
+				Message: "something went wrong",
+			},
+		},
+		"free retrieval required, success": {
+			fve: fakeValidationEnvironment{
+				RequireFree:                     true,
+				CheckDealParamsError:            errors.New("ask should not be checked"),
+				RunDealDecisioningLogicAccepted: true,
+			},
+			baseCid:       proposal.PayloadCID,
+			selector:      selectorparse.CommonSelector_ExploreAllRecursively,
+			voucher:       &freeProposal,
+			expectedError: datatransfer.ErrPause,
+			expectedVoucherResult: &retrievalmarket.DealResponse{
+				Status: retrievalmarket.DealStatusAccepted,
+				ID:     proposal.ID,
+			},
+		},
+		"rate limit exceeded": {
+			fve: fakeValidationEnvironment{
+				RunDealDecisioningLogicAccepted: true,
+				AdmitDealError:                  errors.New("already serving 2 deals, the most allowed at once"),
+			},
+			baseCid:       proposal.PayloadCID,
+			selector:      selectorparse.CommonSelector_ExploreAllRecursively,
+			voucher:       &proposal,
+			expectedError: errors.New("already serving 2 deals, the most allowed at once"),
+			expectedVoucherResult: &retrievalmarket.DealResponse{
+				Status:  retrievalmarket.DealStatusRejected,
+				ID:      proposal.ID,
+				Message: "already serving 2 deals, the most allowed at once",
+			},
+		},
 		"restart": {
 			isRestart: true,
 			fve: fakeValidationEnvironment{
@@ -196,6 +282,7 @@ func TestValidatePull(t *testing.T) {
 			requestValidator := requestvalidation.NewProviderRequestValidator(&data.fve)
 			voucherResult, err := requestValidator.ValidatePull(data.isRestart, datatransfer.ChannelID{}, data.sender, data.voucher, data.baseCid, data.selector)
 			require.Equal(t, data.expectedVoucherResult, voucherResult)
+			require.Equal(t, data.expectReleased, data.fve.released)
 			if data.expectedError == nil {
 				require.NoError(t, err)
 			} else {
@@ -214,13 +301,17 @@ type fakeValidationEnvironment struct {
 	RunDealDecisioningLogicAccepted   bool
 	RunDealDecisioningLogicFailReason string
 	RunDealDecisioningLogicError      error
+	AdmitDealError                    error
 	BeginTrackingError                error
+	RequireFree                       bool
 
 	Ask retrievalmarket.Ask
+
+	released bool
 }
 
 func (fve *fakeValidationEnvironment) GetAsk(ctx context.Context, payloadCid cid.Cid, pieceCid *cid.Cid,
-	piece piecestore.PieceInfo, isUnsealed bool, client peer.ID) (retrievalmarket.Ask, error) {
+	piece piecestore.PieceInfo, isUnsealed bool, client peer.ID, selector *cbg.Deferred) (retrievalmarket.Ask, error) {
 	return fve.Ask, nil
 }
 
@@ -228,6 +319,10 @@ func (fve *fakeValidationEnvironment) GetPiece(c cid.Cid, pieceCID *cid.Cid) (pi
 	return fve.PieceInfo, fve.IsUnsealedPiece, fve.GetPieceErr
 }
 
+func (fve *fakeValidationEnvironment) FreeRetrievalRequired(ctx context.Context, client peer.ID, payloadCid cid.Cid, pieceCid cid.Cid) (bool, error) {
+	return fve.RequireFree, nil
+}
+
 // CheckDealParams verifies the given deal params are acceptable
 func (fve *fakeValidationEnvironment) CheckDealParams(ask retrievalmarket.Ask, pricePerByte abi.TokenAmount, paymentInterval uint64, paymentIntervalIncrease uint64, unsealPrice abi.TokenAmount) error {
 	return fve.CheckDealParamsError
@@ -238,6 +333,14 @@ func (fve *fakeValidationEnvironment) RunDealDecisioningLogic(ctx context.Contex
 	return fve.RunDealDecisioningLogicAccepted, fve.RunDealDecisioningLogicFailReason, fve.RunDealDecisioningLogicError
 }
 
+func (fve *fakeValidationEnvironment) AdmitDeal(state retrievalmarket.ProviderDealState) error {
+	return fve.AdmitDealError
+}
+
+func (fve *fakeValidationEnvironment) ReleaseDeal(state retrievalmarket.ProviderDealState) {
+	fve.released = true
+}
+
 // StateMachines returns the FSM Group to begin tracking with
 func (fve *fakeValidationEnvironment) BeginTracking(pds retrievalmarket.ProviderDealState) error {
 	return fve.BeginTrackingError
@@ -4,12 +4,15 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"time"
 
 	logging "github.com/ipfs/go-log/v2"
 
+	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
+	paychtypes "github.com/filecoin-project/go-state-types/builtin/v8/paych"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
@@ -24,6 +27,15 @@ type RevalidatorEnvironment interface {
 	Node() rm.RetrievalProviderNode
 	SendEvent(dealID rm.ProviderDealIdentifier, evt rm.ProviderEvent, args ...interface{}) error
 	Get(dealID rm.ProviderDealIdentifier) (rm.ProviderDealState, error)
+	// ThrottleTransfer records bytes sent for a deal against the provider's
+	// rate limits, if any, returning how long the transfer should pause
+	// before more can be sent
+	ThrottleTransfer(dealID rm.ProviderDealIdentifier, bytesSent uint64) (time.Duration, error)
+	// ResumeTransferAfter resumes a paused transfer once wait has passed
+	ResumeTransferAfter(chid datatransfer.ChannelID, wait time.Duration)
+	// RecordPaymentVoucher records a voucher that has been saved, so that it
+	// can be redeemed before its payment channel settles
+	RecordPaymentVoucher(paymentChannel address.Address, voucher *paychtypes.SignedVoucher) error
 }
 
 type channelData struct {
@@ -34,6 +46,7 @@ type channelData struct {
 	pricePerByte   abi.TokenAmount
 	reload         bool
 	legacyProtocol bool
+	free           bool
 }
 
 // ProviderRevalidator defines data transfer revalidation logic in the context of
@@ -104,6 +117,7 @@ func (pr *ProviderRevalidator) writeDealState(deal rm.ProviderDealState) {
 	channel.interval = deal.CurrentInterval
 	channel.pricePerByte = deal.PricePerByte
 	channel.legacyProtocol = deal.LegacyProtocol
+	channel.free = deal.Free
 }
 
 // Revalidate revalidates a request with a new voucher
@@ -115,6 +129,12 @@ func (pr *ProviderRevalidator) Revalidate(channelID datatransfer.ChannelID, vouc
 		return nil, nil
 	}
 
+	// free retrievals never request payment, so never expect any
+	if channel.free {
+		err := errors.New("payment received for free retrieval")
+		return finalResponse(errorDealResponse(channel.dealID, err), channel.legacyProtocol), err
+	}
+
 	// read payment, or fail
 	payment, ok := voucher.(*rm.DealPayment)
 	var legacyProtocol bool
@@ -155,6 +175,12 @@ func (pr *ProviderRevalidator) processPayment(dealID rm.ProviderDealIdentifier,
 		return errorDealResponse(dealID, err), err
 	}
 
+	// a voucher the provider can't redeem doesn't pay for anything
+	if err := pr.env.RecordPaymentVoucher(payment.PaymentChannel, payment.PaymentVoucher); err != nil {
+		_ = pr.env.SendEvent(dealID, rm.ProviderEventSaveVoucherFailed, err)
+		return errorDealResponse(dealID, err), err
+	}
+
 	totalPaid := big.Add(deal.FundsReceived, received)
 
 	// check if all payments are received to continue the deal, or send updated required payment
@@ -186,7 +212,7 @@ func (pr *ProviderRevalidator) processPayment(dealID rm.ProviderDealIdentifier,
 
 	// We shouldn't resume the data transfer if we haven't finished unsealing/reading the unsealed data into the
 	// local block-store.
-	if deal.Status == rm.DealStatusUnsealing || deal.Status == rm.DealStatusFundsNeededUnseal {
+	if deal.Status == rm.DealStatusUnsealQueued || deal.Status == rm.DealStatusUnsealing || deal.Status == rm.DealStatusFundsNeededUnseal {
 		return nil, nil
 	}
 
@@ -243,6 +269,28 @@ func (pr *ProviderRevalidator) OnPullDataSent(chid datatransfer.ChannelID, addit
 		return false, nil, nil
 	}
 
+	// The deal has already been accepted, so going over a rate limit ends
+	// it with an error rather than rejecting it
+	wait, err := pr.env.ThrottleTransfer(channel.dealID, additionalBytesSent)
+	if err != nil {
+		return true, finalResponse(errorDealResponse(channel.dealID, err), channel.legacyProtocol), err
+	}
+
+	handled, result, err := pr.processPullDataSent(channel, additionalBytesSent)
+	if err == nil && wait > 0 {
+		// Pause the transfer until the bytes sent have been paced out. A
+		// transfer that is already pausing for payment is not held up
+		// further: the wait is carried over to the bytes sent after it
+		// resumes.
+		pr.env.ResumeTransferAfter(chid, wait)
+		return handled, result, datatransfer.ErrPause
+	}
+	return handled, result, err
+}
+
+// processPullDataSent records bytes sent on a channel, requesting payment
+// once the channel's payment interval has been sent
+func (pr *ProviderRevalidator) processPullDataSent(channel *channelData, additionalBytesSent uint64) (bool, datatransfer.VoucherResult, error) {
 	err := pr.loadDealState(channel)
 	if err != nil {
 		return true, nil, err
@@ -250,6 +298,9 @@ func (pr *ProviderRevalidator) OnPullDataSent(chid datatransfer.ChannelID, addit
 
 	// Calculate how much data has been sent in total
 	channel.totalSent += additionalBytesSent
+	if channel.free {
+		return true, nil, pr.env.SendEvent(channel.dealID, rm.ProviderEventBlockSent, channel.totalSent)
+	}
 	if channel.pricePerByte.IsZero() || channel.totalSent < channel.interval {
 		if !channel.pricePerByte.IsZero() {
 			log.Debugf("provider: total sent %d < interval %d, sending block", channel.totalSent, channel.interval)
@@ -304,6 +355,13 @@ func (pr *ProviderRevalidator) OnComplete(chid datatransfer.ChannelID) (bool, da
 		return true, nil, err
 	}
 
+	if channel.free {
+		return true, finalResponse(&rm.DealResponse{
+			ID:     channel.dealID.DealID,
+			Status: rm.DealStatusCompleted,
+		}, channel.legacyProtocol), nil
+	}
+
 	// Calculate how much payment is owed
 	paymentOwed := big.Mul(abi.NewTokenAmount(int64(channel.totalSent-channel.totalPaidFor)), channel.pricePerByte)
 	if paymentOwed.Equals(big.Zero()) {
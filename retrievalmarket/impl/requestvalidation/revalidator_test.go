@@ -4,6 +4,7 @@ import (
 	"errors"
 	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -11,6 +12,7 @@ import (
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
+	paychtypes "github.com/filecoin-project/go-state-types/builtin/v8/paych"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
@@ -36,8 +38,13 @@ func TestOnPullDataSent(t *testing.T) {
 	dealZeroPricePerByte.PricePerByte = big.Zero()
 	legacyDeal := deal
 	legacyDeal.LegacyProtocol = true
+	freeDeal := deal
+	freeDeal.Free = true
 	testCases := map[string]struct {
 		noSend          bool
+		throttleWait    time.Duration
+		throttleError   error
+		expectResume    bool
 		expectedID      rm.ProviderDealIdentifier
 		expectedEvent   rm.ProviderEvent
 		expectedArgs    []interface{}
@@ -62,6 +69,34 @@ func TestOnPullDataSent(t *testing.T) {
 			expectedHandled: true,
 			dataAmount:      uint64(500),
 		},
+		"pause a rate limited transfer": {
+			deal:            deal,
+			channelID:       *deal.ChannelID,
+			throttleWait:    time.Second,
+			expectedID:      deal.Identifier(),
+			expectedEvent:   rm.ProviderEventBlockSent,
+			expectedArgs:    []interface{}{deal.TotalSent + uint64(500)},
+			expectedHandled: true,
+			dataAmount:      uint64(500),
+			expectedError:   datatransfer.ErrPause,
+			expectResume:    true,
+		},
+		"rate limited transfer pausing for payment is resumed by the payment": {
+			deal:          deal,
+			channelID:     *deal.ChannelID,
+			throttleWait:  time.Second,
+			expectedID:    deal.Identifier(),
+			expectedEvent: rm.ProviderEventPaymentRequested,
+			expectedArgs:  []interface{}{deal.TotalSent + defaultCurrentInterval},
+			dataAmount:    defaultCurrentInterval,
+			expectedError: datatransfer.ErrPause,
+			expectedResult: &rm.DealResponse{
+				ID:          deal.ID,
+				Status:      rm.DealStatusFundsNeeded,
+				PaymentOwed: big.Mul(abi.NewTokenAmount(int64(defaultCurrentInterval)), defaultPricePerByte),
+			},
+			expectedHandled: true,
+		},
 		"record block zero price per byte": {
 			deal:            dealZeroPricePerByte,
 			channelID:       *dealZeroPricePerByte.ChannelID,
@@ -71,6 +106,15 @@ func TestOnPullDataSent(t *testing.T) {
 			expectedHandled: true,
 			dataAmount:      uint64(500),
 		},
+		"free deal never requests payment": {
+			deal:            freeDeal,
+			channelID:       *freeDeal.ChannelID,
+			expectedID:      freeDeal.Identifier(),
+			expectedEvent:   rm.ProviderEventBlockSent,
+			expectedArgs:    []interface{}{freeDeal.TotalSent + defaultCurrentInterval},
+			expectedHandled: true,
+			dataAmount:      defaultCurrentInterval,
+		},
 		"request payment": {
 			deal:          deal,
 			channelID:     *deal.ChannelID,
@@ -101,14 +145,30 @@ func TestOnPullDataSent(t *testing.T) {
 			},
 			expectedHandled: true,
 		},
+		"daily limit exceeded": {
+			deal:          deal,
+			channelID:     *deal.ChannelID,
+			throttleError: errors.New("sent 1500 bytes today, over the limit of 1000 per day"),
+			dataAmount:    uint64(500),
+			noSend:        true,
+			expectedError: errors.New("sent 1500 bytes today, over the limit of 1000 per day"),
+			expectedResult: &rm.DealResponse{
+				ID:      deal.ID,
+				Status:  rm.DealStatusErrored,
+				Message: "sent 1500 bytes today, over the limit of 1000 per day",
+			},
+			expectedHandled: true,
+		},
 	}
 	for testCase, data := range testCases {
 		t.Run(testCase, func(t *testing.T) {
 			tn := testnodes.NewTestRetrievalProviderNode()
 			fre := &fakeRevalidatorEnvironment{
-				node:         tn,
-				returnedDeal: data.deal,
-				getError:     nil,
+				node:          tn,
+				returnedDeal:  data.deal,
+				getError:      nil,
+				throttleWait:  data.throttleWait,
+				throttleError: data.throttleError,
 			}
 			revalidator := requestvalidation.NewProviderRevalidator(fre)
 			revalidator.TrackChannel(data.deal)
@@ -121,6 +181,11 @@ func TestOnPullDataSent(t *testing.T) {
 				require.Error(t, err)
 				require.EqualError(t, err, data.expectedError.Error())
 			}
+			if data.expectResume {
+				require.Equal(t, []time.Duration{data.throttleWait}, fre.resumes[data.channelID])
+			} else {
+				require.Empty(t, fre.resumes)
+			}
 			if !data.noSend {
 				require.Len(t, fre.sentEvents, 1)
 				event := fre.sentEvents[0]
@@ -140,6 +205,8 @@ func TestOnComplete(t *testing.T) {
 	dealZeroPricePerByte.PricePerByte = big.Zero()
 	legacyDeal := deal
 	legacyDeal.LegacyProtocol = true
+	freeDeal := deal
+	freeDeal.Free = true
 	channelID := *deal.ChannelID
 	testCases := map[string]struct {
 		expectedEvents []eventSent
@@ -203,6 +270,26 @@ func TestOnComplete(t *testing.T) {
 			deal:      legacyDeal,
 			channelID: channelID,
 		},
+		"free deal": {
+			unpaidAmount: uint64(500),
+			expectedEvents: []eventSent{
+				{
+					ID:    freeDeal.Identifier(),
+					Event: rm.ProviderEventBlockSent,
+					Args:  []interface{}{freeDeal.TotalSent + 500},
+				},
+				{
+					ID:    freeDeal.Identifier(),
+					Event: rm.ProviderEventBlocksCompleted,
+				},
+			},
+			expectedResult: &rm.DealResponse{
+				ID:     freeDeal.ID,
+				Status: rm.DealStatusCompleted,
+			},
+			deal:      freeDeal,
+			channelID: channelID,
+		},
 		"all funds paid": {
 			unpaidAmount: uint64(0),
 			expectedEvents: []eventSent{
@@ -322,8 +409,20 @@ func TestRevalidate(t *testing.T) {
 		PaymentChannel: payCh,
 		PaymentVoucher: smallerVoucher,
 	}
+	// a deal on a lane reused from an earlier deal, that was paid laneBase,
+	// makes vouchers for laneBase plus what it has paid
+	laneBase := abi.NewTokenAmount(5000000)
+	reusedLaneVoucher := shared_testutil.MakeTestSignedVoucher()
+	reusedLaneVoucher.Amount = big.Sum(laneBase, defaultFundsReceived, defaultPaymentPerInterval)
+	reusedLanePayment := &retrievalmarket.DealPayment{
+		ID:             deal.ID,
+		PaymentChannel: payCh,
+		PaymentVoucher: reusedLaneVoucher,
+	}
 	lastPaymentDeal := deal
 	lastPaymentDeal.Status = rm.DealStatusFundsNeededLastPayment
+	freeDeal := deal
+	freeDeal.Free = true
 	testCases := map[string]struct {
 		configureTestNode func(tn *testnodes.TestRetrievalProviderNode)
 		noSend            bool
@@ -331,17 +430,31 @@ func TestRevalidate(t *testing.T) {
 		expectedEvent     rm.ProviderEvent
 		expectedArgs      []interface{}
 		getError          error
+		recordError       error
 		deal              rm.ProviderDealState
 		channelID         datatransfer.ChannelID
 		voucher           datatransfer.Voucher
 		expectedResult    datatransfer.VoucherResult
 		expectedError     error
+		expectedRecorded  *paychtypes.SignedVoucher
 	}{
 		"not tracked": {
 			deal:      deal,
 			channelID: shared_testutil.MakeTestChannelID(),
 			noSend:    true,
 		},
+		"payment for free deal": {
+			deal:          freeDeal,
+			channelID:     channelID,
+			voucher:       payment,
+			noSend:        true,
+			expectedError: errors.New("payment received for free retrieval"),
+			expectedResult: &rm.DealResponse{
+				ID:      deal.ID,
+				Status:  rm.DealStatusErrored,
+				Message: "payment received for free retrieval",
+			},
+		},
 		"not a payment voucher": {
 			deal:          deal,
 			channelID:     channelID,
@@ -416,6 +529,21 @@ func TestRevalidate(t *testing.T) {
 				Message: "your money's no good here",
 			},
 		},
+		"voucher that can't be redeemed": {
+			deal:          deal,
+			channelID:     channelID,
+			voucher:       payment,
+			recordError:   errors.New("payment channel can no longer be redeemed"),
+			expectedError: errors.New("payment channel can no longer be redeemed"),
+			expectedID:    deal.Identifier(),
+			expectedEvent: rm.ProviderEventSaveVoucherFailed,
+			expectedArgs:  []interface{}{errors.New("payment channel can no longer be redeemed")},
+			expectedResult: &rm.DealResponse{
+				ID:      deal.ID,
+				Status:  rm.DealStatusErrored,
+				Message: "payment channel can no longer be redeemed",
+			},
+		},
 		"not enough funds send": {
 			deal:          deal,
 			channelID:     channelID,
@@ -429,6 +557,7 @@ func TestRevalidate(t *testing.T) {
 				Status:      deal.Status,
 				PaymentOwed: big.Sub(defaultPaymentPerInterval, smallerPaymentAmt),
 			},
+			expectedRecorded: smallerVoucher,
 		},
 		"not enough funds send, legacyPayment": {
 			deal:          deal,
@@ -443,15 +572,17 @@ func TestRevalidate(t *testing.T) {
 				Status:      deal.Status,
 				PaymentOwed: big.Sub(defaultPaymentPerInterval, smallerPaymentAmt),
 			},
+			expectedRecorded: smallerVoucher,
 		},
 		"it works": {
-			deal:          deal,
-			channelID:     channelID,
-			voucher:       payment,
-			expectedID:    deal.Identifier(),
-			expectedEvent: rm.ProviderEventPaymentReceived,
-			expectedArgs:  []interface{}{defaultPaymentPerInterval},
-			expectedError: datatransfer.ErrResume,
+			deal:             deal,
+			channelID:        channelID,
+			voucher:          payment,
+			expectedID:       deal.Identifier(),
+			expectedEvent:    rm.ProviderEventPaymentReceived,
+			expectedArgs:     []interface{}{defaultPaymentPerInterval},
+			expectedError:    datatransfer.ErrResume,
+			expectedRecorded: voucher,
 		},
 
 		"it completes": {
@@ -466,6 +597,7 @@ func TestRevalidate(t *testing.T) {
 				ID:     deal.ID,
 				Status: rm.DealStatusCompleted,
 			},
+			expectedRecorded: voucher,
 		},
 		"it completes, legacy payment": {
 			deal:          lastPaymentDeal,
@@ -479,15 +611,30 @@ func TestRevalidate(t *testing.T) {
 				ID:     deal.ID,
 				Status: rm.DealStatusCompleted,
 			},
+			expectedRecorded: voucher,
+		},
+		"voucher on a reused lane": {
+			configureTestNode: func(tn *testnodes.TestRetrievalProviderNode) {
+				tn.AddReceivedVoucher(big.Add(laneBase, defaultFundsReceived))
+			},
+			deal:             deal,
+			channelID:        channelID,
+			voucher:          reusedLanePayment,
+			expectedID:       deal.Identifier(),
+			expectedError:    datatransfer.ErrResume,
+			expectedEvent:    rm.ProviderEventPaymentReceived,
+			expectedArgs:     []interface{}{defaultPaymentPerInterval},
+			expectedRecorded: reusedLaneVoucher,
 		},
 		"voucher already saved": {
-			deal:          deal,
-			channelID:     channelID,
-			voucher:       payment,
-			expectedID:    deal.Identifier(),
-			expectedError: datatransfer.ErrResume,
-			expectedEvent: rm.ProviderEventPaymentReceived,
-			expectedArgs:  []interface{}{defaultPaymentPerInterval},
+			deal:             deal,
+			channelID:        channelID,
+			voucher:          payment,
+			expectedID:       deal.Identifier(),
+			expectedError:    datatransfer.ErrResume,
+			expectedEvent:    rm.ProviderEventPaymentReceived,
+			expectedArgs:     []interface{}{defaultPaymentPerInterval},
+			expectedRecorded: voucher,
 		},
 	}
 	for testCase, data := range testCases {
@@ -501,6 +648,7 @@ func TestRevalidate(t *testing.T) {
 				node:         tn,
 				returnedDeal: data.deal,
 				getError:     data.getError,
+				recordError:  data.recordError,
 			}
 			revalidator := requestvalidation.NewProviderRevalidator(fre)
 			revalidator.TrackChannel(data.deal)
@@ -521,6 +669,11 @@ func TestRevalidate(t *testing.T) {
 			} else {
 				require.Len(t, fre.sentEvents, 0)
 			}
+			if data.expectedRecorded != nil {
+				require.Equal(t, []recordedVoucher{{payCh, data.expectedRecorded}}, fre.recorded)
+			} else {
+				require.Empty(t, fre.recorded)
+			}
 		})
 	}
 }
@@ -536,6 +689,16 @@ type fakeRevalidatorEnvironment struct {
 	sendEventError error
 	returnedDeal   rm.ProviderDealState
 	getError       error
+	throttleWait   time.Duration
+	throttleError  error
+	resumes        map[datatransfer.ChannelID][]time.Duration
+	recorded       []recordedVoucher
+	recordError    error
+}
+
+type recordedVoucher struct {
+	paymentChannel address.Address
+	voucher        *paychtypes.SignedVoucher
 }
 
 func (fre *fakeRevalidatorEnvironment) Node() rm.RetrievalProviderNode {
@@ -551,6 +714,25 @@ func (fre *fakeRevalidatorEnvironment) Get(dealID rm.ProviderDealIdentifier) (rm
 	return fre.returnedDeal, fre.getError
 }
 
+func (fre *fakeRevalidatorEnvironment) ThrottleTransfer(dealID rm.ProviderDealIdentifier, bytesSent uint64) (time.Duration, error) {
+	return fre.throttleWait, fre.throttleError
+}
+
+func (fre *fakeRevalidatorEnvironment) ResumeTransferAfter(chid datatransfer.ChannelID, wait time.Duration) {
+	if fre.resumes == nil {
+		fre.resumes = make(map[datatransfer.ChannelID][]time.Duration)
+	}
+	fre.resumes[chid] = append(fre.resumes[chid], wait)
+}
+
+func (fre *fakeRevalidatorEnvironment) RecordPaymentVoucher(paymentChannel address.Address, voucher *paychtypes.SignedVoucher) error {
+	if fre.recordError != nil {
+		return fre.recordError
+	}
+	fre.recorded = append(fre.recorded, recordedVoucher{paymentChannel, voucher})
+	return nil
+}
+
 var dealID = retrievalmarket.DealID(10)
 var defaultCurrentInterval = uint64(3000)
 var defaultPaymentInterval = uint64(1000)
@@ -0,0 +1,73 @@
+package settlement
+
+import (
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	paychtypes "github.com/filecoin-project/go-state-types/builtin/v8/paych"
+)
+
+//go:generate cbor-gen-for --map-encoding ChannelRecord LaneRecord
+
+// ChannelRecord is the persisted record of the vouchers a provider has
+// received on a payment channel, and of the progress of its settlement
+type ChannelRecord struct {
+	Channel address.Address
+	// Lanes holds the best voucher received on each lane of the channel
+	Lanes []LaneRecord
+	// FirstSeen is the epoch at which the channel was first checked after
+	// a voucher was received on it
+	FirstSeen abi.ChainEpoch
+	// LastVoucher is the epoch at which the last voucher that was better
+	// than the one before on its lane was received, or zero for records
+	// saved before it was kept
+	LastVoucher abi.ChainEpoch
+	// SettlingAt is the epoch at which the channel settles, or zero if
+	// settlement has not been started
+	SettlingAt abi.ChainEpoch
+	// SettleMessage is the message sent to start settlement, if any
+	SettleMessage *cid.Cid
+	// CollectMessage is the message sent to collect the channel's funds,
+	// if any
+	CollectMessage *cid.Cid
+}
+
+// LaneRecord is the best voucher received on a lane of a payment channel
+type LaneRecord struct {
+	Lane    uint64
+	Voucher *paychtypes.SignedVoucher
+	// SubmitMessage is the message sent to redeem Voucher, if any
+	SubmitMessage *cid.Cid
+}
+
+func (r *ChannelRecord) lane(lane uint64) *LaneRecord {
+	for i := range r.Lanes {
+		if r.Lanes[i].Lane == lane {
+			return &r.Lanes[i]
+		}
+	}
+	return nil
+}
+
+// collected is true once the channel's funds have been collected
+func (r *ChannelRecord) collected() bool {
+	return r.CollectMessage != nil
+}
+
+// lastActive is the latest epoch at which the channel is known to have
+// been in use
+func (r *ChannelRecord) lastActive() abi.ChainEpoch {
+	if r.LastVoucher > r.FirstSeen {
+		return r.LastVoucher
+	}
+	return r.FirstSeen
+}
+
+// copy returns a copy of the record that can be modified without
+// changing the original
+func (r *ChannelRecord) copy() *ChannelRecord {
+	c := *r
+	c.Lanes = append([]LaneRecord(nil), r.Lanes...)
+	return &c
+}
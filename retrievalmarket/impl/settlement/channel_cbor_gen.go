@@ -0,0 +1,573 @@
+// Code generated by github.com/whyrusleeping/cbor-gen. DO NOT EDIT.
+
+package settlement
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	abi "github.com/filecoin-project/go-state-types/abi"
+	paych "github.com/filecoin-project/go-state-types/builtin/v8/paych"
+	cid "github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	xerrors "golang.org/x/xerrors"
+)
+
+var _ = xerrors.Errorf
+var _ = cid.Undef
+var _ = math.E
+var _ = sort.Sort
+
+func (t *ChannelRecord) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write([]byte{167}); err != nil {
+		return err
+	}
+
+	// t.Channel (address.Address) (struct)
+	if len("Channel") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Channel\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Channel"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Channel")); err != nil {
+		return err
+	}
+
+	if err := t.Channel.MarshalCBOR(cw); err != nil {
+		return err
+	}
+
+	// t.Lanes ([]settlement.LaneRecord) (slice)
+	if len("Lanes") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Lanes\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Lanes"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Lanes")); err != nil {
+		return err
+	}
+
+	if len(t.Lanes) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.Lanes was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajArray, uint64(len(t.Lanes))); err != nil {
+		return err
+	}
+	for _, v := range t.Lanes {
+		if err := v.MarshalCBOR(cw); err != nil {
+			return err
+		}
+	}
+
+	// t.FirstSeen (abi.ChainEpoch) (int64)
+	if len("FirstSeen") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"FirstSeen\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("FirstSeen"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("FirstSeen")); err != nil {
+		return err
+	}
+
+	if t.FirstSeen >= 0 {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.FirstSeen)); err != nil {
+			return err
+		}
+	} else {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-t.FirstSeen-1)); err != nil {
+			return err
+		}
+	}
+
+	// t.LastVoucher (abi.ChainEpoch) (int64)
+	if len("LastVoucher") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"LastVoucher\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("LastVoucher"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("LastVoucher")); err != nil {
+		return err
+	}
+
+	if t.LastVoucher >= 0 {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.LastVoucher)); err != nil {
+			return err
+		}
+	} else {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-t.LastVoucher-1)); err != nil {
+			return err
+		}
+	}
+
+	// t.SettlingAt (abi.ChainEpoch) (int64)
+	if len("SettlingAt") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"SettlingAt\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("SettlingAt"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("SettlingAt")); err != nil {
+		return err
+	}
+
+	if t.SettlingAt >= 0 {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.SettlingAt)); err != nil {
+			return err
+		}
+	} else {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-t.SettlingAt-1)); err != nil {
+			return err
+		}
+	}
+
+	// t.SettleMessage (cid.Cid) (struct)
+	if len("SettleMessage") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"SettleMessage\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("SettleMessage"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("SettleMessage")); err != nil {
+		return err
+	}
+
+	if t.SettleMessage == nil {
+		if _, err := cw.Write(cbg.CborNull); err != nil {
+			return err
+		}
+	} else {
+		if err := cbg.WriteCid(cw, *t.SettleMessage); err != nil {
+			return xerrors.Errorf("failed to write cid field t.SettleMessage: %w", err)
+		}
+	}
+
+	// t.CollectMessage (cid.Cid) (struct)
+	if len("CollectMessage") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"CollectMessage\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("CollectMessage"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("CollectMessage")); err != nil {
+		return err
+	}
+
+	if t.CollectMessage == nil {
+		if _, err := cw.Write(cbg.CborNull); err != nil {
+			return err
+		}
+	} else {
+		if err := cbg.WriteCid(cw, *t.CollectMessage); err != nil {
+			return xerrors.Errorf("failed to write cid field t.CollectMessage: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (t *ChannelRecord) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = ChannelRecord{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("ChannelRecord: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadString(cr)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Channel (address.Address) (struct)
+		case "Channel":
+
+			{
+
+				if err := t.Channel.UnmarshalCBOR(cr); err != nil {
+					return xerrors.Errorf("unmarshaling t.Channel: %w", err)
+				}
+
+			}
+			// t.Lanes ([]settlement.LaneRecord) (slice)
+		case "Lanes":
+
+			maj, extra, err = cr.ReadHeader()
+			if err != nil {
+				return err
+			}
+
+			if extra > cbg.MaxLength {
+				return fmt.Errorf("t.Lanes: array too large (%d)", extra)
+			}
+
+			if maj != cbg.MajArray {
+				return fmt.Errorf("expected cbor array")
+			}
+
+			if extra > 0 {
+				t.Lanes = make([]LaneRecord, extra)
+			}
+
+			for i := 0; i < int(extra); i++ {
+
+				var v LaneRecord
+				if err := v.UnmarshalCBOR(cr); err != nil {
+					return err
+				}
+
+				t.Lanes[i] = v
+			}
+
+			// t.FirstSeen (abi.ChainEpoch) (int64)
+		case "FirstSeen":
+			{
+				maj, extra, err := cr.ReadHeader()
+				var extraI int64
+				if err != nil {
+					return err
+				}
+				switch maj {
+				case cbg.MajUnsignedInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 positive overflow")
+					}
+				case cbg.MajNegativeInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 negative oveflow")
+					}
+					extraI = -1 - extraI
+				default:
+					return fmt.Errorf("wrong type for int64 field: %d", maj)
+				}
+
+				t.FirstSeen = abi.ChainEpoch(extraI)
+			}
+			// t.LastVoucher (abi.ChainEpoch) (int64)
+		case "LastVoucher":
+			{
+				maj, extra, err := cr.ReadHeader()
+				var extraI int64
+				if err != nil {
+					return err
+				}
+				switch maj {
+				case cbg.MajUnsignedInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 positive overflow")
+					}
+				case cbg.MajNegativeInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 negative oveflow")
+					}
+					extraI = -1 - extraI
+				default:
+					return fmt.Errorf("wrong type for int64 field: %d", maj)
+				}
+
+				t.LastVoucher = abi.ChainEpoch(extraI)
+			}
+			// t.SettlingAt (abi.ChainEpoch) (int64)
+		case "SettlingAt":
+			{
+				maj, extra, err := cr.ReadHeader()
+				var extraI int64
+				if err != nil {
+					return err
+				}
+				switch maj {
+				case cbg.MajUnsignedInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 positive overflow")
+					}
+				case cbg.MajNegativeInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 negative oveflow")
+					}
+					extraI = -1 - extraI
+				default:
+					return fmt.Errorf("wrong type for int64 field: %d", maj)
+				}
+
+				t.SettlingAt = abi.ChainEpoch(extraI)
+			}
+			// t.SettleMessage (cid.Cid) (struct)
+		case "SettleMessage":
+
+			{
+
+				b, err := cr.ReadByte()
+				if err != nil {
+					return err
+				}
+				if b != cbg.CborNull[0] {
+					if err := cr.UnreadByte(); err != nil {
+						return err
+					}
+
+					c, err := cbg.ReadCid(cr)
+					if err != nil {
+						return xerrors.Errorf("failed to read cid field t.SettleMessage: %w", err)
+					}
+
+					t.SettleMessage = &c
+				}
+
+			}
+			// t.CollectMessage (cid.Cid) (struct)
+		case "CollectMessage":
+
+			{
+
+				b, err := cr.ReadByte()
+				if err != nil {
+					return err
+				}
+				if b != cbg.CborNull[0] {
+					if err := cr.UnreadByte(); err != nil {
+						return err
+					}
+
+					c, err := cbg.ReadCid(cr)
+					if err != nil {
+						return xerrors.Errorf("failed to read cid field t.CollectMessage: %w", err)
+					}
+
+					t.CollectMessage = &c
+				}
+
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
+func (t *LaneRecord) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write([]byte{163}); err != nil {
+		return err
+	}
+
+	// t.Lane (uint64) (uint64)
+	if len("Lane") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Lane\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Lane"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Lane")); err != nil {
+		return err
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Lane)); err != nil {
+		return err
+	}
+
+	// t.Voucher (paych.SignedVoucher) (struct)
+	if len("Voucher") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Voucher\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Voucher"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Voucher")); err != nil {
+		return err
+	}
+
+	if err := t.Voucher.MarshalCBOR(cw); err != nil {
+		return err
+	}
+
+	// t.SubmitMessage (cid.Cid) (struct)
+	if len("SubmitMessage") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"SubmitMessage\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("SubmitMessage"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("SubmitMessage")); err != nil {
+		return err
+	}
+
+	if t.SubmitMessage == nil {
+		if _, err := cw.Write(cbg.CborNull); err != nil {
+			return err
+		}
+	} else {
+		if err := cbg.WriteCid(cw, *t.SubmitMessage); err != nil {
+			return xerrors.Errorf("failed to write cid field t.SubmitMessage: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (t *LaneRecord) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = LaneRecord{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("LaneRecord: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadString(cr)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Lane (uint64) (uint64)
+		case "Lane":
+
+			{
+
+				maj, extra, err = cr.ReadHeader()
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.Lane = uint64(extra)
+
+			}
+			// t.Voucher (paych.SignedVoucher) (struct)
+		case "Voucher":
+
+			{
+
+				b, err := cr.ReadByte()
+				if err != nil {
+					return err
+				}
+				if b != cbg.CborNull[0] {
+					if err := cr.UnreadByte(); err != nil {
+						return err
+					}
+					t.Voucher = new(paych.SignedVoucher)
+					if err := t.Voucher.UnmarshalCBOR(cr); err != nil {
+						return xerrors.Errorf("unmarshaling t.Voucher pointer: %w", err)
+					}
+				}
+
+			}
+			// t.SubmitMessage (cid.Cid) (struct)
+		case "SubmitMessage":
+
+			{
+
+				b, err := cr.ReadByte()
+				if err != nil {
+					return err
+				}
+				if b != cbg.CborNull[0] {
+					if err := cr.UnreadByte(); err != nil {
+						return err
+					}
+
+					c, err := cbg.ReadCid(cr)
+					if err != nil {
+						return xerrors.Errorf("failed to read cid field t.SubmitMessage: %w", err)
+					}
+
+					t.SubmitMessage = &c
+				}
+
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
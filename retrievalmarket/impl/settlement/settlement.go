@@ -0,0 +1,473 @@
+// Package settlement redeems the payment vouchers a retrieval provider
+// receives.
+//
+// Vouchers are only worth something once they are submitted to their
+// payment channel on chain, and must be submitted before the channel
+// settles, after which the client can reclaim whatever was not redeemed.
+// A Manager records the best voucher received on each lane of each payment
+// channel, and periodically checks the channels on chain:
+//
+//   - vouchers are submitted once the channel settles, or the voucher
+//     expires, within the submit margin
+//   - settlement is started by the provider once no voucher has been
+//     received on a channel for a while, submitting its vouchers first
+//   - once the channel has settled, its funds are collected
+//
+// A voucher received on a channel that has settled, or whose funds have
+// been collected, can't be redeemed, so it is refused.
+//
+// Records are persisted, so that vouchers are redeemed across restarts.
+package settlement
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	paychtypes "github.com/filecoin-project/go-state-types/builtin/v8/paych"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+var log = logging.Logger("markets-rtvl-settlement")
+
+// DefaultSettleAfter is how long after the last voucher on a channel is
+// received that the provider starts settling it, by default. Settling a
+// channel stops the client using it for more deals, so it is long enough
+// that a client that is still retrieving from the provider, on new lanes
+// or lanes it reuses, will have sent another voucher.
+const DefaultSettleAfter = 7 * builtin.EpochsInDay
+
+// ErrChannelClosed is returned when recording a voucher for a payment
+// channel that has settled or whose funds have been collected, since the
+// voucher can no longer be redeemed
+var ErrChannelClosed = errors.New("payment channel can no longer be redeemed")
+
+// DefaultSubmitMargin is how long before a channel settles, or a voucher
+// expires, that vouchers are submitted, by default. It is the time a
+// channel takes to settle, so that vouchers are submitted as soon as
+// settlement is seen to have started.
+const DefaultSubmitMargin = paychtypes.SettleDelay
+
+// DefaultCheckInterval is how often payment channels are checked, by
+// default
+const DefaultCheckInterval = 5 * time.Minute
+
+// Option is a function that configures a Manager
+type Option func(m *Manager)
+
+// SettleAfter sets how many epochs after the last voucher on a channel is
+// received the provider starts settling it. Zero means the provider never
+// starts settlement, and only redeems vouchers and collects funds once the
+// client has started it.
+func SettleAfter(epochs abi.ChainEpoch) Option {
+	return func(m *Manager) {
+		m.settleAfter = epochs
+	}
+}
+
+// SubmitMargin sets how many epochs before a channel settles, or a voucher
+// expires, vouchers are submitted
+func SubmitMargin(epochs abi.ChainEpoch) Option {
+	return func(m *Manager) {
+		m.submitMargin = epochs
+	}
+}
+
+// CheckInterval sets how often payment channels are checked
+func CheckInterval(interval time.Duration) Option {
+	return func(m *Manager) {
+		m.checkInterval = interval
+	}
+}
+
+// ManagerClock sets the clock the manager uses to schedule checks
+func ManagerClock(clock shared.Clock) Option {
+	return func(m *Manager) {
+		m.clock = clock
+	}
+}
+
+// ChannelRevenue is the revenue from a payment channel whose funds have not
+// been collected
+type ChannelRevenue struct {
+	Channel address.Address
+	// Unredeemed is the total of the best vouchers on each lane that have
+	// not been submitted
+	Unredeemed abi.TokenAmount
+	// Uncollected is the total of the best vouchers on each lane
+	Uncollected abi.TokenAmount
+	// SettlingAt is the epoch at which the channel settles, or zero if
+	// settlement has not been started
+	SettlingAt abi.ChainEpoch
+}
+
+// Revenue is the revenue from all payment channels whose funds have not
+// been collected
+type Revenue struct {
+	Unredeemed  abi.TokenAmount
+	Uncollected abi.TokenAmount
+	Channels    []ChannelRevenue
+}
+
+// Manager redeems the payment vouchers a retrieval provider receives
+type Manager struct {
+	ds            datastore.Batching
+	node          retrievalmarket.RetrievalSettlementNode
+	clock         shared.Clock
+	settleAfter   abi.ChainEpoch
+	submitMargin  abi.ChainEpoch
+	checkInterval time.Duration
+
+	lk       sync.Mutex
+	loaded   bool
+	channels map[address.Address]*ChannelRecord
+
+	// checkLk ensures only one check of the channels runs at a time
+	checkLk sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewManager returns a Manager that persists its records to ds
+func NewManager(ds datastore.Batching, node retrievalmarket.RetrievalSettlementNode, opts ...Option) *Manager {
+	m := &Manager{
+		ds:            ds,
+		node:          node,
+		clock:         shared.NewClock(),
+		settleAfter:   DefaultSettleAfter,
+		submitMargin:  DefaultSubmitMargin,
+		checkInterval: DefaultCheckInterval,
+		channels:      make(map[address.Address]*ChannelRecord),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Start checks the payment channels periodically, until Stop is called
+func (m *Manager) Start() {
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.run(m.stop, m.done)
+}
+
+// Stop stops checking payment channels
+func (m *Manager) Stop() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+	m.stop = nil
+}
+
+func (m *Manager) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := m.clock.Ticker(m.checkInterval)
+	defer ticker.Stop()
+	for {
+		if err := m.CheckChannels(ctx); err != nil {
+			log.Errorf("checking payment channels: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// RecordVoucher records a voucher received on a payment channel. It
+// becomes the voucher to redeem for its lane if it is for more than any
+// voucher received on the lane before. It returns an error wrapping
+// ErrChannelClosed if the channel is known to have settled or been
+// collected.
+func (m *Manager) RecordVoucher(ctx context.Context, paymentChannel address.Address, voucher *paychtypes.SignedVoucher) error {
+	_, epoch, err := m.node.GetChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("getting chain head: %w", err)
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if err := m.loadLocked(ctx); err != nil {
+		return err
+	}
+	rec, ok := m.channels[paymentChannel]
+	if !ok {
+		rec = &ChannelRecord{Channel: paymentChannel}
+	}
+	if rec.collected() {
+		return xerrors.Errorf("%w: %s has already been collected", ErrChannelClosed, paymentChannel)
+	}
+	if rec.SettlingAt != 0 && epoch >= rec.SettlingAt {
+		return xerrors.Errorf("%w: %s settled at epoch %d", ErrChannelClosed, paymentChannel, rec.SettlingAt)
+	}
+	if lane := rec.lane(voucher.Lane); lane != nil && !voucher.Amount.GreaterThan(lane.Voucher.Amount) {
+		return nil
+	}
+
+	updated := rec.copy()
+	updated.LastVoucher = epoch
+	if lane := updated.lane(voucher.Lane); lane != nil {
+		lane.Voucher = voucher
+		lane.SubmitMessage = nil
+	} else {
+		updated.Lanes = append(updated.Lanes, LaneRecord{Lane: voucher.Lane, Voucher: voucher})
+		sort.Slice(updated.Lanes, func(i, j int) bool {
+			return updated.Lanes[i].Lane < updated.Lanes[j].Lane
+		})
+	}
+	return m.saveLocked(ctx, updated)
+}
+
+// Revenue returns the revenue from the payment channels whose funds have
+// not been collected
+func (m *Manager) Revenue(ctx context.Context) (Revenue, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if err := m.loadLocked(ctx); err != nil {
+		return Revenue{}, err
+	}
+	revenue := Revenue{Unredeemed: big.Zero(), Uncollected: big.Zero()}
+	for _, rec := range m.openChannelsLocked() {
+		cr := ChannelRevenue{
+			Channel:     rec.Channel,
+			Unredeemed:  big.Zero(),
+			Uncollected: big.Zero(),
+			SettlingAt:  rec.SettlingAt,
+		}
+		for _, lane := range rec.Lanes {
+			cr.Uncollected = big.Add(cr.Uncollected, lane.Voucher.Amount)
+			if lane.SubmitMessage == nil {
+				cr.Unredeemed = big.Add(cr.Unredeemed, lane.Voucher.Amount)
+			}
+		}
+		revenue.Unredeemed = big.Add(revenue.Unredeemed, cr.Unredeemed)
+		revenue.Uncollected = big.Add(revenue.Uncollected, cr.Uncollected)
+		revenue.Channels = append(revenue.Channels, cr)
+	}
+	return revenue, nil
+}
+
+// CheckChannels checks each payment channel whose funds have not been
+// collected, submitting vouchers, starting settlement and collecting funds
+// as they become due. An error checking one channel is logged, and does
+// not stop the others from being checked.
+func (m *Manager) CheckChannels(ctx context.Context) error {
+	m.checkLk.Lock()
+	defer m.checkLk.Unlock()
+
+	m.lk.Lock()
+	err := m.loadLocked(ctx)
+	channels := m.openChannelsLocked()
+	m.lk.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(channels) == 0 {
+		return nil
+	}
+
+	tok, epoch, err := m.node.GetChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("getting chain head: %w", err)
+	}
+	for _, rec := range channels {
+		if err := m.checkChannel(ctx, tok, epoch, rec.Channel); err != nil {
+			log.Errorf("settling payment channel %s: %s", rec.Channel, err)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) checkChannel(ctx context.Context, tok shared.TipSetToken, epoch abi.ChainEpoch, paymentChannel address.Address) error {
+	settlingAt, err := m.node.GetPaymentChannelSettlingAt(ctx, paymentChannel, tok)
+	if err != nil {
+		return xerrors.Errorf("getting settlement epoch: %w", err)
+	}
+	rec, err := m.update(ctx, paymentChannel, func(rec *ChannelRecord) {
+		rec.SettlingAt = settlingAt
+		if rec.FirstSeen == 0 {
+			rec.FirstSeen = epoch
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	startSettlement := settlingAt == 0 && rec.SettleMessage == nil &&
+		m.settleAfter > 0 && epoch >= rec.lastActive()+m.settleAfter
+
+	for _, lane := range rec.Lanes {
+		if lane.SubmitMessage != nil || !m.submitDue(epoch, settlingAt, lane.Voucher, startSettlement) {
+			continue
+		}
+		msg, err := m.node.SubmitPaymentVoucher(ctx, paymentChannel, lane.Voucher)
+		if err != nil {
+			return xerrors.Errorf("submitting voucher for lane %d: %w", lane.Lane, err)
+		}
+		submitted := lane.Voucher
+		_, err = m.update(ctx, paymentChannel, func(rec *ChannelRecord) {
+			// a better voucher may have arrived while this one was submitted
+			if l := rec.lane(submitted.Lane); l != nil && l.Voucher.Amount.Equals(submitted.Amount) {
+				l.SubmitMessage = &msg
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case startSettlement:
+		msg, err := m.node.SettlePaymentChannel(ctx, paymentChannel)
+		if err != nil {
+			return xerrors.Errorf("starting settlement: %w", err)
+		}
+		_, err = m.update(ctx, paymentChannel, func(rec *ChannelRecord) {
+			rec.SettleMessage = &msg
+		})
+		return err
+	case settlingAt != 0 && epoch >= settlingAt:
+		msg, err := m.node.CollectPaymentChannel(ctx, paymentChannel)
+		if err != nil {
+			return xerrors.Errorf("collecting funds: %w", err)
+		}
+		_, err = m.update(ctx, paymentChannel, func(rec *ChannelRecord) {
+			rec.CollectMessage = &msg
+		})
+		return err
+	}
+	return nil
+}
+
+// submitDue is true if a voucher should be submitted now, because the
+// channel is about to settle, the voucher is about to expire, or the
+// provider is about to start settlement
+func (m *Manager) submitDue(epoch abi.ChainEpoch, settlingAt abi.ChainEpoch, voucher *paychtypes.SignedVoucher, startSettlement bool) bool {
+	if voucher.TimeLockMin > epoch {
+		return false
+	}
+	if voucher.TimeLockMax != 0 && epoch > voucher.TimeLockMax {
+		log.Warnf("voucher for lane %d of payment channel %s expired at epoch %d without being submitted",
+			voucher.Lane, voucher.ChannelAddr, voucher.TimeLockMax)
+		return false
+	}
+	if settlingAt != 0 && epoch >= settlingAt {
+		log.Warnf("payment channel %s settled at epoch %d before the voucher for lane %d was submitted",
+			voucher.ChannelAddr, settlingAt, voucher.Lane)
+		return false
+	}
+	if startSettlement {
+		return true
+	}
+	for _, deadline := range []abi.ChainEpoch{settlingAt, voucher.TimeLockMax} {
+		if deadline != 0 && epoch+m.submitMargin >= deadline {
+			return true
+		}
+	}
+	return false
+}
+
+// update applies a change to a channel's record and saves it, returning
+// the updated record
+func (m *Manager) update(ctx context.Context, paymentChannel address.Address, change func(rec *ChannelRecord)) (*ChannelRecord, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	rec, ok := m.channels[paymentChannel]
+	if !ok {
+		return nil, xerrors.Errorf("no record of payment channel %s", paymentChannel)
+	}
+	updated := rec.copy()
+	change(updated)
+	if err := m.saveLocked(ctx, updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// openChannelsLocked returns the records of the channels whose funds have
+// not been collected, ordered by channel address
+func (m *Manager) openChannelsLocked() []*ChannelRecord {
+	var open []*ChannelRecord
+	for _, rec := range m.channels {
+		if !rec.collected() {
+			open = append(open, rec)
+		}
+	}
+	sort.Slice(open, func(i, j int) bool {
+		return open[i].Channel.String() < open[j].Channel.String()
+	})
+	return open
+}
+
+// loadLocked loads the channel records from the datastore the first time
+// it is called
+func (m *Manager) loadLocked(ctx context.Context) error {
+	if m.loaded {
+		return nil
+	}
+	results, err := m.ds.Query(ctx, query.Query{})
+	if err != nil {
+		return xerrors.Errorf("loading payment channel records: %w", err)
+	}
+	defer results.Close() //nolint:errcheck
+	for res := range results.Next() {
+		if res.Error != nil {
+			return xerrors.Errorf("loading payment channel records: %w", res.Error)
+		}
+		var rec ChannelRecord
+		if err := rec.UnmarshalCBOR(bytes.NewReader(res.Value)); err != nil {
+			return xerrors.Errorf("decoding payment channel record %s: %w", res.Key, err)
+		}
+		m.channels[rec.Channel] = &rec
+	}
+	m.loaded = true
+	return nil
+}
+
+func (m *Manager) saveLocked(ctx context.Context, rec *ChannelRecord) error {
+	data, err := cborutil.Dump(rec)
+	if err != nil {
+		return xerrors.Errorf("encoding payment channel record %s: %w", rec.Channel, err)
+	}
+	if err := m.ds.Put(ctx, channelKey(rec.Channel), data); err != nil {
+		return xerrors.Errorf("saving payment channel record %s: %w", rec.Channel, err)
+	}
+	m.channels[rec.Channel] = rec
+	return nil
+}
+
+func channelKey(paymentChannel address.Address) datastore.Key {
+	return datastore.NewKey(paymentChannel.String())
+}
@@ -0,0 +1,232 @@
+package settlement_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	paychtypes "github.com/filecoin-project/go-state-types/builtin/v8/paych"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/settlement"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	ch1 := tut.NewIDAddr(t, 100)
+	ch2 := tut.NewIDAddr(t, 101)
+	voucher := func(ch address.Address, lane uint64, nonce uint64, amount int64) *paychtypes.SignedVoucher {
+		return &paychtypes.SignedVoucher{
+			ChannelAddr: ch,
+			Lane:        lane,
+			Nonce:       nonce,
+			Amount:      abi.NewTokenAmount(amount),
+		}
+	}
+	newManager := func(ds datastore.Batching, opts ...settlement.Option) (*settlement.Manager, *testnodes.TestRetrievalSettlementNode) {
+		node := testnodes.NewTestRetrievalSettlementNode()
+		node.SetEpoch(1000)
+		return settlement.NewManager(ds, node, opts...), node
+	}
+
+	t.Run("keeps the best voucher on each lane", func(t *testing.T) {
+		m, _ := newManager(dss.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, m.RecordVoucher(ctx, ch1, voucher(ch1, 0, 1, 100)))
+		require.NoError(t, m.RecordVoucher(ctx, ch1, voucher(ch1, 0, 2, 300)))
+		require.NoError(t, m.RecordVoucher(ctx, ch1, voucher(ch1, 0, 3, 200)))
+		require.NoError(t, m.RecordVoucher(ctx, ch1, voucher(ch1, 1, 1, 50)))
+		require.NoError(t, m.RecordVoucher(ctx, ch2, voucher(ch2, 0, 1, 10)))
+
+		revenue, err := m.Revenue(ctx)
+		require.NoError(t, err)
+		require.Equal(t, settlement.Revenue{
+			Unredeemed:  abi.NewTokenAmount(360),
+			Uncollected: abi.NewTokenAmount(360),
+			Channels: []settlement.ChannelRevenue{
+				{Channel: ch1, Unredeemed: abi.NewTokenAmount(350), Uncollected: abi.NewTokenAmount(350)},
+				{Channel: ch2, Unredeemed: abi.NewTokenAmount(10), Uncollected: abi.NewTokenAmount(10)},
+			},
+		}, revenue)
+	})
+
+	t.Run("redeems and collects a channel the client settles", func(t *testing.T) {
+		m, node := newManager(dss.MutexWrap(datastore.NewMapDatastore()), settlement.SettleAfter(0))
+		best := voucher(ch1, 0, 2, 300)
+		require.NoError(t, m.RecordVoucher(ctx, ch1, voucher(ch1, 0, 1, 100)))
+		require.NoError(t, m.RecordVoucher(ctx, ch1, best))
+
+		// nothing is due while the channel is open
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Empty(t, node.Submitted())
+
+		// vouchers are submitted as soon as the channel starts settling
+		node.SetSettlingAt(ch1, 1000+paychtypes.SettleDelay)
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Equal(t, []testnodes.SubmittedVoucher{{PaymentChannel: ch1, Voucher: best}}, node.Submitted())
+		revenue, err := m.Revenue(ctx)
+		require.NoError(t, err)
+		require.Equal(t, big.Zero(), revenue.Unredeemed)
+		require.Equal(t, abi.NewTokenAmount(300), revenue.Uncollected)
+		require.Equal(t, abi.ChainEpoch(1000)+paychtypes.SettleDelay, revenue.Channels[0].SettlingAt)
+
+		// and not submitted again
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Len(t, node.Submitted(), 1)
+		require.Empty(t, node.Collected())
+
+		// vouchers can't be redeemed once the channel has settled
+		node.SetEpoch(1000 + paychtypes.SettleDelay)
+		require.ErrorIs(t, m.RecordVoucher(ctx, ch1, voucher(ch1, 0, 3, 400)), settlement.ErrChannelClosed)
+
+		// funds are collected once the channel has settled
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Equal(t, []address.Address{ch1}, node.Collected())
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Len(t, node.Collected(), 1)
+
+		revenue, err = m.Revenue(ctx)
+		require.NoError(t, err)
+		require.Equal(t, big.Zero(), revenue.Uncollected)
+		require.Empty(t, revenue.Channels)
+		require.ErrorIs(t, m.RecordVoucher(ctx, ch1, voucher(ch1, 0, 3, 400)), settlement.ErrChannelClosed)
+	})
+
+	t.Run("settles a channel itself once it is no longer used", func(t *testing.T) {
+		m, node := newManager(dss.MutexWrap(datastore.NewMapDatastore()), settlement.SettleAfter(100))
+		v := voucher(ch1, 0, 1, 100)
+		require.NoError(t, m.RecordVoucher(ctx, ch1, v))
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Empty(t, node.Settled())
+
+		node.SetEpoch(1099)
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Empty(t, node.Settled())
+
+		// a voucher received while the channel is in use puts settlement off
+		reused := voucher(ch1, 0, 2, 200)
+		require.NoError(t, m.RecordVoucher(ctx, ch1, reused))
+		node.SetEpoch(1198)
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Empty(t, node.Settled())
+
+		node.SetEpoch(1199)
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Equal(t, []testnodes.SubmittedVoucher{{PaymentChannel: ch1, Voucher: reused}}, node.Submitted())
+		require.Equal(t, []address.Address{ch1}, node.Settled())
+
+		node.SetEpoch(1199 + paychtypes.SettleDelay)
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Len(t, node.Settled(), 1)
+		require.Equal(t, []address.Address{ch1}, node.Collected())
+	})
+
+	t.Run("submits a better voucher received after submitting", func(t *testing.T) {
+		m, node := newManager(dss.MutexWrap(datastore.NewMapDatastore()))
+		node.SetSettlingAt(ch1, 1000+paychtypes.SettleDelay)
+		require.NoError(t, m.RecordVoucher(ctx, ch1, voucher(ch1, 0, 1, 100)))
+		require.NoError(t, m.CheckChannels(ctx))
+		better := voucher(ch1, 0, 2, 200)
+		require.NoError(t, m.RecordVoucher(ctx, ch1, better))
+		revenue, err := m.Revenue(ctx)
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(200), revenue.Unredeemed)
+
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Len(t, node.Submitted(), 2)
+		require.Equal(t, better, node.Submitted()[1].Voucher)
+	})
+
+	t.Run("respects voucher time locks", func(t *testing.T) {
+		m, node := newManager(dss.MutexWrap(datastore.NewMapDatastore()), settlement.SettleAfter(0), settlement.SubmitMargin(50))
+		expiring := voucher(ch1, 0, 1, 100)
+		expiring.TimeLockMax = 1100
+		locked := voucher(ch1, 1, 1, 100)
+		locked.TimeLockMin = 2000
+		require.NoError(t, m.RecordVoucher(ctx, ch1, expiring))
+		require.NoError(t, m.RecordVoucher(ctx, ch1, locked))
+
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Empty(t, node.Submitted())
+
+		// an expiring voucher is submitted within the margin of expiry
+		node.SetEpoch(1050)
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Equal(t, []testnodes.SubmittedVoucher{{PaymentChannel: ch1, Voucher: expiring}}, node.Submitted())
+
+		// a voucher can't be submitted before its minimum time lock, even
+		// when the channel is settling
+		node.SetSettlingAt(ch1, 2010)
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Len(t, node.Submitted(), 1)
+		node.SetEpoch(2000)
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Len(t, node.Submitted(), 2)
+		require.Equal(t, locked, node.Submitted()[1].Voucher)
+	})
+
+	t.Run("retries after an error", func(t *testing.T) {
+		m, node := newManager(dss.MutexWrap(datastore.NewMapDatastore()))
+		node.SetSettlingAt(ch1, 1000+paychtypes.SettleDelay)
+		require.NoError(t, m.RecordVoucher(ctx, ch1, voucher(ch1, 0, 1, 100)))
+		require.NoError(t, m.RecordVoucher(ctx, ch2, voucher(ch2, 0, 1, 100)))
+
+		node.ChainHeadError = errors.New("something went wrong")
+		require.EqualError(t, m.CheckChannels(ctx), "getting chain head: something went wrong")
+		node.ChainHeadError = nil
+
+		// a failed submission is tried again at the next check
+		node.SubmitError = errors.New("something went wrong")
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Empty(t, node.Submitted())
+		node.SubmitError = nil
+		require.NoError(t, m.CheckChannels(ctx))
+		require.Len(t, node.Submitted(), 1)
+	})
+
+	t.Run("persists records", func(t *testing.T) {
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		m, node := newManager(ds)
+		node.SetSettlingAt(ch1, 1000+paychtypes.SettleDelay)
+		require.NoError(t, m.RecordVoucher(ctx, ch1, voucher(ch1, 0, 1, 100)))
+		require.NoError(t, m.RecordVoucher(ctx, ch2, voucher(ch2, 0, 1, 20)))
+		require.NoError(t, m.CheckChannels(ctx))
+		before, err := m.Revenue(ctx)
+		require.NoError(t, err)
+
+		restarted, node := newManager(ds)
+		after, err := restarted.Revenue(ctx)
+		require.NoError(t, err)
+		require.Equal(t, before, after)
+		require.Equal(t, abi.NewTokenAmount(20), after.Unredeemed)
+
+		// vouchers already submitted are not submitted again
+		node.SetSettlingAt(ch1, 1000+paychtypes.SettleDelay)
+		require.NoError(t, restarted.CheckChannels(ctx))
+		require.Empty(t, node.Submitted())
+	})
+
+	t.Run("checks channels periodically once started", func(t *testing.T) {
+		mockClock := clock.NewMock()
+		m, node := newManager(dss.MutexWrap(datastore.NewMapDatastore()),
+			settlement.ManagerClock(mockClock), settlement.CheckInterval(time.Minute))
+		require.NoError(t, m.RecordVoucher(ctx, ch1, voucher(ch1, 0, 1, 100)))
+		m.Start()
+		defer m.Stop()
+
+		node.SetSettlingAt(ch1, 1000+paychtypes.SettleDelay)
+		require.Eventually(t, func() bool {
+			mockClock.Add(time.Minute)
+			return len(node.Submitted()) == 1
+		}, time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,307 @@
+package testnodes
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// DealBehaviour is how a provider simulated by a FakeRetrievalClient
+// responds to deals
+type DealBehaviour int
+
+const (
+	// ServeDeals serves every deal
+	ServeDeals DealBehaviour = iota
+	// RejectDeals rejects every deal
+	RejectDeals
+	// StallDeals accepts every deal but never sends any data
+	StallDeals
+)
+
+// FakeProvider is a provider simulated by a FakeRetrievalClient
+type FakeProvider struct {
+	Behaviour DealBehaviour
+	// RejectFirst is the number of deals the provider rejects before it
+	// starts to respond with Behaviour
+	RejectFirst int
+	// Query is the provider's response to queries
+	Query retrievalmarket.QueryResponse
+}
+
+// ServeFunc writes the data a deal retrieves into the deal's blockstore,
+// returning the number of bytes received
+type ServeFunc func(ctx context.Context, payloadCID cid.Cid, params retrievalmarket.Params, bs bstore.Blockstore) (uint64, error)
+
+// FakeRetrievalClient is a retrieval client that simulates deals with a
+// set of providers, writing the data of the deals that are served into
+// their blockstores with a ServeFunc. Deals emit events to subscribers as
+// they progress, and can be cancelled. Methods of
+// retrievalmarket.RetrievalClient it does not implement panic.
+type FakeRetrievalClient struct {
+	retrievalmarket.RetrievalClient
+
+	// ServeDelay is how long providers wait before serving a deal
+	ServeDelay time.Duration
+
+	accessor retrievalmarket.BlockstoreAccessor
+	serve    ServeFunc
+
+	lk        sync.Mutex
+	nextID    retrievalmarket.DealID
+	peers     []retrievalmarket.RetrievalPeer
+	providers map[peer.ID]FakeProvider
+	subs      map[int]retrievalmarket.ClientSubscriber
+	nextSub   int
+	cancels   map[retrievalmarket.DealID]chan struct{}
+	stores    map[retrievalmarket.DealID]bstore.Blockstore
+	funds     map[retrievalmarket.DealID]abi.TokenAmount
+	received  map[retrievalmarket.DealID]uint64
+	served    map[peer.ID]struct{}
+	rejected  map[peer.ID]int
+	spent     abi.TokenAmount
+	cancelled []retrievalmarket.DealID
+}
+
+// NewFakeRetrievalClient returns a FakeRetrievalClient with no providers,
+// whose deals get their blockstores from accessor and are served with serve
+func NewFakeRetrievalClient(accessor retrievalmarket.BlockstoreAccessor, serve ServeFunc) *FakeRetrievalClient {
+	return &FakeRetrievalClient{
+		accessor:  accessor,
+		serve:     serve,
+		providers: make(map[peer.ID]FakeProvider),
+		subs:      make(map[int]retrievalmarket.ClientSubscriber),
+		cancels:   make(map[retrievalmarket.DealID]chan struct{}),
+		stores:    make(map[retrievalmarket.DealID]bstore.Blockstore),
+		funds:     make(map[retrievalmarket.DealID]abi.TokenAmount),
+		received:  make(map[retrievalmarket.DealID]uint64),
+		served:    make(map[peer.ID]struct{}),
+		rejected:  make(map[peer.ID]int),
+		spent:     big.Zero(),
+	}
+}
+
+// AddProvider adds a provider with a random peer ID, returning the peer
+func (fc *FakeRetrievalClient) AddProvider(t *testing.T, p FakeProvider) retrievalmarket.RetrievalPeer {
+	rp := retrievalmarket.RetrievalPeer{ID: test.RandPeerIDFatal(t), Address: address.TestAddress2}
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	fc.providers[rp.ID] = p
+	fc.peers = append(fc.peers, rp)
+	return rp
+}
+
+// FindProviders returns every provider, in the order they were added
+func (fc *FakeRetrievalClient) FindProviders(payloadCID cid.Cid) []retrievalmarket.RetrievalPeer {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	return append([]retrievalmarket.RetrievalPeer(nil), fc.peers...)
+}
+
+// Query returns the provider's query response
+func (fc *FakeRetrievalClient) Query(ctx context.Context, p retrievalmarket.RetrievalPeer, payloadCID cid.Cid, params retrievalmarket.QueryParams) (retrievalmarket.QueryResponse, error) {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	provider, ok := fc.providers[p.ID]
+	if !ok {
+		return retrievalmarket.QueryResponseUndefined, errors.New("unknown provider")
+	}
+	return provider.Query, nil
+}
+
+// NextID generates a new deal ID
+func (fc *FakeRetrievalClient) NextID() retrievalmarket.DealID {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	fc.nextID++
+	return fc.nextID
+}
+
+// SubscribeToEvents adds a subscriber to the events of deals
+func (fc *FakeRetrievalClient) SubscribeToEvents(subscriber retrievalmarket.ClientSubscriber) retrievalmarket.Unsubscribe {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	id := fc.nextSub
+	fc.nextSub++
+	fc.subs[id] = subscriber
+	return func() {
+		fc.lk.Lock()
+		defer fc.lk.Unlock()
+		delete(fc.subs, id)
+	}
+}
+
+// Retrieve starts a deal with the provider, which goes on to serve,
+// reject or stall it
+func (fc *FakeRetrievalClient) Retrieve(ctx context.Context, id retrievalmarket.DealID, payloadCID cid.Cid, params retrievalmarket.Params,
+	totalFunds abi.TokenAmount, p retrievalmarket.RetrievalPeer, clientWallet address.Address, minerWallet address.Address) (retrievalmarket.DealID, error) {
+	fc.lk.Lock()
+	provider, ok := fc.providers[p.ID]
+	behaviour := provider.Behaviour
+	if ok && fc.rejected[p.ID] < provider.RejectFirst {
+		fc.rejected[p.ID]++
+		behaviour = RejectDeals
+	}
+	fc.lk.Unlock()
+	if !ok {
+		return 0, errors.New("unknown provider")
+	}
+	bs, err := fc.accessor.Get(id, payloadCID)
+	if err != nil {
+		return 0, err
+	}
+	cancelled := make(chan struct{})
+	fc.lk.Lock()
+	fc.cancels[id] = cancelled
+	fc.stores[id] = bs
+	fc.funds[id] = totalFunds
+	fc.lk.Unlock()
+
+	go func() {
+		state := retrievalmarket.ClientDealState{
+			DealProposal: retrievalmarket.DealProposal{PayloadCID: payloadCID, ID: id, Params: params},
+			Sender:       p.ID,
+			Status:       retrievalmarket.DealStatusOngoing,
+			FundsSpent:   big.Zero(),
+		}
+		fc.publish(state)
+
+		switch behaviour {
+		case RejectDeals:
+			state.Status = retrievalmarket.DealStatusRejected
+			state.Message = "not today"
+			fc.publish(state)
+		case StallDeals:
+			<-cancelled
+			state.Status = retrievalmarket.DealStatusCancelled
+			fc.publish(state)
+		case ServeDeals:
+			time.Sleep(fc.ServeDelay)
+			received, err := fc.serve(ctx, payloadCID, params, bs)
+			if err != nil {
+				state.Status = retrievalmarket.DealStatusErrored
+				state.Message = err.Error()
+				fc.publish(state)
+				return
+			}
+			state.TotalReceived = received
+			state.FundsSpent = big.Mul(big.NewIntUnsigned(received), params.PricePerByte)
+			fc.lk.Lock()
+			fc.received[id] = received
+			fc.served[p.ID] = struct{}{}
+			fc.spent = big.Add(fc.spent, state.FundsSpent)
+			fc.lk.Unlock()
+			fc.publish(state)
+			state.Status = retrievalmarket.DealStatusCompleted
+			fc.publish(state)
+		}
+	}()
+	return id, nil
+}
+
+// CancelDeal cancels a stalled deal
+func (fc *FakeRetrievalClient) CancelDeal(id retrievalmarket.DealID) error {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	ch, ok := fc.cancels[id]
+	if !ok {
+		return errors.New("unknown deal")
+	}
+	fc.cancelled = append(fc.cancelled, id)
+	close(ch)
+	delete(fc.cancels, id)
+	return nil
+}
+
+func (fc *FakeRetrievalClient) publish(state retrievalmarket.ClientDealState) {
+	fc.lk.Lock()
+	var subs []retrievalmarket.ClientSubscriber
+	for _, sub := range fc.subs {
+		subs = append(subs, sub)
+	}
+	fc.lk.Unlock()
+	for _, sub := range subs {
+		sub(retrievalmarket.ClientEventBlocksReceived, state)
+	}
+}
+
+// Cancelled returns the deals that were cancelled, in order
+func (fc *FakeRetrievalClient) Cancelled() []retrievalmarket.DealID {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	return append([]retrievalmarket.DealID(nil), fc.cancelled...)
+}
+
+// BlockstoreFor returns the blockstore a deal wrote into
+func (fc *FakeRetrievalClient) BlockstoreFor(id retrievalmarket.DealID) bstore.Blockstore {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	return fc.stores[id]
+}
+
+// DealFunds returns the funds committed to each deal, and the bytes each
+// deal that was served received
+func (fc *FakeRetrievalClient) DealFunds() (map[retrievalmarket.DealID]abi.TokenAmount, map[retrievalmarket.DealID]uint64) {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	funds := make(map[retrievalmarket.DealID]abi.TokenAmount, len(fc.funds))
+	for id, f := range fc.funds {
+		funds[id] = f
+	}
+	received := make(map[retrievalmarket.DealID]uint64, len(fc.received))
+	for id, r := range fc.received {
+		received[id] = r
+	}
+	return funds, received
+}
+
+// TotalReceived returns the bytes received across every deal
+func (fc *FakeRetrievalClient) TotalReceived() uint64 {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	var total uint64
+	for _, r := range fc.received {
+		total += r
+	}
+	return total
+}
+
+// Spent returns the funds spent across every deal
+func (fc *FakeRetrievalClient) Spent() abi.TokenAmount {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	return fc.spent
+}
+
+// ServedBy returns the providers that served at least one deal
+func (fc *FakeRetrievalClient) ServedBy() []peer.ID {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	served := make([]peer.ID, 0, len(fc.served))
+	for p := range fc.served {
+		served = append(served, p)
+	}
+	return served
+}
+
+// Subscribers returns how many subscribers are subscribed to deal events
+func (fc *FakeRetrievalClient) Subscribers() int {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	return len(fc.subs)
+}
+
+var _ retrievalmarket.RetrievalClient = &FakeRetrievalClient{}
@@ -73,6 +73,8 @@ func (trpn *TestRetrievalProviderNode) ExpectPricingParams(pieceCID cid.Cid, dea
 }
 
 func (trpn *TestRetrievalProviderNode) GetRetrievalPricingInput(_ context.Context, pieceCID cid.Cid, deals []abi.DealID) (retrievalmarket.PricingInput, error) {
+	trpn.lk.Lock()
+	defer trpn.lk.Unlock()
 	trpn.receivedPricingParamDeals = deals
 	trpn.receivedPricingPieceCID = pieceCID
 
@@ -0,0 +1,138 @@
+package testnodes
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	paychtypes "github.com/filecoin-project/go-state-types/builtin/v8/paych"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+// SubmittedVoucher is a voucher submitted to a TestRetrievalSettlementNode
+type SubmittedVoucher struct {
+	PaymentChannel address.Address
+	Voucher        *paychtypes.SignedVoucher
+}
+
+// TestRetrievalSettlementNode is a node adapter for settling payment
+// channels that records the messages it is asked to send. A channel starts
+// settling as soon as it is asked to settle.
+type TestRetrievalSettlementNode struct {
+	ChainHeadError  error
+	SettlingAtError error
+	SubmitError     error
+	SettleError     error
+	CollectError    error
+
+	lk         sync.Mutex
+	epoch      abi.ChainEpoch
+	settlingAt map[address.Address]abi.ChainEpoch
+	submitted  []SubmittedVoucher
+	settled    []address.Address
+	collected  []address.Address
+}
+
+var _ retrievalmarket.RetrievalSettlementNode = &TestRetrievalSettlementNode{}
+
+// NewTestRetrievalSettlementNode instantiates a new TestRetrievalSettlementNode
+func NewTestRetrievalSettlementNode() *TestRetrievalSettlementNode {
+	return &TestRetrievalSettlementNode{
+		settlingAt: make(map[address.Address]abi.ChainEpoch),
+	}
+}
+
+// SetEpoch sets the epoch of the chain head
+func (trsn *TestRetrievalSettlementNode) SetEpoch(epoch abi.ChainEpoch) {
+	trsn.lk.Lock()
+	defer trsn.lk.Unlock()
+	trsn.epoch = epoch
+}
+
+// SetSettlingAt sets the epoch at which a payment channel settles, as
+// though its client had started settlement
+func (trsn *TestRetrievalSettlementNode) SetSettlingAt(paymentChannel address.Address, epoch abi.ChainEpoch) {
+	trsn.lk.Lock()
+	defer trsn.lk.Unlock()
+	trsn.settlingAt[paymentChannel] = epoch
+}
+
+// Submitted returns the vouchers submitted so far
+func (trsn *TestRetrievalSettlementNode) Submitted() []SubmittedVoucher {
+	trsn.lk.Lock()
+	defer trsn.lk.Unlock()
+	return append([]SubmittedVoucher(nil), trsn.submitted...)
+}
+
+// Settled returns the payment channels asked to settle so far
+func (trsn *TestRetrievalSettlementNode) Settled() []address.Address {
+	trsn.lk.Lock()
+	defer trsn.lk.Unlock()
+	return append([]address.Address(nil), trsn.settled...)
+}
+
+// Collected returns the payment channels collected so far
+func (trsn *TestRetrievalSettlementNode) Collected() []address.Address {
+	trsn.lk.Lock()
+	defer trsn.lk.Unlock()
+	return append([]address.Address(nil), trsn.collected...)
+}
+
+// GetChainHead returns the epoch set with SetEpoch
+func (trsn *TestRetrievalSettlementNode) GetChainHead(ctx context.Context) (shared.TipSetToken, abi.ChainEpoch, error) {
+	trsn.lk.Lock()
+	defer trsn.lk.Unlock()
+	return []byte{42}, trsn.epoch, trsn.ChainHeadError
+}
+
+// GetPaymentChannelSettlingAt returns the epoch at which a payment channel
+// settles
+func (trsn *TestRetrievalSettlementNode) GetPaymentChannelSettlingAt(ctx context.Context, paymentChannel address.Address, tok shared.TipSetToken) (abi.ChainEpoch, error) {
+	trsn.lk.Lock()
+	defer trsn.lk.Unlock()
+	if trsn.SettlingAtError != nil {
+		return 0, trsn.SettlingAtError
+	}
+	return trsn.settlingAt[paymentChannel], nil
+}
+
+// SubmitPaymentVoucher records a submitted voucher
+func (trsn *TestRetrievalSettlementNode) SubmitPaymentVoucher(ctx context.Context, paymentChannel address.Address, voucher *paychtypes.SignedVoucher) (cid.Cid, error) {
+	trsn.lk.Lock()
+	defer trsn.lk.Unlock()
+	if trsn.SubmitError != nil {
+		return cid.Undef, trsn.SubmitError
+	}
+	trsn.submitted = append(trsn.submitted, SubmittedVoucher{PaymentChannel: paymentChannel, Voucher: voucher})
+	return shared_testutil.GenerateCids(1)[0], nil
+}
+
+// SettlePaymentChannel records a channel asked to settle, and starts it
+// settling
+func (trsn *TestRetrievalSettlementNode) SettlePaymentChannel(ctx context.Context, paymentChannel address.Address) (cid.Cid, error) {
+	trsn.lk.Lock()
+	defer trsn.lk.Unlock()
+	if trsn.SettleError != nil {
+		return cid.Undef, trsn.SettleError
+	}
+	trsn.settled = append(trsn.settled, paymentChannel)
+	trsn.settlingAt[paymentChannel] = trsn.epoch + paychtypes.SettleDelay
+	return shared_testutil.GenerateCids(1)[0], nil
+}
+
+// CollectPaymentChannel records a collected channel
+func (trsn *TestRetrievalSettlementNode) CollectPaymentChannel(ctx context.Context, paymentChannel address.Address) (cid.Cid, error) {
+	trsn.lk.Lock()
+	defer trsn.lk.Unlock()
+	if trsn.CollectError != nil {
+		return cid.Undef, trsn.CollectError
+	}
+	trsn.collected = append(trsn.collected, paymentChannel)
+	return shared_testutil.GenerateCids(1)[0], nil
+}
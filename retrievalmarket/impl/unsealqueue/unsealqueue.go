@@ -0,0 +1,200 @@
+// Package unsealqueue schedules the unsealing a retrieval provider does to
+// serve deals for pieces it has no unsealed copy of.
+//
+// Unsealing is expensive, so a Queue limits how many pieces are unsealed at
+// once. Deals for the same piece share a single place in the queue, because
+// the DAG store unseals a piece once however many deals load it at the same
+// time; a deal for a piece that is already being unsealed starts at once.
+// Waiting pieces are ordered by the highest unseal price paid by any of their
+// deals, and then by when they were first queued.
+package unsealqueue
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// Job is a deal waiting for its piece to be unsealed. The callbacks of a
+// job are called while the queue is locked, so that positions are reported
+// in order, and must not call into the queue.
+type Job struct {
+	Deal     retrievalmarket.ProviderDealIdentifier
+	PieceCID cid.Cid
+	// UnsealPrice is what the client paid for unsealing, which sets the
+	// priority of the job
+	UnsealPrice abi.TokenAmount
+	// Queued is called with the job's position in the queue, counting from
+	// one, when it is first queued and whenever the position changes
+	Queued func(position int)
+	// Start is called when the job may start unsealing
+	Start func()
+}
+
+// entry is a piece waiting to be unsealed, or being unsealed
+type entry struct {
+	pieceCID cid.Cid
+	seq      uint64
+	priority abi.TokenAmount
+	jobs     map[retrievalmarket.ProviderDealIdentifier]*Job
+	// positions are the last positions reported to the jobs
+	positions map[retrievalmarket.ProviderDealIdentifier]int
+}
+
+// Queue limits how many pieces are unsealed at once
+type Queue struct {
+	maxActive int
+
+	lk      sync.Mutex
+	seq     uint64
+	waiting []*entry
+	active  map[cid.Cid]*entry
+	jobs    map[retrievalmarket.ProviderDealIdentifier]*entry
+}
+
+// NewQueue returns a Queue that unseals at most maxActive pieces at once.
+// Zero means there is no limit.
+func NewQueue(maxActive int) *Queue {
+	return &Queue{
+		maxActive: maxActive,
+		active:    make(map[cid.Cid]*entry),
+		jobs:      make(map[retrievalmarket.ProviderDealIdentifier]*entry),
+	}
+}
+
+// Push queues a job, starting it at once if its piece is already being
+// unsealed or there is room for another unseal
+func (q *Queue) Push(job *Job) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	if _, ok := q.jobs[job.Deal]; ok {
+		return
+	}
+
+	if e, ok := q.active[job.PieceCID]; ok {
+		e.jobs[job.Deal] = job
+		q.jobs[job.Deal] = e
+		job.Start()
+		return
+	}
+
+	var e *entry
+	for _, w := range q.waiting {
+		if w.pieceCID == job.PieceCID {
+			e = w
+			break
+		}
+	}
+	if e == nil {
+		q.seq++
+		e = &entry{
+			pieceCID:  job.PieceCID,
+			seq:       q.seq,
+			priority:  big.Zero(),
+			jobs:      make(map[retrievalmarket.ProviderDealIdentifier]*Job),
+			positions: make(map[retrievalmarket.ProviderDealIdentifier]int),
+		}
+		q.waiting = append(q.waiting, e)
+	}
+	e.jobs[job.Deal] = job
+	if !job.UnsealPrice.Nil() && job.UnsealPrice.GreaterThan(e.priority) {
+		e.priority = job.UnsealPrice
+	}
+	q.jobs[job.Deal] = e
+	q.scheduleLocked()
+}
+
+// Done removes a job from the queue, either because it has finished
+// unsealing or because its deal has ended. The job's piece stops counting
+// towards the limit once all of the jobs for it are done. Done does nothing
+// if the job is not in the queue.
+func (q *Queue) Done(id retrievalmarket.ProviderDealIdentifier) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	e, ok := q.jobs[id]
+	if !ok {
+		return
+	}
+	delete(q.jobs, id)
+	delete(e.jobs, id)
+	delete(e.positions, id)
+	if len(e.jobs) > 0 {
+		return
+	}
+	if q.active[e.pieceCID] == e {
+		delete(q.active, e.pieceCID)
+	} else {
+		for i, w := range q.waiting {
+			if w == e {
+				q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+	q.scheduleLocked()
+}
+
+// Position returns the position of a waiting job in the queue, counting
+// from one, or false if the job is not waiting
+func (q *Queue) Position(id retrievalmarket.ProviderDealIdentifier) (int, bool) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	e, ok := q.jobs[id]
+	if !ok || q.active[e.pieceCID] == e {
+		return 0, false
+	}
+	for i, w := range q.waiting {
+		if w == e {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// Len returns the number of pieces waiting to be unsealed and the number
+// being unsealed
+func (q *Queue) Len() (waiting int, active int) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	return len(q.waiting), len(q.active)
+}
+
+// scheduleLocked orders the waiting pieces, starts as many as there is room
+// for, and tells the jobs that are still waiting if their position changed
+func (q *Queue) scheduleLocked() {
+	sort.SliceStable(q.waiting, func(i, j int) bool {
+		a, b := q.waiting[i], q.waiting[j]
+		if !a.priority.Equals(b.priority) {
+			return a.priority.GreaterThan(b.priority)
+		}
+		return a.seq < b.seq
+	})
+
+	for len(q.waiting) > 0 && (q.maxActive <= 0 || len(q.active) < q.maxActive) {
+		e := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.active[e.pieceCID] = e
+		for _, job := range e.jobs {
+			job.Start()
+		}
+	}
+
+	for i, e := range q.waiting {
+		position := i + 1
+		for id, job := range e.jobs {
+			if e.positions[id] != position {
+				e.positions[id] = position
+				job.Queued(position)
+			}
+		}
+	}
+}
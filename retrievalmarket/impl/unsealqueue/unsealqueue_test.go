@@ -0,0 +1,107 @@
+package unsealqueue_test
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/unsealqueue"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+type recorder struct {
+	started   []retrievalmarket.DealID
+	positions map[retrievalmarket.DealID]int
+}
+
+func (r *recorder) job(id retrievalmarket.DealID, piece cid.Cid, price int64) *unsealqueue.Job {
+	return &unsealqueue.Job{
+		Deal:        retrievalmarket.ProviderDealIdentifier{Receiver: "client", DealID: id},
+		PieceCID:    piece,
+		UnsealPrice: abi.NewTokenAmount(price),
+		Queued: func(position int) {
+			r.positions[id] = position
+		},
+		Start: func() {
+			r.started = append(r.started, id)
+			delete(r.positions, id)
+		},
+	}
+}
+
+func dealID(id retrievalmarket.DealID) retrievalmarket.ProviderDealIdentifier {
+	return retrievalmarket.ProviderDealIdentifier{Receiver: "client", DealID: id}
+}
+
+func TestQueue(t *testing.T) {
+	pieces := tut.GenerateCids(4)
+
+	t.Run("orders by unseal price then arrival", func(t *testing.T) {
+		r := &recorder{positions: make(map[retrievalmarket.DealID]int)}
+		q := unsealqueue.NewQueue(1)
+		q.Push(r.job(1, pieces[0], 0))
+		q.Push(r.job(2, pieces[1], 0))
+		q.Push(r.job(3, pieces[2], 10))
+		q.Push(r.job(4, pieces[3], 0))
+		require.Equal(t, []retrievalmarket.DealID{1}, r.started)
+		require.Equal(t, map[retrievalmarket.DealID]int{3: 1, 2: 2, 4: 3}, r.positions)
+
+		pos, ok := q.Position(dealID(2))
+		require.True(t, ok)
+		require.Equal(t, 2, pos)
+		_, ok = q.Position(dealID(1))
+		require.False(t, ok)
+
+		q.Done(dealID(1))
+		require.Equal(t, []retrievalmarket.DealID{1, 3}, r.started)
+		require.Equal(t, map[retrievalmarket.DealID]int{2: 1, 4: 2}, r.positions)
+
+		// a deal that ends while waiting leaves the queue
+		q.Done(dealID(2))
+		_, ok = q.Position(dealID(2))
+		require.False(t, ok)
+		require.Equal(t, 1, r.positions[4])
+		q.Done(dealID(3))
+		require.Equal(t, []retrievalmarket.DealID{1, 3, 4}, r.started)
+		waiting, active := q.Len()
+		require.Equal(t, 0, waiting)
+		require.Equal(t, 1, active)
+	})
+
+	t.Run("deduplicates deals for the same piece", func(t *testing.T) {
+		r := &recorder{positions: make(map[retrievalmarket.DealID]int)}
+		q := unsealqueue.NewQueue(1)
+		q.Push(r.job(1, pieces[0], 0))
+		q.Push(r.job(2, pieces[1], 0))
+		q.Push(r.job(3, pieces[2], 0))
+		// joining a waiting piece raises its priority
+		q.Push(r.job(4, pieces[2], 5))
+		require.Equal(t, map[retrievalmarket.DealID]int{3: 1, 4: 1, 2: 2}, r.positions)
+		// joining a piece being unsealed starts at once
+		q.Push(r.job(5, pieces[0], 0))
+		require.Equal(t, []retrievalmarket.DealID{1, 5}, r.started)
+
+		// the piece holds its place until all of its deals are done
+		q.Done(dealID(1))
+		require.Equal(t, []retrievalmarket.DealID{1, 5}, r.started)
+		q.Done(dealID(5))
+		require.ElementsMatch(t, []retrievalmarket.DealID{1, 5, 3, 4}, r.started)
+		waiting, active := q.Len()
+		require.Equal(t, 1, waiting)
+		require.Equal(t, 1, active)
+	})
+
+	t.Run("no limit", func(t *testing.T) {
+		r := &recorder{positions: make(map[retrievalmarket.DealID]int)}
+		q := unsealqueue.NewQueue(0)
+		for i, piece := range pieces {
+			q.Push(r.job(retrievalmarket.DealID(i+1), piece, 0))
+		}
+		require.Len(t, r.started, len(pieces))
+		require.Empty(t, r.positions)
+	})
+}
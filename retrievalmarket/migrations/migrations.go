@@ -10,6 +10,7 @@ import (
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 	"github.com/filecoin-project/go-ds-versioning/pkg/versioned"
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
 	paychtypes "github.com/filecoin-project/go-state-types/builtin/v8/paych"
 
 	"github.com/filecoin-project/go-fil-markets/piecestore"
@@ -241,8 +242,9 @@ func MigratePaymentInfo0To1(oldPi *PaymentInfo0) *retrievalmarket.PaymentInfo {
 		return nil
 	}
 	return &retrievalmarket.PaymentInfo{
-		PayCh: oldPi.PayCh,
-		Lane:  oldPi.Lane,
+		PayCh:    oldPi.PayCh,
+		Lane:     oldPi.Lane,
+		LaneBase: big.Zero(),
 	}
 }
 
@@ -263,11 +263,27 @@ func (e *mockClientEnv) FinalizeBlockstore(ctx context.Context, id retrievalmark
 	return nil
 }
 
+func (e *mockClientEnv) AuthorizePayment(ctx context.Context, deal retrievalmarket.ClientDealState, total abi.TokenAmount) error {
+	return nil
+}
+
+func (e *mockClientEnv) RecordPayment(ctx context.Context, deal retrievalmarket.ClientDealState) error {
+	return nil
+}
+
+func (e *mockClientEnv) LeaseLane(ctx context.Context, id retrievalmarket.DealID, paymentChannel address.Address) (uint64, abi.TokenAmount, error) {
+	return 0, abi.NewTokenAmount(0), nil
+}
+
 var _ clientstates.ClientDealEnvironment = &mockClientEnv{}
 
 type mockProviderEnv struct {
 }
 
+func (te *mockProviderEnv) QueueUnseal(ctx context.Context, deal retrievalmarket.ProviderDealState) error {
+	return nil
+}
+
 func (te *mockProviderEnv) PrepareBlockstore(ctx context.Context, dealID retrievalmarket.DealID, pieceCid cid.Cid) error {
 	return nil
 }
@@ -18,6 +18,7 @@ import (
 
 var log = logging.Logger("retrieval_network")
 var _ RetrievalMarketNetwork = new(libp2pRetrievalMarketNetwork)
+var _ BatchQueryNetwork = new(libp2pRetrievalMarketNetwork)
 
 // Option is an option for configuring the libp2p storage market network
 type Option func(*libp2pRetrievalMarketNetwork)
@@ -29,6 +30,23 @@ func RetryParameters(minDuration time.Duration, maxDuration time.Duration, attem
 	}
 }
 
+// RetryClock sets the clock used to wait between attempts to open a stream
+func RetryClock(clock shared.Clock) Option {
+	return func(impl *libp2pRetrievalMarketNetwork) {
+		impl.retryStream.SetOptions(shared.RetryStreamClock(clock))
+	}
+}
+
+// PeerHealthTracking sets the circuit breaker used to fail fast when opening
+// streams to unreachable peers. Pass the same tracker to the storage and
+// retrieval networks to share peer health between them, and to inspect it.
+// Without it, streams are opened without failing fast.
+func PeerHealthTracking(tracker *shared.PeerHealthTracker) Option {
+	return func(impl *libp2pRetrievalMarketNetwork) {
+		impl.retryStream.SetOptions(shared.PeerHealthTracking(tracker))
+	}
+}
+
 // SupportedProtocols sets what protocols this network instances listens on
 func SupportedProtocols(supportedProtocols []protocol.ID) Option {
 	return func(impl *libp2pRetrievalMarketNetwork) {
@@ -43,6 +61,7 @@ func NewFromLibp2pHost(h host.Host, options ...Option) RetrievalMarketNetwork {
 		host:        h,
 		retryStream: shared.NewRetryStream(h),
 		supportedProtocols: []protocol.ID{
+			retrievalmarket.BatchQueryProtocolID,
 			retrievalmarket.QueryProtocolID,
 			retrievalmarket.OldQueryProtocolID,
 		},
@@ -66,7 +85,8 @@ type libp2pRetrievalMarketNetwork struct {
 
 //  NewQueryStream creates a new RetrievalQueryStream using the provided peer.ID
 func (impl *libp2pRetrievalMarketNetwork) NewQueryStream(id peer.ID) (RetrievalQueryStream, error) {
-	s, err := impl.retryStream.OpenStream(context.Background(), id, impl.supportedProtocols)
+	_, protocols := impl.queryProtocols()
+	s, err := impl.retryStream.OpenStream(context.Background(), id, protocols)
 	if err != nil {
 		log.Warn(err)
 		return nil, err
@@ -78,10 +98,51 @@ func (impl *libp2pRetrievalMarketNetwork) NewQueryStream(id peer.ID) (RetrievalQ
 	return &queryStream{p: id, rw: s, buffered: buffered}, nil
 }
 
+// NewBatchQueryStream creates a new RetrievalBatchQueryStream using the provided peer.ID
+func (impl *libp2pRetrievalMarketNetwork) NewBatchQueryStream(id peer.ID) (RetrievalBatchQueryStream, error) {
+	batch, protocols := impl.queryProtocols()
+	if !batch {
+		return nil, ErrBatchQueryNotSupported
+	}
+	// offer the single query protocols as well, so that a peer that doesn't
+	// support batches picks one of them instead of failing the negotiation,
+	// which would be retried as if the peer were unreachable
+	protocols = append([]protocol.ID{retrievalmarket.BatchQueryProtocolID}, protocols...)
+	s, err := impl.retryStream.OpenStream(context.Background(), id, protocols)
+	if err != nil {
+		log.Warn(err)
+		return nil, err
+	}
+	if s.Protocol() != retrievalmarket.BatchQueryProtocolID {
+		s.Reset() // nolint: errcheck,gosec
+		return nil, ErrBatchQueryNotSupported
+	}
+	return &batchQueryStream{p: id, rw: s, buffered: bufio.NewReaderSize(s, 16)}, nil
+}
+
+// queryProtocols returns whether the batch query protocol is supported, and
+// the supported single query protocols
+func (impl *libp2pRetrievalMarketNetwork) queryProtocols() (bool, []protocol.ID) {
+	batch := false
+	var protocols []protocol.ID
+	for _, proto := range impl.supportedProtocols {
+		if proto == retrievalmarket.BatchQueryProtocolID {
+			batch = true
+			continue
+		}
+		protocols = append(protocols, proto)
+	}
+	return batch, protocols
+}
+
 // SetDelegate sets a RetrievalReceiver to handle stream data
 func (impl *libp2pRetrievalMarketNetwork) SetDelegate(r RetrievalReceiver) error {
 	impl.receiver = r
+	_, batch := r.(BatchQueryReceiver)
 	for _, proto := range impl.supportedProtocols {
+		if proto == retrievalmarket.BatchQueryProtocolID && !batch {
+			continue
+		}
 		impl.host.SetStreamHandler(proto, impl.handleNewQueryStream)
 	}
 	return nil
@@ -105,6 +166,16 @@ func (impl *libp2pRetrievalMarketNetwork) handleNewQueryStream(s network.Stream)
 	}
 	remotePID := s.Conn().RemotePeer()
 	buffered := bufio.NewReaderSize(s, 16)
+	if s.Protocol() == retrievalmarket.BatchQueryProtocolID {
+		br, ok := impl.receiver.(BatchQueryReceiver)
+		if !ok {
+			log.Warn("receiver does not handle batch queries")
+			s.Reset() // nolint: errcheck,gosec
+			return
+		}
+		br.HandleBatchQueryStream(&batchQueryStream{remotePID, s, buffered})
+		return
+	}
 	var qs RetrievalQueryStream
 	if s.Protocol() == retrievalmarket.OldQueryProtocolID {
 		qs = &oldQueryStream{remotePID, s, buffered}
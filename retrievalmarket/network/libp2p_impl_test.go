@@ -16,8 +16,9 @@ import (
 )
 
 type testReceiver struct {
-	t                  *testing.T
-	queryStreamHandler func(network.RetrievalQueryStream)
+	t                       *testing.T
+	queryStreamHandler      func(network.RetrievalQueryStream)
+	batchQueryStreamHandler func(network.RetrievalBatchQueryStream)
 }
 
 func (tr *testReceiver) HandleQueryStream(s network.RetrievalQueryStream) {
@@ -27,6 +28,20 @@ func (tr *testReceiver) HandleQueryStream(s network.RetrievalQueryStream) {
 	}
 }
 
+func (tr *testReceiver) HandleBatchQueryStream(s network.RetrievalBatchQueryStream) {
+	defer s.Close()
+	if tr.batchQueryStreamHandler != nil {
+		tr.batchQueryStreamHandler(s)
+	}
+}
+
+// singleQueryReceiver is a receiver that only handles single queries
+type singleQueryReceiver struct{}
+
+func (singleQueryReceiver) HandleQueryStream(s network.RetrievalQueryStream) {
+	_ = s.Close()
+}
+
 func TestQueryStreamSendReceiveQuery(t *testing.T) {
 	ctx := context.Background()
 
@@ -168,6 +183,72 @@ func TestQueryStreamSendReceiveMultipleSuccessful(t *testing.T) {
 	assert.Equal(t, qr, resp)
 }
 
+func TestBatchQueryStreamSendReceive(t *testing.T) {
+	ctxBg := context.Background()
+	td := shared_testutil.NewLibp2pTestData(ctxBg, t)
+	nw1 := network.NewFromLibp2pHost(td.Host1)
+	nw2 := network.NewFromLibp2pHost(td.Host2)
+	require.NoError(t, td.Host1.Connect(ctxBg, peer.AddrInfo{ID: td.Host2.ID()}))
+
+	// host2 answers the queries in reverse order
+	qr := shared_testutil.MakeTestQueryResponse()
+	tr2 := &testReceiver{t: t, batchQueryStreamHandler: func(s network.RetrievalBatchQueryStream) {
+		batch, err := s.ReadBatchQuery()
+		require.NoError(t, err)
+		for i := len(batch.Queries) - 1; i >= 0; i-- {
+			require.NoError(t, s.WriteBatchQueryResponse(retrievalmarket.BatchQueryResponse{Index: uint64(i), Response: qr}))
+		}
+	}}
+	require.NoError(t, nw2.SetDelegate(tr2))
+
+	qs, err := nw1.(network.BatchQueryNetwork).NewBatchQueryStream(td.Host2.ID())
+	require.NoError(t, err)
+	defer qs.Close()
+
+	cids := shared_testutil.GenerateCids(3)
+	batch := retrievalmarket.BatchQuery{}
+	for _, c := range cids {
+		batch.Queries = append(batch.Queries, retrievalmarket.Query{PayloadCID: c})
+	}
+	require.NoError(t, qs.WriteBatchQuery(batch))
+	for i := len(cids) - 1; i >= 0; i-- {
+		resp, err := qs.ReadBatchQueryResponse()
+		require.NoError(t, err)
+		assert.Equal(t, uint64(i), resp.Index)
+		assert.Equal(t, qr, resp.Response)
+	}
+}
+
+func TestBatchQueryStreamNotSupported(t *testing.T) {
+	ctxBg := context.Background()
+	td := shared_testutil.NewLibp2pTestData(ctxBg, t)
+	require.NoError(t, td.Host1.Connect(ctxBg, peer.AddrInfo{ID: td.Host2.ID()}))
+	singleOnly := network.SupportedProtocols([]protocol.ID{retrievalmarket.QueryProtocolID, retrievalmarket.OldQueryProtocolID})
+
+	// the remote peer only supports single queries
+	nw1 := network.NewFromLibp2pHost(td.Host1)
+	nw2 := network.NewFromLibp2pHost(td.Host2, singleOnly)
+	require.NoError(t, nw2.SetDelegate(&testReceiver{t: t}))
+	_, err := nw1.(network.BatchQueryNetwork).NewBatchQueryStream(td.Host2.ID())
+	require.ErrorIs(t, err, network.ErrBatchQueryNotSupported)
+
+	// single queries still work
+	qs, err := nw1.NewQueryStream(td.Host2.ID())
+	require.NoError(t, err)
+	require.NoError(t, qs.Close())
+
+	// the remote receiver doesn't handle batches
+	nw2 = network.NewFromLibp2pHost(td.Host2)
+	require.NoError(t, nw2.SetDelegate(&singleQueryReceiver{}))
+	_, err = nw1.(network.BatchQueryNetwork).NewBatchQueryStream(td.Host2.ID())
+	require.ErrorIs(t, err, network.ErrBatchQueryNotSupported)
+
+	// the local network doesn't support batches
+	nw1 = network.NewFromLibp2pHost(td.Host1, singleOnly)
+	_, err = nw1.(network.BatchQueryNetwork).NewBatchQueryStream(td.Host2.ID())
+	require.ErrorIs(t, err, network.ErrBatchQueryNotSupported)
+}
+
 func TestLibp2pRetrievalMarketNetwork_StopHandlingRequests(t *testing.T) {
 	bgCtx := context.Background()
 	td := shared_testutil.NewLibp2pTestData(bgCtx, t)
@@ -1,6 +1,8 @@
 package network
 
 import (
+	"errors"
+
 	"github.com/libp2p/go-libp2p-core/peer"
 	ma "github.com/multiformats/go-multiaddr"
 
@@ -21,6 +23,21 @@ type RetrievalQueryStream interface {
 	RemotePeer() peer.ID
 }
 
+// RetrievalBatchQueryStream is the API needed to send a batch of retrieval
+// queries and receive the responses to them one at a time
+type RetrievalBatchQueryStream interface {
+	ReadBatchQuery() (retrievalmarket.BatchQuery, error)
+	WriteBatchQuery(retrievalmarket.BatchQuery) error
+	ReadBatchQueryResponse() (retrievalmarket.BatchQueryResponse, error)
+	WriteBatchQueryResponse(retrievalmarket.BatchQueryResponse) error
+	Close() error
+	RemotePeer() peer.ID
+}
+
+// ErrBatchQueryNotSupported is returned when opening a batch query stream to
+// a peer that doesn't support the batch query protocol
+var ErrBatchQueryNotSupported = errors.New("peer does not support batch retrieval queries")
+
 // RetrievalReceiver is the API for handling data coming in on
 // both query and deal streams
 type RetrievalReceiver interface {
@@ -29,6 +46,15 @@ type RetrievalReceiver interface {
 	HandleQueryStream(RetrievalQueryStream)
 }
 
+// BatchQueryReceiver is implemented by a RetrievalReceiver that also
+// answers batches of queries. The network only serves the batch query
+// protocol to a receiver that implements it.
+type BatchQueryReceiver interface {
+	// HandleBatchQueryStream answers the batch of queries read from the
+	// RetrievalBatchQueryStream provided
+	HandleBatchQueryStream(RetrievalBatchQueryStream)
+}
+
 // RetrievalMarketNetwork is the API for creating query and deal streams and
 // delegating responders to those streams.
 type RetrievalMarketNetwork interface {
@@ -48,3 +74,12 @@ type RetrievalMarketNetwork interface {
 	// AddAddrs adds the given multi-addrs to the peerstore for the passed peer ID
 	AddAddrs(peer.ID, []ma.Multiaddr)
 }
+
+// BatchQueryNetwork is implemented by a RetrievalMarketNetwork that can
+// also send batches of queries
+type BatchQueryNetwork interface {
+	// NewBatchQueryStream creates a new RetrievalBatchQueryStream to the given
+	// peer, or returns ErrBatchQueryNotSupported if the peer only supports
+	// single queries
+	NewBatchQueryStream(peer.ID) (RetrievalBatchQueryStream, error)
+}
@@ -49,7 +49,32 @@ type RetrievalProviderNode interface {
 
 	// returns the worker address associated with a miner
 	GetMinerWorkerAddress(ctx context.Context, miner address.Address, tok shared.TipSetToken) (address.Address, error)
+	// saves a payment voucher and returns how much it is for beyond the best
+	// voucher previously saved on the same lane, since vouchers on a lane are
+	// cumulative and the lane may have been used by earlier deals
 	SavePaymentVoucher(ctx context.Context, paymentChannel address.Address, voucher *paychtypes.SignedVoucher, proof []byte, expectedAmount abi.TokenAmount, tok shared.TipSetToken) (abi.TokenAmount, error)
 
 	GetRetrievalPricingInput(ctx context.Context, pieceCID cid.Cid, storageDeals []abi.DealID) (PricingInput, error)
 }
+
+// RetrievalSettlementNode are the node dependencies for redeeming the
+// payment vouchers a RetrievalProvider receives
+type RetrievalSettlementNode interface {
+	GetChainHead(ctx context.Context) (shared.TipSetToken, abi.ChainEpoch, error)
+
+	// GetPaymentChannelSettlingAt returns the epoch at which a payment channel
+	// settles, or zero if settlement has not been started
+	GetPaymentChannelSettlingAt(ctx context.Context, paymentChannel address.Address, tok shared.TipSetToken) (abi.ChainEpoch, error)
+
+	// SubmitPaymentVoucher sends a message that redeems a voucher against its
+	// payment channel, returning the message CID
+	SubmitPaymentVoucher(ctx context.Context, paymentChannel address.Address, voucher *paychtypes.SignedVoucher) (cid.Cid, error)
+
+	// SettlePaymentChannel sends a message that starts settlement of a payment
+	// channel, returning the message CID
+	SettlePaymentChannel(ctx context.Context, paymentChannel address.Address) (cid.Cid, error)
+
+	// CollectPaymentChannel sends a message that pays out the redeemed funds
+	// of a settled payment channel, returning the message CID
+	CollectPaymentChannel(ctx context.Context, paymentChannel address.Address) (cid.Cid, error)
+}
@@ -0,0 +1,64 @@
+package parallel
+
+import (
+	"sync"
+
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// BlockstoreAccessor is the retrievalmarket.BlockstoreAccessor a retrieval
+// client should be constructed with, so that a Coordinator can route all
+// the deals of a retrieval into the retrieval's blockstore. Deals that were
+// not bound to a blockstore are passed through to a fallback accessor.
+type BlockstoreAccessor struct {
+	fallback retrievalmarket.BlockstoreAccessor
+
+	lk    sync.Mutex
+	bound map[retrievalmarket.DealID]bstore.Blockstore
+}
+
+var _ retrievalmarket.BlockstoreAccessor = (*BlockstoreAccessor)(nil)
+
+// NewBlockstoreAccessor returns a new BlockstoreAccessor that passes deals
+// not started by a Coordinator to fallback
+func NewBlockstoreAccessor(fallback retrievalmarket.BlockstoreAccessor) *BlockstoreAccessor {
+	return &BlockstoreAccessor{
+		fallback: fallback,
+		bound:    make(map[retrievalmarket.DealID]bstore.Blockstore),
+	}
+}
+
+// Get returns the blockstore for the given deal
+func (a *BlockstoreAccessor) Get(id retrievalmarket.DealID, payloadCID retrievalmarket.PayloadCID) (bstore.Blockstore, error) {
+	a.lk.Lock()
+	bs, ok := a.bound[id]
+	a.lk.Unlock()
+	if ok {
+		return bs, nil
+	}
+	return a.fallback.Get(id, payloadCID)
+}
+
+// Done releases the blockstore for the given deal. The blockstore of a
+// bound deal may be shared with other deals and belongs to the caller
+// that bound it, so it is left open.
+func (a *BlockstoreAccessor) Done(id retrievalmarket.DealID) error {
+	a.lk.Lock()
+	_, ok := a.bound[id]
+	delete(a.bound, id)
+	a.lk.Unlock()
+	if ok {
+		return nil
+	}
+	return a.fallback.Done(id)
+}
+
+// Bind routes the deal with the given ID into bs. It must be called before
+// the deal is started.
+func (a *BlockstoreAccessor) Bind(id retrievalmarket.DealID, bs bstore.Blockstore) {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	a.bound[id] = bs
+}
@@ -0,0 +1,217 @@
+// Package parallel retrieves a single DAG from several providers at once.
+//
+// A Coordinator first retrieves the root block of the DAG, then splits the
+// rest of the DAG into one subtree per link of the root, each retrieved with
+// its own selector. Every provider works through the subtrees one deal at a
+// time, and all deals write into the same blockstore. A subtree whose deal
+// fails, or receives no data for longer than the stall timeout, is handed
+// to another provider, and a provider that fails too many deals in a row is
+// dropped from the retrieval. When no other provider is left to hand a
+// subtree to, the provider that failed it retries it, up to a limit.
+//
+// Each deal is paid for separately, from its own payment channel lane, but
+// the progress and cost of all the deals is reported through a single
+// Retrieval. Every subtree selector starts from the root of the DAG, so the
+// provider sends the root block again on each deal, and each deal pays for
+// it. A subtree deal commits only enough funds for the root block and the
+// subtree, when the root node records the size of the subtree as dag-pb
+// links do, and the price of the whole piece otherwise.
+package parallel
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipld/go-ipld-prime"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+var log = logging.Logger("retrieval-parallel")
+
+// DefaultStallTimeout is how long a deal may go without receiving data
+// before its subtree is handed to another provider
+const DefaultStallTimeout = time.Minute
+
+// DefaultMaxProviderFailures is the number of deals in a row a provider may
+// fail before it is dropped from a retrieval
+const DefaultMaxProviderFailures = 2
+
+// DefaultMaxSubtreeRetries is the number of times a provider may retry a
+// subtree it failed to retrieve, when no other provider is left to try it
+const DefaultMaxSubtreeRetries = 2
+
+// Offer is a provider's offer to serve a retrieval
+type Offer struct {
+	Peer retrievalmarket.RetrievalPeer
+	// Response is the provider's response to a query for the payload, which
+	// sets the terms of the deals made with the provider
+	Response retrievalmarket.QueryResponse
+	// PieceCID optionally restricts deals to a single piece
+	PieceCID *cid.Cid
+	// FundsPerDeal is the most a single deal may spend. It defaults to the
+	// price of retrieving the deal's subtree along with the root block, if
+	// the size of the subtree is known, or of the whole piece otherwise.
+	FundsPerDeal abi.TokenAmount
+}
+
+// params returns the params for a deal retrieving the selected blocks, and
+// the funds to commit to it. size is the total size of the blocks the deal
+// retrieves, or zero if it is unknown.
+func (o Offer) params(sel ipld.Node, size uint64) (retrievalmarket.Params, abi.TokenAmount, error) {
+	params, err := o.Response.DealParams(sel, o.PieceCID)
+	if o.Response.FreeRetrievalRequired {
+		return params, big.Zero(), err
+	}
+	funds := o.FundsPerDeal
+	if funds.Nil() {
+		funds = o.Response.PieceRetrievalPrice()
+		if size > 0 && size < o.Response.Size {
+			funds = big.Add(big.Mul(o.Response.MinPricePerByte, abi.NewTokenAmount(int64(size))), o.Response.UnsealPrice)
+		}
+	}
+	return params, funds, err
+}
+
+// Option is a function that configures a Coordinator
+type Option func(c *Coordinator)
+
+// StallTimeout sets how long a deal may go without receiving data before
+// it is cancelled and its subtree handed to another provider. Zero disables
+// stall detection.
+func StallTimeout(timeout time.Duration) Option {
+	return func(c *Coordinator) {
+		c.stallTimeout = timeout
+	}
+}
+
+// MaxProviderFailures sets the number of deals in a row a provider may fail
+// before it is dropped from a retrieval
+func MaxProviderFailures(n int) Option {
+	return func(c *Coordinator) {
+		c.maxFailures = n
+	}
+}
+
+// MaxSubtreeRetries sets the number of times a provider may retry a subtree
+// it failed to retrieve, when no other provider is left to try it. Zero
+// fails the retrieval as soon as every provider has failed a subtree once.
+func MaxSubtreeRetries(n int) Option {
+	return func(c *Coordinator) {
+		c.maxRetries = n
+	}
+}
+
+// CoordinatorClock sets the clock the coordinator uses to detect stalled deals
+func CoordinatorClock(clock shared.Clock) Option {
+	return func(c *Coordinator) {
+		c.clock = clock
+	}
+}
+
+// Coordinator runs retrievals of a single DAG from several providers
+type Coordinator struct {
+	client       retrievalmarket.RetrievalClient
+	accessor     *BlockstoreAccessor
+	stallTimeout time.Duration
+	maxFailures  int
+	maxRetries   int
+	clock        shared.Clock
+}
+
+// NewCoordinator returns a Coordinator that makes deals with the given
+// client. The client must have been constructed with accessor as its
+// blockstore accessor.
+func NewCoordinator(client retrievalmarket.RetrievalClient, accessor *BlockstoreAccessor, opts ...Option) *Coordinator {
+	c := &Coordinator{
+		client:       client,
+		accessor:     accessor,
+		stallTimeout: DefaultStallTimeout,
+		maxFailures:  DefaultMaxProviderFailures,
+		maxRetries:   DefaultMaxSubtreeRetries,
+		clock:        shared.NewClock(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.maxFailures < 1 {
+		c.maxFailures = 1
+	}
+	if c.maxRetries < 0 {
+		c.maxRetries = 0
+	}
+	return c
+}
+
+// Retrieve starts retrieving the DAG under payloadCID into bs, from the
+// providers in offers, paying from clientWallet. The returned Retrieval
+// tracks the progress of the retrieval, which runs until every block has
+// been retrieved, every provider has been dropped, or ctx is cancelled.
+func (c *Coordinator) Retrieve(ctx context.Context, payloadCID cid.Cid, bs bstore.Blockstore, clientWallet address.Address, offers []Offer) (*Retrieval, error) {
+	if len(offers) == 0 {
+		return nil, xerrors.New("no providers offered to serve the retrieval")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &Retrieval{
+		c:            c,
+		payloadCID:   payloadCID,
+		bs:           bs,
+		clientWallet: clientWallet,
+		ctx:          ctx,
+		cancel:       cancel,
+		queue:        []*subtree{newSubtree(rootSelector, true, 0)},
+		subtrees:     1,
+		remaining:    1,
+		live:         make(map[peer.ID]struct{}),
+		deals:        make(map[retrievalmarket.DealID]*deal),
+		done:         make(chan struct{}),
+	}
+	r.cond = sync.NewCond(&r.lk)
+	r.unsubscribe = c.client.SubscribeToEvents(r.onEvent)
+
+	// register every provider before any starts work, so that an early
+	// failure isn't mistaken for the last provider giving up
+	var workers []Offer
+	for _, offer := range offers {
+		if _, ok := r.live[offer.Peer.ID]; ok {
+			continue
+		}
+		r.live[offer.Peer.ID] = struct{}{}
+		workers = append(workers, offer)
+	}
+
+	var wg sync.WaitGroup
+	for _, offer := range workers {
+		wg.Add(1)
+		go func(offer Offer) {
+			defer wg.Done()
+			r.work(offer)
+		}(offer)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.fail(ctx.Err())
+		case <-r.done:
+		}
+	}()
+	go func() {
+		wg.Wait()
+		r.finish()
+	}()
+
+	return r, nil
+}
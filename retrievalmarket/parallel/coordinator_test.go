@@ -0,0 +1,377 @@
+package parallel_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-graphsync/storeutil"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/parallel"
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil/unixfs"
+)
+
+func TestCoordinatorRetrieve(t *testing.T) {
+	ctx := context.Background()
+	src, root := makeDAG(t)
+	allBlocks := copySelected(t, ctx, src, newBlockstore(), root, selectorparse.CommonSelector_ExploreAllRecursively)
+
+	testCases := map[string]struct {
+		behaviours   []testnodes.DealBehaviour
+		expectErr    bool
+		minProviders int
+	}{
+		"spreads the DAG across providers": {
+			behaviours:   []testnodes.DealBehaviour{testnodes.ServeDeals, testnodes.ServeDeals, testnodes.ServeDeals},
+			minProviders: 2,
+		},
+		"hands subtrees of a failing provider to the others": {
+			behaviours:   []testnodes.DealBehaviour{testnodes.ServeDeals, testnodes.RejectDeals},
+			minProviders: 1,
+		},
+		"hands subtrees of a stalled provider to the others": {
+			behaviours:   []testnodes.DealBehaviour{testnodes.StallDeals, testnodes.ServeDeals},
+			minProviders: 1,
+		},
+		"fails when every provider fails": {
+			behaviours: []testnodes.DealBehaviour{testnodes.RejectDeals, testnodes.RejectDeals},
+			expectErr:  true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+
+			fc, accessor := newFakeClient(src)
+			var offers []parallel.Offer
+			for _, b := range tc.behaviours {
+				offers = append(offers, addProvider(t, fc, b))
+			}
+			coord := parallel.NewCoordinator(fc, accessor, parallel.StallTimeout(100*time.Millisecond))
+
+			dest := newBlockstore()
+			r, err := coord.Retrieve(ctx, root, dest, address.TestAddress, offers)
+			require.NoError(t, err)
+			err = r.Wait(ctx)
+			progress := r.Progress()
+
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			// the root block and one subtree per leaf were retrieved
+			require.Equal(t, len(allBlocks), progress.Subtrees)
+			require.Equal(t, progress.Subtrees, progress.SubtreesRetrieved)
+			for _, c := range allBlocks {
+				has, err := dest.Has(ctx, c)
+				require.NoError(t, err)
+				require.True(t, has, "missing block %s", c)
+			}
+
+			// progress and cost are aggregated across deals
+			require.GreaterOrEqual(t, len(progress.Deals), progress.Subtrees)
+			require.Equal(t, fc.TotalReceived(), progress.BytesReceived)
+			require.Equal(t, big.Mul(big.NewIntUnsigned(fc.TotalReceived()), pricePerByte), progress.FundsSpent)
+			require.GreaterOrEqual(t, len(fc.ServedBy()), tc.minProviders)
+			require.Zero(t, fc.Subscribers(), "retrieval should unsubscribe when done")
+		})
+	}
+}
+
+func TestCoordinatorSingleProvider(t *testing.T) {
+	ctx := context.Background()
+	src, root := makeDAG(t)
+
+	testCases := map[string]struct {
+		rejectFirst int
+		behaviour   testnodes.DealBehaviour
+		expectErr   bool
+		expectDeals int
+	}{
+		"retries a failed subtree": {
+			rejectFirst: 2,
+			behaviour:   testnodes.ServeDeals,
+		},
+		"fails once the retries are used up": {
+			rejectFirst: 3,
+			behaviour:   testnodes.ServeDeals,
+			expectErr:   true,
+			expectDeals: 3,
+		},
+		"fails when the provider fails every deal": {
+			behaviour:   testnodes.RejectDeals,
+			expectErr:   true,
+			expectDeals: 3,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+
+			fc, accessor := newFakeClient(src)
+			offer := addFakeProvider(t, fc, testnodes.FakeProvider{Behaviour: tc.behaviour, RejectFirst: tc.rejectFirst})
+			coord := parallel.NewCoordinator(fc, accessor, parallel.MaxProviderFailures(10), parallel.MaxSubtreeRetries(2))
+
+			dest := newBlockstore()
+			r, err := coord.Retrieve(ctx, root, dest, address.TestAddress, []parallel.Offer{offer})
+			require.NoError(t, err)
+			err = r.Wait(ctx)
+			progress := r.Progress()
+
+			if tc.expectErr {
+				require.Error(t, err)
+				require.Len(t, progress.Deals, tc.expectDeals)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, progress.Subtrees, progress.SubtreesRetrieved)
+			require.Len(t, progress.Deals, progress.Subtrees+tc.rejectFirst)
+		})
+	}
+}
+
+func TestCoordinatorCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	src, root := makeDAG(t)
+
+	fc, accessor := newFakeClient(src)
+	offers := []parallel.Offer{addProvider(t, fc, testnodes.StallDeals)}
+	coord := parallel.NewCoordinator(fc, accessor, parallel.StallTimeout(0))
+
+	r, err := coord.Retrieve(ctx, root, newBlockstore(), address.TestAddress, offers)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(r.Progress().Deals) == 1 }, time.Second, time.Millisecond)
+	r.Cancel()
+	require.ErrorIs(t, r.Wait(ctx), context.Canceled)
+	require.Len(t, fc.Cancelled(), 1)
+}
+
+func TestCoordinatorFunds(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	src, root := makeDAG(t)
+	rootBlk, err := src.Get(ctx, root)
+	require.NoError(t, err)
+
+	fc, accessor := newFakeClient(src)
+	offer := addProvider(t, fc, testnodes.ServeDeals)
+	coord := parallel.NewCoordinator(fc, accessor)
+	r, err := coord.Retrieve(ctx, root, newBlockstore(), address.TestAddress, []parallel.Offer{offer})
+	require.NoError(t, err)
+	require.NoError(t, r.Wait(ctx))
+
+	// the root deal commits the price of the piece, and each subtree deal
+	// commits just enough for the root block and its subtree
+	funds, received := fc.DealFunds()
+	require.Len(t, funds, r.Progress().Subtrees)
+	for id, committed := range funds {
+		if received[id] == uint64(len(rootBlk.RawData())) {
+			require.Equal(t, offer.Response.PieceRetrievalPrice(), committed)
+			continue
+		}
+		require.Greater(t, received[id], uint64(len(rootBlk.RawData())))
+		require.Equal(t, big.Mul(big.NewIntUnsigned(received[id]), pricePerByte), committed)
+	}
+
+	// an explicit limit applies to every deal
+	fc, accessor = newFakeClient(src)
+	offer = addProvider(t, fc, testnodes.ServeDeals)
+	offer.FundsPerDeal = abi.NewTokenAmount(1 << 30)
+	coord = parallel.NewCoordinator(fc, accessor)
+	r, err = coord.Retrieve(ctx, root, newBlockstore(), address.TestAddress, []parallel.Offer{offer})
+	require.NoError(t, err)
+	require.NoError(t, r.Wait(ctx))
+	funds, _ = fc.DealFunds()
+	for _, committed := range funds {
+		require.Equal(t, offer.FundsPerDeal, committed)
+	}
+}
+
+func TestSubtreeSelectors(t *testing.T) {
+	ctx := context.Background()
+	src, root := makeDAG(t)
+
+	blk, err := src.Get(ctx, root)
+	require.NoError(t, err)
+	nb := dagpb.Type.PBNode.NewBuilder()
+	require.NoError(t, dagpb.DecodeBytes(nb, blk.RawData()))
+	rootNode := nb.Build()
+
+	sels, err := parallel.SubtreeSelectors(rootNode)
+	require.NoError(t, err)
+	links, err := rootNode.LookupByString("Links")
+	require.NoError(t, err)
+	require.Equal(t, int(links.Length()), len(sels))
+
+	// each selector retrieves the root and exactly one of its children
+	for i, sel := range sels {
+		link, err := links.LookupByIndex(int64(i))
+		require.NoError(t, err)
+		hash, err := link.LookupByString("Hash")
+		require.NoError(t, err)
+		lnk, err := hash.AsLink()
+		require.NoError(t, err)
+
+		copied := copySelected(t, ctx, src, newBlockstore(), root, sel)
+		require.ElementsMatch(t, []cid.Cid{root, lnk.(cidlink.Link).Cid}, copied)
+	}
+}
+
+var pricePerByte = abi.NewTokenAmount(2)
+
+// newFakeClient returns a fake client whose providers serve the blocks a
+// deal's selector matches in src, after giving the other providers a chance
+// to pick up work
+func newFakeClient(src bstore.Blockstore) (*testnodes.FakeRetrievalClient, *parallel.BlockstoreAccessor) {
+	accessor := parallel.NewBlockstoreAccessor(tut.NewTestRetrievalBlockstoreAccessor())
+	fc := testnodes.NewFakeRetrievalClient(accessor, func(ctx context.Context, payloadCID cid.Cid, params retrievalmarket.Params, bs bstore.Blockstore) (uint64, error) {
+		sel, err := decodeSelector(params.Selector)
+		if err != nil {
+			return 0, err
+		}
+		var received uint64
+		for _, c := range copyBlocks(ctx, src, bs, payloadCID, sel) {
+			blk, err := bs.Get(ctx, c)
+			if err != nil {
+				return 0, err
+			}
+			received += uint64(len(blk.RawData()))
+		}
+		return received, nil
+	})
+	fc.ServeDelay = 5 * time.Millisecond
+	return fc, accessor
+}
+
+// addProvider adds a provider that responds to deals with behaviour, and
+// returns its offer
+func addProvider(t *testing.T, fc *testnodes.FakeRetrievalClient, behaviour testnodes.DealBehaviour) parallel.Offer {
+	return addFakeProvider(t, fc, testnodes.FakeProvider{Behaviour: behaviour})
+}
+
+// addFakeProvider adds the provider, with a query response offering the
+// whole DAG, and returns its offer
+func addFakeProvider(t *testing.T, fc *testnodes.FakeRetrievalClient, provider testnodes.FakeProvider) parallel.Offer {
+	provider.Query = retrievalmarket.QueryResponse{
+		Status:          retrievalmarket.QueryResponseAvailable,
+		Size:            1 << 20,
+		PaymentAddress:  address.TestAddress2,
+		MinPricePerByte: pricePerByte,
+		UnsealPrice:     big.Zero(),
+	}
+	p := fc.AddProvider(t, provider)
+	return parallel.Offer{Peer: p, Response: provider.Query}
+}
+
+func newBlockstore() bstore.Blockstore {
+	return bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+}
+
+// makeDAG imports a 19000 byte file, which is chunked into leaves under a
+// single root node
+func makeDAG(t *testing.T) (bstore.Blockstore, cid.Cid) {
+	bs := newBlockstore()
+	dagService := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	root := unixfs.WriteUnixfsDAGTo(t, filepath.Join(tut.ThisDir(t), "../impl/fixtures/lorem.txt"), dagService)
+	return bs, root
+}
+
+func decodeSelector(sel *cbg.Deferred) (ipld.Node, error) {
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dagcbor.Decode(nb, bytes.NewReader(sel.Raw)); err != nil {
+		return nil, err
+	}
+	return nb.Build(), nil
+}
+
+func copySelected(t *testing.T, ctx context.Context, src, dest bstore.Blockstore, root cid.Cid, sel ipld.Node) []cid.Cid {
+	copied := copyBlocks(ctx, src, dest, root, sel)
+	require.NotEmpty(t, copied)
+	return copied
+}
+
+// copyBlocks copies the blocks a traversal with the selector loads from src
+// to dest, returning their CIDs
+func copyBlocks(ctx context.Context, src, dest bstore.Blockstore, root cid.Cid, sel ipld.Node) []cid.Cid {
+	compiled, err := selector.CompileSelector(sel)
+	if err != nil {
+		return nil
+	}
+	var copied []cid.Cid
+	seen := cid.NewSet()
+	lsys := storeutil.LinkSystemForBlockstore(src)
+	open := lsys.StorageReadOpener
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		r, err := open(lctx, lnk)
+		if err != nil {
+			return nil, err
+		}
+		c := lnk.(cidlink.Link).Cid
+		if seen.Visit(c) {
+			blk, err := src.Get(ctx, c)
+			if err != nil {
+				return nil, err
+			}
+			if err := dest.Put(ctx, blk); err != nil {
+				return nil, err
+			}
+			copied = append(copied, c)
+		}
+		return r, nil
+	}
+
+	chooser := dagpb.AddSupportToChooser(basicnode.Chooser)
+	rootLnk := cidlink.Link{Cid: root}
+	proto, err := chooser(rootLnk, ipld.LinkContext{Ctx: ctx})
+	if err != nil {
+		return nil
+	}
+	rootNode, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, rootLnk, proto)
+	if err != nil {
+		return nil
+	}
+	prog := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: chooser,
+		},
+	}
+	_ = prog.WalkAdv(rootNode, compiled, func(traversal.Progress, datamodel.Node, traversal.VisitReason) error {
+		return nil
+	})
+	return copied
+}
@@ -0,0 +1,338 @@
+package parallel
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-ipld-prime"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/dealwatch"
+)
+
+// Progress is a snapshot of the progress of a Retrieval
+type Progress struct {
+	// Subtrees is the number of parts the DAG has been split into so far,
+	// including the root block
+	Subtrees int
+	// SubtreesRetrieved is the number of those parts that have been
+	// retrieved
+	SubtreesRetrieved int
+	// Deals are the IDs of all deals made for the retrieval, including
+	// deals that failed
+	Deals []retrievalmarket.DealID
+	// BytesReceived is the total received across all deals
+	BytesReceived uint64
+	// FundsSpent is the total spent across all deals
+	FundsSpent abi.TokenAmount
+}
+
+// Retrieval is a retrieval of a single DAG from several providers
+type Retrieval struct {
+	c            *Coordinator
+	payloadCID   cid.Cid
+	bs           bstore.Blockstore
+	clientWallet address.Address
+	ctx          context.Context
+	cancel       context.CancelFunc
+	unsubscribe  retrievalmarket.Unsubscribe
+	done         chan struct{}
+
+	lk        sync.Mutex
+	cond      *sync.Cond
+	queue     []*subtree
+	rootSize  uint64
+	subtrees  int
+	remaining int
+	live      map[peer.ID]struct{}
+	deals     map[retrievalmarket.DealID]*deal
+	finished  bool
+	err       error
+}
+
+type subtree struct {
+	selector ipld.Node
+	root     bool
+	// size is the total size of the blocks in the subtree, not counting the
+	// root block, or zero if it is unknown
+	size uint64
+	// tried are the providers that have failed to retrieve the subtree and
+	// may not retry it
+	tried map[peer.ID]struct{}
+	// failures counts the deals for the subtree each provider has failed
+	failures map[peer.ID]int
+}
+
+func newSubtree(selector ipld.Node, root bool, size uint64) *subtree {
+	return &subtree{
+		selector: selector,
+		root:     root,
+		size:     size,
+		tried:    make(map[peer.ID]struct{}),
+		failures: make(map[peer.ID]int),
+	}
+}
+
+type deal struct {
+	provider peer.ID
+	watcher  *dealwatch.Watcher
+}
+
+// PayloadCID returns the root of the DAG being retrieved
+func (r *Retrieval) PayloadCID() cid.Cid {
+	return r.payloadCID
+}
+
+// Progress returns the current progress of the retrieval
+func (r *Retrieval) Progress() Progress {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	p := Progress{
+		Subtrees:          r.subtrees,
+		SubtreesRetrieved: r.subtrees - r.remaining,
+		FundsSpent:        big.Zero(),
+	}
+	for id, d := range r.deals {
+		state := d.watcher.Latest()
+		p.Deals = append(p.Deals, id)
+		p.BytesReceived += state.TotalReceived
+		if !state.FundsSpent.Nil() {
+			p.FundsSpent = big.Add(p.FundsSpent, state.FundsSpent)
+		}
+	}
+	sort.Slice(p.Deals, func(i, j int) bool { return p.Deals[i] < p.Deals[j] })
+	return p
+}
+
+// Done returns a channel that is closed when the retrieval ends
+func (r *Retrieval) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns the reason the retrieval failed, or nil if it succeeded or
+// is still running
+func (r *Retrieval) Err() error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.err
+}
+
+// Wait waits for the retrieval to end and returns its error
+func (r *Retrieval) Wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.done:
+		return r.Err()
+	}
+}
+
+// Cancel stops the retrieval, cancelling any deals in progress
+func (r *Retrieval) Cancel() {
+	r.fail(context.Canceled)
+}
+
+// work retrieves subtrees from a single provider until there are none left
+// that it can retrieve
+func (r *Retrieval) work(offer Offer) {
+	failures := 0
+	for {
+		st := r.next(offer.Peer.ID)
+		if st == nil {
+			return
+		}
+
+		err := r.runDeal(offer, st)
+		if err == nil {
+			failures = 0
+			r.retrieved(st)
+			continue
+		}
+
+		failures++
+		dropped := failures >= r.c.maxFailures
+		log.Warnf("retrieving part of %s from %s failed (dropped: %t): %s", r.payloadCID, offer.Peer.ID, dropped, err)
+		r.requeue(st, offer.Peer.ID, dropped)
+		if dropped {
+			return
+		}
+	}
+}
+
+// next waits for a subtree the provider has not yet failed to retrieve,
+// returning nil once the retrieval ends
+func (r *Retrieval) next(p peer.ID) *subtree {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	for {
+		if r.err != nil || r.remaining == 0 {
+			return nil
+		}
+		for i, st := range r.queue {
+			if _, tried := st.tried[p]; !tried {
+				r.queue = append(r.queue[:i], r.queue[i+1:]...)
+				return st
+			}
+		}
+		r.cond.Wait()
+	}
+}
+
+// retrieved records that a subtree has been retrieved. Once the root block
+// has been retrieved, the rest of the DAG is split into subtrees.
+func (r *Retrieval) retrieved(st *subtree) {
+	var children []*subtree
+	var rootSize int
+	if st.root {
+		root, err := loadNode(r.ctx, r.bs, r.payloadCID)
+		if err != nil {
+			r.fail(xerrors.Errorf("failed to load root %s: %w", r.payloadCID, err))
+			return
+		}
+		rootSize, err = r.bs.GetSize(r.ctx, r.payloadCID)
+		if err != nil {
+			r.fail(xerrors.Errorf("failed to get size of root %s: %w", r.payloadCID, err))
+			return
+		}
+		specs, err := subtreeSpecs(root)
+		if err != nil {
+			r.fail(err)
+			return
+		}
+		for _, spec := range specs {
+			children = append(children, newSubtree(spec.selector, false, spec.size))
+		}
+	}
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if st.root {
+		r.rootSize = uint64(rootSize)
+	}
+	r.queue = append(r.queue, children...)
+	r.subtrees += len(children)
+	r.remaining += len(children) - 1
+	r.cond.Broadcast()
+}
+
+// requeue puts a subtree a provider failed to retrieve back in the queue,
+// and fails the retrieval if any queued subtree has no provider left to try.
+// The subtree is handed to another provider if there is one, and otherwise
+// retried by the same provider until it has used up its retries.
+func (r *Retrieval) requeue(st *subtree, p peer.ID, dropped bool) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	st.tried[p] = struct{}{}
+	st.failures[p]++
+	if dropped {
+		delete(r.live, p)
+	} else if !r.retrievableLocked(st) && st.failures[p] <= r.c.maxRetries {
+		delete(st.tried, p)
+	}
+	r.queue = append(r.queue, st)
+	for _, queued := range r.queue {
+		if !r.retrievableLocked(queued) {
+			r.failLocked(xerrors.Errorf("no provider left to retrieve part of %s", r.payloadCID))
+			break
+		}
+	}
+	r.cond.Broadcast()
+}
+
+func (r *Retrieval) retrievableLocked(st *subtree) bool {
+	for p := range r.live {
+		if _, tried := st.tried[p]; !tried {
+			return true
+		}
+	}
+	return false
+}
+
+// runDeal makes a deal with a provider for a subtree, and waits for it to
+// complete, fail or stall. A cancelled deal is waited on until it winds
+// down, so that the client does not still consider it active when the next
+// deal with the same provider starts.
+func (r *Retrieval) runDeal(offer Offer, st *subtree) error {
+	// every subtree selector passes through the root, so the deal pays for
+	// the root block as well as the subtree
+	var size uint64
+	if st.size > 0 {
+		r.lk.Lock()
+		size = r.rootSize + st.size
+		r.lk.Unlock()
+	}
+	params, funds, err := offer.params(st.selector, size)
+	if err != nil {
+		return xerrors.Errorf("failed to create deal params: %w", err)
+	}
+
+	id := r.c.client.NextID()
+	r.c.accessor.Bind(id, r.bs)
+	d := &deal{provider: offer.Peer.ID, watcher: dealwatch.NewWatcher(id)}
+	r.lk.Lock()
+	r.deals[id] = d
+	r.lk.Unlock()
+
+	_, err = r.c.client.Retrieve(r.ctx, id, r.payloadCID, params, funds, offer.Peer, r.clientWallet, offer.Response.PaymentAddress)
+	if err != nil {
+		_ = r.c.accessor.Done(id)
+		r.lk.Lock()
+		delete(r.deals, id)
+		r.lk.Unlock()
+		return xerrors.Errorf("failed to start deal: %w", err)
+	}
+
+	return d.watcher.Wait(r.ctx, r.c.client, r.c.clock, r.c.stallTimeout, nil)
+}
+
+// onEvent passes events for the retrieval's deals to their watchers
+func (r *Retrieval) onEvent(event retrievalmarket.ClientEvent, state retrievalmarket.ClientDealState) {
+	r.lk.Lock()
+	d, ok := r.deals[state.ID]
+	r.lk.Unlock()
+	if ok {
+		d.watcher.OnEvent(event, state)
+	}
+}
+
+// fail ends the retrieval with an error, cancelling any deals in progress
+func (r *Retrieval) fail(err error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.failLocked(err)
+}
+
+func (r *Retrieval) failLocked(err error) {
+	if r.finished || r.err != nil {
+		return
+	}
+	r.err = err
+	r.cancel()
+	r.cond.Broadcast()
+}
+
+// finish ends the retrieval once every provider has stopped working on it
+func (r *Retrieval) finish() {
+	r.lk.Lock()
+	if r.err == nil && r.remaining > 0 {
+		r.err = xerrors.Errorf("all providers failed to retrieve %s", r.payloadCID)
+	}
+	r.finished = true
+	r.lk.Unlock()
+
+	r.unsubscribe()
+	r.cancel()
+	close(r.done)
+}
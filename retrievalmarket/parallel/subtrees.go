@@ -0,0 +1,127 @@
+package parallel
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync/storeutil"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"golang.org/x/xerrors"
+)
+
+// rootSelector matches just the root node of a DAG
+var rootSelector = builder.NewSelectorSpecBuilder(basicnode.Prototype.Any).Matcher().Node()
+
+// SubtreeSelectors returns one selector for each link in the given root node.
+// Each selector, applied to the root of the DAG, traverses the path to its
+// link and then the entire subtree under the link. Together the selectors
+// cover every block of the DAG other than the root.
+func SubtreeSelectors(root datamodel.Node) ([]ipld.Node, error) {
+	specs, err := subtreeSpecs(root)
+	if err != nil {
+		return nil, err
+	}
+	sels := make([]ipld.Node, 0, len(specs))
+	for _, spec := range specs {
+		sels = append(sels, spec.selector)
+	}
+	return sels, nil
+}
+
+// subtreeSpec is the selector for a subtree, and the size of the subtree
+// if the root node records it
+type subtreeSpec struct {
+	selector ipld.Node
+	// size is the total size of the blocks in the subtree, taken from the
+	// Tsize of a dag-pb link, or zero if it is unknown
+	size uint64
+}
+
+func subtreeSpecs(root datamodel.Node) ([]subtreeSpec, error) {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	all := ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge()))
+
+	var specs []subtreeSpec
+	var walk func(n datamodel.Node, size uint64, wrap func(builder.SelectorSpec) builder.SelectorSpec) error
+	walk = func(n datamodel.Node, size uint64, wrap func(builder.SelectorSpec) builder.SelectorSpec) error {
+		switch n.Kind() {
+		case datamodel.Kind_Link:
+			specs = append(specs, subtreeSpec{selector: wrap(all).Node(), size: size})
+		case datamodel.Kind_Map:
+			size := linkSize(n)
+			it := n.MapIterator()
+			for !it.Done() {
+				k, v, err := it.Next()
+				if err != nil {
+					return err
+				}
+				key, err := k.AsString()
+				if err != nil {
+					return xerrors.Errorf("non-string map key: %w", err)
+				}
+				err = walk(v, size, func(spec builder.SelectorSpec) builder.SelectorSpec {
+					return wrap(ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+						efsb.Insert(key, spec)
+					}))
+				})
+				if err != nil {
+					return err
+				}
+			}
+		case datamodel.Kind_List:
+			it := n.ListIterator()
+			for !it.Done() {
+				idx, v, err := it.Next()
+				if err != nil {
+					return err
+				}
+				err = walk(v, 0, func(spec builder.SelectorSpec) builder.SelectorSpec {
+					return wrap(ssb.ExploreIndex(idx, spec))
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	err := walk(root, 0, func(spec builder.SelectorSpec) builder.SelectorSpec { return spec })
+	if err != nil {
+		return nil, xerrors.Errorf("failed to walk root node: %w", err)
+	}
+	return specs, nil
+}
+
+// linkSize returns the Tsize of a map shaped like a dag-pb link, or zero if
+// the map has no Tsize
+func linkSize(n datamodel.Node) uint64 {
+	tsize, err := n.LookupByString("Tsize")
+	if err != nil || tsize.IsAbsent() || tsize.IsNull() {
+		return 0
+	}
+	size, err := tsize.AsInt()
+	if err != nil || size < 0 {
+		return 0
+	}
+	return uint64(size)
+}
+
+// loadNode loads and decodes the node with the given CID from a blockstore
+func loadNode(ctx context.Context, bs bstore.Blockstore, c cid.Cid) (datamodel.Node, error) {
+	lsys := storeutil.LinkSystemForBlockstore(bs)
+	lnk := cidlink.Link{Cid: c}
+	chooser := dagpb.AddSupportToChooser(basicnode.Chooser)
+	proto, err := chooser(lnk, ipld.LinkContext{Ctx: ctx})
+	if err != nil {
+		return nil, err
+	}
+	return lsys.Load(ipld.LinkContext{Ctx: ctx}, lnk, proto)
+}
@@ -0,0 +1,99 @@
+package reputation
+
+import (
+	"context"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/filecoin-project/go-fil-markets/discovery"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/failover"
+)
+
+// SortPeers sorts peers in place so that those with the highest score come
+// first. Peers with the same score, including those without a peer ID,
+// which score as if they had no record, keep their order.
+func (s *Store) SortPeers(ctx context.Context, peers []retrievalmarket.RetrievalPeer) {
+	ids := make([]peer.ID, 0, len(peers))
+	for _, p := range peers {
+		ids = append(ids, p.ID)
+	}
+	scores := s.scores(ctx, ids)
+	sort.SliceStable(peers, func(i, j int) bool {
+		return scores[peers[i].ID] > scores[peers[j].ID]
+	})
+}
+
+// Ranker returns a failover.Ranker that ranks offers from providers with a
+// higher score first. Offers from providers with the same score are ranked
+// by next, e.g. failover.RankByPrice.
+func (s *Store) Ranker(next failover.Ranker) failover.Ranker {
+	return func(offers []failover.Offer) {
+		if next != nil {
+			next(offers)
+		}
+		ids := make([]peer.ID, 0, len(offers))
+		for _, o := range offers {
+			ids = append(ids, o.Peer.ID)
+		}
+		scores := s.scores(context.TODO(), ids)
+		sort.SliceStable(offers, func(i, j int) bool {
+			return scores[offers[i].Peer.ID] > scores[offers[j].Peer.ID]
+		})
+	}
+}
+
+// RankedResolver is a resolver that sorts the peers another resolver finds
+// by their score. It can be cancelled and streams peers whatever resolver it
+// wraps: lookups with a resolver that can't be cancelled run to completion,
+// and a resolver that doesn't stream has its peers sent all at once when it
+// answers.
+type RankedResolver struct {
+	store    *Store
+	resolver discovery.PeerResolver
+}
+
+var _ discovery.ContextPeerResolver = &RankedResolver{}
+var _ discovery.StreamingPeerResolver = &RankedResolver{}
+
+// NewRankedResolver returns a resolver that sorts the peers found by
+// resolver with the scores in store
+func NewRankedResolver(store *Store, resolver discovery.PeerResolver) *RankedResolver {
+	return &RankedResolver{store: store, resolver: resolver}
+}
+
+// GetPeers looks up the peers that may have the payload, best first
+func (r *RankedResolver) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	return r.GetPeersContext(context.TODO(), payloadCID)
+}
+
+// GetPeersContext looks up the peers that may have the payload, best first,
+// until the context is cancelled
+func (r *RankedResolver) GetPeersContext(ctx context.Context, payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	var peers []retrievalmarket.RetrievalPeer
+	var err error
+	if cr, ok := r.resolver.(discovery.ContextPeerResolver); ok {
+		peers, err = cr.GetPeersContext(ctx, payloadCID)
+	} else {
+		peers, err = r.resolver.GetPeers(payloadCID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.store.SortPeers(ctx, peers)
+	return peers, nil
+}
+
+// FindPeers sends the peers that may have the payload as the wrapped
+// resolver finds them. Peers from a resolver that streams are sent in the
+// order they are found, since later peers can't be ranked before they
+// arrive. Peers from a resolver that doesn't stream are sent best first.
+func (r *RankedResolver) FindPeers(ctx context.Context, payloadCID cid.Cid) <-chan retrievalmarket.PeerResult {
+	if sr, ok := r.resolver.(discovery.StreamingPeerResolver); ok {
+		return sr.FindPeers(ctx, payloadCID)
+	}
+	// hide FindPeers, so that the peers are looked up with GetPeersContext
+	return discovery.FindPeers(ctx, struct{ discovery.ContextPeerResolver }{r}, payloadCID)
+}
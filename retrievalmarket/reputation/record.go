@@ -0,0 +1,81 @@
+package reputation
+
+import (
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+)
+
+//go:generate cbor-gen-for --map-encoding Record
+
+// Record is the persisted record of the outcomes of the retrieval deals
+// made with a provider
+type Record struct {
+	// Successes is the number of deals that completed
+	Successes uint64
+	// Failures is the number of deals that errored, were rejected or found
+	// the provider did not have the data
+	Failures uint64
+	// FirstByteNanos is the total time from the start of each deal to the
+	// first data it received, over FirstByteSamples deals
+	FirstByteNanos   uint64
+	FirstByteSamples uint64
+	// TransferBytes is the total received by completed deals, over
+	// TransferNanos spent from their first data to their completion
+	TransferBytes uint64
+	TransferNanos uint64
+	// BytesReceived is the total received by every deal
+	BytesReceived uint64
+	// FundsSpent is the total paid by every deal
+	FundsSpent abi.TokenAmount
+}
+
+func newRecord() *Record {
+	return &Record{FundsSpent: big.Zero()}
+}
+
+// Stats summarizes a provider's record
+type Stats struct {
+	Record
+	// SuccessRate is the fraction of the deals with an outcome that
+	// completed, or zero if there were none
+	SuccessRate float64
+	// TimeToFirstByte is the mean time to the first data of a deal
+	TimeToFirstByte time.Duration
+	// Throughput is the mean transfer rate of completed deals, in bytes per
+	// second
+	Throughput float64
+	// PricePerByte is what the provider was effectively paid for each byte
+	// received
+	PricePerByte abi.TokenAmount
+	// Score ranks the provider against others; higher is better
+	Score float64
+}
+
+// ScoreFunc computes the score of a provider from its record
+type ScoreFunc func(r Record) float64
+
+// ScoreBySuccessRate scores a provider by the rate at which its deals
+// succeed, smoothed so that a provider with no record scores 0.5 and a few
+// outcomes do not make for a perfect or zero score
+func ScoreBySuccessRate(r Record) float64 {
+	return float64(r.Successes+1) / float64(r.Successes+r.Failures+2)
+}
+
+func (r Record) stats(score ScoreFunc) Stats {
+	s := Stats{Record: r, PricePerByte: big.Zero(), Score: score(r)}
+	if n := r.Successes + r.Failures; n > 0 {
+		s.SuccessRate = float64(r.Successes) / float64(n)
+	}
+	if r.FirstByteSamples > 0 {
+		s.TimeToFirstByte = time.Duration(r.FirstByteNanos / r.FirstByteSamples)
+	}
+	if r.TransferNanos > 0 {
+		s.Throughput = float64(r.TransferBytes) / time.Duration(r.TransferNanos).Seconds()
+	}
+	if r.BytesReceived > 0 && !r.FundsSpent.Nil() {
+		s.PricePerByte = big.Div(r.FundsSpent, big.NewIntUnsigned(r.BytesReceived))
+	}
+	return s
+}
@@ -0,0 +1,324 @@
+// Code generated by github.com/whyrusleeping/cbor-gen. DO NOT EDIT.
+
+package reputation
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	cid "github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	xerrors "golang.org/x/xerrors"
+)
+
+var _ = xerrors.Errorf
+var _ = cid.Undef
+var _ = math.E
+var _ = sort.Sort
+
+func (t *Record) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write([]byte{168}); err != nil {
+		return err
+	}
+
+	// t.Successes (uint64) (uint64)
+	if len("Successes") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Successes\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Successes"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Successes")); err != nil {
+		return err
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Successes)); err != nil {
+		return err
+	}
+
+	// t.Failures (uint64) (uint64)
+	if len("Failures") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Failures\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Failures"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Failures")); err != nil {
+		return err
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Failures)); err != nil {
+		return err
+	}
+
+	// t.FirstByteNanos (uint64) (uint64)
+	if len("FirstByteNanos") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"FirstByteNanos\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("FirstByteNanos"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("FirstByteNanos")); err != nil {
+		return err
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.FirstByteNanos)); err != nil {
+		return err
+	}
+
+	// t.FirstByteSamples (uint64) (uint64)
+	if len("FirstByteSamples") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"FirstByteSamples\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("FirstByteSamples"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("FirstByteSamples")); err != nil {
+		return err
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.FirstByteSamples)); err != nil {
+		return err
+	}
+
+	// t.TransferBytes (uint64) (uint64)
+	if len("TransferBytes") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"TransferBytes\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("TransferBytes"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("TransferBytes")); err != nil {
+		return err
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.TransferBytes)); err != nil {
+		return err
+	}
+
+	// t.TransferNanos (uint64) (uint64)
+	if len("TransferNanos") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"TransferNanos\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("TransferNanos"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("TransferNanos")); err != nil {
+		return err
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.TransferNanos)); err != nil {
+		return err
+	}
+
+	// t.BytesReceived (uint64) (uint64)
+	if len("BytesReceived") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"BytesReceived\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("BytesReceived"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("BytesReceived")); err != nil {
+		return err
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.BytesReceived)); err != nil {
+		return err
+	}
+
+	// t.FundsSpent (big.Int) (struct)
+	if len("FundsSpent") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"FundsSpent\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("FundsSpent"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("FundsSpent")); err != nil {
+		return err
+	}
+
+	if err := t.FundsSpent.MarshalCBOR(cw); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *Record) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = Record{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("Record: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadString(cr)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Successes (uint64) (uint64)
+		case "Successes":
+
+			{
+
+				maj, extra, err = cr.ReadHeader()
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.Successes = uint64(extra)
+
+			}
+			// t.Failures (uint64) (uint64)
+		case "Failures":
+
+			{
+
+				maj, extra, err = cr.ReadHeader()
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.Failures = uint64(extra)
+
+			}
+			// t.FirstByteNanos (uint64) (uint64)
+		case "FirstByteNanos":
+
+			{
+
+				maj, extra, err = cr.ReadHeader()
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.FirstByteNanos = uint64(extra)
+
+			}
+			// t.FirstByteSamples (uint64) (uint64)
+		case "FirstByteSamples":
+
+			{
+
+				maj, extra, err = cr.ReadHeader()
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.FirstByteSamples = uint64(extra)
+
+			}
+			// t.TransferBytes (uint64) (uint64)
+		case "TransferBytes":
+
+			{
+
+				maj, extra, err = cr.ReadHeader()
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.TransferBytes = uint64(extra)
+
+			}
+			// t.TransferNanos (uint64) (uint64)
+		case "TransferNanos":
+
+			{
+
+				maj, extra, err = cr.ReadHeader()
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.TransferNanos = uint64(extra)
+
+			}
+			// t.BytesReceived (uint64) (uint64)
+		case "BytesReceived":
+
+			{
+
+				maj, extra, err = cr.ReadHeader()
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.BytesReceived = uint64(extra)
+
+			}
+			// t.FundsSpent (big.Int) (struct)
+		case "FundsSpent":
+
+			{
+
+				if err := t.FundsSpent.UnmarshalCBOR(cr); err != nil {
+					return xerrors.Errorf("unmarshaling t.FundsSpent: %w", err)
+				}
+
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
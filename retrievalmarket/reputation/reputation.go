@@ -0,0 +1,280 @@
+// Package reputation scores retrieval providers by the outcomes of the
+// deals a client makes with them.
+//
+// A Store subscribes to the events of a retrieval client and, as each deal
+// with a provider ends, records whether it succeeded, how long it took to
+// receive the first data, how fast the data came and what was paid for it.
+// From that record it computes a score for the provider, which can be used
+// to order the providers found by discovery and the offers ranked by a
+// failover retriever. Records are persisted, so that scores survive
+// restarts.
+//
+// Deals the client cancels are not counted as successes or failures,
+// since the provider may not be at fault. Timing is only recorded for
+// deals whose start the store saw, so deals that were in progress across a
+// restart count towards the success rate only.
+package reputation
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/clientstates"
+	"github.com/filecoin-project/go-fil-markets/shared"
+)
+
+var log = logging.Logger("retrieval-reputation")
+
+// Option is a function that configures a Store
+type Option func(s *Store)
+
+// StoreClock sets the clock the store times deals with
+func StoreClock(clock shared.Clock) Option {
+	return func(s *Store) {
+		s.clock = clock
+	}
+}
+
+// Score sets how providers are scored. The default is ScoreBySuccessRate.
+func Score(score ScoreFunc) Option {
+	return func(s *Store) {
+		s.score = score
+	}
+}
+
+// recentlyEnded is how many of the deals that ended most recently the
+// store remembers, to ignore more events for them in a final state
+const recentlyEnded = 1024
+
+// dealTiming is when a deal the store is watching started and first
+// received data
+type dealTiming struct {
+	start     time.Time
+	firstByte time.Time
+}
+
+// Store keeps the reputation of retrieval providers
+type Store struct {
+	ds    datastore.Batching
+	clock shared.Clock
+	score ScoreFunc
+
+	lk      sync.Mutex
+	records map[peer.ID]*Record
+	deals   map[retrievalmarket.DealID]*dealTiming
+	// ended holds the deals that ended most recently, oldest first, since
+	// a deal can get more events in a final state and its outcome must
+	// only be recorded once
+	ended    map[retrievalmarket.DealID]struct{}
+	endedLog []retrievalmarket.DealID
+}
+
+// NewStore returns a Store that persists provider records to ds
+func NewStore(ds datastore.Batching, opts ...Option) *Store {
+	s := &Store{
+		ds:      ds,
+		clock:   shared.NewClock(),
+		score:   ScoreBySuccessRate,
+		records: make(map[peer.ID]*Record),
+		deals:   make(map[retrievalmarket.DealID]*dealTiming),
+		ended:   make(map[retrievalmarket.DealID]struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Subscribe records the outcomes of the client's deals until the returned
+// function is called
+func (s *Store) Subscribe(client retrievalmarket.RetrievalClient) retrievalmarket.Unsubscribe {
+	return client.SubscribeToEvents(s.OnEvent)
+}
+
+// OnEvent is a retrievalmarket.ClientSubscriber that tracks each deal,
+// and records its outcome on the first event in which it has ended
+func (s *Store) OnEvent(event retrievalmarket.ClientEvent, state retrievalmarket.ClientDealState) {
+	if state.Sender == "" {
+		return
+	}
+	now := s.clock.Now()
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if _, ok := s.ended[state.ID]; ok {
+		return
+	}
+	d, ok := s.deals[state.ID]
+	if !ok {
+		d = &dealTiming{}
+		if event == retrievalmarket.ClientEventOpen {
+			d.start = now
+		}
+		s.deals[state.ID] = d
+	}
+	if d.firstByte.IsZero() && state.TotalReceived > 0 {
+		d.firstByte = now
+	}
+	if !clientstates.IsFinalityState(state.Status) {
+		return
+	}
+	s.endLocked(state.ID)
+	if state.Status == retrievalmarket.DealStatusCancelled {
+		return
+	}
+
+	if err := s.recordLocked(context.TODO(), state, d, now); err != nil {
+		log.Errorw("recording retrieval deal outcome", "dealID", state.ID, "provider", state.Sender, "err", err)
+	}
+}
+
+// endLocked stops tracking a deal, and remembers that it ended, forgetting
+// the deal that ended longest ago once it remembers recentlyEnded deals
+func (s *Store) endLocked(id retrievalmarket.DealID) {
+	delete(s.deals, id)
+	if len(s.endedLog) == recentlyEnded {
+		delete(s.ended, s.endedLog[0])
+		s.endedLog = s.endedLog[1:]
+	}
+	s.ended[id] = struct{}{}
+	s.endedLog = append(s.endedLog, id)
+}
+
+func (s *Store) recordLocked(ctx context.Context, state retrievalmarket.ClientDealState, d *dealTiming, now time.Time) error {
+	r, err := s.recordOfLocked(ctx, state.Sender)
+	if err != nil {
+		return err
+	}
+	updated := *r
+	if state.Status == retrievalmarket.DealStatusCompleted {
+		updated.Successes++
+	} else {
+		updated.Failures++
+	}
+	if !d.start.IsZero() && !d.firstByte.IsZero() {
+		updated.FirstByteNanos += uint64(d.firstByte.Sub(d.start))
+		updated.FirstByteSamples++
+	}
+	if state.Status == retrievalmarket.DealStatusCompleted && !d.firstByte.IsZero() {
+		updated.TransferBytes += state.TotalReceived
+		updated.TransferNanos += uint64(now.Sub(d.firstByte))
+	}
+	updated.BytesReceived += state.TotalReceived
+	if !state.FundsSpent.Nil() {
+		updated.FundsSpent = big.Add(updated.FundsSpent, state.FundsSpent)
+	}
+
+	data, err := cborutil.Dump(&updated)
+	if err != nil {
+		return xerrors.Errorf("encoding record of %s: %w", state.Sender, err)
+	}
+	if err := s.ds.Put(ctx, providerKey(state.Sender), data); err != nil {
+		return xerrors.Errorf("saving record of %s: %w", state.Sender, err)
+	}
+	s.records[state.Sender] = &updated
+	return nil
+}
+
+// Stats returns the stats of a provider. A provider with no record has
+// the stats of an empty record.
+func (s *Store) Stats(ctx context.Context, p peer.ID) (Stats, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	r, err := s.recordOfLocked(ctx, p)
+	if err != nil {
+		return Stats{}, err
+	}
+	return r.stats(s.score), nil
+}
+
+// List returns the stats of every provider with a record
+func (s *Store) List(ctx context.Context) (map[peer.ID]Stats, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	res, err := s.ds.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return nil, xerrors.Errorf("listing provider records: %w", err)
+	}
+	defer res.Close() //nolint:errcheck
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, xerrors.Errorf("listing provider records: %w", err)
+	}
+
+	out := make(map[peer.ID]Stats, len(entries))
+	for _, e := range entries {
+		p, err := peer.Decode(datastore.NewKey(e.Key).BaseNamespace())
+		if err != nil {
+			log.Warnw("skipping provider record with bad key", "key", e.Key, "err", err)
+			continue
+		}
+		r, err := s.recordOfLocked(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		out[p] = r.stats(s.score)
+	}
+	return out, nil
+}
+
+// scores returns the score of each of the given providers
+func (s *Store) scores(ctx context.Context, peers []peer.ID) map[peer.ID]float64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	out := make(map[peer.ID]float64, len(peers))
+	for _, p := range peers {
+		if _, ok := out[p]; ok {
+			continue
+		}
+		r := newRecord()
+		if p != "" {
+			var err error
+			r, err = s.recordOfLocked(ctx, p)
+			if err != nil {
+				log.Warnw("loading provider record", "provider", p, "err", err)
+				r = newRecord()
+			}
+		}
+		out[p] = s.score(*r)
+	}
+	return out
+}
+
+// recordOfLocked returns the record of a provider, loading it from the
+// datastore the first time
+func (s *Store) recordOfLocked(ctx context.Context, p peer.ID) (*Record, error) {
+	if r, ok := s.records[p]; ok {
+		return r, nil
+	}
+	r := newRecord()
+	data, err := s.ds.Get(ctx, providerKey(p))
+	switch {
+	case err == nil:
+		if err := r.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+			return nil, xerrors.Errorf("decoding record of %s: %w", p, err)
+		}
+	case xerrors.Is(err, datastore.ErrNotFound):
+	default:
+		return nil, xerrors.Errorf("loading record of %s: %w", p, err)
+	}
+	s.records[p] = r
+	return r, nil
+}
+
+func providerKey(p peer.ID) datastore.Key {
+	return datastore.NewKey(p.String())
+}
@@ -0,0 +1,153 @@
+package reputation_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+
+	"github.com/filecoin-project/go-fil-markets/discovery"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/failover"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/reputation"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+// runDeal feeds the store the events of a deal that opens, receives its
+// first bytes after ttfb and its last after transfer, and ends in status
+func runDeal(s *reputation.Store, clk *clock.Mock, id retrievalmarket.DealID, p peer.ID, ttfb, transfer time.Duration, received uint64, spent abi.TokenAmount, status retrievalmarket.DealStatus) {
+	state := retrievalmarket.ClientDealState{
+		DealProposal: retrievalmarket.DealProposal{ID: id},
+		Sender:       p,
+		Status:       retrievalmarket.DealStatusNew,
+		FundsSpent:   big.Zero(),
+	}
+	s.OnEvent(retrievalmarket.ClientEventOpen, state)
+	clk.Add(ttfb)
+	if received > 0 {
+		state.Status = retrievalmarket.DealStatusOngoing
+		state.TotalReceived = 1
+		s.OnEvent(retrievalmarket.ClientEventBlocksReceived, state)
+	}
+	clk.Add(transfer)
+	state.Status = status
+	state.TotalReceived = received
+	state.FundsSpent = spent
+	s.OnEvent(retrievalmarket.ClientEventComplete, state)
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	clk := clock.NewMock()
+	s := reputation.NewStore(ds, reputation.StoreClock(clk))
+	good, bad, unknown := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+
+	runDeal(s, clk, 1, good, time.Second, 2*time.Second, 2000, abi.NewTokenAmount(4000), retrievalmarket.DealStatusCompleted)
+	runDeal(s, clk, 2, good, 3*time.Second, 2*time.Second, 2000, abi.NewTokenAmount(4000), retrievalmarket.DealStatusCompleted)
+	runDeal(s, clk, 3, bad, 0, 0, 0, big.Zero(), retrievalmarket.DealStatusRejected)
+	runDeal(s, clk, 4, bad, time.Second, time.Second, 100, abi.NewTokenAmount(100), retrievalmarket.DealStatusErrored)
+	runDeal(s, clk, 5, bad, time.Second, time.Second, 100, abi.NewTokenAmount(100), retrievalmarket.DealStatusCancelled)
+
+	stats, err := s.Stats(ctx, good)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, stats.Successes)
+	require.Equal(t, 1.0, stats.SuccessRate)
+	require.Equal(t, 2*time.Second, stats.TimeToFirstByte)
+	require.Equal(t, 1000.0, stats.Throughput)
+	require.Equal(t, abi.NewTokenAmount(2), stats.PricePerByte)
+	require.Equal(t, 0.75, stats.Score)
+
+	stats, err = s.Stats(ctx, bad)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, stats.Failures)
+	require.EqualValues(t, 100, stats.BytesReceived)
+	require.Equal(t, 0.0, stats.SuccessRate)
+	require.Equal(t, 0.25, stats.Score)
+
+	stats, err = s.Stats(ctx, unknown)
+	require.NoError(t, err)
+	require.Equal(t, 0.5, stats.Score)
+
+	t.Run("records a deal once however many events it gets once ended", func(t *testing.T) {
+		s := reputation.NewStore(dss.MutexWrap(datastore.NewMapDatastore()), reputation.StoreClock(clk))
+		once := test.RandPeerIDFatal(t)
+		runDeal(s, clk, 6, once, time.Second, time.Second, 1000, abi.NewTokenAmount(1000), retrievalmarket.DealStatusCompleted)
+		s.OnEvent(retrievalmarket.ClientEventComplete, retrievalmarket.ClientDealState{
+			DealProposal:  retrievalmarket.DealProposal{ID: 6},
+			Sender:        once,
+			Status:        retrievalmarket.DealStatusCompleted,
+			TotalReceived: 1000,
+			FundsSpent:    abi.NewTokenAmount(1000),
+		})
+		stats, err := s.Stats(ctx, once)
+		require.NoError(t, err)
+		require.EqualValues(t, 1, stats.Successes)
+		require.EqualValues(t, 1000, stats.BytesReceived)
+	})
+
+	t.Run("survives restarts", func(t *testing.T) {
+		restarted := reputation.NewStore(ds)
+		all, err := restarted.List(ctx)
+		require.NoError(t, err)
+		require.Len(t, all, 2)
+		require.EqualValues(t, 2, all[good].Successes)
+		require.EqualValues(t, 2, all[bad].Failures)
+	})
+
+	t.Run("sorts peers", func(t *testing.T) {
+		rps := []retrievalmarket.RetrievalPeer{
+			{Address: shared_testutil.NewIDAddr(t, 1), ID: bad},
+			{Address: shared_testutil.NewIDAddr(t, 2)},
+			{Address: shared_testutil.NewIDAddr(t, 3), ID: good},
+		}
+		s.SortPeers(ctx, rps)
+		require.Equal(t, []peer.ID{good, "", bad}, []peer.ID{rps[0].ID, rps[1].ID, rps[2].ID})
+	})
+
+	t.Run("ranked resolver finds peers best first", func(t *testing.T) {
+		rps := []retrievalmarket.RetrievalPeer{
+			{Address: shared_testutil.NewIDAddr(t, 1), ID: bad},
+			{Address: shared_testutil.NewIDAddr(t, 2), ID: good},
+		}
+		r := reputation.NewRankedResolver(s, shared_testutil.TestPeerResolver{Peers: rps})
+		var found []peer.ID
+		for res := range discovery.FindPeers(ctx, r, shared_testutil.GenerateCids(1)[0]) {
+			require.NoError(t, res.Err)
+			found = append(found, res.Peer.ID)
+		}
+		require.Equal(t, []peer.ID{good, bad}, found)
+	})
+
+	t.Run("ranks offers", func(t *testing.T) {
+		offer := func(p peer.ID, price int64) failover.Offer {
+			return failover.Offer{
+				Peer: retrievalmarket.RetrievalPeer{ID: p},
+				Response: retrievalmarket.QueryResponse{
+					Size:            1,
+					MinPricePerByte: abi.NewTokenAmount(price),
+					UnsealPrice:     big.Zero(),
+				},
+			}
+		}
+		offers := []failover.Offer{offer(bad, 1), offer(unknown, 3), offer(good, 5), offer(unknown, 2)}
+		s.Ranker(failover.RankByPrice)(offers)
+		var order []peer.ID
+		var prices []int64
+		for _, o := range offers {
+			order = append(order, o.Peer.ID)
+			prices = append(prices, o.Price().Int64())
+		}
+		require.Equal(t, []peer.ID{good, unknown, unknown, bad}, order)
+		require.Equal(t, []int64{5, 2, 3, 1}, prices)
+	})
+}
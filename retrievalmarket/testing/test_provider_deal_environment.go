@@ -7,9 +7,11 @@ import (
 	"github.com/ipfs/go-cid"
 
 	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-statemachine/fsm"
 
 	rm "github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	retrievalimpl "github.com/filecoin-project/go-fil-markets/retrievalmarket/impl"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/unsealqueue"
 )
 
 // TestProviderDealEnvironment is a test implementation of ProviderDealEnvironment used
@@ -17,11 +19,16 @@ import (
 type TestProviderDealEnvironment struct {
 	node                    rm.RetrievalProviderNode
 	ResumeDataTransferError error
+	QueueUnsealError        error
 	PrepareBlockstoreError  error
 	TrackTransferError      error
 	UntrackTransferError    error
 	CloseDataTransferError  error
 	DeleteStoreError        error
+	// UnsealQueue, if set, is the queue QueueUnseal pushes deals onto. The
+	// queue's callbacks trigger events for the deal on UnsealEvents.
+	UnsealQueue  *unsealqueue.Queue
+	UnsealEvents fsm.Context
 }
 
 // NewTestProviderDealEnvironment returns a new TestProviderDealEnvironment instance
@@ -40,6 +47,24 @@ func (te *TestProviderDealEnvironment) DeleteStore(dealID rm.DealID) error {
 	return te.DeleteStoreError
 }
 
+func (te *TestProviderDealEnvironment) QueueUnseal(ctx context.Context, deal rm.ProviderDealState) error {
+	if te.QueueUnsealError != nil || te.UnsealQueue == nil {
+		return te.QueueUnsealError
+	}
+	te.UnsealQueue.Push(&unsealqueue.Job{
+		Deal:        deal.Identifier(),
+		PieceCID:    deal.PieceInfo.PieceCID,
+		UnsealPrice: deal.UnsealPrice,
+		Queued: func(position int) {
+			_ = te.UnsealEvents.Trigger(rm.ProviderEventUnsealQueued, uint64(position))
+		},
+		Start: func() {
+			_ = te.UnsealEvents.Trigger(rm.ProviderEventUnsealStarted)
+		},
+	})
+	return nil
+}
+
 func (te *TestProviderDealEnvironment) PrepareBlockstore(ctx context.Context, dealID rm.DealID, pieceCid cid.Cid) error {
 	return te.PrepareBlockstoreError
 }
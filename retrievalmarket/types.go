@@ -7,7 +7,6 @@ import (
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
-	"github.com/ipld/go-ipld-prime/codec/dagcbor"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
 	cbg "github.com/whyrusleeping/cbor-gen"
@@ -20,9 +19,10 @@ import (
 	paychtypes "github.com/filecoin-project/go-state-types/builtin/v8/paych"
 
 	"github.com/filecoin-project/go-fil-markets/piecestore"
+	"github.com/filecoin-project/go-fil-markets/shared"
 )
 
-//go:generate cbor-gen-for --map-encoding Query QueryResponse DealProposal DealResponse Params QueryParams DealPayment ClientDealState ProviderDealState PaymentInfo RetrievalPeer Ask
+//go:generate cbor-gen-for --map-encoding Query QueryResponse BatchQuery BatchQueryResponse DealProposal DealResponse Params QueryParams DealPayment ClientDealState ProviderDealState PaymentInfo RetrievalPeer Ask
 
 // QueryProtocolID is the protocol for querying information about retrieval
 // deal parameters
@@ -31,6 +31,13 @@ const QueryProtocolID = protocol.ID("/fil/retrieval/qry/1.0.0")
 // OldQueryProtocolID is the old query protocol for tuple structs
 const OldQueryProtocolID = protocol.ID("/fil/retrieval/qry/0.0.1")
 
+// BatchQueryProtocolID is the protocol for querying information about many
+// payloads on a single stream
+const BatchQueryProtocolID = protocol.ID("/fil/retrieval/qry/batch/1.0.0")
+
+// MaxBatchQuerySize is the most queries a provider answers in one batch
+const MaxBatchQuerySize = 1024
+
 // Unsubscribe is a function that unsubscribes a subscriber for either the
 // client or the provider
 type Unsubscribe func()
@@ -39,6 +46,10 @@ type Unsubscribe func()
 type PaymentInfo struct {
 	PayCh address.Address
 	Lane  uint64
+	// LaneBase is what the vouchers on the lane added up to before the
+	// deal, when the lane was reused from an earlier deal. The deal's
+	// vouchers are for LaneBase plus what the deal has paid.
+	LaneBase abi.TokenAmount
 }
 
 // ClientDealState is the current state of a deal from the point of view
@@ -159,13 +170,19 @@ const (
 // client is interested in, as well as specific parameters the client is seeking
 // for the retrieval deal
 type QueryParams struct {
-	PieceCID *cid.Cid // optional, query if miner has this cid in this piece. some miners may not be able to respond.
-	//Selector                   ipld.Node // optional, query if miner has this cid in this piece. some miners may not be able to respond.
+	PieceCID *cid.Cid      // optional, query if miner has this cid in this piece. some miners may not be able to respond.
+	Selector *cbg.Deferred // optional, size and price the query for the data matched by this selector
 	//MaxPricePerByte            abi.TokenAmount    // optional, tell miner uninterested if more expensive than this
 	//MinPaymentInterval         uint64    // optional, tell miner uninterested unless payment interval is greater than this
 	//MinPaymentIntervalIncrease uint64    // optional, tell miner uninterested unless payment interval increase is greater than this
 }
 
+// SelectorSpecified returns true if the query is for the data matched by a
+// selector, rather than for the whole payload
+func (qp QueryParams) SelectorSpecified() bool {
+	return qp.Selector != nil && !bytes.Equal(qp.Selector.Raw, cbg.CborNull)
+}
+
 // Query is a query to a given provider to determine information about a piece
 // they may have available for retrieval
 type Query struct {
@@ -197,7 +214,7 @@ type QueryResponse struct {
 	PieceCIDFound QueryItemStatus // V1 - if a PieceCID was requested, the result
 	//SelectorFound   QueryItemStatus // V1 - if a Selector was requested, the result
 
-	Size uint64 // Total size of piece in bytes
+	Size uint64 // Total size of piece in bytes, or of the data matched by the query selector
 	//ExpectedPayloadSize uint64 // V1 - optional, if PayloadCID + selector are specified and miner knows, can offer an expected size
 
 	PaymentAddress             address.Address // address to send funds to -- may be different than miner addr
@@ -206,16 +223,56 @@ type QueryResponse struct {
 	MaxPaymentIntervalIncrease uint64
 	Message                    string
 	UnsealPrice                abi.TokenAmount
+	// FreeRetrievalRequired is set when the provider only serves this
+	// retrieval in free mode, see Params.Free
+	FreeRetrievalRequired bool
 }
 
 // QueryResponseUndefined is an empty QueryResponse
 var QueryResponseUndefined = QueryResponse{}
 
+// BatchQuery is a set of queries sent to a provider on a single stream
+type BatchQuery struct {
+	Queries []Query
+}
+
+// BatchQueryResponse is a provider's response to one query of a batch.
+// Responses are sent as soon as each query is answered, so they may not be
+// in the order of the queries.
+type BatchQueryResponse struct {
+	// Index is the index of the query in the batch
+	Index    uint64
+	Response QueryResponse
+}
+
+// BatchQueryResponseUndefined is an empty BatchQueryResponse
+var BatchQueryResponseUndefined = BatchQueryResponse{}
+
 // PieceRetrievalPrice is the total price to retrieve the piece (size * MinPricePerByte + UnsealedPrice)
 func (qr QueryResponse) PieceRetrievalPrice() abi.TokenAmount {
 	return big.Add(big.Mul(qr.MinPricePerByte, abi.NewTokenAmount(int64(qr.Size))), qr.UnsealPrice)
 }
 
+// DealParams returns the params for a deal for the selected data on the
+// terms of the response, restricted to the given piece if it is not nil
+func (qr QueryResponse) DealParams(sel ipld.Node, pieceCid *cid.Cid) (Params, error) {
+	if qr.FreeRetrievalRequired {
+		return NewFreeParams(sel, pieceCid)
+	}
+	return NewParamsV1(qr.MinPricePerByte, qr.MaxPaymentInterval, qr.MaxPaymentIntervalIncrease, sel, pieceCid, qr.UnsealPrice)
+}
+
+// RemainingRetrievalPrice is the expected price to retrieve the rest of the
+// response's data when the given number of bytes of it are already held
+// locally and will not be sent (V1)
+func (qr QueryResponse) RemainingRetrievalPrice(have uint64) abi.TokenAmount {
+	remaining := uint64(0)
+	if qr.Size > have {
+		remaining = qr.Size - have
+	}
+	return big.Add(big.Mul(qr.MinPricePerByte, abi.NewTokenAmount(int64(remaining))), qr.UnsealPrice)
+}
+
 // PayloadRetrievalPrice is the expected price to retrieve just the given payload
 // & selector (V1)
 //func (qr QueryResponse) PayloadRetrievalPrice() abi.TokenAmount {
@@ -250,6 +307,9 @@ type Params struct {
 	PaymentInterval         uint64 // when to request payment
 	PaymentIntervalIncrease uint64
 	UnsealPrice             abi.TokenAmount
+	// Free requests a retrieval without payment channels or vouchers. Both
+	// prices must be zero, and the provider never requests payment.
+	Free bool // V1
 }
 
 func (p Params) SelectorSpecified() bool {
@@ -290,19 +350,17 @@ func NewParamsV0(pricePerByte abi.TokenAmount, paymentInterval uint64, paymentIn
 
 // NewParamsV1 generates parameters for a retrieval deal, including a selector
 func NewParamsV1(pricePerByte abi.TokenAmount, paymentInterval uint64, paymentIntervalIncrease uint64, sel ipld.Node, pieceCid *cid.Cid, unsealPrice abi.TokenAmount) (Params, error) {
-	var buffer bytes.Buffer
-
 	if sel == nil {
 		return Params{}, xerrors.New("selector required for NewParamsV1")
 	}
 
-	err := dagcbor.Encode(sel, &buffer)
+	selector, err := EncodeNode(sel)
 	if err != nil {
 		return Params{}, xerrors.Errorf("error encoding selector: %w", err)
 	}
 
 	return Params{
-		Selector:                &cbg.Deferred{Raw: buffer.Bytes()},
+		Selector:                selector,
 		PieceCID:                pieceCid,
 		PricePerByte:            pricePerByte,
 		PaymentInterval:         paymentInterval,
@@ -311,6 +369,29 @@ func NewParamsV1(pricePerByte abi.TokenAmount, paymentInterval uint64, paymentIn
 	}, nil
 }
 
+// NewFreeParams generates parameters for a free retrieval deal, which skips
+// payment channel setup and voucher exchange entirely
+func NewFreeParams(sel ipld.Node, pieceCid *cid.Cid) (Params, error) {
+	params, err := NewParamsV1(big.Zero(), 0, 0, sel, pieceCid, big.Zero())
+	if err != nil {
+		return Params{}, err
+	}
+	params.Free = true
+	return params, nil
+}
+
+// ByteRange is a range of bytes in a UnixFS file
+type ByteRange struct {
+	Offset uint64
+	Length uint64
+}
+
+// Selector returns a selector that matches the range of bytes in the UnixFS
+// file at the root of a DAG
+func (r ByteRange) Selector() ipld.Node {
+	return shared.UnixFSByteRangeSelector(r.Offset, r.Length)
+}
+
 // DealID is an identifier for a retrieval deal (unique to a client)
 type DealID uint64
 
@@ -425,6 +506,10 @@ type PricingInput struct {
 	PieceCID cid.Cid
 	// PieceSize is the size of the Piece from which the payload will be retrieved.
 	PieceSize abi.UnpaddedPieceSize
+	// PayloadSize is the size of the data that will be transferred, if the
+	// client asked for part of the payload with a selector and the provider
+	// could measure it. It is zero otherwise.
+	PayloadSize uint64
 	// Client is the peerID of the retrieval client.
 	Client peer.ID
 	// VerifiedDeal is true if there exists a verified storage deal for the PayloadCID.
@@ -146,7 +146,7 @@ func (t *QueryResponse) MarshalCBOR(w io.Writer) error {
 
 	cw := cbg.NewCborWriter(w)
 
-	if _, err := cw.Write([]byte{169}); err != nil {
+	if _, err := cw.Write([]byte{170}); err != nil {
 		return err
 	}
 
@@ -300,6 +300,22 @@ func (t *QueryResponse) MarshalCBOR(w io.Writer) error {
 	if err := t.UnsealPrice.MarshalCBOR(cw); err != nil {
 		return err
 	}
+
+	// t.FreeRetrievalRequired (bool) (bool)
+	if len("FreeRetrievalRequired") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"FreeRetrievalRequired\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("FreeRetrievalRequired"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("FreeRetrievalRequired")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteBool(w, t.FreeRetrievalRequired); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -457,6 +473,257 @@ func (t *QueryResponse) UnmarshalCBOR(r io.Reader) (err error) {
 				}
 
 			}
+			// t.FreeRetrievalRequired (bool) (bool)
+		case "FreeRetrievalRequired":
+
+			maj, extra, err = cr.ReadHeader()
+			if err != nil {
+				return err
+			}
+			if maj != cbg.MajOther {
+				return fmt.Errorf("booleans must be major type 7")
+			}
+			switch extra {
+			case 20:
+				t.FreeRetrievalRequired = false
+			case 21:
+				t.FreeRetrievalRequired = true
+			default:
+				return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
+func (t *BatchQuery) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write([]byte{161}); err != nil {
+		return err
+	}
+
+	// t.Queries ([]retrievalmarket.Query) (slice)
+	if len("Queries") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Queries\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Queries"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Queries")); err != nil {
+		return err
+	}
+
+	if len(t.Queries) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.Queries was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajArray, uint64(len(t.Queries))); err != nil {
+		return err
+	}
+	for _, v := range t.Queries {
+		if err := v.MarshalCBOR(cw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *BatchQuery) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = BatchQuery{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("BatchQuery: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadString(cr)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Queries ([]retrievalmarket.Query) (slice)
+		case "Queries":
+
+			maj, extra, err = cr.ReadHeader()
+			if err != nil {
+				return err
+			}
+
+			if extra > cbg.MaxLength {
+				return fmt.Errorf("t.Queries: array too large (%d)", extra)
+			}
+
+			if maj != cbg.MajArray {
+				return fmt.Errorf("expected cbor array")
+			}
+
+			if extra > 0 {
+				t.Queries = make([]Query, extra)
+			}
+
+			for i := 0; i < int(extra); i++ {
+
+				var v Query
+				if err := v.UnmarshalCBOR(cr); err != nil {
+					return err
+				}
+
+				t.Queries[i] = v
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
+func (t *BatchQueryResponse) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write([]byte{162}); err != nil {
+		return err
+	}
+
+	// t.Index (uint64) (uint64)
+	if len("Index") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Index\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Index"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Index")); err != nil {
+		return err
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Index)); err != nil {
+		return err
+	}
+
+	// t.Response (retrievalmarket.QueryResponse) (struct)
+	if len("Response") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Response\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Response"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Response")); err != nil {
+		return err
+	}
+
+	if err := t.Response.MarshalCBOR(cw); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *BatchQueryResponse) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = BatchQueryResponse{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("BatchQueryResponse: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadString(cr)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Index (uint64) (uint64)
+		case "Index":
+
+			{
+
+				maj, extra, err = cr.ReadHeader()
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.Index = uint64(extra)
+
+			}
+			// t.Response (retrievalmarket.QueryResponse) (struct)
+		case "Response":
+
+			{
+
+				if err := t.Response.UnmarshalCBOR(cr); err != nil {
+					return xerrors.Errorf("unmarshaling t.Response: %w", err)
+				}
+
+			}
 
 		default:
 			// Field doesn't exist on this type, so ignore it
@@ -804,7 +1071,7 @@ func (t *Params) MarshalCBOR(w io.Writer) error {
 
 	cw := cbg.NewCborWriter(w)
 
-	if _, err := cw.Write([]byte{166}); err != nil {
+	if _, err := cw.Write([]byte{167}); err != nil {
 		return err
 	}
 
@@ -909,6 +1176,22 @@ func (t *Params) MarshalCBOR(w io.Writer) error {
 	if err := t.UnsealPrice.MarshalCBOR(cw); err != nil {
 		return err
 	}
+
+	// t.Free (bool) (bool)
+	if len("Free") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Free\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Free"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Free")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteBool(w, t.Free); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -1034,6 +1317,24 @@ func (t *Params) UnmarshalCBOR(r io.Reader) (err error) {
 				}
 
 			}
+			// t.Free (bool) (bool)
+		case "Free":
+
+			maj, extra, err = cr.ReadHeader()
+			if err != nil {
+				return err
+			}
+			if maj != cbg.MajOther {
+				return fmt.Errorf("booleans must be major type 7")
+			}
+			switch extra {
+			case 20:
+				t.Free = false
+			case 21:
+				t.Free = true
+			default:
+				return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+			}
 
 		default:
 			// Field doesn't exist on this type, so ignore it
@@ -1051,7 +1352,7 @@ func (t *QueryParams) MarshalCBOR(w io.Writer) error {
 
 	cw := cbg.NewCborWriter(w)
 
-	if _, err := cw.Write([]byte{161}); err != nil {
+	if _, err := cw.Write([]byte{162}); err != nil {
 		return err
 	}
 
@@ -1077,6 +1378,21 @@ func (t *QueryParams) MarshalCBOR(w io.Writer) error {
 		}
 	}
 
+	// t.Selector (typegen.Deferred) (struct)
+	if len("Selector") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Selector\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Selector"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Selector")); err != nil {
+		return err
+	}
+
+	if err := t.Selector.MarshalCBOR(cw); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -1141,6 +1457,17 @@ func (t *QueryParams) UnmarshalCBOR(r io.Reader) (err error) {
 				}
 
 			}
+			// t.Selector (typegen.Deferred) (struct)
+		case "Selector":
+
+			{
+
+				t.Selector = new(cbg.Deferred)
+
+				if err := t.Selector.UnmarshalCBOR(cr); err != nil {
+					return xerrors.Errorf("failed to read deferred field: %w", err)
+				}
+			}
 
 		default:
 			// Field doesn't exist on this type, so ignore it
@@ -2450,7 +2777,7 @@ func (t *PaymentInfo) MarshalCBOR(w io.Writer) error {
 
 	cw := cbg.NewCborWriter(w)
 
-	if _, err := cw.Write([]byte{162}); err != nil {
+	if _, err := cw.Write([]byte{163}); err != nil {
 		return err
 	}
 
@@ -2486,6 +2813,21 @@ func (t *PaymentInfo) MarshalCBOR(w io.Writer) error {
 		return err
 	}
 
+	// t.LaneBase (big.Int) (struct)
+	if len("LaneBase") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"LaneBase\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("LaneBase"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("LaneBase")); err != nil {
+		return err
+	}
+
+	if err := t.LaneBase.MarshalCBOR(cw); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -2552,6 +2894,16 @@ func (t *PaymentInfo) UnmarshalCBOR(r io.Reader) (err error) {
 				t.Lane = uint64(extra)
 
 			}
+			// t.LaneBase (big.Int) (struct)
+		case "LaneBase":
+
+			{
+
+				if err := t.LaneBase.UnmarshalCBOR(cr); err != nil {
+					return xerrors.Errorf("unmarshaling t.LaneBase: %w", err)
+				}
+
+			}
 
 		default:
 			// Field doesn't exist on this type, so ignore it
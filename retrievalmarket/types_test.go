@@ -7,6 +7,7 @@ import (
 
 	"github.com/ipld/go-ipld-prime/codec/dagcbor"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	"github.com/libp2p/go-libp2p-core/test"
 	"github.com/stretchr/testify/assert"
@@ -43,6 +44,41 @@ func TestParamsMarshalUnmarshal(t *testing.T) {
 	assert.Equal(t, sel, allSelector)
 }
 
+func TestQueryParamsSelectorMarshalUnmarshal(t *testing.T) {
+	pieceCid := tut.GenerateCids(1)[0]
+
+	// legacy query params carry no selector
+	params := retrievalmarket.QueryParams{PieceCID: &pieceCid}
+	require.False(t, params.SelectorSpecified())
+	buf := new(bytes.Buffer)
+	require.NoError(t, params.MarshalCBOR(buf))
+	unmarshalled := retrievalmarket.QueryParams{}
+	require.NoError(t, unmarshalled.UnmarshalCBOR(buf))
+	require.Equal(t, params.PieceCID, unmarshalled.PieceCID)
+	require.False(t, unmarshalled.SelectorSpecified())
+
+	rangeSelector := retrievalmarket.ByteRange{Offset: 100, Length: 200}.Selector()
+	sel, err := retrievalmarket.EncodeNode(rangeSelector)
+	require.NoError(t, err)
+	params.Selector = sel
+	require.True(t, params.SelectorSpecified())
+
+	buf = new(bytes.Buffer)
+	require.NoError(t, params.MarshalCBOR(buf))
+	unmarshalled = retrievalmarket.QueryParams{}
+	require.NoError(t, unmarshalled.UnmarshalCBOR(buf))
+	require.Equal(t, params, unmarshalled)
+
+	nb := basicnode.Prototype.Any.NewBuilder()
+	require.NoError(t, dagcbor.Decode(nb, bytes.NewBuffer(unmarshalled.Selector.Raw)))
+	decoded := nb.Build()
+	_, err = selector.CompileSelector(decoded)
+	require.NoError(t, err)
+	reencoded, err := retrievalmarket.EncodeNode(decoded)
+	require.NoError(t, err)
+	require.Equal(t, sel.Raw, reencoded.Raw)
+}
+
 func TestPricingInputMarshalUnmarshalJSON(t *testing.T) {
 	pid := test.RandPeerIDFatal(t)
 
@@ -118,3 +154,16 @@ func TestParamsIntervalBounds(t *testing.T) {
 		})
 	}
 }
+
+func TestRemainingRetrievalPrice(t *testing.T) {
+	qr := retrievalmarket.QueryResponse{
+		Size:            1000,
+		MinPricePerByte: abi.NewTokenAmount(2),
+		UnsealPrice:     abi.NewTokenAmount(50),
+	}
+	require.Equal(t, qr.PieceRetrievalPrice(), qr.RemainingRetrievalPrice(0))
+	require.Equal(t, abi.NewTokenAmount(2*600+50), qr.RemainingRetrievalPrice(400))
+	// the unseal price is still due when every byte is already held
+	require.Equal(t, abi.NewTokenAmount(50), qr.RemainingRetrievalPrice(1000))
+	require.Equal(t, abi.NewTokenAmount(50), qr.RemainingRetrievalPrice(2000))
+}
@@ -0,0 +1,23 @@
+package shared
+
+import (
+	"time"
+
+	"github.com/benbjohnson/clock"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// Clock is the source of time for deal state machines, stage timestamps and
+// timers. Production code uses the system clock, while tests can pass a
+// clock.Mock to control time.
+type Clock = clock.Clock
+
+// NewClock returns a Clock backed by the system time
+func NewClock() Clock {
+	return clock.New()
+}
+
+// CborTime returns the current time of the given clock as a UTC CborTime
+func CborTime(c Clock) cbg.CborTime {
+	return cbg.CborTime(time.Unix(0, c.Now().UnixNano()).UTC())
+}
@@ -0,0 +1,230 @@
+package shared
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+)
+
+// ErrPeerUnavailable is returned when a peer's circuit is open because
+// recent attempts to reach it have failed
+var ErrPeerUnavailable = xerrors.New("peer is unavailable")
+
+// The number of consecutive failures after which a peer's circuit opens
+const defaultFailureThreshold = defaultMaxStreamOpenAttempts
+
+// How long a peer's circuit stays open before a request is let through to
+// probe whether the peer has recovered
+const defaultOpenDuration = 1 * time.Minute
+
+// CircuitState is the state of the circuit breaker for a peer
+type CircuitState uint64
+
+const (
+	// CircuitClosed means requests to the peer are allowed
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen means the peer recently failed repeatedly, and requests to
+	// it fail immediately
+	CircuitOpen
+
+	// CircuitHalfOpen means a single probe request is allowed through to
+	// check whether the peer has recovered
+	CircuitHalfOpen
+)
+
+// CircuitStates maps circuit state codes to string names
+var CircuitStates = map[CircuitState]string{
+	CircuitClosed:   "CircuitClosed",
+	CircuitOpen:     "CircuitOpen",
+	CircuitHalfOpen: "CircuitHalfOpen",
+}
+
+func (s CircuitState) String() string {
+	str, ok := CircuitStates[s]
+	if ok {
+		return str
+	}
+	return "CircuitStateUnknown"
+}
+
+// PeerHealth is a snapshot of the health of a peer
+type PeerHealth struct {
+	Peer                peer.ID
+	State               CircuitState
+	ConsecutiveFailures int
+	LastFailure         time.Time
+	LastSuccess         time.Time
+	// OpenUntil is when an open circuit will let a probe request through
+	OpenUntil time.Time
+}
+
+type peerHealth struct {
+	PeerHealth
+	probing bool
+}
+
+// PeerHealthTrackerOption configures a PeerHealthTracker
+type PeerHealthTrackerOption func(*PeerHealthTracker)
+
+// CircuitBreakerParameters sets the number of consecutive failures after
+// which a peer's circuit opens, and how long it stays open
+func CircuitBreakerParameters(failureThreshold int, openDuration time.Duration) PeerHealthTrackerOption {
+	return func(t *PeerHealthTracker) {
+		t.failureThreshold = failureThreshold
+		t.openDuration = openDuration
+	}
+}
+
+// PeerHealthClock sets the clock used to time failures and open circuits
+func PeerHealthClock(c Clock) PeerHealthTrackerOption {
+	return func(t *PeerHealthTracker) {
+		t.clock = c
+	}
+}
+
+// PeerHealthTracker is a per-peer circuit breaker. It tracks failures to
+// reach each peer, and once a peer has failed too many times in a row fails
+// requests to it immediately, until a probe request succeeds. A single
+// tracker can be shared between the storage and retrieval networks.
+type PeerHealthTracker struct {
+	failureThreshold int
+	openDuration     time.Duration
+	clock            Clock
+
+	lk    sync.Mutex
+	peers map[peer.ID]*peerHealth
+}
+
+// NewPeerHealthTracker creates a new PeerHealthTracker
+func NewPeerHealthTracker(options ...PeerHealthTrackerOption) *PeerHealthTracker {
+	t := &PeerHealthTracker{
+		failureThreshold: defaultFailureThreshold,
+		openDuration:     defaultOpenDuration,
+		clock:            NewClock(),
+		peers:            make(map[peer.ID]*peerHealth),
+	}
+	for _, option := range options {
+		option(t)
+	}
+	return t
+}
+
+// Allow returns an error wrapping ErrPeerUnavailable if requests to the peer
+// should fail fast. Once an open circuit's timeout has passed, Allow lets a
+// single probe request through and moves the circuit to half-open.
+func (t *PeerHealthTracker) Allow(p peer.ID) error {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	ph, ok := t.peers[p]
+	if !ok {
+		return nil
+	}
+	switch ph.State {
+	case CircuitOpen:
+		if t.clock.Now().Before(ph.OpenUntil) {
+			return xerrors.Errorf("%d consecutive failures to reach %s, retrying after %s: %w",
+				ph.ConsecutiveFailures, p, ph.OpenUntil.Format(time.RFC3339), ErrPeerUnavailable)
+		}
+		ph.State = CircuitHalfOpen
+		ph.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if ph.probing {
+			return xerrors.Errorf("waiting for probe of %s to complete: %w", p, ErrPeerUnavailable)
+		}
+		ph.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// RecordSuccess records that the peer was reached, closing its circuit
+func (t *PeerHealthTracker) RecordSuccess(p peer.ID) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	ph := t.peer(p)
+	if ph.State != CircuitClosed {
+		log.Infof("peer %s is reachable again, closing circuit", p)
+	}
+	ph.State = CircuitClosed
+	ph.ConsecutiveFailures = 0
+	ph.LastSuccess = t.clock.Now()
+	ph.OpenUntil = time.Time{}
+	ph.probing = false
+}
+
+// RecordFailure records a failure to reach the peer. The peer's circuit
+// opens once the failure threshold is reached, or immediately if a probe of
+// a half-open circuit failed.
+func (t *PeerHealthTracker) RecordFailure(p peer.ID) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	ph := t.peer(p)
+	now := t.clock.Now()
+	ph.ConsecutiveFailures++
+	ph.LastFailure = now
+	if ph.State == CircuitHalfOpen || ph.ConsecutiveFailures >= t.failureThreshold {
+		if ph.State != CircuitOpen {
+			log.Warnf("%d consecutive failures to reach peer %s, opening circuit for %s", ph.ConsecutiveFailures, p, t.openDuration)
+		}
+		ph.State = CircuitOpen
+		ph.OpenUntil = now.Add(t.openDuration)
+		ph.probing = false
+	}
+}
+
+// abandonProbe lets another probe through a half-open circuit, when the
+// current probe was cancelled before reaching a verdict
+func (t *PeerHealthTracker) abandonProbe(p peer.ID) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	if ph, ok := t.peers[p]; ok && ph.State == CircuitHalfOpen {
+		ph.probing = false
+	}
+}
+
+// Health returns the health of the given peer. Peers that have never been
+// seen are reported healthy.
+func (t *PeerHealthTracker) Health(p peer.ID) PeerHealth {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	ph, ok := t.peers[p]
+	if !ok {
+		return PeerHealth{Peer: p, State: CircuitClosed}
+	}
+	return ph.PeerHealth
+}
+
+// List returns the health of all tracked peers, ordered by peer ID
+func (t *PeerHealthTracker) List() []PeerHealth {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	list := make([]PeerHealth, 0, len(t.peers))
+	for _, ph := range t.peers {
+		list = append(list, ph.PeerHealth)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Peer < list[j].Peer
+	})
+	return list
+}
+
+func (t *PeerHealthTracker) peer(p peer.ID) *peerHealth {
+	ph, ok := t.peers[p]
+	if !ok {
+		ph = &peerHealth{PeerHealth: PeerHealth{Peer: p}}
+		t.peers[p] = ph
+	}
+	return ph
+}
@@ -0,0 +1,117 @@
+package shared
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestPeerHealthTracker(t *testing.T) {
+	clock := clock.NewMock()
+	tracker := NewPeerHealthTracker(CircuitBreakerParameters(2, time.Minute), PeerHealthClock(clock))
+	p := peer.ID("peer1")
+
+	require.NoError(t, tracker.Allow(p))
+	require.Equal(t, CircuitClosed, tracker.Health(p).State)
+
+	tracker.RecordFailure(p)
+	require.NoError(t, tracker.Allow(p))
+	require.Equal(t, CircuitClosed, tracker.Health(p).State)
+
+	// the circuit opens once the threshold is reached
+	tracker.RecordFailure(p)
+	health := tracker.Health(p)
+	require.Equal(t, CircuitOpen, health.State)
+	require.Equal(t, 2, health.ConsecutiveFailures)
+	require.Equal(t, clock.Now().Add(time.Minute), health.OpenUntil)
+	require.ErrorIs(t, tracker.Allow(p), ErrPeerUnavailable)
+
+	// other peers are unaffected
+	require.NoError(t, tracker.Allow(peer.ID("peer2")))
+
+	// after the open duration a single probe is let through
+	clock.Add(time.Minute)
+	require.NoError(t, tracker.Allow(p))
+	require.Equal(t, CircuitHalfOpen, tracker.Health(p).State)
+	require.ErrorIs(t, tracker.Allow(p), ErrPeerUnavailable)
+
+	// a failed probe reopens the circuit
+	tracker.RecordFailure(p)
+	require.Equal(t, CircuitOpen, tracker.Health(p).State)
+	require.ErrorIs(t, tracker.Allow(p), ErrPeerUnavailable)
+
+	// an abandoned probe lets another probe through
+	clock.Add(time.Minute)
+	require.NoError(t, tracker.Allow(p))
+	tracker.abandonProbe(p)
+	require.NoError(t, tracker.Allow(p))
+
+	// a successful probe closes the circuit
+	tracker.RecordSuccess(p)
+	health = tracker.Health(p)
+	require.Equal(t, CircuitClosed, health.State)
+	require.Zero(t, health.ConsecutiveFailures)
+	require.NoError(t, tracker.Allow(p))
+	require.NoError(t, tracker.Allow(p))
+
+	tracker.RecordFailure(peer.ID("peer0"))
+	list := tracker.List()
+	require.Len(t, list, 2)
+	require.Equal(t, peer.ID("peer0"), list[0].Peer)
+	require.Equal(t, p, list[1].Peer)
+}
+
+func TestRetryStreamCircuitBreaker(t *testing.T) {
+	tracker := NewPeerHealthTracker(CircuitBreakerParameters(3, time.Hour))
+	p := peer.ID("peer1")
+
+	opener := &mockOpener{errs: make(chan error, 10)}
+	for i := 0; i < 10; i++ {
+		opener.errs <- xerrors.Errorf("network err")
+	}
+	rs := NewRetryStream(opener, RetryParameters(time.Millisecond, time.Millisecond, 2, 1), PeerHealthTracking(tracker))
+	require.Equal(t, tracker, rs.PeerHealth())
+
+	// two failed attempts, circuit still closed
+	_, err := rs.OpenStream(context.Background(), p, []protocol.ID{"proto1"})
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrPeerUnavailable)
+	require.Equal(t, CircuitClosed, tracker.Health(p).State)
+
+	// the third failure opens the circuit and stops retrying
+	_, err = rs.OpenStream(context.Background(), p, []protocol.ID{"proto1"})
+	require.ErrorIs(t, err, ErrPeerUnavailable)
+	require.Equal(t, CircuitOpen, tracker.Health(p).State)
+	require.Len(t, opener.errs, 7)
+
+	// further attempts fail fast without reaching the network, including
+	// from other retry streams sharing the tracker
+	other := NewRetryStream(opener, PeerHealthTracking(tracker))
+	_, err = other.OpenStream(context.Background(), p, []protocol.ID{"proto1"})
+	require.ErrorIs(t, err, ErrPeerUnavailable)
+	require.Len(t, opener.errs, 7)
+}
+
+func TestRetryStreamWithoutTracker(t *testing.T) {
+	p := peer.ID("peer1")
+	opener := &mockOpener{errs: make(chan error, 10)}
+	for i := 0; i < 10; i++ {
+		opener.errs <- xerrors.Errorf("network err")
+	}
+	rs := NewRetryStream(opener, RetryParameters(time.Millisecond, time.Millisecond, 2, 1))
+	require.Nil(t, rs.PeerHealth())
+
+	// without a tracker every call runs the full retry schedule
+	for i := 0; i < 3; i++ {
+		_, err := rs.OpenStream(context.Background(), p, []protocol.ID{"proto1"})
+		require.Error(t, err)
+		require.NotErrorIs(t, err, ErrPeerUnavailable)
+	}
+	require.Len(t, opener.errs, 4)
+}
@@ -41,8 +41,29 @@ func RetryParameters(minDuration time.Duration, maxDuration time.Duration, attem
 	}
 }
 
+// PeerHealthTracking sets the tracker used to fail fast when opening streams
+// to peers that are known to be unreachable. Pass the same tracker to several
+// RetryStreams to share peer health between them. Without a tracker, every
+// call to OpenStream runs the full retry schedule, however often the peer
+// failed before.
+func PeerHealthTracking(tracker *PeerHealthTracker) RetryStreamOption {
+	return func(impl *RetryStream) {
+		impl.health = tracker
+	}
+}
+
+// RetryStreamClock sets the clock used to wait between attempts to open a
+// stream
+func RetryStreamClock(c Clock) RetryStreamOption {
+	return func(impl *RetryStream) {
+		impl.clock = c
+	}
+}
+
 type RetryStream struct {
 	opener StreamOpener
+	health *PeerHealthTracker
+	clock  Clock
 
 	backoffFactor         float64
 	maxStreamOpenAttempts float64
@@ -53,6 +74,7 @@ type RetryStream struct {
 func NewRetryStream(opener StreamOpener, options ...RetryStreamOption) *RetryStream {
 	impl := &RetryStream{
 		opener:                opener,
+		clock:                 NewClock(),
 		backoffFactor:         defaultBackoffFactor,
 		maxStreamOpenAttempts: defaultMaxStreamOpenAttempts,
 		minAttemptDuration:    defaultMinAttemptDuration,
@@ -68,7 +90,19 @@ func (impl *RetryStream) SetOptions(options ...RetryStreamOption) {
 	}
 }
 
+// PeerHealth returns the tracker of the health of peers streams are opened
+// to, or nil if peer health is not tracked
+func (impl *RetryStream) PeerHealth() *PeerHealthTracker {
+	return impl.health
+}
+
 func (impl *RetryStream) OpenStream(ctx context.Context, id peer.ID, protocols []protocol.ID) (network.Stream, error) {
+	if impl.health != nil {
+		if err := impl.health.Allow(id); err != nil {
+			return nil, xerrors.Errorf("failed to open stream: %w", err)
+		}
+	}
+
 	b := &backoff.Backoff{
 		Min:    impl.minAttemptDuration,
 		Max:    impl.maxAttemptDuration,
@@ -79,8 +113,18 @@ func (impl *RetryStream) OpenStream(ctx context.Context, id peer.ID, protocols [
 	for {
 		s, err := impl.opener.NewStream(ctx, id, protocols...)
 		if err == nil {
+			if impl.health != nil {
+				impl.health.RecordSuccess(id)
+			}
 			return s, err
 		}
+		if ctx.Err() != nil {
+			impl.abandonProbe(id)
+			return nil, xerrors.Errorf("open stream to %s canceled by context: %w", id, err)
+		}
+		if impl.health != nil {
+			impl.health.RecordFailure(id)
+		}
 
 		// b.Attempt() starts from zero
 		nAttempts := b.Attempt() + 1
@@ -88,16 +132,29 @@ func (impl *RetryStream) OpenStream(ctx context.Context, id peer.ID, protocols [
 			return nil, xerrors.Errorf("exhausted %d attempts but failed to open stream, err: %w", int(impl.maxStreamOpenAttempts), err)
 		}
 
+		// stop retrying if the peer's circuit opened, eg because other
+		// requests to it failed in the meantime
+		if impl.health != nil && impl.health.Health(id).State == CircuitOpen {
+			return nil, xerrors.Errorf("giving up on opening stream after %.0f attempts, err: %s: %w", nAttempts, err, ErrPeerUnavailable)
+		}
+
 		duration := b.Duration()
 		log.Warnf("failed to open stream to %s on attempt %.0f of %.0f, waiting %s to try again, err: %s",
 			id, nAttempts, impl.maxStreamOpenAttempts, duration, err)
 
-		ebt := time.NewTimer(duration)
+		ebt := impl.clock.Timer(duration)
 		select {
 		case <-ctx.Done():
 			ebt.Stop()
+			impl.abandonProbe(id)
 			return nil, xerrors.Errorf("open stream to %s canceled by context", id)
 		case <-ebt.C:
 		}
 	}
 }
+
+func (impl *RetryStream) abandonProbe(id peer.ID) {
+	if impl.health != nil {
+		impl.health.abandonProbe(id)
+	}
+}
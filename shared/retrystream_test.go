@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
@@ -60,6 +61,33 @@ func TestRetryStream(t *testing.T) {
 	}
 }
 
+func TestRetryStreamClock(t *testing.T) {
+	opener := &mockOpener{
+		errs: make(chan error, 1),
+	}
+	opener.errs <- xerrors.Errorf("network err")
+	mockClock := clock.NewMock()
+	rs := NewRetryStream(opener, RetryParameters(time.Minute, time.Minute, 2, 1), RetryStreamClock(mockClock))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := rs.OpenStream(context.Background(), peer.ID("peer1"), []protocol.ID{"proto1"})
+		done <- err
+	}()
+
+	// the second attempt waits for the backoff to pass on the clock
+	require.Eventually(t, func() bool {
+		mockClock.Add(time.Minute)
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+}
+
 type mockOpener struct {
 	errs chan error
 }
@@ -1,10 +1,165 @@
 package shared
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync/storeutil"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	dagpb "github.com/ipld/go-codec-dagpb"
 	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"golang.org/x/xerrors"
 )
 
 // Deprecated: AllSelector is a compatibility alias for an entire DAG non-matching-selector.
 // Use github.com/ipld/go-ipld-prime/traversal/selector/parse.CommonSelector_ExploreAllRecursively instead.
 func AllSelector() ipld.Node { return selectorparse.CommonSelector_ExploreAllRecursively }
+
+// UnixFSByteRangeSelector returns a selector that interprets the root of a
+// DAG as a UnixFS file and matches length bytes of the file starting at
+// offset. A traversal with the selector only loads the blocks that hold the
+// range, and the intermediate nodes above them.
+func UnixFSByteRangeSelector(offset, length uint64) ipld.Node {
+	from := clampInt64(offset)
+	to := clampInt64(offset + length)
+	if offset+length < offset {
+		to = math.MaxInt64
+	}
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	return ssb.ExploreInterpretAs("unixfs", ssb.MatcherSubset(from, to)).Node()
+}
+
+func clampInt64(v uint64) int64 {
+	if v > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(v)
+}
+
+// SelectorSize returns the total size of the distinct blocks loaded by a
+// traversal of the DAG under root with the given selector. This is the
+// amount of data a graphsync transfer with the selector sends.
+func SelectorSize(ctx context.Context, bs bstore.Blockstore, root cid.Cid, sel ipld.Node) (uint64, error) {
+	var size uint64
+	seen := cid.NewSet()
+	err := walkSelector(ctx, bs, root, sel, false, func(c cid.Cid, data []byte) {
+		if seen.Visit(c) {
+			size += uint64(len(data))
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// LocalBlocks returns the blocks of the DAG under root matched by the given
+// selector that are already in bs, and their total size. A traversal can't
+// see past a missing block, so blocks under a missing block are not
+// counted, even if they are in bs.
+func LocalBlocks(ctx context.Context, bs bstore.Blockstore, root cid.Cid, sel ipld.Node) (*cid.Set, uint64, error) {
+	var size uint64
+	have := cid.NewSet()
+	hasRoot, err := bs.Has(ctx, root)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("failed to check for root %s: %w", root, err)
+	}
+	if !hasRoot {
+		return have, 0, nil
+	}
+	err = walkSelector(ctx, bs, root, sel, true, func(c cid.Cid, data []byte) {
+		if have.Visit(c) {
+			size += uint64(len(data))
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return have, size, nil
+}
+
+// walkSelector traverses the DAG under root with the given selector, calling
+// visitBlock with each block the traversal loads. If skipMissing is true,
+// the traversal skips blocks that are not in bs instead of failing.
+func walkSelector(ctx context.Context, bs bstore.Blockstore, root cid.Cid, sel ipld.Node, skipMissing bool, visitBlock func(c cid.Cid, data []byte)) error {
+	compiled, err := selector.CompileSelector(sel)
+	if err != nil {
+		return xerrors.Errorf("failed to compile selector: %w", err)
+	}
+
+	lsys := storeutil.LinkSystemForBlockstore(bs)
+	open := lsys.StorageReadOpener
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		c := lnk.(cidlink.Link).Cid
+		if skipMissing {
+			has, err := bs.Has(lctx.Ctx, c)
+			if err != nil {
+				return nil, err
+			}
+			if !has {
+				return nil, traversal.SkipMe{}
+			}
+		}
+		r, err := open(lctx, lnk)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		visitBlock(c, data)
+		return bytes.NewReader(data), nil
+	}
+
+	chooser := dagpb.AddSupportToChooser(basicnode.Chooser)
+	rootLnk := cidlink.Link{Cid: root}
+	proto, err := chooser(rootLnk, ipld.LinkContext{Ctx: ctx})
+	if err != nil {
+		return err
+	}
+	rootNode, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, rootLnk, proto)
+	if err != nil {
+		return xerrors.Errorf("failed to load root %s: %w", root, err)
+	}
+
+	prog := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: chooser,
+		},
+	}
+	err = prog.WalkAdv(rootNode, compiled, func(_ traversal.Progress, n datamodel.Node, _ traversal.VisitReason) error {
+		// matched byte ranges of files are only loaded when they are read,
+		// as graphsync does when sending them
+		if lbn, ok := n.(datamodel.LargeBytesNode); ok {
+			r, err := lbn.AsLargeBytes()
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(ioutil.Discard, r)
+			if err != nil && skipMissing {
+				// the rest of the range is missing
+				return nil
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to traverse %s: %w", root, err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package shared_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-fil-markets/shared"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil/unixfs"
+)
+
+func TestSelectorSize(t *testing.T) {
+	ctx := context.Background()
+	bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dagService := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	// a 19000 byte file, in 1KiB raw leaves under a single root node
+	src := filepath.Join(shared_testutil.ThisDir(t), "../retrievalmarket/impl/fixtures/lorem.txt")
+	root := unixfs.WriteUnixfsDAGTo(t, src, dagService)
+
+	rootBlk, err := bs.Get(ctx, root)
+	require.NoError(t, err)
+	rootSize := uint64(len(rootBlk.RawData()))
+
+	all, err := shared.SelectorSize(ctx, bs, root, selectorparse.CommonSelector_ExploreAllRecursively)
+	require.NoError(t, err)
+	require.Equal(t, rootSize+19000, all)
+
+	// a range within a single leaf
+	size, err := shared.SelectorSize(ctx, bs, root, shared.UnixFSByteRangeSelector(2100, 100))
+	require.NoError(t, err)
+	require.Equal(t, rootSize+1024, size)
+
+	// a range spanning two leaves
+	size, err = shared.SelectorSize(ctx, bs, root, shared.UnixFSByteRangeSelector(2000, 100))
+	require.NoError(t, err)
+	require.Equal(t, rootSize+2048, size)
+
+	// a range running past the end of the file
+	size, err = shared.SelectorSize(ctx, bs, root, shared.UnixFSByteRangeSelector(18500, 1<<20))
+	require.NoError(t, err)
+	require.Equal(t, rootSize+(19000-18*1024), size)
+}
+
+func TestLocalBlocks(t *testing.T) {
+	ctx := context.Background()
+	bs := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dagService := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	src := filepath.Join(shared_testutil.ThisDir(t), "../retrievalmarket/impl/fixtures/lorem.txt")
+	root := unixfs.WriteUnixfsDAGTo(t, src, dagService)
+
+	rootNd, err := dagService.Get(ctx, root)
+	require.NoError(t, err)
+	links := rootNd.Links()
+	require.Len(t, links, 19)
+
+	// a partial copy with the root and the first five leaves
+	partial := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	require.NoError(t, partial.Put(ctx, rootNd))
+	expected := []cid.Cid{root}
+	for _, l := range links[:5] {
+		blk, err := bs.Get(ctx, l.Cid)
+		require.NoError(t, err)
+		require.NoError(t, partial.Put(ctx, blk))
+		expected = append(expected, l.Cid)
+	}
+
+	have, size, err := shared.LocalBlocks(ctx, partial, root, selectorparse.CommonSelector_ExploreAllRecursively)
+	require.NoError(t, err)
+	require.ElementsMatch(t, expected, have.Keys())
+	require.Equal(t, uint64(len(rootNd.RawData()))+5*1024, size)
+
+	// a range that is partly held locally
+	have, _, err = shared.LocalBlocks(ctx, partial, root, shared.UnixFSByteRangeSelector(4000, 3000))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []cid.Cid{root, links[3].Cid, links[4].Cid}, have.Keys())
+
+	// without the root nothing under it can be found
+	leavesOnly := bstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	blk, err := bs.Get(ctx, links[0].Cid)
+	require.NoError(t, err)
+	require.NoError(t, leavesOnly.Put(ctx, blk))
+	have, size, err = shared.LocalBlocks(ctx, leavesOnly, root, selectorparse.CommonSelector_ExploreAllRecursively)
+	require.NoError(t, err)
+	require.Zero(t, have.Len())
+	require.Zero(t, size)
+}
@@ -2,7 +2,6 @@ package shared
 
 import (
 	"sync/atomic"
-	"time"
 )
 
 // timeCounter is used to generate a monotonically increasing sequence.
@@ -12,7 +11,13 @@ type TimeCounter struct {
 }
 
 func NewTimeCounter() *TimeCounter {
-	return &TimeCounter{counter: uint64(time.Now().UnixNano())}
+	return NewTimeCounterWithClock(NewClock())
+}
+
+// NewTimeCounterWithClock creates a TimeCounter that starts at the current
+// time of the given clock
+func NewTimeCounterWithClock(c Clock) *TimeCounter {
+	return &TimeCounter{counter: uint64(c.Now().UnixNano())}
 }
 
 func (tc *TimeCounter) Next() uint64 {
@@ -4,6 +4,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/benbjohnson/clock"
 )
 
 func TestTimeCounter(t *testing.T) {
@@ -46,3 +48,12 @@ func TestTimeCounter(t *testing.T) {
 		t.Fatal("Next() is not thread safe")
 	}
 }
+
+func TestTimeCounterWithClock(t *testing.T) {
+	clock := clock.NewMock()
+	clock.Set(time.Unix(0, 500))
+	tc := NewTimeCounterWithClock(clock)
+	if next := tc.Next(); next != 501 {
+		t.Fatal("counter should start at the clock's current time", next)
+	}
+}
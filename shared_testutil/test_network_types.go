@@ -105,6 +105,100 @@ func (trqs *TestRetrievalQueryStream) WriteQueryResponse(newResp rm.QueryRespons
 // Close closes the stream (does nothing for test).
 func (trqs *TestRetrievalQueryStream) Close() error { return nil }
 
+// BatchQueryReader is a function to mock reading batch queries.
+type BatchQueryReader func() (rm.BatchQuery, error)
+
+// BatchQueryWriter is a function to mock writing batch queries.
+type BatchQueryWriter func(rm.BatchQuery) error
+
+// BatchQueryResponseReader is a function to mock reading batch query responses.
+type BatchQueryResponseReader func() (rm.BatchQueryResponse, error)
+
+// BatchQueryResponseWriter is a function to mock writing batch query responses.
+type BatchQueryResponseWriter func(rm.BatchQueryResponse) error
+
+// TestRetrievalBatchQueryStream is a retrieval batch query stream with
+// predefined stubbed behavior.
+type TestRetrievalBatchQueryStream struct {
+	p          peer.ID
+	reader     BatchQueryReader
+	writer     BatchQueryWriter
+	respReader BatchQueryResponseReader
+	respWriter BatchQueryResponseWriter
+}
+
+// TestBatchQueryStreamParams are parameters used to setup a
+// TestRetrievalBatchQueryStream. All parameters except the peer ID are
+// optional.
+type TestBatchQueryStreamParams struct {
+	PeerID     peer.ID
+	Reader     BatchQueryReader
+	Writer     BatchQueryWriter
+	RespReader BatchQueryResponseReader
+	RespWriter BatchQueryResponseWriter
+}
+
+// NewTestRetrievalBatchQueryStream returns a new TestRetrievalBatchQueryStream
+// with the behavior specified by the paramaters, or default behaviors if not
+// specified.
+func NewTestRetrievalBatchQueryStream(params TestBatchQueryStreamParams) *TestRetrievalBatchQueryStream {
+	stream := TestRetrievalBatchQueryStream{
+		p: params.PeerID,
+		reader: func() (rm.BatchQuery, error) {
+			return rm.BatchQuery{}, nil
+		},
+		writer: func(rm.BatchQuery) error {
+			return nil
+		},
+		respReader: func() (rm.BatchQueryResponse, error) {
+			return rm.BatchQueryResponseUndefined, nil
+		},
+		respWriter: func(rm.BatchQueryResponse) error {
+			return nil
+		},
+	}
+	if params.Reader != nil {
+		stream.reader = params.Reader
+	}
+	if params.Writer != nil {
+		stream.writer = params.Writer
+	}
+	if params.RespReader != nil {
+		stream.respReader = params.RespReader
+	}
+	if params.RespWriter != nil {
+		stream.respWriter = params.RespWriter
+	}
+	return &stream
+}
+
+func (tbqs *TestRetrievalBatchQueryStream) RemotePeer() peer.ID {
+	return tbqs.p
+}
+
+// ReadBatchQuery calls the mocked batch query reader.
+func (tbqs *TestRetrievalBatchQueryStream) ReadBatchQuery() (rm.BatchQuery, error) {
+	return tbqs.reader()
+}
+
+// WriteBatchQuery calls the mocked batch query writer.
+func (tbqs *TestRetrievalBatchQueryStream) WriteBatchQuery(q rm.BatchQuery) error {
+	return tbqs.writer(q)
+}
+
+// ReadBatchQueryResponse calls the mocked batch query response reader.
+func (tbqs *TestRetrievalBatchQueryStream) ReadBatchQueryResponse() (rm.BatchQueryResponse, error) {
+	return tbqs.respReader()
+}
+
+// WriteBatchQueryResponse calls the mocked batch query response writer.
+func (tbqs *TestRetrievalBatchQueryStream) WriteBatchQueryResponse(resp rm.BatchQueryResponse) error {
+	return tbqs.respWriter(resp)
+}
+
+// Close closes the stream (does nothing for test).
+func (tbqs *TestRetrievalBatchQueryStream) Close() error { return nil }
+
 // DealProposalReader is a function to mock reading deal proposals.
 type DealProposalReader func() (rm.DealProposal, error)
 
@@ -150,31 +244,42 @@ type TestDealStreamParams struct {
 // QueryStreamBuilder is a function that builds retrieval query streams.
 type QueryStreamBuilder func(peer.ID) (rmnet.RetrievalQueryStream, error)
 
+// BatchQueryStreamBuilder is a function that builds retrieval batch query
+// streams.
+type BatchQueryStreamBuilder func(peer.ID) (rmnet.RetrievalBatchQueryStream, error)
+
 // TestRetrievalMarketNetwork is a test network that has stubbed behavior
 // for testing the retrieval market implementation
 type TestRetrievalMarketNetwork struct {
-	receiver  rmnet.RetrievalReceiver
-	qsbuilder QueryStreamBuilder
+	receiver   rmnet.RetrievalReceiver
+	qsbuilder  QueryStreamBuilder
+	bqsbuilder BatchQueryStreamBuilder
 }
 
 // TestNetworkParams are parameters for setting up a test network. All
 // parameters other than the receiver are optional
 type TestNetworkParams struct {
-	QueryStreamBuilder QueryStreamBuilder
-	Receiver           rmnet.RetrievalReceiver
+	QueryStreamBuilder      QueryStreamBuilder
+	BatchQueryStreamBuilder BatchQueryStreamBuilder
+	Receiver                rmnet.RetrievalReceiver
 }
 
 // NewTestRetrievalMarketNetwork returns a new TestRetrievalMarketNetwork with the
 // behavior specified by the paramaters, or default behaviors if not specified.
+// By default the network behaves as if peers don't support batch queries.
 func NewTestRetrievalMarketNetwork(params TestNetworkParams) *TestRetrievalMarketNetwork {
 	trmn := TestRetrievalMarketNetwork{
-		qsbuilder: TrivialNewQueryStream,
-		receiver:  params.Receiver,
+		qsbuilder:  TrivialNewQueryStream,
+		bqsbuilder: UnsupportedNewBatchQueryStream,
+		receiver:   params.Receiver,
 	}
 
 	if params.QueryStreamBuilder != nil {
 		trmn.qsbuilder = params.QueryStreamBuilder
 	}
+	if params.BatchQueryStreamBuilder != nil {
+		trmn.bqsbuilder = params.BatchQueryStreamBuilder
+	}
 	return &trmn
 }
 
@@ -184,6 +289,11 @@ func (trmn *TestRetrievalMarketNetwork) NewQueryStream(id peer.ID) (rmnet.Retrie
 	return trmn.qsbuilder(id)
 }
 
+// NewBatchQueryStream returns a batch query stream from the builder
+func (trmn *TestRetrievalMarketNetwork) NewBatchQueryStream(id peer.ID) (rmnet.RetrievalBatchQueryStream, error) {
+	return trmn.bqsbuilder(id)
+}
+
 // SetDelegate sets the market receiver
 func (trmn *TestRetrievalMarketNetwork) SetDelegate(r rmnet.RetrievalReceiver) error {
 	trmn.receiver = r
@@ -195,6 +305,11 @@ func (trmn *TestRetrievalMarketNetwork) ReceiveQueryStream(qs rmnet.RetrievalQue
 	trmn.receiver.HandleQueryStream(qs)
 }
 
+// ReceiveBatchQueryStream simulates receiving a batch query stream
+func (trmn *TestRetrievalMarketNetwork) ReceiveBatchQueryStream(qs rmnet.RetrievalBatchQueryStream) {
+	trmn.receiver.(rmnet.BatchQueryReceiver).HandleBatchQueryStream(qs)
+}
+
 // StopHandlingRequests sets receiver to nil
 func (trmn *TestRetrievalMarketNetwork) StopHandlingRequests() error {
 	trmn.receiver = nil
@@ -211,6 +326,7 @@ func (trmn *TestRetrievalMarketNetwork) AddAddrs(peer.ID, []ma.Multiaddr) {
 }
 
 var _ rmnet.RetrievalMarketNetwork = &TestRetrievalMarketNetwork{}
+var _ rmnet.BatchQueryNetwork = &TestRetrievalMarketNetwork{}
 
 // Some convenience builders
 
@@ -219,6 +335,12 @@ func FailNewQueryStream(peer.ID) (rmnet.RetrievalQueryStream, error) {
 	return nil, errors.New("new query stream failed")
 }
 
+// UnsupportedNewBatchQueryStream fails as if the peer doesn't support batch
+// queries
+func UnsupportedNewBatchQueryStream(peer.ID) (rmnet.RetrievalBatchQueryStream, error) {
+	return nil, rmnet.ErrBatchQueryNotSupported
+}
+
 // FailQueryReader always fails
 func FailQueryReader() (rm.Query, error) {
 	return rm.QueryUndefined, errors.New("read query failed")
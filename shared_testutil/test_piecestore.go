@@ -3,6 +3,7 @@ package shared_testutil
 import (
 	"context"
 	"errors"
+	"sync"
 	"testing"
 
 	"github.com/ipfs/go-cid"
@@ -24,6 +25,9 @@ type TestPieceStore struct {
 	cidInfosStubbed             map[cid.Cid]piecestore.CIDInfo
 	cidInfosExpected            map[cid.Cid]struct{}
 	cidInfosReceived            map[cid.Cid]struct{}
+
+	// lk guards the received maps, which are written by concurrent lookups
+	lk sync.Mutex
 }
 
 // TestPieceStoreParams sets parameters for a piece store
@@ -91,6 +95,8 @@ func (tps *TestPieceStore) ExpectMissingCID(c cid.Cid) {
 
 // VerifyExpectations verifies that the piecestore was queried in the expected ways
 func (tps *TestPieceStore) VerifyExpectations(t *testing.T) {
+	tps.lk.Lock()
+	defer tps.lk.Unlock()
 	require.Equal(t, tps.piecesExpected, tps.piecesReceived)
 	require.Equal(t, tps.cidInfosExpected, tps.cidInfosReceived)
 }
@@ -115,7 +121,9 @@ func (tps *TestPieceStore) GetPieceInfo(pieceCID cid.Cid) (piecestore.PieceInfo,
 		return piecestore.PieceInfoUndefined, tps.getPieceInfoError
 	}
 
+	tps.lk.Lock()
 	tps.piecesReceived[pieceCID] = struct{}{}
+	tps.lk.Unlock()
 
 	pio, ok := tps.piecesStubbed[pieceCID]
 	if ok {
@@ -130,7 +138,9 @@ func (tps *TestPieceStore) GetPieceInfo(pieceCID cid.Cid) (piecestore.PieceInfo,
 
 // GetCIDInfo returns cid info if it's been stubbed
 func (tps *TestPieceStore) GetCIDInfo(c cid.Cid) (piecestore.CIDInfo, error) {
+	tps.lk.Lock()
 	tps.cidInfosReceived[c] = struct{}{}
+	tps.lk.Unlock()
 
 	cio, ok := tps.cidInfosStubbed[c]
 	if ok {
@@ -8,8 +8,9 @@ import (
 	"github.com/hannahhoward/go-pubsub"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
 	logging "github.com/ipfs/go-log/v2"
-	cbg "github.com/whyrusleeping/cbor-gen"
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-address"
@@ -23,6 +24,7 @@ import (
 	"github.com/filecoin-project/go-state-types/exitcode"
 	"github.com/filecoin-project/go-statemachine/fsm"
 
+	"github.com/filecoin-project/go-fil-markets/dealarchive"
 	discoveryimpl "github.com/filecoin-project/go-fil-markets/discovery/impl"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/shared"
@@ -59,6 +61,10 @@ type Client struct {
 	migrateStateMachines func(context.Context) error
 	pollingInterval      time.Duration
 	maxTraversalLinks    uint64
+	clock                shared.Clock
+	archiveDeals         bool
+	archiveOpts          []dealarchive.Option
+	archiver             *dealarchive.Archiver
 
 	unsubDataTransfer datatransfer.Unsubscribe
 
@@ -76,6 +82,14 @@ func DealPollingInterval(t time.Duration) StorageClientOption {
 	}
 }
 
+// ClientClock sets the clock the client uses for deal timestamps and polling
+// timers
+func ClientClock(clock shared.Clock) StorageClientOption {
+	return func(c *Client) {
+		c.clock = clock
+	}
+}
+
 // MaxTraversalLinks sets the maximum number of links in a DAG to traverse when calculating CommP,
 // sets a budget that limits the depth and density of a DAG that can be traversed
 func MaxTraversalLinks(m uint64) StorageClientOption {
@@ -84,6 +98,17 @@ func MaxTraversalLinks(m uint64) StorageClientOption {
 	}
 }
 
+// ClientDealArchival moves the records of deals that have finished into an
+// archive once they have been finished for a while, so that the client's
+// state machines only hold live deals. GetLocalDeal still finds archived
+// deals, and the archive can be listed or exported with DealArchiver.
+func ClientDealArchival(opts ...dealarchive.Option) StorageClientOption {
+	return func(c *Client) {
+		c.archiveDeals = true
+		c.archiveOpts = opts
+	}
+}
+
 // NewClient creates a new storage client
 func NewClient(
 	net network.StorageMarketNetwork,
@@ -104,7 +129,10 @@ func NewClient(
 		pollingInterval:   DefaultPollingInterval,
 		maxTraversalLinks: DefaultMaxTraversalLinks,
 		bstores:           bstores,
+		clock:             shared.NewClock(),
 	}
+	// the clock option must be applied before the state machines are built
+	c.Configure(options...)
 	storageMigrations, err := migrations.ClientMigrations.Build()
 	if err != nil {
 		return nil, err
@@ -115,12 +143,18 @@ func NewClient(
 		c.dispatch,
 		storageMigrations,
 		versioning.VersionKey("1"),
+		c.clock,
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	c.Configure(options...)
+	if c.archiveDeals {
+		c.archiver = dealarchive.NewArchiver(namespace.Wrap(ds, datastore.NewKey("archive/1")), c.statemachines,
+			storagemarket.ClientDeal{}, func(deal interface{}) interface{} {
+				return deal.(storagemarket.ClientDeal).ProposalCid
+			}, append([]dealarchive.Option{dealarchive.ArchiverClock(c.clock)}, c.archiveOpts...)...)
+	}
 
 	// register a data transfer event handler -- this will send events to the state machines based on DT events
 	c.unsubDataTransfer = dataTransfer.SubscribeToEvents(dtutils.ClientDataTransferSubscriber(c.statemachines))
@@ -157,6 +191,9 @@ func (c *Client) OnReady(ready shared.ReadyFunc) {
 
 // Stop ends deal processing on a StorageClient
 func (c *Client) Stop() error {
+	if c.archiver != nil {
+		c.archiver.Stop()
+	}
 	c.unsubDataTransfer()
 	return c.statemachines.Stop(context.TODO())
 }
@@ -198,15 +235,26 @@ func (c *Client) ListLocalDeals(ctx context.Context) ([]storagemarket.ClientDeal
 	return out, nil
 }
 
-// GetLocalDeal lists deals that are in progress or rejected
+// GetLocalDeal lists deals that are in progress or rejected, looking in the
+// archive for deals that are no longer live
 func (c *Client) GetLocalDeal(ctx context.Context, cid cid.Cid) (storagemarket.ClientDeal, error) {
 	var out storagemarket.ClientDeal
-	if err := c.statemachines.Get(cid).Get(&out); err != nil {
+	err := c.statemachines.Get(cid).Get(&out)
+	if err != nil && c.archiver != nil && xerrors.Is(err, datastore.ErrNotFound) {
+		err = c.archiver.Get(cid, &out)
+	}
+	if err != nil {
 		return storagemarket.ClientDeal{}, err
 	}
 	return out, nil
 }
 
+// DealArchiver returns the archiver of the client's finished deals, or nil
+// if deal archival is not enabled
+func (c *Client) DealArchiver() *dealarchive.Archiver {
+	return c.archiver
+}
+
 // GetAsk queries a provider for its current storage ask
 //
 // The client creates a new `StorageAskStream` for the chosen peer ID,
@@ -339,9 +387,14 @@ func (c *Client) ProposeStorageDeal(ctx context.Context, params storagemarket.Pr
 		return nil, xerrors.Errorf("looking up addresses: %w", err)
 	}
 
-	bs, err := c.bstores.Get(params.Data.Root)
-	if err != nil {
-		return nil, xerrors.Errorf("failed to get blockstore for imported root %s: %w", params.Data.Root, err)
+	// The payload of a manual deal with a known piece CID, such as an
+	// aggregate of several pieces, doesn't need to be read
+	var bs bstore.Blockstore
+	if params.Data.TransferType != storagemarket.TTManual || params.Data.PieceCid == nil {
+		bs, err = c.bstores.Get(params.Data.Root)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to get blockstore for imported root %s: %w", params.Data.Root, err)
+		}
 	}
 
 	commP, pieceSize, err := clientutils.CommP(ctx, bs, params.Data, c.maxTraversalLinks)
@@ -399,7 +452,7 @@ func (c *Client) ProposeStorageDeal(ctx context.Context, params storagemarket.Pr
 		DataRef:            params.Data,
 		FastRetrieval:      params.FastRetrieval,
 		DealStages:         storagemarket.NewDealStages(),
-		CreationTime:       curTime(),
+		CreationTime:       shared.CborTime(c.clock),
 	}
 
 	err = c.statemachines.Begin(proposalNd.Cid(), deal)
@@ -421,11 +474,6 @@ func (c *Client) ProposeStorageDeal(ctx context.Context, params storagemarket.Pr
 		})
 }
 
-func curTime() cbg.CborTime {
-	now := time.Now()
-	return cbg.CborTime(time.Unix(0, now.UnixNano()).UTC())
-}
-
 // GetPaymentEscrow returns the current funds available for deal payment
 func (c *Client) GetPaymentEscrow(ctx context.Context, addr address.Address) (storagemarket.Balance, error) {
 	tok, _, err := c.node.GetChainHead(ctx)
@@ -491,6 +539,9 @@ func (c *Client) start(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("Migrating storage client state machines: %w", err)
 	}
+	if c.archiver != nil {
+		c.archiver.Start()
+	}
 	if err := c.restartDeals(ctx); err != nil {
 		return fmt.Errorf("Failed to restart deals: %w", err)
 	}
@@ -569,12 +620,12 @@ func (c *Client) addMultiaddrs(ctx context.Context, providerAddr address.Address
 	return nil
 }
 
-func newClientStateMachine(ds datastore.Batching, env fsm.Environment, notifier fsm.Notifier, storageMigrations versioning.VersionedMigrationList, target versioning.VersionKey) (fsm.Group, func(context.Context) error, error) {
+func newClientStateMachine(ds datastore.Batching, env fsm.Environment, notifier fsm.Notifier, storageMigrations versioning.VersionedMigrationList, target versioning.VersionKey, clock shared.Clock) (fsm.Group, func(context.Context) error, error) {
 	return versionedfsm.NewVersionedFSM(ds, fsm.Parameters{
 		Environment:     env,
 		StateType:       storagemarket.ClientDeal{},
 		StateKeyField:   "State",
-		Events:          clientstates.ClientEvents,
+		Events:          clientstates.NewClientEvents(clock),
 		StateEntryFuncs: clientstates.ClientStateEntryFuncs,
 		FinalityStates:  clientstates.ClientFinalityStates,
 		Notifier:        notifier,
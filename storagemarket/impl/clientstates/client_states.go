@@ -16,6 +16,7 @@ import (
 	"github.com/filecoin-project/go-state-types/exitcode"
 	"github.com/filecoin-project/go-statemachine/fsm"
 
+	"github.com/filecoin-project/go-fil-markets/shared"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/requestvalidation"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
@@ -39,6 +40,7 @@ type ClientDealEnvironment interface {
 	RestartDataTransfer(ctx context.Context, chid datatransfer.ChannelID) error
 	GetProviderDealState(ctx context.Context, proposalCid cid.Cid) (*storagemarket.ProviderDealState, error)
 	PollingInterval() time.Duration
+	Clock() shared.Clock
 	network.PeerTagger
 }
 
@@ -207,7 +209,7 @@ func CheckForDealAcceptance(ctx fsm.Context, environment ClientDealEnvironment,
 }
 
 func waitAgain(ctx fsm.Context, environment ClientDealEnvironment, pollError bool, providerState storagemarket.StorageDealStatus) error {
-	t := time.NewTimer(environment.PollingInterval())
+	t := environment.Clock().Timer(environment.PollingInterval())
 
 	go func() {
 		select {
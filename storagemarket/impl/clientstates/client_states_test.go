@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -21,6 +22,7 @@ import (
 	"github.com/filecoin-project/go-statemachine/fsm"
 	fsmtest "github.com/filecoin-project/go-statemachine/fsm/testutil"
 
+	"github.com/filecoin-project/go-fil-markets/shared"
 	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/clientstates"
@@ -632,6 +634,7 @@ func makeExecutor(ctx context.Context,
 			providerDealState:          envParams.providerDealState,
 			getDealStatusErr:           envParams.getDealStatusErr,
 			pollingInterval:            envParams.pollingInterval,
+			clock:                      shared.NewClock(),
 			peerTagger:                 tut.NewTestPeerTagger(),
 		}
 
@@ -724,6 +727,7 @@ type fakeEnvironment struct {
 	providerDealState *storagemarket.ProviderDealState
 	getDealStatusErr  error
 	pollingInterval   time.Duration
+	clock             shared.Clock
 	peerTagger        *tut.TestPeerTagger
 }
 
@@ -777,6 +781,10 @@ func (fe *fakeEnvironment) PollingInterval() time.Duration {
 	return fe.pollingInterval
 }
 
+func (fe *fakeEnvironment) Clock() shared.Clock {
+	return fe.clock
+}
+
 func (fe *fakeEnvironment) TagPeer(id peer.ID, ident string) {
 	fe.peerTagger.TagPeer(id, ident)
 }
@@ -819,6 +827,26 @@ func testResponseReader(t *testing.T, params responseParams) tut.StorageDealResp
 	})
 }
 
+func TestClientEventsClock(t *testing.T) {
+	ctx := context.Background()
+	clock := clock.NewMock()
+	clock.Add(time.Hour)
+	eventProcessor, err := fsm.NewEventProcessor(storagemarket.ClientDeal{}, "State", clientstates.NewClientEvents(clock))
+	assert.NoError(t, err)
+
+	fsmCtx := fsmtest.NewTestContext(ctx, eventProcessor)
+	assert.NoError(t, fsmCtx.Trigger(storagemarket.ClientEventFundingInitiated, tut.GenerateCids(1)[0]))
+	deal := &storagemarket.ClientDeal{State: storagemarket.StorageDealReserveClientFunds, DealStages: storagemarket.NewDealStages()}
+	fsmCtx.ReplayEvents(t, deal)
+
+	stage := deal.DealStages.GetStage(storagemarket.DealStates[storagemarket.StorageDealReserveClientFunds])
+	if !assert.NotNil(t, stage) {
+		return
+	}
+	assert.Equal(t, shared.CborTime(clock), stage.CreatedTime)
+	assert.Equal(t, shared.CborTime(clock), stage.Logs[0].UpdatedTime)
+}
+
 type testCase struct {
 	envParams   envParams
 	nodeParams  nodeParams
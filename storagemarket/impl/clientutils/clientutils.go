@@ -13,11 +13,11 @@ import (
 
 	"github.com/filecoin-project/go-address"
 	cborutil "github.com/filecoin-project/go-cbor-util"
-	"github.com/filecoin-project/go-commp-utils/writer"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/builtin/v8/market"
 	"github.com/filecoin-project/go-state-types/crypto"
 
+	"github.com/filecoin-project/go-fil-markets/commp"
 	"github.com/filecoin-project/go-fil-markets/shared"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
@@ -28,7 +28,9 @@ import (
 // We can't rely on the CARv1 payload in the given CARv2 file being deterministic as the client could have
 // written a "non-deterministic/unordered" CARv2 file.
 // So, we need to do a CARv1 traversal here by giving the traverser a random access CARv2 blockstore that wraps the given CARv2 file.
-func CommP(ctx context.Context, bs bstore.Blockstore, data *storagemarket.DataRef, maxTraversalLinks uint64) (cid.Cid, abi.UnpaddedPieceSize, error) {
+// The CARv1 payload is hashed in parallel, and the given options can be used
+// to observe progress of the computation.
+func CommP(ctx context.Context, bs bstore.Blockstore, data *storagemarket.DataRef, maxTraversalLinks uint64, opts ...commp.Option) (cid.Cid, abi.UnpaddedPieceSize, error) {
 	// if we already have the PieceCid, there's no need to do anything here.
 	if data.PieceCid != nil {
 		return *data.PieceCid, data.PieceSize, nil
@@ -58,18 +60,21 @@ func CommP(ctx context.Context, bs bstore.Blockstore, data *storagemarket.DataRe
 		return cid.Undef, 0, xerrors.Errorf("failed to prepare CAR: %w", err)
 	}
 
-	// write out the deterministic CARv1 payload to the CommP writer and calculate the CommP.
-	commpWriter := &writer.Writer{}
-	err = prepared.Dump(ctx, commpWriter)
+	// write out the deterministic CARv1 payload to the CommP calculator and calculate the CommP.
+	commpCalc, err := commp.NewCalc(opts...)
 	if err != nil {
-		return cid.Undef, 0, xerrors.Errorf("failed to write CARv1 to commP writer: %w", err)
+		return cid.Undef, 0, xerrors.Errorf("failed to create commP calculator: %w", err)
 	}
-	dataCIDSize, err := commpWriter.Sum()
+	err = prepared.Dump(ctx, commpCalc)
 	if err != nil {
-		return cid.Undef, 0, xerrors.Errorf("commpWriter.Sum failed: %w", err)
+		return cid.Undef, 0, xerrors.Errorf("failed to write CARv1 to commP calculator: %w", err)
+	}
+	res, err := commpCalc.Sum()
+	if err != nil {
+		return cid.Undef, 0, xerrors.Errorf("commpCalc.Sum failed: %w", err)
 	}
 
-	return dataCIDSize.PieceCID, dataCIDSize.PieceSize.Unpadded(), nil
+	return res.PieceCID, res.PieceSize.Unpadded(), nil
 }
 
 // VerifyFunc is a function that can validate a signature for a given address and bytes
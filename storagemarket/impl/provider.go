@@ -12,17 +12,14 @@ import (
 	"github.com/hashicorp/go-multierror"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-address"
 	cborutil "github.com/filecoin-project/go-cbor-util"
-	"github.com/filecoin-project/go-commp-utils/ffiwrapper"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 	versionedfsm "github.com/filecoin-project/go-ds-versioning/pkg/fsm"
-	commcid "github.com/filecoin-project/go-fil-commcid"
-	commp "github.com/filecoin-project/go-fil-commp-hashhash"
-	"github.com/filecoin-project/go-padreader"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/crypto"
 	"github.com/filecoin-project/go-state-types/exitcode"
@@ -30,6 +27,8 @@ import (
 	provider "github.com/filecoin-project/index-provider"
 	"github.com/filecoin-project/index-provider/metadata"
 
+	"github.com/filecoin-project/go-fil-markets/commp"
+	"github.com/filecoin-project/go-fil-markets/dealarchive"
 	"github.com/filecoin-project/go-fil-markets/filestore"
 	"github.com/filecoin-project/go-fil-markets/piecestore"
 	"github.com/filecoin-project/go-fil-markets/shared"
@@ -72,6 +71,7 @@ type Provider struct {
 	dataTransfer                datatransfer.Manager
 	customDealDeciderFunc       DealDeciderFunc
 	awaitTransferRestartTimeout time.Duration
+	clock                       shared.Clock
 	pubSub                      *pubsub.PubSub
 	readyMgr                    *shared.ReadyManager
 
@@ -83,6 +83,12 @@ type Provider struct {
 	dagStore      stores.DAGStoreWrapper
 	indexProvider provider.Interface
 	stores        *stores.ReadWriteBlockstores
+
+	archiveDeals bool
+	archiveOpts  []dealarchive.Option
+	archiver     *dealarchive.Archiver
+
+	commpCheckpoints *commp.CheckpointStore
 }
 
 // StorageProviderOption allows custom configuration of a storage provider
@@ -113,6 +119,26 @@ func AwaitTransferRestartTimeout(waitTime time.Duration) StorageProviderOption {
 	}
 }
 
+// ProviderClock sets the clock the provider uses for deal timestamps and
+// timeouts
+func ProviderClock(clock shared.Clock) StorageProviderOption {
+	return func(p *Provider) {
+		p.clock = clock
+	}
+}
+
+// ProviderDealArchival moves the records of deals that have finished into
+// an archive once they have been finished for a while, so that the
+// provider's state machines only hold live deals. GetLocalDeal still finds
+// archived deals, and the archive can be listed or exported with
+// DealArchiver.
+func ProviderDealArchival(opts ...dealarchive.Option) StorageProviderOption {
+	return func(p *Provider) {
+		p.archiveDeals = true
+		p.archiveOpts = opts
+	}
+}
+
 // NewProvider returns a new storage provider
 func NewProvider(net network.StorageMarketNetwork,
 	ds datastore.Batching,
@@ -142,7 +168,9 @@ func NewProvider(net network.StorageMarketNetwork,
 		dagStore:                    dagStore,
 		stores:                      stores.NewReadWriteBlockstores(),
 		awaitTransferRestartTimeout: defaultAwaitRestartTimeout,
+		clock:                       shared.NewClock(),
 		indexProvider:               indexer,
+		commpCheckpoints:            commp.NewCheckpointStore(namespace.Wrap(ds, datastore.NewKey("commp-checkpoints/1"))),
 	}
 	storageMigrations, err := migrations.ProviderMigrations.Build()
 	if err != nil {
@@ -159,6 +187,12 @@ func NewProvider(net network.StorageMarketNetwork,
 		return nil, err
 	}
 	h.Configure(options...)
+	if h.archiveDeals {
+		h.archiver = dealarchive.NewArchiver(namespace.Wrap(ds, datastore.NewKey("archive/2")), h.deals,
+			storagemarket.MinerDeal{}, func(deal interface{}) interface{} {
+				return deal.(storagemarket.MinerDeal).ProposalCid
+			}, append([]dealarchive.Option{dealarchive.ArchiverClock(h.clock)}, h.archiveOpts...)...)
+	}
 
 	// register a data transfer event handler -- this will send events to the state machines based on DT events
 	h.unsubDataTransfer = dataTransfer.SubscribeToEvents(dtutils.ProviderDataTransferSubscriber(h.deals))
@@ -200,7 +234,7 @@ func (p *Provider) Start(ctx context.Context) error {
 	go func() {
 		for {
 			select {
-			case <-time.After(time.Minute):
+			case <-p.clock.After(time.Minute):
 				if err := p.meshCreator.Connect(ctx); err != nil {
 					log.Errorf("failed to connect index provider host with the full node: %s", err)
 				}
@@ -271,8 +305,7 @@ func (p *Provider) receiveDeal(s network.StorageDealStream) error {
 	}
 
 	// Check if we are already tracking this deal
-	var md storagemarket.MinerDeal
-	if err := p.deals.Get(proposalNd.Cid()).Get(&md); err == nil {
+	if md, err := p.GetLocalDeal(proposalNd.Cid()); err == nil {
 		// We are already tracking this deal, for some reason it was re-proposed, perhaps because of a client restart
 		// this is ok, just send a response back.
 		return p.resendProposalResponse(s, &md)
@@ -304,7 +337,7 @@ func (p *Provider) receiveDeal(s network.StorageDealStream) error {
 		State:              storagemarket.StorageDealUnknown,
 		Ref:                proposal.Piece,
 		FastRetrieval:      proposal.FastRetrieval,
-		CreationTime:       curTime(),
+		CreationTime:       shared.CborTime(p.clock),
 		InboundCAR:         path,
 	}
 
@@ -321,6 +354,9 @@ func (p *Provider) receiveDeal(s network.StorageDealStream) error {
 
 // Stop terminates processing of deals on a StorageProvider
 func (p *Provider) Stop() error {
+	if p.archiver != nil {
+		p.archiver.Stop()
+	}
 	p.readyMgr.Stop()
 	p.unsubDataTransfer()
 	err := p.deals.Stop(context.TODO())
@@ -346,7 +382,13 @@ func (p *Provider) ImportDataForDeal(ctx context.Context, propCid cid.Cid, data
 	}
 	defer tempfi.Close()
 	cleanup := func() {
-		_ = tempfi.Close()
+		// the file is about to be deleted, so don't persist it first if the
+		// filestore can avoid it
+		if d, ok := tempfi.(filestore.Discarder); ok {
+			_ = d.Discard()
+		} else {
+			_ = tempfi.Close()
+		}
 		_ = p.fs.Delete(tempfi.Path())
 	}
 
@@ -368,55 +410,36 @@ func (p *Provider) ImportDataForDeal(ctx context.Context, propCid cid.Cid, data
 		return xerrors.Errorf("failed to seek through temp imported file: %w", err)
 	}
 
-	proofType, err := p.spn.GetProofType(ctx, p.actor, nil)
-	if err != nil {
-		cleanup()
-		return xerrors.Errorf("failed to determine proof type: %w", err)
-	}
-	log.Debugw("fetched proof type", "propCid", propCid)
-
-	pieceCid, err := generatePieceCommitment(proofType, tempfi, carSize)
+	// the data is copied to a new temp file on every import, so unlike the
+	// commP of transferred data this computation is not checkpointed
+	pieceCid, err := commp.GenerateCommpWithContext(ctx, tempfi, carSize, uint64(d.Proposal.PieceSize),
+		commp.WithProgress(func(processed uint64) {
+			log.Debugw("generating pieceCid for imported file", "propCid", propCid, "processed", processed, "total", carSize)
+		}))
 	if err != nil {
 		cleanup()
 		return xerrors.Errorf("failed to generate commP: %w", err)
 	}
 	log.Debugw("generated pieceCid for imported file", "propCid", propCid)
 
-	if carSizePadded := padreader.PaddedSize(carSize).Padded(); carSizePadded < d.Proposal.PieceSize {
-		// need to pad up!
-		rawPaddedCommp, err := commp.PadCommP(
-			// we know how long a pieceCid "hash" is, just blindly extract the trailing 32 bytes
-			pieceCid.Hash()[len(pieceCid.Hash())-32:],
-			uint64(carSizePadded),
-			uint64(d.Proposal.PieceSize),
-		)
-		if err != nil {
-			cleanup()
-			return err
-		}
-		pieceCid, _ = commcid.DataCommitmentV1ToCID(rawPaddedCommp)
-	}
-
 	// Verify CommP matches
 	if !pieceCid.Equals(d.Proposal.PieceCID) {
 		cleanup()
 		return xerrors.Errorf("given data does not match expected commP (got: %s, expected %s)", pieceCid, d.Proposal.PieceCID)
 	}
 
+	// Close the file before handing it off, so that filestores that persist
+	// files remotely have finished writing it by the time it is read again
+	if err := tempfi.Close(); err != nil {
+		cleanup()
+		return xerrors.Errorf("failed to close temp file for data import: %w", err)
+	}
+
 	log.Debugw("will fire ProviderEventVerifiedData for imported file", "propCid", propCid)
 
 	return p.deals.Send(propCid, storagemarket.ProviderEventVerifiedData, tempfi.Path(), filestore.Path(""))
 }
 
-func generatePieceCommitment(rt abi.RegisteredSealProof, rd io.Reader, pieceSize uint64) (cid.Cid, error) {
-	paddedReader, paddedSize := padreader.New(rd, pieceSize)
-	commitment, err := ffiwrapper.GeneratePieceCIDFromFile(rt, paddedReader, paddedSize)
-	if err != nil {
-		return cid.Undef, err
-	}
-	return commitment, nil
-}
-
 // GetAsk returns the storage miner's ask, or nil if one does not exist.
 func (p *Provider) GetAsk() *storagemarket.SignedStorageAsk {
 	return p.storedAsk.GetAsk()
@@ -480,12 +503,23 @@ func (p *Provider) ListLocalDeals() ([]storagemarket.MinerDeal, error) {
 	return out, nil
 }
 
+// GetLocalDeal returns a deal processed by this storage provider, looking
+// in the archive for deals that are no longer live
 func (p *Provider) GetLocalDeal(propCid cid.Cid) (storagemarket.MinerDeal, error) {
 	var d storagemarket.MinerDeal
 	err := p.deals.Get(propCid).Get(&d)
+	if err != nil && p.archiver != nil && xerrors.Is(err, datastore.ErrNotFound) {
+		err = p.archiver.Get(propCid, &d)
+	}
 	return d, err
 }
 
+// DealArchiver returns the archiver of the provider's finished deals, or
+// nil if deal archival is not enabled
+func (p *Provider) DealArchiver() *dealarchive.Archiver {
+	return p.archiver
+}
+
 func (p *Provider) ListLocalDealsPage(startPropCid *cid.Cid, offset int, limit int) ([]storagemarket.MinerDeal, error) {
 	if limit == 0 {
 		return []storagemarket.MinerDeal{}, nil
@@ -536,8 +570,8 @@ func (p *Provider) SetAsk(price abi.TokenAmount, verifiedPrice abi.TokenAmount,
 // AnnounceDealToIndexer informs indexer nodes that a new deal was received,
 // so they can download its index
 func (p *Provider) AnnounceDealToIndexer(ctx context.Context, proposalCid cid.Cid) error {
-	var deal storagemarket.MinerDeal
-	if err := p.deals.Get(proposalCid).Get(&deal); err != nil {
+	deal, err := p.GetLocalDeal(proposalCid)
+	if err != nil {
 		return xerrors.Errorf("failed getting deal %s: %w", proposalCid, err)
 	}
 
@@ -693,8 +727,8 @@ func (p *Provider) HandleDealStatusStream(s network.DealStatusStream) {
 
 func (p *Provider) processDealStatusRequest(ctx context.Context, request *network.DealStatusRequest) (*storagemarket.ProviderDealState, error) {
 	// fetch deal state
-	var md = storagemarket.MinerDeal{}
-	if err := p.deals.Get(request.Proposal).Get(&md); err != nil {
+	md, err := p.GetLocalDeal(request.Proposal)
+	if err != nil {
 		log.Errorf("proposal doesn't exist in state store: %s", err)
 		return nil, xerrors.Errorf("no such proposal")
 	}
@@ -786,6 +820,10 @@ func (p *Provider) start(ctx context.Context) (err error) {
 		return fmt.Errorf("failed to restart deals: %w", err)
 	}
 
+	if p.archiver != nil {
+		p.archiver.Start()
+	}
+
 	// register indexer provider callback now that everything has booted up.
 	p.indexProvider.RegisterMultihashLister(func(ctx context.Context, contextID []byte) (provider.MultihashIterator, error) {
 		proposalCid, err := cid.Cast(contextID)
@@ -793,8 +831,8 @@ func (p *Provider) start(ctx context.Context) (err error) {
 			return nil, fmt.Errorf("failed to cast context ID to a cid")
 		}
 
-		var deal storagemarket.MinerDeal
-		if err := p.deals.Get(proposalCid).Get(&deal); err != nil {
+		deal, err := p.GetLocalDeal(proposalCid)
+		if err != nil {
 			return nil, xerrors.Errorf("failed getting deal %s: %w", proposalCid, err)
 		}
 
@@ -139,10 +139,53 @@ func (p *providerDealEnvironment) GeneratePieceCommitment(proposalCid cid.Cid, c
 		return cid.Undef, "", fmt.Errorf("failed to get data reader over CAR file, proposalCid=%s, carPath=%s: %w", proposalCid, carPath, err)
 	}
 
-	pieceCID, err := commp.GenerateCommp(r, rd.Header.DataSize, uint64(dealSize))
+	ctx := context.TODO()
+	opts, resumed := p.commpCheckpointOptions(ctx, proposalCid, rd.Header.DataSize)
+	pieceCID, err := commp.GenerateCommp(r, rd.Header.DataSize, uint64(dealSize), opts...)
+	if err == nil || resumed {
+		// the computation is complete, or resuming it failed and the next
+		// attempt should start over
+		p.deleteCommpCheckpoint(ctx, proposalCid)
+	}
 	return pieceCID, "", err
 }
 
+// commpCheckpointOptions returns the options that resume the commP
+// computation for a deal from its last checkpoint, if there is one, and keep
+// checkpointing it so that it can be resumed if the provider restarts
+func (p *providerDealEnvironment) commpCheckpointOptions(ctx context.Context, proposalCid cid.Cid, dataSize uint64) ([]commp.Option, bool) {
+	cps := p.p.commpCheckpoints
+	if cps == nil {
+		return nil, false
+	}
+	key := proposalCid.String()
+
+	var opts []commp.Option
+	resumed := false
+	cp, err := cps.Get(ctx, key)
+	if err != nil {
+		log.Warnw("failed to load commP checkpoint", "proposalCid", proposalCid, "err", err)
+	} else if cp != nil && cp.Processed <= dataSize {
+		log.Infow("resuming commP computation", "proposalCid", proposalCid, "processed", cp.Processed, "total", dataSize)
+		opts = append(opts, commp.ResumeFrom(*cp))
+		resumed = true
+	}
+	opts = append(opts, commp.WithCheckpoint(func(cp commp.Checkpoint) {
+		if err := cps.Put(ctx, key, cp); err != nil {
+			log.Warnw("failed to save commP checkpoint", "proposalCid", proposalCid, "err", err)
+		}
+	}))
+	return opts, resumed
+}
+
+func (p *providerDealEnvironment) deleteCommpCheckpoint(ctx context.Context, proposalCid cid.Cid) {
+	if cps := p.p.commpCheckpoints; cps != nil {
+		if err := cps.Delete(ctx, proposalCid.String()); err != nil {
+			log.Warnw("failed to delete commP checkpoint", "proposalCid", proposalCid, "err", err)
+		}
+	}
+}
+
 func (p *providerDealEnvironment) FileStore() filestore.FileStore {
 	return p.p.fs
 }
@@ -195,7 +238,7 @@ func (p *providerDealEnvironment) UntagPeer(id peer.ID, s string) {
 }
 
 func (p *providerDealEnvironment) AwaitRestartTimeout() <-chan time.Time {
-	timer := time.NewTimer(p.p.awaitTransferRestartTimeout)
+	timer := p.p.clock.Timer(p.p.awaitTransferRestartTimeout)
 	return timer.C
 }
 
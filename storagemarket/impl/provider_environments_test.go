@@ -1,15 +1,21 @@
 package storageimpl
 
 import (
+	"context"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	carv2 "github.com/ipld/go-car/v2"
 	"github.com/stretchr/testify/require"
 
 	"github.com/filecoin-project/go-state-types/abi"
 
+	"github.com/filecoin-project/go-fil-markets/commp"
 	"github.com/filecoin-project/go-fil-markets/shared_testutil"
 )
 
@@ -35,15 +41,51 @@ func TestGeneratePieceCommitment(t *testing.T) {
 	require.NotEqual(t, commP2, commP3)
 
 	// fails when CARv2 file path isn't a valid one.
-	env := &providerDealEnvironment{}
+	env := &providerDealEnvironment{&Provider{}}
 	pieceCid, _, err := env.GeneratePieceCommitment(cid.Cid{}, "randpath", pieceSize)
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "no such file or directory")
 	require.Equal(t, cid.Undef, pieceCid)
 }
 
+func TestGeneratePieceCommitmentResumes(t *testing.T) {
+	ctx := context.Background()
+	pieceSize := abi.PaddedPieceSize(32768)
+	_, carV2File := shared_testutil.CreateDenseCARv2(t, filepath.Join(shared_testutil.ThisDir(t), "../fixtures/payload.txt"))
+	defer os.Remove(carV2File)
+	expected := genProviderCommP(t, carV2File, pieceSize)
+
+	// checkpoint the first part of the payload, as if the provider had
+	// restarted in the middle of computing commP
+	rd, err := carv2.OpenReader(carV2File)
+	require.NoError(t, err)
+	defer rd.Close() //nolint:errcheck
+	r, err := rd.DataReader()
+	require.NoError(t, err)
+	calc, err := commp.NewCalc(commp.WithChunkSize(127<<3), commp.WithParallelism(2))
+	require.NoError(t, err)
+	_, err = io.CopyN(calc, r, int64(rd.Header.DataSize/2))
+	require.NoError(t, err)
+	cp := calc.Checkpoint()
+	require.NotZero(t, cp.Processed)
+
+	proposalCid := shared_testutil.GenerateCids(1)[0]
+	cps := commp.NewCheckpointStore(dss.MutexWrap(datastore.NewMapDatastore()))
+	require.NoError(t, cps.Put(ctx, proposalCid.String(), cp))
+
+	env := &providerDealEnvironment{&Provider{commpCheckpoints: cps}}
+	pieceCid, _, err := env.GeneratePieceCommitment(proposalCid, carV2File, pieceSize)
+	require.NoError(t, err)
+	require.Equal(t, expected, pieceCid)
+
+	// the checkpoint is removed once commP is known
+	stored, err := cps.Get(ctx, proposalCid.String())
+	require.NoError(t, err)
+	require.Nil(t, stored)
+}
+
 func genProviderCommP(t *testing.T, carv2 string, pieceSize abi.PaddedPieceSize) cid.Cid {
-	env := &providerDealEnvironment{}
+	env := &providerDealEnvironment{&Provider{}}
 	pieceCid, _, err := env.GeneratePieceCommitment(cid.Cid{}, carv2, pieceSize)
 	require.NoError(t, err)
 	require.NotEqual(t, pieceCid, cid.Undef)
@@ -28,6 +28,23 @@ func RetryParameters(minDuration time.Duration, maxDuration time.Duration, attem
 	}
 }
 
+// RetryClock sets the clock used to wait between attempts to open a stream
+func RetryClock(clock shared.Clock) Option {
+	return func(impl *libp2pStorageMarketNetwork) {
+		impl.retryStream.SetOptions(shared.RetryStreamClock(clock))
+	}
+}
+
+// PeerHealthTracking sets the circuit breaker used to fail fast when opening
+// streams to unreachable peers. Pass the same tracker to the storage and
+// retrieval networks to share peer health between them, and to inspect it.
+// Without it, streams are opened without failing fast.
+func PeerHealthTracking(tracker *shared.PeerHealthTracker) Option {
+	return func(impl *libp2pStorageMarketNetwork) {
+		impl.retryStream.SetOptions(shared.PeerHealthTracking(tracker))
+	}
+}
+
 // SupportedAskProtocols sets what ask protocols this network instances listens on
 func SupportedAskProtocols(supportedProtocols []protocol.ID) Option {
 	return func(impl *libp2pStorageMarketNetwork) {
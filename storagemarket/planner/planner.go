@@ -0,0 +1,469 @@
+// Package planner picks storage providers for a piece of data and plans
+// the deals to store it with them.
+//
+// A Planner gathers the asks of the candidate providers concurrently, and
+// keeps those whose asks are current, accept the piece's size and are
+// priced within the client's limit. It ranks the candidates, by default by
+// price and then by an optional reputation score, and builds the
+// parameters of a deal with each of the best, up to the requested number
+// of replicas. The deal terms are the same for every provider: the start
+// epoch is a fixed delay after the chain head, and the provider collateral
+// is a margin above the minimum the chain allows for the piece, since the
+// minimum can rise before the provider publishes the deal.
+//
+// A plan can be inspected before it is executed. Executing a plan proposes
+// each of its deals, and when a proposal fails, proposes the same terms to
+// the next best candidate instead. Only failures to send a proposal are
+// handled this way: a provider accepts or rejects a deal after the proposal
+// is sent, so a deal that fails later is left to a replication.Manager,
+// which watches the client's deals and replaces those that fail.
+package planner
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/go-state-types/builtin/v8/market"
+
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+var log = logging.Logger("storagemarket-planner")
+
+// ErrNotEnoughProviders is returned when fewer providers can take a deal
+// than the replicas requested
+var ErrNotEnoughProviders = xerrors.New("not enough storage providers for the requested replicas")
+
+// DefaultStartDelay is how many epochs after the chain head deals start, by
+// default. It leaves providers time to receive the data and seal it.
+const DefaultStartDelay = abi.ChainEpoch(4 * builtin.EpochsInDay)
+
+// DefaultAskTimeout is how long to wait for each provider's ask, by default
+const DefaultAskTimeout = 30 * time.Second
+
+// DefaultConcurrency is how many asks are gathered at once, by default
+const DefaultConcurrency = 16
+
+// DefaultCollateralMargin is how many percent above the minimum provider
+// collateral deals offer, by default
+const DefaultCollateralMargin = 20
+
+// ScoreFunc returns a provider's reputation score; higher is better
+type ScoreFunc func(ctx context.Context, info storagemarket.StorageProviderInfo) float64
+
+// Candidate is a provider that can take a deal for the piece
+type Candidate struct {
+	Info storagemarket.StorageProviderInfo
+	Ask  storagemarket.StorageAsk
+	// Price is the ask's price per GiB per epoch for the kind of deal
+	// planned, verified or not
+	Price abi.TokenAmount
+	// EpochPrice is what the deal costs per epoch for the piece
+	EpochPrice abi.TokenAmount
+	// Score is the provider's reputation score, or zero if the planner has
+	// no ScoreFunc
+	Score float64
+}
+
+// Ranker sorts candidates in place so that the most preferred come first
+type Ranker func(candidates []Candidate)
+
+// RankByPrice ranks cheaper candidates first, and candidates with the same
+// price by score
+func RankByPrice(candidates []Candidate) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if !candidates[i].Price.Equals(candidates[j].Price) {
+			return candidates[i].Price.LessThan(candidates[j].Price)
+		}
+		return candidates[i].Score > candidates[j].Score
+	})
+}
+
+// RankByScore ranks candidates with a higher score first, and candidates
+// with the same score by price
+func RankByScore(candidates []Candidate) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Price.LessThan(candidates[j].Price)
+	})
+}
+
+// Option is a function that configures a Planner
+type Option func(p *Planner)
+
+// Score sets how providers are scored for ranking
+func Score(score ScoreFunc) Option {
+	return func(p *Planner) {
+		p.score = score
+	}
+}
+
+// Rank sets how candidates are ranked. The default is RankByPrice.
+func Rank(rank Ranker) Option {
+	return func(p *Planner) {
+		p.rank = rank
+	}
+}
+
+// AskTimeout sets how long to wait for each provider's ask
+func AskTimeout(timeout time.Duration) Option {
+	return func(p *Planner) {
+		p.askTimeout = timeout
+	}
+}
+
+// Concurrency sets how many asks are gathered at once
+func Concurrency(n int) Option {
+	return func(p *Planner) {
+		p.concurrency = n
+	}
+}
+
+// CollateralMargin sets how many percent above the minimum provider
+// collateral deals offer, up to the maximum the chain allows. Providers
+// reject deals whose collateral has fallen below the minimum by the time
+// they publish them.
+func CollateralMargin(percent uint64) Option {
+	return func(p *Planner) {
+		p.collateralMargin = percent
+	}
+}
+
+// Request describes the deals to plan
+type Request struct {
+	// Data is the data to store. Its PieceSize must be set, e.g. by
+	// computing its commP beforehand.
+	Data *storagemarket.DataRef
+	// Wallet pays for the deals
+	Wallet address.Address
+	// Replicas is the number of providers to make deals with
+	Replicas int
+	// MaxPrice is the most to pay per GiB per epoch. Nil means there is no
+	// limit.
+	MaxPrice abi.TokenAmount
+	// VerifiedDeal makes verified deals, paying the providers' verified
+	// price
+	VerifiedDeal bool
+	// FastRetrieval asks providers to keep an unsealed copy
+	FastRetrieval bool
+	// Duration is how many epochs the deals last. Zero means the minimum
+	// deal duration.
+	Duration abi.ChainEpoch
+	// StartDelay is how many epochs after the chain head the deals start.
+	// Zero means DefaultStartDelay.
+	StartDelay abi.ChainEpoch
+	// Providers optionally restricts the candidates to the given providers.
+	// When empty, every provider listed by the client is a candidate.
+	Providers []address.Address
+	// Exclude are providers that are never candidates, e.g. because they
+	// already store the data
+	Exclude []address.Address
+}
+
+// Plan is a set of deals to store a piece with several providers
+type Plan struct {
+	// Deals are the deals to propose, best provider first
+	Deals []storagemarket.ProposeStorageDealParams
+	// Candidates are all the providers that can take the deal, ranked
+	Candidates []Candidate
+	// Rejected holds the reason each provider that can't take the deal was
+	// left out
+	Rejected map[address.Address]error
+}
+
+// Proposal is the outcome of proposing one of the deals of a plan
+type Proposal struct {
+	Params      storagemarket.ProposeStorageDealParams
+	ProposalCid *storagemarket.ProposeStorageDealResult
+	// Failed are the providers the deal was proposed to before Params'
+	// provider, with the reason each proposal failed
+	Failed map[address.Address]error
+}
+
+// Planner plans and executes storage deals with the best providers
+type Planner struct {
+	client      storagemarket.StorageClient
+	node        storagemarket.StorageCommon
+	score       ScoreFunc
+	rank        Ranker
+	askTimeout  time.Duration
+	concurrency int
+	// collateralMargin is in percent of the minimum provider collateral
+	collateralMargin uint64
+}
+
+// NewPlanner returns a Planner that finds providers and makes deals with
+// the given client, and reads chain state with node
+func NewPlanner(client storagemarket.StorageClient, node storagemarket.StorageCommon, opts ...Option) *Planner {
+	p := &Planner{
+		client:           client,
+		node:             node,
+		rank:             RankByPrice,
+		askTimeout:       DefaultAskTimeout,
+		concurrency:      DefaultConcurrency,
+		collateralMargin: DefaultCollateralMargin,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Plan gathers the asks of the candidate providers and plans deals with
+// the best of them. If fewer providers can take the deal than the replicas
+// requested, the plan has a deal with each that can, and the error wraps
+// ErrNotEnoughProviders.
+func (p *Planner) Plan(ctx context.Context, req Request) (*Plan, error) {
+	if req.Data == nil || req.Data.PieceSize == 0 {
+		return nil, xerrors.New("the piece size of the data must be known to plan deals")
+	}
+	if req.Replicas <= 0 {
+		return nil, xerrors.Errorf("invalid number of replicas %d", req.Replicas)
+	}
+	pieceSize := req.Data.PieceSize.Padded()
+
+	_, head, err := p.node.GetChainHead(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("getting chain head: %w", err)
+	}
+	minCollateral, maxCollateral, err := p.node.DealProviderCollateralBounds(ctx, pieceSize, req.VerifiedDeal)
+	if err != nil {
+		return nil, xerrors.Errorf("computing deal provider collateral bounds: %w", err)
+	}
+	collateral := big.Add(minCollateral, big.Div(big.Mul(minCollateral, big.NewIntUnsigned(p.collateralMargin)), big.NewInt(100)))
+	if collateral.GreaterThan(maxCollateral) {
+		collateral = maxCollateral
+	}
+
+	infos, err := p.providers(ctx, req.Providers, req.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Rejected: make(map[address.Address]error)}
+	var lk sync.Mutex
+	throttle := make(chan struct{}, p.concurrency)
+	var wg sync.WaitGroup
+	for _, info := range infos {
+		wg.Add(1)
+		go func(info storagemarket.StorageProviderInfo) {
+			defer wg.Done()
+			select {
+			case throttle <- struct{}{}:
+				defer func() { <-throttle }()
+			case <-ctx.Done():
+				return
+			}
+			c, err := p.candidate(ctx, req, info, pieceSize, head)
+			lk.Lock()
+			defer lk.Unlock()
+			if err != nil {
+				plan.Rejected[info.Address] = err
+				return
+			}
+			plan.Candidates = append(plan.Candidates, c)
+		}(info)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// rank from a stable order, since the asks arrive in any order
+	sort.SliceStable(plan.Candidates, func(i, j int) bool {
+		return plan.Candidates[i].Info.Address.String() < plan.Candidates[j].Info.Address.String()
+	})
+	p.rank(plan.Candidates)
+
+	start := head + req.StartDelay
+	if req.StartDelay == 0 {
+		start = head + DefaultStartDelay
+	}
+	duration := req.Duration
+	if duration == 0 {
+		duration = market.DealMinDuration
+	}
+	for i := 0; i < len(plan.Candidates) && len(plan.Deals) < req.Replicas; i++ {
+		plan.Deals = append(plan.Deals, dealParams(req, plan.Candidates[i], start, start+duration, collateral))
+	}
+	if len(plan.Deals) < req.Replicas {
+		return plan, xerrors.Errorf("%w: %d of %d found", ErrNotEnoughProviders, len(plan.Deals), req.Replicas)
+	}
+	return plan, nil
+}
+
+// Execute proposes each deal of a plan. When proposing a deal to a
+// provider fails, the same terms are proposed to the next best candidate
+// that the plan has no deal with. The proposals made are returned, with an
+// error wrapping ErrNotEnoughProviders if some deals could not be made.
+//
+// Execute returns once the proposals are sent, and does not watch the
+// deals: a provider that rejects a deal, or fails it later, does so after
+// Execute has returned, and the deal is not replaced. Use a
+// replication.Manager to keep a number of deals healthy.
+func (p *Planner) Execute(ctx context.Context, plan *Plan) ([]Proposal, error) {
+	used := make(map[address.Address]struct{}, len(plan.Deals))
+	for _, d := range plan.Deals {
+		used[d.Info.Address] = struct{}{}
+	}
+	next := 0
+	nextCandidate := func() (Candidate, bool) {
+		for ; next < len(plan.Candidates); next++ {
+			c := plan.Candidates[next]
+			if _, ok := used[c.Info.Address]; !ok {
+				used[c.Info.Address] = struct{}{}
+				next++
+				return c, true
+			}
+		}
+		return Candidate{}, false
+	}
+
+	var proposals []Proposal
+	for _, params := range plan.Deals {
+		failed := make(map[address.Address]error)
+		for {
+			res, err := p.client.ProposeStorageDeal(ctx, params)
+			if err == nil {
+				proposals = append(proposals, Proposal{Params: params, ProposalCid: res, Failed: failed})
+				break
+			}
+			if ctx.Err() != nil {
+				return proposals, ctx.Err()
+			}
+			log.Warnw("proposing planned storage deal", "provider", params.Info.Address, "err", err)
+			failed[params.Info.Address] = err
+			c, ok := nextCandidate()
+			if !ok {
+				break
+			}
+			params = withCandidate(params, c)
+		}
+	}
+	if len(proposals) < len(plan.Deals) {
+		return proposals, xerrors.Errorf("%w: proposed %d of %d deals", ErrNotEnoughProviders, len(proposals), len(plan.Deals))
+	}
+	return proposals, nil
+}
+
+// providers returns the info of the given providers, or of every provider
+// if none are given, leaving out the excluded providers
+func (p *Planner) providers(ctx context.Context, only []address.Address, exclude []address.Address) ([]storagemarket.StorageProviderInfo, error) {
+	ch, err := p.client.ListProviders(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("listing storage providers: %w", err)
+	}
+	wanted := make(map[address.Address]struct{}, len(only))
+	for _, a := range only {
+		wanted[a] = struct{}{}
+	}
+	excluded := make(map[address.Address]struct{}, len(exclude))
+	for _, a := range exclude {
+		excluded[a] = struct{}{}
+	}
+	var infos []storagemarket.StorageProviderInfo
+	for info := range ch {
+		if _, ok := excluded[info.Address]; ok {
+			continue
+		}
+		if _, ok := wanted[info.Address]; len(only) == 0 || ok {
+			infos = append(infos, info)
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return infos, nil
+}
+
+// candidate fetches a provider's ask and checks that the provider can take
+// the deal
+func (p *Planner) candidate(ctx context.Context, req Request, info storagemarket.StorageProviderInfo, pieceSize abi.PaddedPieceSize, head abi.ChainEpoch) (Candidate, error) {
+	if uint64(pieceSize) > info.SectorSize {
+		return Candidate{}, xerrors.Errorf("piece size %d is greater than sector size %d", pieceSize, info.SectorSize)
+	}
+	askCtx, cancel := context.WithTimeout(ctx, p.askTimeout)
+	defer cancel()
+	ask, err := p.client.GetAsk(askCtx, info)
+	if err != nil {
+		return Candidate{}, xerrors.Errorf("getting ask: %w", err)
+	}
+	if ask.Expiry <= head {
+		return Candidate{}, xerrors.Errorf("ask expired at epoch %d", ask.Expiry)
+	}
+	if pieceSize < ask.MinPieceSize || pieceSize > ask.MaxPieceSize {
+		return Candidate{}, xerrors.Errorf("piece size %d is outside of ask bounds %d to %d", pieceSize, ask.MinPieceSize, ask.MaxPieceSize)
+	}
+	price := ask.Price
+	if req.VerifiedDeal {
+		price = ask.VerifiedPrice
+	}
+	if !req.MaxPrice.Nil() && price.GreaterThan(req.MaxPrice) {
+		return Candidate{}, xerrors.Errorf("price %s is over the maximum of %s", price, req.MaxPrice)
+	}
+	c := Candidate{
+		Info:       info,
+		Ask:        *ask,
+		Price:      price,
+		EpochPrice: big.Div(big.Mul(price, big.NewIntUnsigned(uint64(pieceSize))), big.NewInt(1<<30)),
+	}
+	if p.score != nil {
+		c.Score = p.score(ctx, info)
+	}
+	return c, nil
+}
+
+func dealParams(req Request, c Candidate, start, end abi.ChainEpoch, collateral abi.TokenAmount) storagemarket.ProposeStorageDealParams {
+	info := c.Info
+	return storagemarket.ProposeStorageDealParams{
+		Addr:          req.Wallet,
+		Info:          &info,
+		Data:          req.Data,
+		StartEpoch:    start,
+		EndEpoch:      end,
+		Price:         c.EpochPrice,
+		Collateral:    collateral,
+		Rt:            sealProof(info.SectorSize),
+		FastRetrieval: req.FastRetrieval,
+		VerifiedDeal:  req.VerifiedDeal,
+	}
+}
+
+// withCandidate returns the params of the same deal with another provider
+func withCandidate(params storagemarket.ProposeStorageDealParams, c Candidate) storagemarket.ProposeStorageDealParams {
+	info := c.Info
+	params.Info = &info
+	params.Price = c.EpochPrice
+	params.Rt = sealProof(info.SectorSize)
+	return params
+}
+
+// sealProofs are the seal proofs new sectors are sealed with
+var sealProofs = []abi.RegisteredSealProof{
+	abi.RegisteredSealProof_StackedDrg2KiBV1_1,
+	abi.RegisteredSealProof_StackedDrg8MiBV1_1,
+	abi.RegisteredSealProof_StackedDrg512MiBV1_1,
+	abi.RegisteredSealProof_StackedDrg32GiBV1_1,
+	abi.RegisteredSealProof_StackedDrg64GiBV1_1,
+}
+
+// sealProof returns the seal proof for sectors of the given size
+func sealProof(sectorSize uint64) abi.RegisteredSealProof {
+	for _, sp := range sealProofs {
+		if ss, err := sp.SectorSize(); err == nil && uint64(ss) == sectorSize {
+			return sp
+		}
+	}
+	return abi.RegisteredSealProof_StackedDrg32GiBV1_1
+}
@@ -0,0 +1,149 @@
+package planner_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin/v8/market"
+
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/planner"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/testnodes"
+)
+
+func TestPlanner(t *testing.T) {
+	ctx := context.Background()
+	const gib = 1 << 30
+	root := shared_testutil.GenerateCids(1)[0]
+	data := &storagemarket.DataRef{TransferType: storagemarket.TTGraphsync, Root: root, PieceSize: abi.PaddedPieceSize(gib).Unpadded()}
+
+	addrs := make([]address.Address, 6)
+	for i := range addrs {
+		addrs[i] = shared_testutil.NewIDAddr(t, uint64(1000+i))
+	}
+	ask := func(miner address.Address, price, verifiedPrice int64) *storagemarket.StorageAsk {
+		return &storagemarket.StorageAsk{
+			Price:         abi.NewTokenAmount(price),
+			VerifiedPrice: abi.NewTokenAmount(verifiedPrice),
+			MinPieceSize:  256,
+			MaxPieceSize:  32 * gib,
+			Miner:         miner,
+			Expiry:        200,
+		}
+	}
+	expired := ask(addrs[3], 1, 1)
+	expired.Expiry = 50
+	tooSmall := ask(addrs[4], 1, 1)
+	tooSmall.MaxPieceSize = gib / 2
+
+	newClient := func() *testnodes.FakeStorageClient {
+		fc := testnodes.NewFakeStorageClient()
+		fc.Asks = map[address.Address]*storagemarket.StorageAsk{
+			addrs[0]: ask(addrs[0], 30, 0),
+			addrs[1]: ask(addrs[1], 10, 5),
+			addrs[2]: ask(addrs[2], 20, 0),
+			addrs[3]: expired,
+			addrs[4]: tooSmall,
+			// addrs[5] has no ask
+		}
+		for _, a := range addrs {
+			fc.Providers = append(fc.Providers, storagemarket.StorageProviderInfo{Address: a, SectorSize: 32 * gib})
+		}
+		return fc
+	}
+	state := testnodes.NewStorageMarketState()
+	state.Epoch = 100
+	node := &testnodes.FakeCommonNode{SMState: state}
+
+	t.Run("plans deals with the cheapest providers", func(t *testing.T) {
+		p := planner.NewPlanner(newClient(), node)
+		plan, err := p.Plan(ctx, planner.Request{Data: data, Wallet: address.TestAddress, Replicas: 2})
+		require.NoError(t, err)
+		require.Len(t, plan.Candidates, 3)
+		require.Len(t, plan.Rejected, 3)
+		require.Len(t, plan.Deals, 2)
+
+		d := plan.Deals[0]
+		require.Equal(t, addrs[1], d.Info.Address)
+		require.Equal(t, addrs[2], plan.Deals[1].Info.Address)
+		require.Equal(t, abi.NewTokenAmount(10), d.Price)
+		require.Equal(t, abi.ChainEpoch(100)+planner.DefaultStartDelay, d.StartEpoch)
+		require.Equal(t, d.StartEpoch+market.DealMinDuration, d.EndEpoch)
+		// the minimum collateral plus the default margin
+		require.Equal(t, abi.NewTokenAmount(6000), d.Collateral)
+		require.Equal(t, abi.RegisteredSealProof_StackedDrg32GiBV1_1, d.Rt)
+		require.Equal(t, address.TestAddress, d.Addr)
+	})
+
+	t.Run("filters by max price and verified price", func(t *testing.T) {
+		p := planner.NewPlanner(newClient(), node)
+		plan, err := p.Plan(ctx, planner.Request{Data: data, Replicas: 3, MaxPrice: abi.NewTokenAmount(20)})
+		require.True(t, xerrors.Is(err, planner.ErrNotEnoughProviders))
+		require.Len(t, plan.Deals, 2)
+
+		plan, err = p.Plan(ctx, planner.Request{Data: data, Replicas: 2, VerifiedDeal: true, MaxPrice: abi.NewTokenAmount(0)})
+		require.NoError(t, err)
+		require.Equal(t, []address.Address{addrs[0], addrs[2]}, []address.Address{plan.Deals[0].Info.Address, plan.Deals[1].Info.Address})
+		require.True(t, plan.Deals[0].VerifiedDeal)
+	})
+
+	t.Run("offers a margin above the minimum collateral", func(t *testing.T) {
+		p := planner.NewPlanner(newClient(), node, planner.CollateralMargin(0))
+		plan, err := p.Plan(ctx, planner.Request{Data: data, Replicas: 1})
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(5000), plan.Deals[0].Collateral)
+
+		p = planner.NewPlanner(newClient(), node, planner.CollateralMargin(50))
+		plan, err = p.Plan(ctx, planner.Request{Data: data, Replicas: 1})
+		require.NoError(t, err)
+		require.Equal(t, abi.NewTokenAmount(7500), plan.Deals[0].Collateral)
+	})
+
+	t.Run("ranks by score", func(t *testing.T) {
+		score := func(ctx context.Context, info storagemarket.StorageProviderInfo) float64 {
+			if info.Address == addrs[0] {
+				return 1
+			}
+			return 0
+		}
+		p := planner.NewPlanner(newClient(), node, planner.Score(score), planner.Rank(planner.RankByScore))
+		plan, err := p.Plan(ctx, planner.Request{Data: data, Replicas: 2})
+		require.NoError(t, err)
+		require.Equal(t, addrs[0], plan.Deals[0].Info.Address)
+		require.Equal(t, addrs[1], plan.Deals[1].Info.Address)
+	})
+
+	t.Run("executes plans, falling back to the next candidate", func(t *testing.T) {
+		fc := newClient()
+		fc.Rejects[addrs[1]] = true
+		p := planner.NewPlanner(fc, node)
+		plan, err := p.Plan(ctx, planner.Request{Data: data, Replicas: 2})
+		require.NoError(t, err)
+
+		proposals, err := p.Execute(ctx, plan)
+		require.NoError(t, err)
+		require.Len(t, proposals, 2)
+		require.Equal(t, addrs[0], proposals[0].Params.Info.Address)
+		require.Contains(t, proposals[0].Failed, addrs[1])
+		require.Equal(t, abi.NewTokenAmount(30), proposals[0].Params.Price)
+		require.Equal(t, addrs[2], proposals[1].Params.Info.Address)
+		require.Equal(t, []address.Address{addrs[1], addrs[0], addrs[2]}, fc.Proposed())
+
+		fc.Rejects[addrs[0]] = true
+		_, err = p.Execute(ctx, plan)
+		require.True(t, xerrors.Is(err, planner.ErrNotEnoughProviders))
+	})
+
+	t.Run("requires the piece size", func(t *testing.T) {
+		p := planner.NewPlanner(newClient(), node)
+		_, err := p.Plan(ctx, planner.Request{Data: &storagemarket.DataRef{Root: cid.Undef}, Replicas: 1})
+		require.Error(t, err)
+	})
+}
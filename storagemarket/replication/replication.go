@@ -0,0 +1,489 @@
+// Package replication keeps a target number of healthy storage deals for
+// each of a client's payloads.
+//
+// A Manager records the payloads it is asked to replicate, and the deals
+// made for each of them. It watches the client's deal events, and when a
+// deal fails, is slashed or expires, it proposes a replacement deal to a
+// provider that does not already store the payload, using a
+// planner.Planner to pick the provider. Deals that are nearing the end of
+// their term stop counting as healthy, so that they are replaced before
+// they expire. Besides reacting to events, the Manager periodically checks
+// the state of every deal with the client, so that deals that changed
+// state while it was not running are caught up with.
+//
+// The Manager's records are persisted in their own namespace of the
+// datastore it is given, so that replication continues across restarts.
+package replication
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin"
+
+	"github.com/filecoin-project/go-fil-markets/shared"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/planner"
+)
+
+var log = logging.Logger("storagemarket-replication")
+
+// DefaultCheckInterval is how often the state of every deal is checked, by
+// default
+const DefaultCheckInterval = time.Hour
+
+// DefaultRenewWindow is how many epochs before a deal ends it is replaced,
+// by default
+const DefaultRenewWindow = abi.ChainEpoch(14 * builtin.EpochsInDay)
+
+// Option is a function that configures a Manager
+type Option func(m *Manager)
+
+// CheckInterval sets how often the state of every deal is checked
+func CheckInterval(interval time.Duration) Option {
+	return func(m *Manager) {
+		m.checkInterval = interval
+	}
+}
+
+// RenewWindow sets how many epochs before a deal ends it is replaced
+func RenewWindow(window abi.ChainEpoch) Option {
+	return func(m *Manager) {
+		m.renewWindow = window
+	}
+}
+
+// ManagerClock sets the clock the manager schedules checks with
+func ManagerClock(clock shared.Clock) Option {
+	return func(m *Manager) {
+		m.clock = clock
+	}
+}
+
+// Request describes a payload to replicate
+type Request struct {
+	// Data is the data to store. Its PieceSize must be set.
+	Data *storagemarket.DataRef
+	// Replicas is the number of healthy deals to keep
+	Replicas uint64
+	// Wallet pays for the deals
+	Wallet address.Address
+	// MaxPrice is the most to pay per GiB per epoch. Nil means there is no
+	// limit.
+	MaxPrice      abi.TokenAmount
+	VerifiedDeal  bool
+	FastRetrieval bool
+	// Duration is how many epochs each deal lasts. Zero means the minimum
+	// deal duration.
+	Duration abi.ChainEpoch
+}
+
+// Manager keeps payloads replicated with several storage providers
+type Manager struct {
+	ds            datastore.Batching
+	client        storagemarket.StorageClient
+	node          storagemarket.StorageCommon
+	planner       *planner.Planner
+	clock         shared.Clock
+	checkInterval time.Duration
+	renewWindow   abi.ChainEpoch
+
+	// lk guards the records in the datastore
+	lk sync.Mutex
+	// reconcileLk ensures only one payload is reconciled at a time
+	reconcileLk sync.Mutex
+
+	pendingLk sync.Mutex
+	pending   map[cid.Cid]struct{}
+	wake      chan struct{}
+
+	unsubscribe shared.Unsubscribe
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// NewManager returns a Manager that makes deals with client, picking
+// providers with p, and persists its records to a namespace of ds
+func NewManager(ds datastore.Batching, client storagemarket.StorageClient, node storagemarket.StorageCommon, p *planner.Planner, opts ...Option) *Manager {
+	m := &Manager{
+		ds:            namespace.Wrap(ds, datastore.NewKey("replication/1")),
+		client:        client,
+		node:          node,
+		planner:       p,
+		clock:         shared.NewClock(),
+		checkInterval: DefaultCheckInterval,
+		renewWindow:   DefaultRenewWindow,
+		pending:       make(map[cid.Cid]struct{}),
+		wake:          make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Start watches the client's deals and replaces those that fail, until
+// Stop is called
+func (m *Manager) Start() {
+	m.unsubscribe = m.client.SubscribeToEvents(m.onEvent)
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.run(m.stop, m.done)
+}
+
+// Stop stops watching the client's deals
+func (m *Manager) Stop() {
+	if m.stop == nil {
+		return
+	}
+	m.unsubscribe()
+	close(m.stop)
+	<-m.done
+	m.stop = nil
+}
+
+// Replicate starts keeping a payload replicated, or updates the terms of a
+// payload already being replicated, and proposes the deals it is missing
+func (m *Manager) Replicate(ctx context.Context, req Request) error {
+	if req.Data == nil {
+		return xerrors.New("no data to replicate")
+	}
+	root := req.Data.Root
+
+	m.lk.Lock()
+	p, err := m.load(ctx, root)
+	if err != nil && !xerrors.Is(err, datastore.ErrNotFound) {
+		m.lk.Unlock()
+		return err
+	}
+	if p == nil {
+		p = &Payload{}
+	}
+	p.Data = req.Data
+	p.Target = req.Replicas
+	p.Wallet = req.Wallet
+	p.MaxPrice = req.MaxPrice
+	p.AnyPrice = req.MaxPrice.Nil()
+	if p.AnyPrice {
+		p.MaxPrice = abi.NewTokenAmount(0)
+	}
+	p.VerifiedDeal = req.VerifiedDeal
+	p.FastRetrieval = req.FastRetrieval
+	p.Duration = req.Duration
+	err = m.save(ctx, root, p)
+	m.lk.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return m.Reconcile(ctx, root)
+}
+
+// Remove stops replicating a payload. The deals already made are left as
+// they are.
+func (m *Manager) Remove(ctx context.Context, root cid.Cid) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.ds.Delete(ctx, payloadKey(root))
+}
+
+// Get returns the record of a payload being replicated
+func (m *Manager) Get(ctx context.Context, root cid.Cid) (Payload, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	p, err := m.load(ctx, root)
+	if err != nil {
+		return Payload{}, err
+	}
+	return *p, nil
+}
+
+// List returns the records of every payload being replicated
+func (m *Manager) List(ctx context.Context) ([]Payload, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	res, err := m.ds.Query(ctx, query.Query{})
+	if err != nil {
+		return nil, xerrors.Errorf("listing replicated payloads: %w", err)
+	}
+	defer res.Close() //nolint:errcheck
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, xerrors.Errorf("listing replicated payloads: %w", err)
+	}
+	payloads := make([]Payload, 0, len(entries))
+	for _, e := range entries {
+		var p Payload
+		if err := p.UnmarshalCBOR(bytes.NewReader(e.Value)); err != nil {
+			return nil, xerrors.Errorf("decoding replicated payload %s: %w", e.Key, err)
+		}
+		payloads = append(payloads, p)
+	}
+	return payloads, nil
+}
+
+// Reconcile proposes deals for a payload until it has its target number of
+// healthy replicas. A replica is healthy if its deal has not failed and
+// does not end within the renew window. Replacement deals are only
+// proposed to providers that have no healthy or failed replica of the
+// payload.
+func (m *Manager) Reconcile(ctx context.Context, root cid.Cid) error {
+	m.reconcileLk.Lock()
+	defer m.reconcileLk.Unlock()
+
+	_, head, err := m.node.GetChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("getting chain head: %w", err)
+	}
+
+	m.lk.Lock()
+	p, err := m.load(ctx, root)
+	m.lk.Unlock()
+	if err != nil {
+		return err
+	}
+	healthy, exclude := m.assess(p, head)
+	if healthy >= p.Target {
+		return nil
+	}
+
+	maxPrice := p.MaxPrice
+	if p.AnyPrice {
+		maxPrice = abi.TokenAmount{}
+	}
+	plan, planErr := m.planner.Plan(ctx, planner.Request{
+		Data:          p.Data,
+		Wallet:        p.Wallet,
+		Replicas:      int(p.Target - healthy),
+		MaxPrice:      maxPrice,
+		VerifiedDeal:  p.VerifiedDeal,
+		FastRetrieval: p.FastRetrieval,
+		Duration:      p.Duration,
+		Exclude:       exclude,
+	})
+	if planErr != nil && (plan == nil || len(plan.Deals) == 0) {
+		return xerrors.Errorf("planning deals for %s: %w", root, planErr)
+	}
+	proposals, execErr := m.planner.Execute(ctx, plan)
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	p, err = m.load(ctx, root)
+	if err != nil {
+		return err
+	}
+	for _, prop := range proposals {
+		p.Replicas = append(p.Replicas, Replica{
+			ProposalCid: prop.ProposalCid.ProposalCid,
+			Provider:    prop.Params.Info.Address,
+			EndEpoch:    prop.Params.EndEpoch,
+			State:       ReplicaPending,
+		})
+	}
+	if err := m.save(ctx, root, p); err != nil {
+		return err
+	}
+
+	var merr error
+	if planErr != nil {
+		merr = multierror.Append(merr, xerrors.Errorf("planning deals for %s: %w", root, planErr))
+	}
+	if execErr != nil {
+		merr = multierror.Append(merr, xerrors.Errorf("proposing deals for %s: %w", root, execErr))
+	}
+	return merr
+}
+
+// Check refreshes the state of every replica from the client's deals, and
+// reconciles every payload
+func (m *Manager) Check(ctx context.Context) error {
+	payloads, err := m.List(ctx)
+	if err != nil {
+		return err
+	}
+	var merr error
+	for _, p := range payloads {
+		for _, r := range p.Replicas {
+			if r.State == ReplicaFailed {
+				continue
+			}
+			deal, err := m.client.GetLocalDeal(ctx, r.ProposalCid)
+			if err != nil {
+				log.Warnw("getting replica deal", "proposalCid", r.ProposalCid, "err", err)
+				continue
+			}
+			m.update(ctx, deal)
+		}
+		if err := m.Reconcile(ctx, p.Data.Root); err != nil {
+			merr = multierror.Append(merr, err)
+		}
+	}
+	return merr
+}
+
+func (m *Manager) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	var tick <-chan time.Time
+	if m.checkInterval > 0 {
+		ticker := m.clock.Ticker(m.checkInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick:
+			if err := m.Check(ctx); err != nil {
+				log.Errorf("checking replicated payloads: %s", err)
+			}
+		case <-m.wake:
+			m.pendingLk.Lock()
+			roots := m.pending
+			m.pending = make(map[cid.Cid]struct{})
+			m.pendingLk.Unlock()
+			for root := range roots {
+				if err := m.Reconcile(ctx, root); err != nil {
+					log.Errorf("replacing failed replicas: %s", err)
+				}
+			}
+		}
+	}
+}
+
+// onEvent updates the replica a deal is for, and schedules its payload to
+// be reconciled if the deal failed. The client calls subscribers from its
+// event loop, so it must not block on proposing deals.
+func (m *Manager) onEvent(_ storagemarket.ClientEvent, deal storagemarket.ClientDeal) {
+	if m.update(context.TODO(), deal) != ReplicaFailed {
+		return
+	}
+	m.pendingLk.Lock()
+	m.pending[deal.DataRef.Root] = struct{}{}
+	m.pendingLk.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// update records the state of the replica a deal is for, returning the
+// state the replica changed to, or ReplicaPending if it did not change
+func (m *Manager) update(ctx context.Context, deal storagemarket.ClientDeal) ReplicaState {
+	state, ok := replicaState(deal.State)
+	if !ok || deal.DataRef == nil {
+		return ReplicaPending
+	}
+	root := deal.DataRef.Root
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	p, err := m.load(ctx, root)
+	if err != nil {
+		if !xerrors.Is(err, datastore.ErrNotFound) {
+			log.Warnw("loading replicated payload", "root", root, "err", err)
+		}
+		return ReplicaPending
+	}
+	for i, r := range p.Replicas {
+		if r.ProposalCid != deal.ProposalCid {
+			continue
+		}
+		if r.State == state || r.State == ReplicaFailed {
+			return ReplicaPending
+		}
+		p.Replicas[i].State = state
+		if state == ReplicaFailed {
+			p.Replicas[i].Message = storagemarket.DealStates[deal.State] + ": " + deal.Message
+			log.Infow("replica failed", "root", root, "provider", r.Provider, "state", storagemarket.DealStates[deal.State], "message", deal.Message)
+		}
+		if err := m.save(ctx, root, p); err != nil {
+			log.Errorw("saving replicated payload", "root", root, "err", err)
+			return ReplicaPending
+		}
+		return state
+	}
+	return ReplicaPending
+}
+
+// assess returns the number of healthy replicas of a payload, and the
+// providers that should not be given another replica
+func (m *Manager) assess(p *Payload, head abi.ChainEpoch) (uint64, []address.Address) {
+	var healthy uint64
+	var exclude []address.Address
+	for _, r := range p.Replicas {
+		switch {
+		case r.State == ReplicaFailed:
+			exclude = append(exclude, r.Provider)
+		case r.EndEpoch > head+m.renewWindow:
+			healthy++
+			exclude = append(exclude, r.Provider)
+		}
+	}
+	return healthy, exclude
+}
+
+func (m *Manager) load(ctx context.Context, root cid.Cid) (*Payload, error) {
+	data, err := m.ds.Get(ctx, payloadKey(root))
+	if err != nil {
+		return nil, xerrors.Errorf("loading replicated payload %s: %w", root, err)
+	}
+	var p Payload
+	if err := p.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+		return nil, xerrors.Errorf("decoding replicated payload %s: %w", root, err)
+	}
+	return &p, nil
+}
+
+func (m *Manager) save(ctx context.Context, root cid.Cid, p *Payload) error {
+	data, err := cborutil.Dump(p)
+	if err != nil {
+		return xerrors.Errorf("encoding replicated payload %s: %w", root, err)
+	}
+	if err := m.ds.Put(ctx, payloadKey(root), data); err != nil {
+		return xerrors.Errorf("saving replicated payload %s: %w", root, err)
+	}
+	return nil
+}
+
+// replicaState returns the replica state for a deal status, if the status
+// is one that changes it
+func replicaState(status storagemarket.StorageDealStatus) (ReplicaState, bool) {
+	switch status {
+	case storagemarket.StorageDealActive:
+		return ReplicaActive, true
+	case storagemarket.StorageDealError,
+		storagemarket.StorageDealFailing,
+		storagemarket.StorageDealProposalRejected,
+		storagemarket.StorageDealProposalNotFound,
+		storagemarket.StorageDealSlashed,
+		storagemarket.StorageDealExpired:
+		return ReplicaFailed, true
+	}
+	return ReplicaPending, false
+}
+
+func payloadKey(root cid.Cid) datastore.Key {
+	return datastore.NewKey(root.String())
+}
@@ -0,0 +1,104 @@
+package replication_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/planner"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/replication"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/testnodes"
+)
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	const gib = 1 << 30
+	root := shared_testutil.GenerateCids(1)[0]
+	data := &storagemarket.DataRef{TransferType: storagemarket.TTGraphsync, Root: root, PieceSize: abi.PaddedPieceSize(gib).Unpadded()}
+
+	addrs := make([]address.Address, 4)
+	fc := testnodes.NewFakeStorageClient()
+	for i := range addrs {
+		addrs[i] = shared_testutil.NewIDAddr(t, uint64(1000+i))
+		fc.Providers = append(fc.Providers, storagemarket.StorageProviderInfo{Address: addrs[i], SectorSize: 32 * gib})
+		fc.Asks[addrs[i]] = &storagemarket.StorageAsk{
+			Price:         abi.NewTokenAmount(int64(10 * (i + 1))),
+			VerifiedPrice: abi.NewTokenAmount(0),
+			MinPieceSize:  256,
+			MaxPieceSize:  32 * gib,
+			Miner:         addrs[i],
+			Expiry:        1 << 20,
+		}
+	}
+	state := testnodes.NewStorageMarketState()
+	state.Epoch = 100
+	node := &testnodes.FakeCommonNode{SMState: state}
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	newManager := func() *replication.Manager {
+		return replication.NewManager(ds, fc, node, planner.NewPlanner(fc, node), replication.ManagerClock(clock.NewMock()))
+	}
+
+	m := newManager()
+	m.Start()
+	err := m.Replicate(ctx, replication.Request{Data: data, Replicas: 2, Wallet: address.TestAddress})
+	require.NoError(t, err)
+	require.Equal(t, []address.Address{addrs[0], addrs[1]}, fc.Proposed())
+
+	p, err := m.Get(ctx, root)
+	require.NoError(t, err)
+	require.Len(t, p.Replicas, 2)
+	first, second := p.Replicas[0], p.Replicas[1]
+	require.Equal(t, replication.ReplicaPending, first.State)
+
+	// replicating again proposes nothing while both replicas are healthy
+	err = m.Replicate(ctx, replication.Request{Data: data, Replicas: 2, Wallet: address.TestAddress})
+	require.NoError(t, err)
+	require.Len(t, fc.Proposed(), 2)
+
+	// a slashed deal is replaced with a provider that has no replica
+	fc.EmitDealState(data, first.ProposalCid, storagemarket.StorageDealActive)
+	state.Epoch = 1000
+	fc.EmitDealState(data, second.ProposalCid, storagemarket.StorageDealSlashed)
+	require.Eventually(t, func() bool {
+		return len(fc.Proposed()) == 3
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, addrs[2], fc.Proposed()[2])
+
+	require.Eventually(t, func() bool {
+		p, err = m.Get(ctx, root)
+		return err == nil && len(p.Replicas) == 3
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, replication.ReplicaActive, p.Replicas[0].State)
+	require.Equal(t, replication.ReplicaFailed, p.Replicas[1].State)
+	require.Contains(t, p.Replicas[1].Message, "StorageDealSlashed")
+	require.Equal(t, replication.ReplicaPending, p.Replicas[2].State)
+	m.Stop()
+
+	// a deal nearing expiry is renewed, and the manager's records survive a
+	// restart
+	m = newManager()
+	state.Epoch = first.EndEpoch - replication.DefaultRenewWindow
+	require.NoError(t, m.Check(ctx))
+	require.Equal(t, []address.Address{addrs[0], addrs[1], addrs[2], addrs[0]}, fc.Proposed())
+
+	payloads, err := m.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, payloads, 1)
+	require.Len(t, payloads[0].Replicas, 4)
+	require.Equal(t, replication.ReplicaActive, payloads[0].Replicas[0].State)
+
+	require.NoError(t, m.Remove(ctx, root))
+	payloads, err = m.List(ctx)
+	require.NoError(t, err)
+	require.Empty(t, payloads)
+}
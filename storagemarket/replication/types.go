@@ -0,0 +1,63 @@
+package replication
+
+import (
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+//go:generate cbor-gen-for --map-encoding Payload Replica
+
+// ReplicaState is the state of a replica of a payload
+type ReplicaState uint64
+
+const (
+	// ReplicaPending means the deal for the replica was proposed and has
+	// not become active yet
+	ReplicaPending ReplicaState = iota
+
+	// ReplicaActive means the deal for the replica is active on chain
+	ReplicaActive
+
+	// ReplicaFailed means the deal for the replica failed, was slashed or
+	// expired
+	ReplicaFailed
+)
+
+// ReplicaStates maps replica states to their names
+var ReplicaStates = map[ReplicaState]string{
+	ReplicaPending: "ReplicaPending",
+	ReplicaActive:  "ReplicaActive",
+	ReplicaFailed:  "ReplicaFailed",
+}
+
+// Replica is a deal storing a copy of a payload with a provider
+type Replica struct {
+	ProposalCid cid.Cid
+	Provider    address.Address
+	EndEpoch    abi.ChainEpoch
+	State       ReplicaState
+	// Message is why the deal failed, if it did
+	Message string
+}
+
+// Payload is the persisted record of a payload the manager keeps
+// replicated
+type Payload struct {
+	Data *storagemarket.DataRef
+	// Target is the number of healthy replicas to keep
+	Target   uint64
+	Wallet   address.Address
+	MaxPrice abi.TokenAmount
+	// AnyPrice is set when there is no max price
+	AnyPrice      bool
+	VerifiedDeal  bool
+	FastRetrieval bool
+	Duration      abi.ChainEpoch
+	// Replicas are every deal made for the payload, including those that
+	// failed
+	Replicas []Replica
+}
@@ -0,0 +1,635 @@
+// Code generated by github.com/whyrusleeping/cbor-gen. DO NOT EDIT.
+
+package replication
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	storagemarket "github.com/filecoin-project/go-fil-markets/storagemarket"
+	abi "github.com/filecoin-project/go-state-types/abi"
+	cid "github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	xerrors "golang.org/x/xerrors"
+)
+
+var _ = xerrors.Errorf
+var _ = cid.Undef
+var _ = math.E
+var _ = sort.Sort
+
+func (t *Payload) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write([]byte{169}); err != nil {
+		return err
+	}
+
+	// t.Data (storagemarket.DataRef) (struct)
+	if len("Data") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Data\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Data"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Data")); err != nil {
+		return err
+	}
+
+	if err := t.Data.MarshalCBOR(cw); err != nil {
+		return err
+	}
+
+	// t.Target (uint64) (uint64)
+	if len("Target") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Target\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Target"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Target")); err != nil {
+		return err
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Target)); err != nil {
+		return err
+	}
+
+	// t.Wallet (address.Address) (struct)
+	if len("Wallet") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Wallet\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Wallet"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Wallet")); err != nil {
+		return err
+	}
+
+	if err := t.Wallet.MarshalCBOR(cw); err != nil {
+		return err
+	}
+
+	// t.MaxPrice (big.Int) (struct)
+	if len("MaxPrice") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"MaxPrice\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("MaxPrice"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("MaxPrice")); err != nil {
+		return err
+	}
+
+	if err := t.MaxPrice.MarshalCBOR(cw); err != nil {
+		return err
+	}
+
+	// t.AnyPrice (bool) (bool)
+	if len("AnyPrice") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"AnyPrice\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("AnyPrice"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("AnyPrice")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteBool(w, t.AnyPrice); err != nil {
+		return err
+	}
+
+	// t.VerifiedDeal (bool) (bool)
+	if len("VerifiedDeal") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"VerifiedDeal\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("VerifiedDeal"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("VerifiedDeal")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteBool(w, t.VerifiedDeal); err != nil {
+		return err
+	}
+
+	// t.FastRetrieval (bool) (bool)
+	if len("FastRetrieval") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"FastRetrieval\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("FastRetrieval"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("FastRetrieval")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteBool(w, t.FastRetrieval); err != nil {
+		return err
+	}
+
+	// t.Duration (abi.ChainEpoch) (int64)
+	if len("Duration") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Duration\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Duration"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Duration")); err != nil {
+		return err
+	}
+
+	if t.Duration >= 0 {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Duration)); err != nil {
+			return err
+		}
+	} else {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-t.Duration-1)); err != nil {
+			return err
+		}
+	}
+
+	// t.Replicas ([]replication.Replica) (slice)
+	if len("Replicas") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Replicas\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Replicas"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Replicas")); err != nil {
+		return err
+	}
+
+	if len(t.Replicas) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.Replicas was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajArray, uint64(len(t.Replicas))); err != nil {
+		return err
+	}
+	for _, v := range t.Replicas {
+		if err := v.MarshalCBOR(cw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Payload) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = Payload{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("Payload: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadString(cr)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Data (storagemarket.DataRef) (struct)
+		case "Data":
+
+			{
+
+				b, err := cr.ReadByte()
+				if err != nil {
+					return err
+				}
+				if b != cbg.CborNull[0] {
+					if err := cr.UnreadByte(); err != nil {
+						return err
+					}
+					t.Data = new(storagemarket.DataRef)
+					if err := t.Data.UnmarshalCBOR(cr); err != nil {
+						return xerrors.Errorf("unmarshaling t.Data pointer: %w", err)
+					}
+				}
+
+			}
+			// t.Target (uint64) (uint64)
+		case "Target":
+
+			{
+
+				maj, extra, err = cr.ReadHeader()
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.Target = uint64(extra)
+
+			}
+			// t.Wallet (address.Address) (struct)
+		case "Wallet":
+
+			{
+
+				if err := t.Wallet.UnmarshalCBOR(cr); err != nil {
+					return xerrors.Errorf("unmarshaling t.Wallet: %w", err)
+				}
+
+			}
+			// t.MaxPrice (big.Int) (struct)
+		case "MaxPrice":
+
+			{
+
+				if err := t.MaxPrice.UnmarshalCBOR(cr); err != nil {
+					return xerrors.Errorf("unmarshaling t.MaxPrice: %w", err)
+				}
+
+			}
+			// t.AnyPrice (bool) (bool)
+		case "AnyPrice":
+
+			maj, extra, err = cr.ReadHeader()
+			if err != nil {
+				return err
+			}
+			if maj != cbg.MajOther {
+				return fmt.Errorf("booleans must be major type 7")
+			}
+			switch extra {
+			case 20:
+				t.AnyPrice = false
+			case 21:
+				t.AnyPrice = true
+			default:
+				return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+			}
+			// t.VerifiedDeal (bool) (bool)
+		case "VerifiedDeal":
+
+			maj, extra, err = cr.ReadHeader()
+			if err != nil {
+				return err
+			}
+			if maj != cbg.MajOther {
+				return fmt.Errorf("booleans must be major type 7")
+			}
+			switch extra {
+			case 20:
+				t.VerifiedDeal = false
+			case 21:
+				t.VerifiedDeal = true
+			default:
+				return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+			}
+			// t.FastRetrieval (bool) (bool)
+		case "FastRetrieval":
+
+			maj, extra, err = cr.ReadHeader()
+			if err != nil {
+				return err
+			}
+			if maj != cbg.MajOther {
+				return fmt.Errorf("booleans must be major type 7")
+			}
+			switch extra {
+			case 20:
+				t.FastRetrieval = false
+			case 21:
+				t.FastRetrieval = true
+			default:
+				return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+			}
+			// t.Duration (abi.ChainEpoch) (int64)
+		case "Duration":
+			{
+				maj, extra, err := cr.ReadHeader()
+				var extraI int64
+				if err != nil {
+					return err
+				}
+				switch maj {
+				case cbg.MajUnsignedInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 positive overflow")
+					}
+				case cbg.MajNegativeInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 negative oveflow")
+					}
+					extraI = -1 - extraI
+				default:
+					return fmt.Errorf("wrong type for int64 field: %d", maj)
+				}
+
+				t.Duration = abi.ChainEpoch(extraI)
+			}
+			// t.Replicas ([]replication.Replica) (slice)
+		case "Replicas":
+
+			maj, extra, err = cr.ReadHeader()
+			if err != nil {
+				return err
+			}
+
+			if extra > cbg.MaxLength {
+				return fmt.Errorf("t.Replicas: array too large (%d)", extra)
+			}
+
+			if maj != cbg.MajArray {
+				return fmt.Errorf("expected cbor array")
+			}
+
+			if extra > 0 {
+				t.Replicas = make([]Replica, extra)
+			}
+
+			for i := 0; i < int(extra); i++ {
+
+				var v Replica
+				if err := v.UnmarshalCBOR(cr); err != nil {
+					return err
+				}
+
+				t.Replicas[i] = v
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
+func (t *Replica) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write([]byte{165}); err != nil {
+		return err
+	}
+
+	// t.ProposalCid (cid.Cid) (struct)
+	if len("ProposalCid") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"ProposalCid\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("ProposalCid"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("ProposalCid")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteCid(cw, t.ProposalCid); err != nil {
+		return xerrors.Errorf("failed to write cid field t.ProposalCid: %w", err)
+	}
+
+	// t.Provider (address.Address) (struct)
+	if len("Provider") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Provider\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Provider"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Provider")); err != nil {
+		return err
+	}
+
+	if err := t.Provider.MarshalCBOR(cw); err != nil {
+		return err
+	}
+
+	// t.EndEpoch (abi.ChainEpoch) (int64)
+	if len("EndEpoch") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"EndEpoch\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("EndEpoch"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("EndEpoch")); err != nil {
+		return err
+	}
+
+	if t.EndEpoch >= 0 {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.EndEpoch)); err != nil {
+			return err
+		}
+	} else {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-t.EndEpoch-1)); err != nil {
+			return err
+		}
+	}
+
+	// t.State (replication.ReplicaState) (uint64)
+	if len("State") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"State\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("State"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("State")); err != nil {
+		return err
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.State)); err != nil {
+		return err
+	}
+
+	// t.Message (string) (string)
+	if len("Message") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Message\" was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Message"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Message")); err != nil {
+		return err
+	}
+
+	if len(t.Message) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.Message was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Message))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.Message)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *Replica) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = Replica{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("Replica: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadString(cr)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.ProposalCid (cid.Cid) (struct)
+		case "ProposalCid":
+
+			{
+
+				c, err := cbg.ReadCid(cr)
+				if err != nil {
+					return xerrors.Errorf("failed to read cid field t.ProposalCid: %w", err)
+				}
+
+				t.ProposalCid = c
+
+			}
+			// t.Provider (address.Address) (struct)
+		case "Provider":
+
+			{
+
+				if err := t.Provider.UnmarshalCBOR(cr); err != nil {
+					return xerrors.Errorf("unmarshaling t.Provider: %w", err)
+				}
+
+			}
+			// t.EndEpoch (abi.ChainEpoch) (int64)
+		case "EndEpoch":
+			{
+				maj, extra, err := cr.ReadHeader()
+				var extraI int64
+				if err != nil {
+					return err
+				}
+				switch maj {
+				case cbg.MajUnsignedInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 positive overflow")
+					}
+				case cbg.MajNegativeInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 negative oveflow")
+					}
+					extraI = -1 - extraI
+				default:
+					return fmt.Errorf("wrong type for int64 field: %d", maj)
+				}
+
+				t.EndEpoch = abi.ChainEpoch(extraI)
+			}
+			// t.State (replication.ReplicaState) (uint64)
+		case "State":
+
+			{
+
+				maj, extra, err = cr.ReadHeader()
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.State = ReplicaState(extra)
+
+			}
+			// t.Message (string) (string)
+		case "Message":
+
+			{
+				sval, err := cbg.ReadString(cr)
+				if err != nil {
+					return err
+				}
+
+				t.Message = string(sval)
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
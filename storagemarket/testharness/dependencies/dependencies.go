@@ -28,6 +28,7 @@ import (
 	"github.com/filecoin-project/go-fil-markets/filestore"
 	"github.com/filecoin-project/go-fil-markets/piecestore"
 	piecestoreimpl "github.com/filecoin-project/go-fil-markets/piecestore/impl"
+	"github.com/filecoin-project/go-fil-markets/shared"
 	"github.com/filecoin-project/go-fil-markets/shared_testutil"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/storedask"
@@ -56,6 +57,9 @@ type StorageDependencies struct {
 	ProviderClientDelayFakeCommonNode testnodes.DelayFakeCommonNode
 	Fs                                filestore.FileStore
 	StoredAsk                         *storedask.StoredAsk
+	// Clock is passed to the client and provider, and can be replaced with
+	// a mock clock before creating the harness
+	Clock shared.Clock
 }
 
 func NewDependenciesWithTestData(t *testing.T,
@@ -197,5 +201,6 @@ func (gen *DepGenerator) New(
 		PieceStore:                        ps,
 		Fs:                                fs,
 		StoredAsk:                         storedAsk,
+		Clock:                             shared.NewClock(),
 	}
 }
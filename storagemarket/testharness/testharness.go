@@ -98,6 +98,7 @@ func NewHarnessWithTestData(t *testing.T, td *shared_testutil.Libp2pTestData, de
 		deps.ClientNode,
 		ba,
 		storageimpl.DealPollingInterval(0),
+		storageimpl.ClientClock(deps.Clock),
 	)
 	require.NoError(t, err)
 
@@ -125,6 +126,7 @@ func NewHarnessWithTestData(t *testing.T, td *shared_testutil.Libp2pTestData, de
 		deps.ProviderAddr,
 		deps.StoredAsk,
 		&MeshCreatorStub{},
+		storageimpl.ProviderClock(deps.Clock),
 	)
 	assert.NoError(t, err)
 
@@ -164,6 +166,7 @@ func (h *StorageHarness) CreateNewProvider(t *testing.T, ctx context.Context, td
 		h.ProviderAddr,
 		h.StoredAsk,
 		&MeshCreatorStub{},
+		storageimpl.ProviderClock(h.Clock),
 	)
 	require.NoError(t, err)
 	return provider
@@ -0,0 +1,114 @@
+package testnodes
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/go-address"
+
+	"github.com/filecoin-project/go-fil-markets/shared"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+// FakeStorageClient is a storage client that lists a fixed set of
+// providers, answers with their stubbed asks, and records the deals
+// proposed to them. Tests set the state of the proposed deals with
+// EmitDealState. Methods of storagemarket.StorageClient it does not
+// implement panic.
+type FakeStorageClient struct {
+	storagemarket.StorageClient
+
+	Providers []storagemarket.StorageProviderInfo
+	Asks      map[address.Address]*storagemarket.StorageAsk
+	// Rejects are the providers whose proposals fail
+	Rejects map[address.Address]bool
+
+	lk         sync.Mutex
+	proposed   []address.Address
+	states     map[cid.Cid]storagemarket.StorageDealStatus
+	subscriber storagemarket.ClientSubscriber
+}
+
+// NewFakeStorageClient returns a FakeStorageClient with no providers
+func NewFakeStorageClient() *FakeStorageClient {
+	return &FakeStorageClient{
+		Asks:    make(map[address.Address]*storagemarket.StorageAsk),
+		Rejects: make(map[address.Address]bool),
+		states:  make(map[cid.Cid]storagemarket.StorageDealStatus),
+	}
+}
+
+// ListProviders lists the providers
+func (fc *FakeStorageClient) ListProviders(ctx context.Context) (<-chan storagemarket.StorageProviderInfo, error) {
+	out := make(chan storagemarket.StorageProviderInfo, len(fc.Providers))
+	for _, p := range fc.Providers {
+		out <- p
+	}
+	close(out)
+	return out, nil
+}
+
+// GetAsk returns the stubbed ask of a provider, or an error if it has none
+func (fc *FakeStorageClient) GetAsk(ctx context.Context, info storagemarket.StorageProviderInfo) (*storagemarket.StorageAsk, error) {
+	ask, ok := fc.Asks[info.Address]
+	if !ok {
+		return nil, errors.New("no ask")
+	}
+	return ask, nil
+}
+
+// ProposeStorageDeal records the provider proposed to, and fails if the
+// provider rejects proposals
+func (fc *FakeStorageClient) ProposeStorageDeal(ctx context.Context, params storagemarket.ProposeStorageDealParams) (*storagemarket.ProposeStorageDealResult, error) {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	fc.proposed = append(fc.proposed, params.Info.Address)
+	if fc.Rejects[params.Info.Address] {
+		return nil, errors.New("rejected")
+	}
+	return &storagemarket.ProposeStorageDealResult{ProposalCid: shared_testutil.GenerateCids(1)[0]}, nil
+}
+
+// GetLocalDeal returns a deal in the state last emitted for it
+func (fc *FakeStorageClient) GetLocalDeal(ctx context.Context, proposalCid cid.Cid) (storagemarket.ClientDeal, error) {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	return storagemarket.ClientDeal{ProposalCid: proposalCid, State: fc.states[proposalCid]}, nil
+}
+
+// SubscribeToEvents sets the subscriber that EmitDealState sends events to
+func (fc *FakeStorageClient) SubscribeToEvents(subscriber storagemarket.ClientSubscriber) shared.Unsubscribe {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	fc.subscriber = subscriber
+	return func() {
+		fc.lk.Lock()
+		defer fc.lk.Unlock()
+		fc.subscriber = nil
+	}
+}
+
+// EmitDealState sets the state of a deal, and sends an event for it to the
+// subscriber
+func (fc *FakeStorageClient) EmitDealState(data *storagemarket.DataRef, proposalCid cid.Cid, state storagemarket.StorageDealStatus) {
+	fc.lk.Lock()
+	fc.states[proposalCid] = state
+	subscriber := fc.subscriber
+	fc.lk.Unlock()
+	if subscriber != nil {
+		subscriber(storagemarket.ClientEventDealActivated, storagemarket.ClientDeal{ProposalCid: proposalCid, State: state, DataRef: data})
+	}
+}
+
+// Proposed returns the providers deals were proposed to, in order
+func (fc *FakeStorageClient) Proposed() []address.Address {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	return append([]address.Address(nil), fc.proposed...)
+}
+
+var _ storagemarket.StorageClient = &FakeStorageClient{}
@@ -2,7 +2,6 @@ package storagemarket
 
 import (
 	"fmt"
-	"time"
 
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
@@ -17,6 +16,7 @@ import (
 	"github.com/filecoin-project/go-state-types/crypto"
 
 	"github.com/filecoin-project/go-fil-markets/filestore"
+	"github.com/filecoin-project/go-fil-markets/shared"
 )
 
 var log = logging.Logger("storagemrkt")
@@ -186,17 +186,17 @@ func (ds *DealStages) GetStage(stage string) *DealStage {
 	return nil
 }
 
-// AddStageLog adds a log to the specified stage, creating the stage if it
-// doesn't exist yet.
+// AddStageLog adds a log to the specified stage, timestamped with the
+// given clock, creating the stage if it doesn't exist yet.
 // EXPERIMENTAL; subject to change.
-func (ds *DealStages) AddStageLog(stage, description, expectedDuration, msg string) {
+func (ds *DealStages) AddStageLog(clock shared.Clock, stage, description, expectedDuration, msg string) {
 	if ds == nil {
 		return
 	}
 
 	log.Debugf("adding log for stage <%s> msg <%s>", stage, msg)
 
-	now := curTime()
+	now := shared.CborTime(clock)
 	st := ds.GetStage(stage)
 	if st == nil {
 		st = &DealStage{
@@ -215,9 +215,10 @@ func (ds *DealStages) AddStageLog(stage, description, expectedDuration, msg stri
 	}
 }
 
-// AddLog adds a log inside the DealStages object of the deal.
+// AddLog adds a log, timestamped with the given clock, inside the
+// DealStages object of the deal.
 // EXPERIMENTAL; subject to change.
-func (d *ClientDeal) AddLog(msg string, a ...interface{}) {
+func (d *ClientDeal) AddLog(clock shared.Clock, msg string, a ...interface{}) {
 	if len(a) > 0 {
 		msg = fmt.Sprintf(msg, a...)
 	}
@@ -226,7 +227,7 @@ func (d *ClientDeal) AddLog(msg string, a ...interface{}) {
 	description := DealStatesDescriptions[d.State]
 	expectedDuration := DealStatesDurations[d.State]
 
-	d.DealStages.AddStageLog(stage, description, expectedDuration, msg)
+	d.DealStages.AddStageLog(clock, stage, description, expectedDuration, msg)
 }
 
 // ClientDeal is the local state tracked for a deal by a StorageClient
@@ -312,8 +313,3 @@ type ProviderDealState struct {
 	DealID        abi.DealID
 	FastRetrieval bool
 }
-
-func curTime() cbg.CborTime {
-	now := time.Now()
-	return cbg.CborTime(time.Unix(0, now.UnixNano()).UTC())
-}
@@ -2,12 +2,37 @@ package storagemarket_test
 
 import (
 	"testing"
+	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-fil-markets/shared"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 )
 
 func TestDealStagesNil(t *testing.T) {
 	var ds *storagemarket.DealStages
-	ds.GetStage("none")                                  // no panic.
-	ds.AddStageLog("MyStage", "desc", "duration", "msg") // no panic.
+	ds.GetStage("none")                                                     // no panic.
+	ds.AddStageLog(shared.NewClock(), "MyStage", "desc", "duration", "msg") // no panic.
+}
+
+func TestDealStagesClock(t *testing.T) {
+	mockClock := clock.NewMock()
+	mockClock.Set(time.Unix(100, 0))
+	created := cbg.CborTime(time.Unix(100, 0).UTC())
+	updated := cbg.CborTime(time.Unix(160, 0).UTC())
+
+	ds := storagemarket.NewDealStages()
+	ds.AddStageLog(mockClock, "MyStage", "desc", "duration", "first")
+	mockClock.Add(time.Minute)
+	ds.AddStageLog(mockClock, "MyStage", "desc", "duration", "second")
+
+	stage := ds.GetStage("MyStage")
+	require.Equal(t, created, stage.CreatedTime)
+	require.Equal(t, updated, stage.UpdatedTime)
+	require.Len(t, stage.Logs, 2)
+	require.Equal(t, created, stage.Logs[0].UpdatedTime)
+	require.Equal(t, updated, stage.Logs[1].UpdatedTime)
 }